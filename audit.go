@@ -0,0 +1,414 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// Audit event types.
+const (
+	// AuditStart is recorded when a command starts.
+	AuditStart = "start"
+	// AuditExit is recorded when a command exits.
+	AuditExit = "exit"
+	// AuditUpload is recorded when an upload finishes or fails.
+	AuditUpload = "upload"
+	// AuditDownload is recorded when a download finishes or fails.
+	AuditDownload = "download"
+	// AuditTransferSession is recorded when a session changes owner.
+	AuditTransferSession = "transfer_session"
+	// AuditShareSession is recorded when a session share token is minted.
+	AuditShareSession = "share_session"
+	// AuditJournal is recorded when a session's journal is read.
+	AuditJournal = "journal"
+	// AuditConnection is recorded once when a connection ends, including
+	// connections refused by limits, to summarize it like an access log.
+	AuditConnection = "connection"
+	// AuditSlowConsumer is recorded the first time a write to a connection
+	// blocks for Options.SlowConsumerTimeout, which is the duration of the
+	// event.
+	AuditSlowConsumer = "slow_consumer"
+)
+
+// AuditEvent records an action taken by a connection.
+type AuditEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Owner is the principal behind the connection from Options.Owner.
+	Owner     string   `json:"owner,omitempty"`
+	SessionID string   `json:"session_id,omitempty"`
+	Command   string   `json:"command,omitempty"`
+	Args      []string `json:"args,omitempty"`
+	UID       uint32   `json:"uid,omitempty"`
+	GID       uint32   `json:"gid,omitempty"`
+	Pid       int      `json:"pid,omitempty"`
+	// Path is the file for transfers.
+	Path string `json:"path,omitempty"`
+	// NewOwner is the owner a session was transferred to.
+	NewOwner string `json:"new_owner,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// The fields below summarize a connection.  RemoteAddr is empty if the
+	// address of the client is not known.  BytesIn counts the stdin received
+	// and BytesOut the output sent.  Exited is set if the command exited, with
+	// its code in ExitCode.  Reason is the code of the error that ended the
+	// connection, or "closed" if the client closed it.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	DurationMS int64  `json:"duration_ms,omitempty"`
+	BytesIn    int64  `json:"bytes_in,omitempty"`
+	BytesOut   int64  `json:"bytes_out,omitempty"`
+	Exited     bool   `json:"exited,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// AuditSink receives audit events.  Sinks are called synchronously from the
+// connection, so slow or unreliable sinks should be wrapped in an
+// AuditBatcher.
+type AuditSink interface {
+	WriteEvents(ctx context.Context, events []AuditEvent) error
+}
+
+// audit records an event if the options have a sink.  Failures are logged
+// since they must not interrupt the connection.
+func audit(ctx context.Context, options *Options, event AuditEvent) {
+	if options.Audit == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.Owner = options.Owner
+	err := options.Audit.WriteEvents(ctx, []AuditEvent{event})
+	if err != nil {
+		flog.Error("failed to write audit event: %v", err)
+	}
+}
+
+// connSummary accumulates the AuditConnection event of a connection.
+type connSummary struct {
+	// bytesIn and bytesOut must be accessed atomically and come first so they
+	// are aligned on 32-bit platforms.
+	bytesIn  int64
+	bytesOut int64
+	begin    time.Time
+
+	mutex sync.Mutex
+	event AuditEvent
+}
+
+func newConnSummary(addr string) *connSummary {
+	return &connSummary{
+		begin: time.Now(),
+		event: AuditEvent{Type: AuditConnection, RemoteAddr: addr},
+	}
+}
+
+// started records the command the connection started.
+func (s *connSummary) started(sessionID string, command *Command, pid int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.event.SessionID = sessionID
+	s.event.Command = command.Command
+	s.event.Args = command.Args
+	s.event.Pid = pid
+}
+
+// addIn counts n bytes of stdin.
+func (s *connSummary) addIn(n int) {
+	atomic.AddInt64(&s.bytesIn, int64(n))
+}
+
+// outputReader returns a reader that counts the output read from r.
+func (s *connSummary) outputReader(r io.Reader) io.Reader {
+	return &countingReader{r: r, n: &s.bytesOut}
+}
+
+// exited records how the command exited.
+func (s *connSummary) exited(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.event.Exited = true
+	if exitErr, ok := err.(ExitError); ok {
+		s.event.ExitCode = exitErr.ExitCode()
+	}
+}
+
+// record audits the summary of the connection, which ended with err.
+func (s *connSummary) record(options *Options, err error) {
+	if options == nil {
+		return
+	}
+	s.mutex.Lock()
+	event := s.event
+	s.mutex.Unlock()
+	event.DurationMS = time.Since(s.begin).Milliseconds()
+	event.BytesIn = atomic.LoadInt64(&s.bytesIn)
+	event.BytesOut = atomic.LoadInt64(&s.bytesOut)
+	event.Error = errorString(err)
+	switch {
+	case err == nil:
+		event.Reason = "closed"
+	case ErrorCode(err) != "":
+		event.Reason = string(ErrorCode(err))
+	case xerrors.Is(err, context.Canceled):
+		event.Reason = "canceled"
+	default:
+		event.Reason = "error"
+	}
+	// The connection is gone but its summary should still be recorded.
+	audit(context.Background(), options, event)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// FileAuditSink appends events to a file as JSON lines, syncing after each
+// write so events survive a crash.
+type FileAuditSink struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+// WriteEvents appends the events to the file.
+func (f *FileAuditSink) WriteEvents(_ context.Context, events []AuditEvent) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range events {
+		err := encoder.Encode(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return xerrors.Errorf("open audit log: %w", err)
+	}
+	defer file.Close()
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		return xerrors.Errorf("write audit log: %w", err)
+	}
+	return file.Sync()
+}
+
+// HTTPAuditSink posts events to a URL as a JSON array.  Any response other
+// than 2xx is an error.
+type HTTPAuditSink struct {
+	URL string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// Header is added to each request, for example for authentication.
+	Header http.Header
+}
+
+// WriteEvents posts the events.
+func (h *HTTPAuditSink) WriteEvents(ctx context.Context, events []AuditEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range h.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return xerrors.Errorf("post audit events: %s", resp.Status)
+	}
+	return nil
+}
+
+// AuditBatchOptions configures an AuditBatcher.
+type AuditBatchOptions struct {
+	// MaxBatch is the most events sent at once.  Defaults to 100.
+	MaxBatch int
+	// FlushInterval is how long events wait for a batch to fill.  Defaults to
+	// a second.
+	FlushInterval time.Duration
+	// MaxRetries is how many times a failed batch is retried before it is
+	// dropped.  Defaults to 5.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubling after each.
+	// Defaults to a second.
+	RetryBackoff time.Duration
+	// MaxPending is the most events held while the sink is failing; further
+	// events are dropped.  Defaults to 10000.
+	MaxPending int
+	// OnDrop is called with events that could not be delivered.
+	OnDrop func(events []AuditEvent, err error)
+}
+
+// AuditBatcher is an AuditSink that queues events and delivers them to
+// another sink in batches from the background, retrying failures.
+type AuditBatcher struct {
+	sink    AuditSink
+	options AuditBatchOptions
+
+	mutex   sync.Mutex
+	pending []AuditEvent
+	// wake is signaled when a batch fills.
+	wake   chan struct{}
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// NewAuditBatcher starts delivering events to the sink.  Close must be called
+// to flush the remaining events.
+func NewAuditBatcher(sink AuditSink, options *AuditBatchOptions) *AuditBatcher {
+	b := &AuditBatcher{
+		sink:   sink,
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if options != nil {
+		b.options = *options
+	}
+	if b.options.MaxBatch <= 0 {
+		b.options.MaxBatch = 100
+	}
+	if b.options.FlushInterval <= 0 {
+		b.options.FlushInterval = time.Second
+	}
+	if b.options.MaxRetries <= 0 {
+		b.options.MaxRetries = 5
+	}
+	if b.options.RetryBackoff <= 0 {
+		b.options.RetryBackoff = time.Second
+	}
+	if b.options.MaxPending <= 0 {
+		b.options.MaxPending = 10000
+	}
+	go b.run()
+	return b
+}
+
+// WriteEvents queues the events without blocking.
+func (b *AuditBatcher) WriteEvents(_ context.Context, events []AuditEvent) error {
+	b.mutex.Lock()
+	room := b.options.MaxPending - len(b.pending)
+	if room < len(events) {
+		if room < 0 {
+			room = 0
+		}
+		dropped := events[room:]
+		events = events[:room]
+		defer b.drop(dropped, xerrors.New("too many pending audit events"))
+	}
+	b.pending = append(b.pending, events...)
+	full := len(b.pending) >= b.options.MaxBatch
+	b.mutex.Unlock()
+
+	if full {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Close delivers the remaining events, giving up when the context ends.
+func (b *AuditBatcher) Close(ctx context.Context) error {
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *AuditBatcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.options.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.closed:
+			for b.flush() {
+			}
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+		for b.flush() {
+		}
+	}
+}
+
+// flush delivers a batch and reports whether more events are pending.
+func (b *AuditBatcher) flush() bool {
+	b.mutex.Lock()
+	n := len(b.pending)
+	if n > b.options.MaxBatch {
+		n = b.options.MaxBatch
+	}
+	batch := b.pending[:n:n]
+	b.pending = b.pending[n:]
+	more := len(b.pending) > 0
+	b.mutex.Unlock()
+	if n == 0 {
+		return false
+	}
+
+	backoff := b.options.RetryBackoff
+	var err error
+	for attempt := 0; attempt <= b.options.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-b.closed:
+				// Still retry once closing but without waiting out the backoff.
+			}
+			backoff *= 2
+		}
+		err = b.sink.WriteEvents(context.Background(), batch)
+		if err == nil {
+			return more
+		}
+	}
+	b.drop(batch, err)
+	return more
+}
+
+func (b *AuditBatcher) drop(events []AuditEvent, err error) {
+	if b.options.OnDrop != nil {
+		b.options.OnDrop(events, err)
+		return
+	}
+	flog.Error("dropped %d audit events: %v", len(events), err)
+}
@@ -0,0 +1,224 @@
+package wsep
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"golang.org/x/xerrors"
+)
+
+// memoryAuditSink records events after failing the given number of writes.
+type memoryAuditSink struct {
+	mutex    sync.Mutex
+	failures int
+	batches  [][]AuditEvent
+}
+
+func (m *memoryAuditSink) WriteEvents(_ context.Context, events []AuditEvent) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		return xerrors.New("unavailable")
+	}
+	m.batches = append(m.batches, append([]AuditEvent(nil), events...))
+	return nil
+}
+
+func (m *memoryAuditSink) events() []AuditEvent {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var events []AuditEvent
+	for _, batch := range m.batches {
+		events = append(events, batch...)
+	}
+	return events
+}
+
+func TestAuditServer(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	sink := &memoryAuditSink{}
+	ws, server := mockConn(ctx, t, nil, &Options{Owner: "alice", Audit: sink})
+	defer server.Close()
+
+	process, err := RemoteExecer(ws).Start(ctx, Command{Command: "sh", Args: []string{"-c", "exit 3"}})
+	assert.Success(t, "start", err)
+	assert.Error(t, "wait", process.Wait())
+
+	// The exit is recorded before the exit code is sent.  The connection may
+	// already be summarized too.
+	var events []AuditEvent
+	for _, event := range sink.events() {
+		if event.Type != AuditConnection {
+			events = append(events, event)
+		}
+	}
+	assert.Equal(t, "events", 2, len(events))
+	assert.Equal(t, "start type", AuditStart, events[0].Type)
+	assert.Equal(t, "start owner", "alice", events[0].Owner)
+	assert.Equal(t, "start command", "sh", events[0].Command)
+	assert.Equal(t, "exit type", AuditExit, events[1].Type)
+	assert.Equal(t, "exit code", 3, events[1].ExitCode)
+}
+
+func TestAuditConnection(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	sink := &memoryAuditSink{}
+	srv := NewServer()
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Success(t, "listen", err)
+	go func() {
+		_ = srv.ServeListener(ctx, l, LocalExecer{}, &Options{Owner: "alice", Audit: sink})
+	}()
+	nc, err := net.Dial("tcp", l.Addr().String())
+	assert.Success(t, "dial", err)
+
+	process, err := RemoteStreamExecer(nc).Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", "read line; echo $line; exit 2"},
+		Stdin:   true,
+		ID:      "main",
+	})
+	assert.Success(t, "start", err)
+	_, err = process.Stdin().Write([]byte("hello\n"))
+	assert.Success(t, "write stdin", err)
+	_, err = io.Copy(ioutil.Discard, process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.Error(t, "wait", process.Wait())
+	_ = nc.Close()
+
+	var summary *AuditEvent
+	for summary == nil {
+		assert.Success(t, "context", ctx.Err())
+		for _, event := range sink.events() {
+			if event.Type == AuditConnection {
+				event := event
+				summary = &event
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "owner", "alice", summary.Owner)
+	assert.Equal(t, "address", nc.LocalAddr().String(), summary.RemoteAddr)
+	assert.Equal(t, "command", "sh", summary.Command)
+	assert.Equal(t, "session", "main", summary.SessionID)
+	assert.Equal(t, "bytes in", int64(6), summary.BytesIn)
+	assert.Equal(t, "bytes out", int64(6), summary.BytesOut)
+	assert.True(t, "exited", summary.Exited)
+	assert.Equal(t, "exit code", 2, summary.ExitCode)
+	assert.Equal(t, "reason", "closed", summary.Reason)
+}
+
+func TestAuditBatcher(t *testing.T) {
+	t.Parallel()
+
+	sink := &memoryAuditSink{failures: 2}
+	batcher := NewAuditBatcher(sink, &AuditBatchOptions{
+		MaxBatch:      2,
+		FlushInterval: time.Hour,
+		RetryBackoff:  time.Millisecond,
+	})
+	for i := 0; i < 5; i++ {
+		err := batcher.WriteEvents(context.Background(), []AuditEvent{{Type: AuditStart, Pid: i}})
+		assert.Success(t, "write", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	assert.Success(t, "close", batcher.Close(ctx))
+
+	events := sink.events()
+	assert.Equal(t, "events", 5, len(events))
+	for i, event := range events {
+		assert.Equal(t, "order", i, event.Pid)
+	}
+	for _, batch := range sink.batches {
+		assert.True(t, "batch size", len(batch) <= 2)
+	}
+}
+
+func TestAuditBatcherDrop(t *testing.T) {
+	t.Parallel()
+
+	var dropped []AuditEvent
+	sink := &memoryAuditSink{failures: 100}
+	batcher := NewAuditBatcher(sink, &AuditBatchOptions{
+		MaxRetries:   1,
+		RetryBackoff: time.Millisecond,
+		OnDrop: func(events []AuditEvent, _ error) {
+			dropped = append(dropped, events...)
+		},
+	})
+	err := batcher.WriteEvents(context.Background(), []AuditEvent{{Type: AuditStart}})
+	assert.Success(t, "write", err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	assert.Success(t, "close", batcher.Close(ctx))
+	assert.Equal(t, "dropped", 1, len(dropped))
+}
+
+func TestFileAuditSink(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(tempDir(t), "audit.log")
+	sink := &FileAuditSink{Path: path}
+	err := sink.WriteEvents(context.Background(), []AuditEvent{{Type: AuditStart}, {Type: AuditExit}})
+	assert.Success(t, "write", err)
+	err = sink.WriteEvents(context.Background(), []AuditEvent{{Type: AuditUpload}})
+	assert.Success(t, "write again", err)
+
+	file, err := os.Open(path)
+	assert.Success(t, "open", err)
+	defer file.Close()
+	var types []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		assert.Success(t, "unmarshal", json.Unmarshal(scanner.Bytes(), &event))
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, "types", []string{AuditStart, AuditExit, AuditUpload}, types)
+}
+
+func TestHTTPAuditSink(t *testing.T) {
+	t.Parallel()
+
+	var received []AuditEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	sink := &HTTPAuditSink{URL: server.URL}
+	err := sink.WriteEvents(context.Background(), []AuditEvent{{Type: AuditStart}})
+	assert.Error(t, "unauthorized", err)
+
+	sink.Header = http.Header{"Authorization": []string{"Bearer token"}}
+	err = sink.WriteEvents(context.Background(), []AuditEvent{{Type: AuditStart}})
+	assert.Success(t, "authorized", err)
+	assert.Equal(t, "received", 1, len(received))
+}
@@ -6,24 +6,143 @@ const DELIMITER = '\n'.charCodeAt(0);
 export interface Command {
   command: string;
   args?: string[];
+  // terminal_modes sets up the terminal of a TTY command before it runs.
+  terminal_modes?: TerminalModes;
+  // shell runs command as a script through the user's shell with args as its
+  // positional parameters.
+  shell?: boolean;
   tty?: boolean;
   uid?: number;
   gid?: number;
   env?: string[];
   working_dir?: string;
+  app_hint?: AppHint;
+  // relay_clipboard sends OSC 52 clipboard writes as clipboard messages.
+  relay_clipboard?: boolean;
+  // relay_bell and relay_notify send BEL and OSC 9/777 notifications as bell
+  // and notify messages.
+  relay_bell?: boolean;
+  relay_notify?: boolean;
+  // timestamps adds the time output was read, in milliseconds since the
+  // epoch, to stdout and stderr messages.
+  timestamps?: boolean;
+  // low_latency sends TTY output as soon as it is read rather than coalescing
+  // small writes.
+  low_latency?: boolean;
+  // acknowledged keeps output of a command with an ID until it is
+  // acknowledged with sendAck.
+  acknowledged?: boolean;
+  // stdout_file and stderr_file write output of a command without a TTY to
+  // files on the server instead of streaming it, unless tee_output is set.
+  stdout_file?: string;
+  stderr_file?: string;
+  tee_output?: boolean;
+  // discard_output sends no stdout or stderr at all, only the exit code.
+  discard_output?: boolean;
+  // line_buffered sends the output of a command without a TTY in whole lines.
+  line_buffered?: boolean;
+  // exclusive_input, on the command creating a session, lets one attached
+  // client at a time send input; the others take over with takeInput.
+  exclusive_input?: boolean;
+}
+
+// TerminalModes are terminal settings by name like SSH's pty modes. Flags
+// such as echo and icanon are on when non-zero and control characters such as
+// verase are set to a character code, or disabled with 0 or 255.
+export type TerminalModes = { [mode: string]: number };
+
+// ResumeOffsets are how many bytes of each output stream were received before
+// the connection dropped.
+export interface ResumeOffsets {
+  stdout: number;
+  stderr: number;
+}
+
+// AppHint describes the class of program a command runs so the UI can pick
+// defaults such as local echo and scrollback behavior.
+export type AppHint = 'shell' | 'repl' | 'editor' | 'pager';
+
+// Signal is a request to a running command that means the same thing on every
+// platform the server runs on.
+export type Signal = 'interrupt' | 'terminate' | 'kill';
+
+// Check is the outcome of one check of a validate request. error is omitted if
+// the check passed.
+export interface Check {
+  value?: string;
+  error?: string;
+}
+
+export interface Validation {
+  command: Check;
+  working_dir: Check;
+  user: Check;
 }
 
 export type ClientHeader =
-  | { type: 'start'; id: string; command: Command; cols: number; rows: number; }
+  | {
+      type: 'start';
+      id: string;
+      command: Command;
+      cols: number;
+      rows: number;
+      resume?: ResumeOffsets;
+      observe?: boolean;
+      token?: string;
+      // term and color_term become the TERM and COLORTERM of a TTY command.
+      term?: string;
+      color_term?: string;
+      // locale holds LANG and LC_* variables to forward if the server accepts
+      // them.
+      locale?: string[];
+    }
   | { type: 'stdin' }
-  | { type: 'close_stdin' }
-  | { type: 'resize'; cols: number; rows: number };
+  | { type: 'close_stdin'; seq?: number }
+  | { type: 'resize'; cols: number; rows: number; seq?: number }
+  | { type: 'signal'; signal: Signal; seq?: number }
+  | { type: 'ack'; stdout: number; stderr: number }
+  | { type: 'take_input' }
+  | { type: 'terminal_modes'; modes: TerminalModes; seq?: number }
+  | { type: 'share_session'; id: string; read_only?: boolean; expires_in?: number }
+  | { type: 'validate'; command: Command }
+  | { type: 'extension'; namespace: string };
 
 export type ServerHeader =
-  | { type: 'stdout' }
-  | { type: 'stderr' }
-  | { type: 'pid'; pid: number }
-  | { type: 'exit_code'; exit_code: number };
+  | { type: 'stdout'; time?: number; offset?: number }
+  | { type: 'stderr'; time?: number; offset?: number }
+  | {
+      type: 'pid';
+      pid: number;
+      app_hint?: AppHint;
+      binary_data?: boolean;
+      resize_acks?: boolean;
+      control_acks?: boolean;
+      working_dir?: string;
+      user?: string;
+      shell?: string;
+      session_id?: string;
+      ignored?: string[];
+    }
+  | { type: 'clipboard'; selection: string }
+  | { type: 'bell' }
+  | { type: 'notify'; title?: string; body: string }
+  | { type: 'extension'; namespace: string }
+  | { type: 'frozen'; frozen: boolean }
+  | { type: 'input_lock'; holder: boolean }
+  | { type: 'truncated'; stream: 'stdout' | 'stderr'; dropped: number }
+  | { type: 'eof'; stream: 'stdout' | 'stderr' }
+  | { type: 'warning'; code?: string; message: string }
+  | { type: 'resized'; seq: number; rows: number; cols: number; error?: string }
+  | { type: 'acked'; seq: number; error?: string }
+  | {
+      type: 'result';
+      code?: string;
+      error?: string;
+      token?: string;
+      validation?: Validation;
+    }
+  | { type: 'error'; code: string; error: string; seq?: number }
+  | { type: 'exit_code'; exit_code: number; error?: string };
 
 export type Header = ClientHeader | ServerHeader;
 
@@ -31,15 +150,25 @@ export const setBinaryType = (ws: WebSocket) => {
   ws.binaryType = 'arraybuffer';
 };
 
+// textFrames sends messages as text frames with readable JSON headers and
+// base64 bodies so that browser developer tools can show the traffic. The
+// server answers in kind.
+let textFrames = false;
+
+export const setTextFrames = (enabled: boolean) => {
+  textFrames = enabled;
+};
+
 export const sendStdin = (ws: WebSocket, data: Uint8Array) => {
   if (data.byteLength < 1) return;
-  const msg = joinMessage({ type: 'stdin' }, data);
-  ws.send(msg.buffer);
+  send(ws, { type: 'stdin' }, data);
 };
 
-export const closeStdin = (ws: WebSocket) => {
-  const msg = joinMessage({ type: 'close_stdin' });
-  ws.send(msg.buffer);
+// closeStdin, sendSignal and setTerminalModes are answered with an acked
+// message carrying the same seq if one is given and the pid message had
+// control_acks set.
+export const closeStdin = (ws: WebSocket, seq?: number) => {
+  send(ws, { type: 'close_stdin', seq });
 };
 
 export const startCommand = (
@@ -47,10 +176,26 @@ export const startCommand = (
   command: Command,
   id: string,
   rows: number,
-  cols: number
+  cols: number,
+  resume?: ResumeOffsets,
+  token?: string,
+  term?: string,
+  colorTerm?: string
 ) => {
-  const msg = joinMessage({ type: 'start', command, id, rows, cols });
-  ws.send(msg.buffer);
+  send(ws, { type: 'start', command, id, rows, cols, resume, token, term, color_term: colorTerm });
+};
+
+// observeSession attaches to an existing TTY session read-only. The server
+// ends the connection if the observer sends any input.
+export const observeSession = (
+  ws: WebSocket,
+  command: Command,
+  id: string,
+  rows: number,
+  cols: number,
+  token?: string
+) => {
+  send(ws, { type: 'start', command, id, rows, cols, observe: true, token });
 };
 
 export const parseServerMessage = (
@@ -60,13 +205,90 @@ export const parseServerMessage = (
   return [header as ServerHeader, body];
 };
 
+export const sendExtension = (
+  ws: WebSocket,
+  namespace: string,
+  payload: Uint8Array
+) => {
+  send(ws, { type: 'extension', namespace }, payload);
+};
+
+// resizeTerminal resizes the command's terminal. If seq is given and the pid
+// message had resize_acks set, the server answers with a resized message
+// carrying the same seq.
 export const resizeTerminal = (
   ws: WebSocket,
   rows: number,
-  cols: number
+  cols: number,
+  seq?: number
 ): void => {
-  const msg = joinMessage({ type: 'resize', cols, rows });
-  ws.send(msg.buffer);
+  send(ws, { type: 'resize', cols, rows, seq });
+};
+
+export const sendSignal = (ws: WebSocket, signal: Signal, seq?: number): void => {
+  send(ws, { type: 'signal', signal, seq });
+};
+
+export const sendAck = (ws: WebSocket, offsets: ResumeOffsets): void => {
+  send(ws, { type: 'ack', stdout: offsets.stdout, stderr: offsets.stderr });
+};
+
+export const takeInput = (ws: WebSocket): void => {
+  send(ws, { type: 'take_input' });
+};
+
+// setTerminalModes changes the modes of a TTY command's terminal, for example
+// { echo: 0 } while a password is typed.
+export const setTerminalModes = (
+  ws: WebSocket,
+  modes: TerminalModes,
+  seq?: number
+): void => {
+  send(ws, { type: 'terminal_modes', modes, seq });
+};
+
+// shareSession asks for a share token for a session the connection owns. The
+// server answers with a result message carrying the token.
+export const shareSession = (
+  ws: WebSocket,
+  id: string,
+  readOnly: boolean,
+  expiresIn?: number
+): void => {
+  send(ws, { type: 'share_session', id, read_only: readOnly, expires_in: expiresIn });
+};
+
+// validateCommand asks whether the server could start a command without
+// starting it. The server answers with a result message carrying the
+// validation.
+export const validateCommand = (ws: WebSocket, command: Command): void => {
+  send(ws, { type: 'validate', command });
+};
+
+const send = (ws: WebSocket, header: ClientHeader, body?: Uint8Array) => {
+  if (textFrames) {
+    const text = JSON.stringify(header);
+    ws.send(body && body.length > 0 ? text + '\n' + encodeBase64(body) : text);
+    return;
+  }
+  ws.send(joinMessage(header, body).buffer);
+};
+
+const encodeBase64 = (data: Uint8Array): string => {
+  let binary = '';
+  for (let i = 0; i < data.length; i++) {
+    binary += String.fromCharCode(data[i]);
+  }
+  return btoa(binary);
+};
+
+const decodeBase64 = (text: string): Uint8Array => {
+  const binary = atob(text);
+  const data = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) {
+    data[i] = binary.charCodeAt(i);
+  }
+  return data;
 };
 
 const joinMessage = (header: ClientHeader, body?: Uint8Array): Uint8Array => {
@@ -81,13 +303,16 @@ const joinMessage = (header: ClientHeader, body?: Uint8Array): Uint8Array => {
   return encodedHeader;
 };
 
-const splitMessage = (message: ArrayBuffer): [Header, Uint8Array] => {
-  let array: Uint8Array;
+const splitMessage = (message: ArrayBuffer | string): [Header, Uint8Array] => {
+  // Text frames carry the body as base64.
   if (typeof message === 'string') {
-    array = new TextEncoder().encode(message);
-  } else {
-    array = new Uint8Array(message);
+    const i = message.indexOf('\n');
+    if (i === -1) {
+      return [JSON.parse(message), new Uint8Array(0)];
+    }
+    return [JSON.parse(message.slice(0, i)), decodeBase64(message.slice(i + 1))];
   }
+  const array = new Uint8Array(message);
 
   for (let i = 0; i < array.length; i++) {
     if (array[i] === DELIMITER) {
@@ -0,0 +1,64 @@
+package wsep
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// frameBudget paces reading messages from a connection to a rate, allowing
+// bursts above it, so that a client cannot make the server spin on a flood of
+// tiny messages.  It is not safe for concurrent use.
+type frameBudget struct {
+	// interval is the time it takes to earn one message.
+	interval time.Duration
+	// tolerance is how far ahead of the rate a burst may run.
+	tolerance time.Duration
+	// next is when the next message is due at the steady rate.
+	next time.Time
+}
+
+// newFrameBudget returns a budget of rate messages per second with bursts of
+// up to burst messages, which defaults to the rate.  It returns nil, which
+// never waits, if rate is not positive.
+func newFrameBudget(rate float64, burst int) *frameBudget {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	return &frameBudget{
+		interval:  interval,
+		tolerance: interval * time.Duration(burst-1),
+	}
+}
+
+// wait blocks until another message is within budget or the context ends.
+func (b *frameBudget) wait(ctx context.Context) error {
+	return b.waitN(ctx, 1)
+}
+
+// waitN is like wait for n messages at once.  A budget of bytes rather than
+// messages waits for n bytes.
+func (b *frameBudget) waitN(ctx context.Context, n int) error {
+	if b == nil {
+		return nil
+	}
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	if delay := b.next.Sub(now) - b.tolerance; delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	b.next = b.next.Add(b.interval * time.Duration(n))
+	return nil
+}
@@ -0,0 +1,53 @@
+package wsep
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestFrameBudget(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.Success(t, "unlimited", newFrameBudget(0, 0).wait(ctx))
+
+	budget := newFrameBudget(100, 5)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.Success(t, "wait", budget.wait(ctx))
+	}
+	assert.True(t, "burst is immediate", time.Since(start) < 50*time.Millisecond)
+
+	// Past the burst messages are paced at 10ms each.
+	for i := 0; i < 10; i++ {
+		assert.Success(t, "wait", budget.wait(ctx))
+	}
+	assert.True(t, "paced after burst", time.Since(start) >= 90*time.Millisecond)
+
+	// Once the budget is spent waiting ends with the context.
+	spent := newFrameBudget(1, 1)
+	assert.Success(t, "wait", spent.wait(ctx))
+	canceled, cancelWait := context.WithCancel(ctx)
+	cancelWait()
+	assert.Error(t, "canceled", spent.wait(canceled))
+}
+
+func TestServerReadLimit(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, &Options{ReadLimit: 256})
+	defer server.Close()
+
+	_, err := RemoteExecer(ws).Start(ctx, Command{
+		Command: "echo",
+		Args:    []string{strings.Repeat("a", 512)},
+	})
+	assert.Error(t, "start message over the limit", err)
+}
@@ -0,0 +1,211 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+)
+
+// CachingExecer wraps an Execer and caches the results of commands that set
+// CacheTTL so repeatedly polling idempotent commands (for example
+// `git status --porcelain`) does not run them every time.  Commands are keyed
+// by their command, arguments, environment, working directory, and user.
+// Commands with a TTY or stdin are never cached.
+//
+// On a cache miss the command runs to completion before Start returns and its
+// output is held in memory, so only mark short commands with small output as
+// cacheable.
+type CachingExecer struct {
+	execer Execer
+
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// NewCachingExecer returns an execer that caches results from execer.
+func NewCachingExecer(execer Execer) *CachingExecer {
+	return &CachingExecer{
+		execer:  execer,
+		entries: map[string]*cacheEntry{},
+	}
+}
+
+type cacheEntry struct {
+	// ready is closed once the result is available.  The remaining fields are
+	// not safe to access until then.
+	ready   chan struct{}
+	expires time.Time
+	pid     int
+	stdout  []byte
+	stderr  []byte
+	exitErr error
+	// err is set if the command could not be run to completion in which case
+	// the entry is not cached.
+	err error
+}
+
+// Start runs the command or returns a process replaying a cached result.
+func (c *CachingExecer) Start(ctx context.Context, command Command) (Process, error) {
+	if command.CacheTTL <= 0 || command.TTY || command.Stdin {
+		return c.execer.Start(ctx, command)
+	}
+
+	key, err := cacheKey(command)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	c.mutex.Lock()
+	c.prune(now)
+	entry, ok := c.entries[key]
+	if !ok {
+		// Concurrent callers for the same command wait on this entry instead of
+		// running it again.
+		entry = &cacheEntry{ready: make(chan struct{})}
+		c.entries[key] = entry
+	}
+	c.mutex.Unlock()
+
+	if ok {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-entry.ready:
+		}
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		return newCachedProcess(entry), nil
+	}
+
+	c.run(ctx, command, entry)
+	close(entry.ready)
+	if entry.err != nil {
+		c.mutex.Lock()
+		delete(c.entries, key)
+		c.mutex.Unlock()
+		return nil, entry.err
+	}
+	return newCachedProcess(entry), nil
+}
+
+// run runs the command to completion and records the result in entry.
+func (c *CachingExecer) run(ctx context.Context, command Command, entry *cacheEntry) {
+	process, err := c.execer.Start(ctx, command)
+	if err != nil {
+		entry.err = err
+		return
+	}
+
+	var stdout, stderr bytes.Buffer
+	var outputgroup errgroup.Group
+	outputgroup.Go(func() error {
+		_, err := io.Copy(&stdout, process.Stdout())
+		return err
+	})
+	outputgroup.Go(func() error {
+		_, err := io.Copy(&stderr, process.Stderr())
+		return err
+	})
+	err = outputgroup.Wait()
+	if err != nil {
+		entry.err = xerrors.Errorf("read output: %w", err)
+		return
+	}
+
+	err = process.Wait()
+	if _, ok := err.(ExitError); err != nil && !ok {
+		entry.err = err
+		return
+	}
+
+	entry.pid = process.Pid()
+	entry.stdout = stdout.Bytes()
+	entry.stderr = stderr.Bytes()
+	entry.exitErr = err
+	entry.expires = time.Now().Add(command.CacheTTL)
+}
+
+// prune removes expired entries.  It must be called with the mutex held.
+func (c *CachingExecer) prune(now time.Time) {
+	for key, entry := range c.entries {
+		select {
+		case <-entry.ready:
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		default:
+			// Still running.
+		}
+	}
+}
+
+func cacheKey(command Command) (string, error) {
+	byt, err := json.Marshal(struct {
+		Command    string
+		Args       []string
+		Shell      bool
+		Env        []string
+		WorkingDir string
+		UID        uint32
+		GID        uint32
+	}{command.Command, command.Args, command.Shell, command.Env, command.WorkingDir, command.UID, command.GID})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(byt)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// cachedProcess replays a cached result.
+type cachedProcess struct {
+	entry  *cacheEntry
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+}
+
+func newCachedProcess(entry *cacheEntry) *cachedProcess {
+	return &cachedProcess{
+		entry:  entry,
+		stdout: ioutil.NopCloser(bytes.NewReader(entry.stdout)),
+		stderr: ioutil.NopCloser(bytes.NewReader(entry.stderr)),
+	}
+}
+
+func (c *cachedProcess) Pid() int {
+	return c.entry.pid
+}
+
+func (c *cachedProcess) Stdin() io.WriteCloser {
+	return disabledStdinWriter{}
+}
+
+func (c *cachedProcess) Stdout() io.ReadCloser {
+	return c.stdout
+}
+
+func (c *cachedProcess) Stderr() io.ReadCloser {
+	return c.stderr
+}
+
+func (c *cachedProcess) Resize(_ context.Context, _, _ uint16) error {
+	return nil
+}
+
+func (c *cachedProcess) Wait() error {
+	return c.entry.exitErr
+}
+
+func (c *cachedProcess) Close() error {
+	return nil
+}
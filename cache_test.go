@@ -0,0 +1,100 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+// countingExecer counts the commands it starts.
+type countingExecer struct {
+	Execer
+	count int32
+}
+
+func (c *countingExecer) Start(ctx context.Context, command Command) (Process, error) {
+	atomic.AddInt32(&c.count, 1)
+	return c.Execer.Start(ctx, command)
+}
+
+func TestCachingExecer(t *testing.T) {
+	t.Parallel()
+
+	run := func(ctx context.Context, t *testing.T, execer Execer, command Command) (string, error) {
+		process, err := execer.Start(ctx, command)
+		assert.Success(t, "start command", err)
+		go io.Copy(ioutil.Discard, process.Stderr())
+		stdout, err := ioutil.ReadAll(process.Stdout())
+		assert.Success(t, "read stdout", err)
+		return string(stdout), process.Wait()
+	}
+
+	t.Run("Cached", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		counter := &countingExecer{Execer: LocalExecer{}}
+		execer := NewCachingExecer(counter)
+		command := Command{
+			Command:  "sh",
+			Args:     []string{"-c", "echo $RANDOM; exit 3"},
+			CacheTTL: time.Minute,
+		}
+
+		first, err := run(ctx, t, execer, command)
+		exitErr, ok := err.(ExitError)
+		assert.True(t, "is exit error", ok)
+		assert.Equal(t, "exit code", 3, exitErr.ExitCode())
+
+		second, err := run(ctx, t, execer, command)
+		exitErr, ok = err.(ExitError)
+		assert.True(t, "is exit error", ok)
+		assert.Equal(t, "exit code", 3, exitErr.ExitCode())
+
+		assert.Equal(t, "same output", first, second)
+		assert.Equal(t, "ran once", int32(1), atomic.LoadInt32(&counter.count))
+
+		// A different environment is a different command.
+		command.Env = []string{"FOO=bar"}
+		_, _ = run(ctx, t, execer, command)
+		assert.Equal(t, "ran again", int32(2), atomic.LoadInt32(&counter.count))
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		counter := &countingExecer{Execer: LocalExecer{}}
+		execer := NewCachingExecer(counter)
+		command := Command{
+			Command:  "pwd",
+			CacheTTL: time.Millisecond,
+		}
+
+		_, err := run(ctx, t, execer, command)
+		assert.Success(t, "run", err)
+		time.Sleep(10 * time.Millisecond)
+		_, err = run(ctx, t, execer, command)
+		assert.Success(t, "run", err)
+		assert.Equal(t, "ran twice", int32(2), atomic.LoadInt32(&counter.count))
+	})
+
+	t.Run("NotMarked", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		counter := &countingExecer{Execer: LocalExecer{}}
+		execer := NewCachingExecer(counter)
+		testExecer(ctx, t, execer)
+		testExecer(ctx, t, execer)
+		assert.Equal(t, "ran twice", int32(2), atomic.LoadInt32(&counter.count))
+	})
+}
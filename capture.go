@@ -0,0 +1,205 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/wsep/internal/proto"
+	"github.com/google/uuid"
+	"go.coder.com/flog"
+)
+
+// Directions of captured messages.
+const (
+	// CaptureIn is a message from the client.
+	CaptureIn = "in"
+	// CaptureOut is a message to the client.
+	CaptureOut = "out"
+)
+
+// CaptureRecord is a line of a file written for Options.CaptureDir.
+type CaptureRecord struct {
+	Time time.Time `json:"time"`
+	// Direction is CaptureIn or CaptureOut, or empty for the last record,
+	// which holds the error (if any) the connection ended with.
+	Direction string `json:"direction,omitempty"`
+	Type      string `json:"type,omitempty"`
+	// Header is the message's JSON header with secrets scrubbed.  Binary data
+	// frames have none.
+	Header json.RawMessage `json:"header,omitempty"`
+	// BodySize is the length of the body, which is not recorded since stdin,
+	// output and files may hold anything.
+	BodySize int    `json:"body_size,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// redacted replaces scrubbed values in captured headers.
+const redacted = "REDACTED"
+
+// captureConn records every message of a conn to a file.
+type captureConn struct {
+	conn
+
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// pingingCaptureConn is a captureConn that keeps the wrapped conn's Ping
+// available for ClientIdleTimeout.
+type pingingCaptureConn struct {
+	*captureConn
+}
+
+func (c pingingCaptureConn) Ping(ctx context.Context) error {
+	return c.conn.(pinger).Ping(ctx)
+}
+
+// newCaptureConn starts capturing the messages of c to a new file in dir.
+// end must be called once the connection is done.
+func newCaptureConn(c conn, dir string) (conn, func(err error), error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, nil, err
+	}
+	name := time.Now().UTC().Format("20060102T150405") + "-" + uuid.NewString() + ".jsonl"
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	cc := &captureConn{conn: c, file: file, encoder: json.NewEncoder(file)}
+	if _, ok := c.(pinger); ok {
+		return pingingCaptureConn{cc}, cc.end, nil
+	}
+	return cc, cc.end, nil
+}
+
+func (c *captureConn) Read(ctx context.Context) ([]byte, error) {
+	msg, err := c.conn.Read(ctx)
+	if err == nil {
+		c.record(CaptureIn, msg)
+	}
+	return msg, err
+}
+
+func (c *captureConn) Write(ctx context.Context, msg []byte) error {
+	c.record(CaptureOut, msg)
+	return c.conn.Write(ctx, msg)
+}
+
+func (c *captureConn) WriteBuffers(ctx context.Context, bufs net.Buffers) error {
+	c.record(CaptureOut, bytes.Join(bufs, nil))
+	return c.conn.WriteBuffers(ctx, bufs)
+}
+
+// record captures a message.
+func (c *captureConn) record(direction string, msg []byte) {
+	record := CaptureRecord{Direction: direction}
+	typ, header, body, err := proto.ParseMessage(msg)
+	if err != nil {
+		record.BodySize = len(msg)
+		record.Error = err.Error()
+	} else {
+		record.Type = typ
+		record.Header = scrubHeader(header)
+		record.BodySize = len(body)
+	}
+	c.write(record)
+}
+
+// end records how the connection ended and closes the file.  Messages sent
+// afterward are not recorded.
+func (c *captureConn) end(err error) {
+	c.write(CaptureRecord{Error: errorString(err)})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == nil {
+		return
+	}
+	err = c.file.Close()
+	if err != nil {
+		flog.Error("failed to close capture: %v", err)
+	}
+	c.file = nil
+}
+
+func (c *captureConn) write(record CaptureRecord) {
+	record.Time = time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == nil {
+		return
+	}
+	err := c.encoder.Encode(record)
+	if err != nil {
+		flog.Error("failed to capture message: %v", err)
+	}
+}
+
+// scrubHeader returns a JSON header with the values of fields that may hold
+// secrets, such as tokens and environment variables, replaced.
+func scrubHeader(header []byte) json.RawMessage {
+	if header == nil {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(header))
+	// Numbers are kept as they are so that large seqs do not lose precision.
+	decoder.UseNumber()
+	var v interface{}
+	err := decoder.Decode(&v)
+	if err != nil {
+		return nil
+	}
+	scrubValue(v)
+	scrubbed, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return scrubbed
+}
+
+func scrubValue(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			switch lower := strings.ToLower(key); {
+			case lower == "env":
+				// Names are kept since which variables were set can matter.
+				list, _ := value.([]interface{})
+				for i, variable := range list {
+					if s, ok := variable.(string); ok {
+						list[i] = strings.SplitN(s, "=", 2)[0] + "=" + redacted
+					}
+				}
+			case secretKey(lower):
+				if value != nil && value != "" {
+					v[key] = redacted
+				}
+			default:
+				scrubValue(value)
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			scrubValue(value)
+		}
+	}
+}
+
+// secretKey reports whether a header field named key, in lowercase, may hold a
+// secret.
+func secretKey(key string) bool {
+	for _, secret := range []string{"token", "secret", "password", "credential", "authorization"} {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
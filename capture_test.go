@@ -0,0 +1,95 @@
+package wsep
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"nhooyr.io/websocket"
+)
+
+func TestCapture(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	dir := filepath.Join(tempDir(t), "captures")
+	ws, server := mockConn(ctx, t, nil, &Options{CaptureDir: dir})
+	defer server.Close()
+
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", "read line; echo done"},
+		Env:     []string{"API_KEY=hunter2"},
+		Stdin:   true,
+	})
+	assert.Success(t, "start", err)
+	_, err = process.Stdin().Write([]byte("swordfish\n"))
+	assert.Success(t, "write stdin", err)
+	_, err = io.Copy(ioutil.Discard, process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.Success(t, "wait", process.Wait())
+	_ = ws.Close(websocket.StatusNormalClosure, "normal closure")
+
+	// The capture is complete once the connection ends.
+	var records []CaptureRecord
+	for len(records) == 0 || records[len(records)-1].Direction != "" {
+		assert.Success(t, "context", ctx.Err())
+		time.Sleep(10 * time.Millisecond)
+		records = readCapture(t, dir)
+	}
+
+	var captured strings.Builder
+	types := map[string]string{}
+	for _, record := range records {
+		captured.Write(record.Header)
+		if record.Type != "" {
+			types[record.Type] = record.Direction
+		}
+	}
+	assert.Equal(t, "start", CaptureIn, types["start"])
+	assert.Equal(t, "stdin", CaptureIn, types["stdin"])
+	assert.Equal(t, "pid", CaptureOut, types["pid"])
+	assert.Equal(t, "exit", CaptureOut, types["exit_code"])
+	assert.True(t, "env name kept", strings.Contains(captured.String(), "API_KEY="+redacted))
+	assert.True(t, "env value scrubbed", !strings.Contains(captured.String(), "hunter2"))
+	assert.True(t, "stdin left out", !strings.Contains(captured.String(), "swordfish"))
+}
+
+func TestScrubHeader(t *testing.T) {
+	t.Parallel()
+
+	scrubbed := scrubHeader([]byte(`{"type":"start","id":"main","token":"abc","seq":18446744073709551615,"command":{"env":["HOME=/root"],"extra":{"Password":"x"}}}`))
+	assert.Equal(t, "scrubbed", `{"command":{"env":["HOME=REDACTED"],"extra":{"Password":"REDACTED"}},"id":"main","seq":18446744073709551615,"token":"REDACTED","type":"start"}`, string(scrubbed))
+	assert.True(t, "invalid", scrubHeader([]byte("{")) == nil)
+}
+
+// readCapture reads the only capture in dir.
+func readCapture(t *testing.T, dir string) []CaptureRecord {
+	names, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	assert.Success(t, "glob", err)
+	if len(names) == 0 {
+		return nil
+	}
+	assert.Equal(t, "captures", 1, len(names))
+	file, err := os.Open(names[0])
+	assert.Success(t, "open", err)
+	defer file.Close()
+	var records []CaptureRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record CaptureRecord
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		assert.Success(t, "unmarshal", err)
+		records = append(records, record)
+	}
+	return records
+}
@@ -1,12 +1,14 @@
 package wsep
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"cdr.dev/wsep/internal/proto"
 	"golang.org/x/xerrors"
@@ -16,30 +18,180 @@ import (
 const maxMessageSize = 64000
 
 type remoteExec struct {
-	conn *websocket.Conn
+	conn conn
+	// jsonData stops the client from offering binary data frames so that the
+	// JSON path can be benchmarked.
+	jsonData bool
 }
 
 // RemoteExecer creates an execution interface from a WebSocket connection.
 func RemoteExecer(conn *websocket.Conn) Execer {
+	return newRemoteExecer(newWSConn(conn, false))
+}
+
+// RemoteStreamExecer creates an execution interface from a byte stream such as
+// a unix socket, to be used with Server.ServeStream on the other end.  Closing
+// a started Process also closes the stream.
+func RemoteStreamExecer(rwc io.ReadWriteCloser) Execer {
+	return newRemoteExecer(newStreamConn(rwc))
+}
+
+func newRemoteExecer(conn conn) Execer {
 	conn.SetReadLimit(maxMessageSize)
 	return remoteExec{conn: conn}
 }
 
 // Command represents an external command to be run
 type Command struct {
-	// ID allows reconnecting commands that have a TTY.
-	ID      string
+	// ID allows reconnecting commands.  Commands with a TTY reattach to their
+	// session while those without keep running on the server for the session
+	// timeout after their connection drops, keeping the end of their output
+	// for the next attach.
+	ID string
+	// Command is the program to run.  If it is empty the user's login shell
+	// from passwd is started, which is what terminals usually want.
 	Command string
 	Args    []string
+	// Shell runs Command as a script through the shell of the user the
+	// command runs as, with Args as the script's positional parameters, so
+	// callers need not quote it for "sh -c" themselves.  Execers that cannot
+	// look the user up use the SHELL of the command's environment or /bin/sh.
+	Shell bool
 	// Commands with a TTY also require Rows and Cols.
-	TTY        bool
-	Rows       uint16
-	Cols       uint16
-	Stdin      bool
-	UID        uint32
-	GID        uint32
-	Env        []string
-	WorkingDir string
+	TTY  bool
+	Rows uint16
+	Cols uint16
+	// TerminalModes sets up the terminal of a TTY command before it runs, for
+	// example to start without echo.  SetTerminalModes changes them later.
+	TerminalModes TerminalModes
+	Stdin         bool
+	UID           uint32
+	GID           uint32
+	Env           []string
+	WorkingDir    string
+	// AppHint describes the kind of program the command runs so clients can
+	// pick suitable terminal behavior.  It is passed through to the execer.
+	AppHint AppHint
+	// CacheTTL marks the command as idempotent so that a CachingExecer may
+	// reuse its result for this long.  It is not sent to the remote.
+	CacheTTL time.Duration
+	// OnClipboard, if set on a TTY command started by a remote execer, asks
+	// the server to remove OSC 52 sequences from the output and is called with
+	// the selection and data each time the application sets the clipboard.  It
+	// is called from the goroutine reading the connection so it must not block.
+	OnClipboard func(selection string, data []byte)
+	// OnBell and OnNotify likewise ask the server to remove BEL characters and
+	// OSC 9 or OSC 777 notifications from TTY output and report them instead.
+	// The title is empty for OSC 9 notifications.
+	OnBell   func()
+	OnNotify func(title, body string)
+	// OnExtension is called with extension messages the server sends while a
+	// remote command runs.  It is called from the goroutine reading the
+	// connection so it must not block.
+	OnExtension func(namespace string, payload []byte)
+	// KeepaliveInterval, if set, makes a remote execer ping the server this
+	// often while the command runs and fail the process with a KeepaliveError
+	// if a ping is not answered within KeepaliveTimeout, which defaults to the
+	// interval.  Pongs are only seen while output is being read.  Only
+	// WebSocket connections support pings.  Neither is sent to the remote.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+	// Paced asks the server to timestamp output and delays delivering it to
+	// Stdout and Stderr so the gaps between chunks match those on the server,
+	// smoothing over bursts introduced by the network.  Combine with Recording
+	// to replay a session later.
+	Paced bool
+	// OnDisconnect is called with the close status and reason if the
+	// connection of a remote command drops before the command exits.  A
+	// connection lost without a close message reports
+	// websocket.StatusAbnormalClosure with the read error as the reason.
+	OnDisconnect func(code websocket.StatusCode, reason string)
+	// OnFreeze is called when the session a remote TTY command is attached to
+	// is frozen or thawed on the server, and on attaching to a frozen session.
+	// It is called from the goroutine reading the connection so it must not
+	// block.
+	OnFreeze func(frozen bool)
+	// OnTruncate is called when a stream of a remote command, "stdout" or
+	// "stderr", ends after the server dropped output beyond its
+	// Options.MaxOutputBytes.  The end of the stream may still follow.  It is
+	// called from the goroutine reading the connection so it must not block.
+	OnTruncate func(stream string, dropped int64)
+	// OnWarning is called with problems a remote command started despite, such
+	// as a working directory that does not exist, in which case it starts in
+	// the user's home directory instead, and with messages a server without
+	// Options.StrictMessages skipped.  The code identifies the problem and is
+	// empty from servers that predate warning codes.  It is called from the
+	// goroutine reading the connection so it must not block.
+	OnWarning func(code Code, message string)
+	// StrictMessages fails a remote command with ErrUnknownMessage when the
+	// server sends a message of a type this client does not know, rather than
+	// skipping it, so that a server newer than the client is noticed.
+	StrictMessages bool
+	// LowLatency asks the server to send TTY output as soon as it is read
+	// instead of coalescing small writes, for applications where every
+	// millisecond of delay is noticeable.
+	LowLatency bool
+	// Acknowledged, on a command without a TTY but with an ID, asks the server
+	// to keep all output until it is acknowledged with AckOutput rather than
+	// only the most recent, so that none is lost across reconnects.  The
+	// command is paused while Options.ResumeBufferSize bytes of a stream are
+	// unacknowledged.
+	Acknowledged bool
+	// StdoutFile and StderrFile ask the server to write the output of a
+	// command without a TTY to these files instead of streaming it, as the
+	// command's UID and GID so the files are owned by its user.  Missing
+	// directories are created and existing files are replaced.  Both may name
+	// the same file.  TeeOutput streams the output as well.  Only servers
+	// redirect output; execers ignore these fields.
+	StdoutFile string
+	StderrFile string
+	TeeOutput  bool
+	// DiscardOutput asks the server not to send the output of a remote
+	// command at all, for callers that only need its exit code.  Its Stdout
+	// and Stderr then end without output when it exits and need not be read.
+	DiscardOutput bool
+	// LineBuffered asks the server to send the output of a remote command
+	// without a TTY in whole lines, holding a partial line until it is
+	// completed or the stream ends, so that each message ends at a line
+	// boundary.  Lines longer than a message are split.
+	LineBuffered bool
+	// ExclusiveInput, on a TTY command that creates a session, lets only one
+	// of the clients attached to the session send input at a time.  Input,
+	// resizes and signals from the others are dropped until one of them takes
+	// over with TakeInput.
+	ExclusiveInput bool
+	// OnInputLock is called when a remote command attached to a session with
+	// ExclusiveInput set gains or loses the session's input lock, and on
+	// attaching.  It is called from the goroutine reading the connection so
+	// it must not block.
+	OnInputLock func(holder bool)
+	// ResumeFrom, if set on a command without a TTY, re-attaches to the
+	// command with the same ID instead of starting it again and replays its
+	// output from these offsets, usually those from ProcessOutputOffsets on
+	// the process of the dropped connection.  It fails with
+	// CodeSessionNotFound once the command is gone.
+	ResumeFrom *OutputOffsets
+	// Observe attaches to the existing TTY session with the same ID read-only,
+	// for watching someone else's terminal.  The session is not started if it
+	// does not exist; Start fails with CodeSessionNotFound instead.  The
+	// server ends the connection with CodeForbidden if the process is sent
+	// input, resized or signaled.
+	Observe bool
+	// ShareToken is a token from SessionAdmin.ShareSession that lets the
+	// command attach to a session with another owner.  Observe must be set
+	// if the token is read-only.
+	ShareToken string
+	// Term and ColorTerm are the TERM and COLORTERM of the client's terminal,
+	// which the server sets for a remote TTY command in place of its own so
+	// the command's output suits the terminal showing it.  Variables in Env
+	// take precedence.
+	Term      string
+	ColorTerm string
+	// Locale forwards variables of the client's locale, such as those from
+	// LocaleEnv, to a remote command so it renders text and dates the way the
+	// user expects.  The server drops any not allowed by its
+	// Options.AcceptEnv, and variables in Env take precedence.
+	Locale []string
 }
 
 // Start runs the command on the remote.  Once a command is started, callers should
@@ -47,20 +199,30 @@ type Command struct {
 // also close the websocket.
 func (r remoteExec) Start(ctx context.Context, c Command) (Process, error) {
 	header := proto.ClientStartHeader{
-		ID:      c.ID,
-		Command: mapToProtoCmd(c),
-		Type:    proto.TypeStart,
+		ID:        c.ID,
+		Command:   mapToProtoCmd(c),
+		Type:      proto.TypeStart,
+		Observe:   c.Observe,
+		Token:     c.ShareToken,
+		Term:      c.Term,
+		ColorTerm: c.ColorTerm,
+		Locale:    c.Locale,
+	}
+	// Servers that do not know about binary data frames ignore the offer.
+	header.Command.BinaryData = !r.jsonData
+	if c.ResumeFrom != nil {
+		header.Resume = &proto.ResumeOffsets{Stdout: c.ResumeFrom.Stdout, Stderr: c.ResumeFrom.Stderr}
 	}
 	payload, err := json.Marshal(header)
 	if err != nil {
 		return nil, err
 	}
-	err = r.conn.Write(ctx, websocket.MessageBinary, payload)
+	err = r.conn.Write(ctx, payload)
 	if err != nil {
 		return nil, err
 	}
 
-	_, payload, err = r.conn.Read(ctx)
+	payload, err = r.conn.Read(ctx)
 	if err != nil {
 		return nil, xerrors.Errorf("read pid message: %w", err)
 	}
@@ -69,72 +231,223 @@ func (r remoteExec) Start(ctx context.Context, c Command) (Process, error) {
 	if err != nil {
 		return nil, xerrors.Errorf("failed to parse pid message: %w", err)
 	}
-
-	var stdin io.WriteCloser
-	if c.Stdin {
-		stdin = remoteStdin{
-			conn: websocket.NetConn(ctx, r.conn, websocket.MessageBinary),
-		}
-	} else {
-		stdin = disabledStdinWriter{}
+	if pidHeader.Type == proto.TypeError {
+		return nil, parseResult(payload)
 	}
 
+	// The start and pid messages are counted too.
+	stats := &processStats{framesSent: 1, framesReceived: 1}
+	counted := countingConn{conn: r.conn, stats: stats}
+
 	listenCtx, cancelListen := context.WithCancel(ctx)
 	rp := &remoteProcess{
 		ctx:          ctx,
-		conn:         r.conn,
+		conn:         counted,
+		stats:        stats,
 		cmd:          c,
 		pid:          pidHeader.Pid,
+		appHint:      AppHint(pidHeader.AppHint),
 		done:         make(chan struct{}),
 		stderr:       newPipe(),
-		stderrData:   make(chan []byte),
 		stdout:       newPipe(),
-		stdoutData:   make(chan []byte),
-		stdin:        stdin,
+		stdin:        disabledStdinWriter{},
 		cancelListen: cancelListen,
+		resizeAcks:   pidHeader.ResizeAcks,
+		controlAcks:  pidHeader.ControlAcks,
+		ignored:      pidHeader.Ignored,
+	}
+	rp.info = ProcessInfo{
+		WorkingDir: pidHeader.WorkingDir,
+		User:       pidHeader.User,
+		Shell:      pidHeader.Shell,
+		SessionID:  pidHeader.SessionID,
+	}
+	if c.ResumeFrom != nil {
+		rp.stdoutOffset, rp.stderrOffset = c.ResumeFrom.Stdout, c.ResumeFrom.Stderr
+	}
+	if c.Stdin {
+		rp.stdin = remoteStdin{
+			conn:    connWriter{ctx: ctx, conn: counted},
+			stats:   stats,
+			binary:  pidHeader.BinaryData,
+			process: rp,
+		}
 	}
 
 	go rp.listen(listenCtx)
+	if p, ok := r.conn.(pinger); ok && c.KeepaliveInterval > 0 {
+		go rp.keepalive(listenCtx, p)
+	}
 	return rp, nil
 }
 
+// SessionAdmin is implemented by remote execers to administer sessions on the
+// server.  Unlike Start, administrative methods may be called any number of
+// times on the same connection before a command is started.
+type SessionAdmin interface {
+	// TransferSession changes the owner of a session.  The connection must own
+	// the session or have admin rights on the server.
+	TransferSession(ctx context.Context, id string, owner string) error
+	// ReadJournal writes the output the server journaled for a session to w,
+	// including output produced while no client was attached.  The connection
+	// must own the session or have admin rights on the server, which are also
+	// required once the session has closed.
+	ReadJournal(ctx context.Context, id string, w io.Writer) error
+	// ShareSession mints a token that lets connections with another owner
+	// attach to a session, only to observe it if readOnly is set.  The token
+	// expires after ttl, rounded up to whole seconds, or lasts as long as the
+	// session if ttl is zero.  A negative ttl is an error.  The connection must
+	// own the session or have admin rights on the server.
+	ShareSession(ctx context.Context, id string, readOnly bool, ttl time.Duration) (string, error)
+}
+
+// TransferSession asks the server to change the owner of a session.
+func (r remoteExec) TransferSession(ctx context.Context, id string, owner string) error {
+	return r.request(ctx, proto.ClientTransferSessionHeader{
+		Type:  proto.TypeTransferSession,
+		ID:    id,
+		Owner: owner,
+	})
+}
+
+// ReadJournal asks the server for the journal of a session.
+func (r remoteExec) ReadJournal(ctx context.Context, id string, w io.Writer) error {
+	header, err := json.Marshal(proto.ClientJournalHeader{
+		Type: proto.TypeJournal,
+		ID:   id,
+	})
+	if err != nil {
+		return err
+	}
+	err = r.conn.Write(ctx, header)
+	if err != nil {
+		return err
+	}
+	return r.receiveFile(ctx, w, nil)
+}
+
+// request sends a message that does not start a command and waits for the
+// result.
+func (r remoteExec) request(ctx context.Context, header interface{}) error {
+	_, err := r.requestResult(ctx, header)
+	return err
+}
+
+// requestResult is like request but returns the result message.
+func (r remoteExec) requestResult(ctx context.Context, header interface{}) (proto.ServerResultHeader, error) {
+	payload, err := json.Marshal(header)
+	if err != nil {
+		return proto.ServerResultHeader{}, err
+	}
+	err = r.conn.Write(ctx, payload)
+	if err != nil {
+		return proto.ServerResultHeader{}, err
+	}
+	payload, err = r.conn.Read(ctx)
+	if err != nil {
+		return proto.ServerResultHeader{}, xerrors.Errorf("read result message: %w", err)
+	}
+	headerByt, _ := proto.SplitMessage(payload)
+	err = parseResult(headerByt)
+	if err != nil {
+		return proto.ServerResultHeader{}, err
+	}
+	var result proto.ServerResultHeader
+	err = json.Unmarshal(headerByt, &result)
+	return result, err
+}
+
+// parseResult converts a result message into an error.
+func parseResult(headerByt []byte) error {
+	var result proto.ServerResultHeader
+	err := json.Unmarshal(headerByt, &result)
+	if err != nil {
+		return xerrors.Errorf("failed to parse result message: %w", err)
+	}
+	if result.Error != "" {
+		return &Error{Code: Code(result.Code), err: xerrors.New(result.Error)}
+	}
+	return nil
+}
+
 type remoteProcess struct {
+	// stdoutOffset and stderrOffset are how much of each stream has been
+	// received, counting any output before a resume.  They are only written by
+	// listen and must be accessed atomically, so they come first to be aligned
+	// on 32-bit platforms.
+	stdoutOffset int64
+	stderrOffset int64
+
 	ctx          context.Context
 	cancelListen func()
 	cmd          Command
-	conn         *websocket.Conn
+	conn         conn
 	pid          int
+	appHint      AppHint
+	info         ProcessInfo
 	done         chan struct{}
 	closeErr     error
 	exitMsg      *proto.ServerExitCodeHeader
 	readErr      error
 	stdin        io.WriteCloser
-	stdout       pipe
+	stdout       *pipe
 	stdoutErr    error
-	stdoutData   chan []byte
-	stderr       pipe
+	stderr       *pipe
 	stderrErr    error
-	stderrData   chan []byte
+
+	stats *processStats
+	// pacer delays output for paced commands.  It is only used by listen.
+	pacer pacer
+
+	// keepaliveErr is set if the server stopped answering pings.
+	keepaliveMutex sync.Mutex
+	keepaliveErr   *KeepaliveError
+
+	// resizeAcks is set if the server acknowledges resizes and controlAcks if
+	// it acknowledges other control messages, which are then waited for.  Each
+	// waiting call has a channel in ackWaiters that receives why the message
+	// failed, if it did.
+	resizeAcks  bool
+	controlAcks bool
+	ackMutex    sync.Mutex
+	ackSeq      uint64
+	ackWaiters  map[uint64]chan error
+	// ignored holds the message types the server skipped before the command
+	// started, which listen reports as warnings.
+	ignored []string
 }
 
 type remoteStdin struct {
-	conn net.Conn
+	// conn must write each call to Write as a single message.
+	conn io.Writer
+	// stats may be nil.
+	stats *processStats
+	// binary sends stdin as binary data frames.
+	binary bool
+	// process, if set, waits for the server to acknowledge closing stdin if
+	// it acknowledges control messages.
+	process *remoteProcess
 }
 
-func (r remoteStdin) Write(b []byte) (int, error) {
-	stdinHeader := proto.Header{
-		Type: proto.TypeStdin,
-	}
+// stdinHeader is the header of stdin messages, marshaled once rather than for
+// every write.
+var stdinHeader, _ = json.Marshal(proto.Header{Type: proto.TypeStdin})
 
-	headerByt, err := json.Marshal(stdinHeader)
-	if err != nil {
-		return 0, err
+func (r remoteStdin) Write(b []byte) (int, error) {
+	var (
+		stdinWriter io.Writer
+		maxBodySize int
+	)
+	if r.binary {
+		stdinWriter = proto.WithDataFrame(r.conn, proto.TypeStdin)
+		maxBodySize = maxMessageSize - 1
+	} else {
+		stdinWriter = proto.WithHeader(r.conn, stdinHeader)
+		maxBodySize = maxMessageSize - len(stdinHeader) - 1
 	}
-	stdinWriter := proto.WithHeader(r.conn, headerByt)
 
-	maxBodySize := maxMessageSize - len(headerByt) - 1
 	var nn int
-	for len(b) > maxMessageSize {
+	for len(b) > maxBodySize {
 		n, err := stdinWriter.Write(b[:maxBodySize])
 		nn += n
 		if err != nil {
@@ -145,10 +458,18 @@ func (r remoteStdin) Write(b []byte) (int, error) {
 
 	n, err := stdinWriter.Write(b)
 	nn += n
+	if r.stats != nil {
+		atomic.AddInt64(&r.stats.stdinBytes, int64(nn))
+	}
 	return nn, err
 }
 
 func (r remoteStdin) Close() error {
+	if r.process != nil {
+		return r.process.control(r.process.ctx, r.process.controlAcks, "close stdin", func(seq uint64) interface{} {
+			return proto.ClientControlHeader{Type: proto.TypeCloseStdin, Seq: seq}
+		})
+	}
 	closeHeader := proto.Header{
 		Type: proto.TypeCloseStdin,
 	}
@@ -160,63 +481,10 @@ func (r remoteStdin) Close() error {
 	return err
 }
 
-type pipe struct {
-	r   *io.PipeReader
-	w   *io.PipeWriter
-	d   chan []byte
-	e   chan error
-	buf []byte
-}
-
-func newPipe() pipe {
-	pr, pw := io.Pipe()
-	return pipe{
-		r:   pr,
-		w:   pw,
-		d:   make(chan []byte),
-		e:   make(chan error),
-		buf: make([]byte, maxMessageSize),
-	}
-}
-
-// writeCtx writes data to the pipe, or returns if the context is canceled.
-func (p *pipe) writeCtx(ctx context.Context, data []byte) error {
-	// actually do the copy on another goroutine so that we can return if context
-	// is canceled
-	go func() {
-		var err error
-		select {
-		case <-ctx.Done():
-			return
-		case body := <-p.d:
-			_, err = io.CopyBuffer(p.w, bytes.NewReader(body), p.buf)
-		}
-		select {
-		case <-ctx.Done():
-			return
-		case p.e <- err:
-			return
-		}
-	}()
-
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case p.d <- data:
-		// data being written.
-	}
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-p.e:
-		return err
-	}
-}
-
 func (r *remoteProcess) listen(ctx context.Context) {
 	defer func() {
-		r.stdoutErr = r.stdout.w.Close()
-		r.stderrErr = r.stderr.w.Close()
+		r.stdoutErr = r.stdout.closeWrite()
+		r.stderrErr = r.stderr.closeWrite()
 
 		r.closeErr = r.conn.Close(websocket.StatusNormalClosure, "normal closure")
 		// If we were in r.conn.Read() we cancel the ctx, the websocket library closes
@@ -228,41 +496,202 @@ func (r *remoteProcess) listen(ctx context.Context) {
 		readCtxCanceled := r.readErr != nil && strings.Contains(r.readErr.Error(), "context canceled")
 		alreadyClosed := r.closeErr != nil &&
 			(strings.Contains(r.closeErr.Error(), "already wrote close") ||
-				strings.Contains(r.closeErr.Error(), "WebSocket closed"))
+				strings.Contains(r.closeErr.Error(), "WebSocket closed") ||
+				strings.Contains(r.closeErr.Error(), "use of closed"))
 		if alreadyClosed && readCtxCanceled {
 			r.closeErr = nil
 		}
 		close(r.done)
 	}()
 
+	if r.cmd.OnWarning != nil {
+		for _, typ := range r.ignored {
+			r.cmd.OnWarning(CodeMessageIgnored, fmt.Sprintf("server ignored unknown message type %q", typ))
+		}
+	}
+
+	// ended holds the streams the server has sent all of.
+	ended := make(map[string]bool, 2)
 	for ctx.Err() == nil {
-		_, payload, err := r.conn.Read(ctx)
+		payload, err := r.conn.Read(ctx)
 		if err != nil {
 			r.readErr = err
+			// Ending the context is a deliberate close rather than a drop.
+			if ctx.Err() == nil && r.cmd.OnDisconnect != nil {
+				r.cmd.OnDisconnect(closeStatus(err))
+			}
 			return
 		}
-		headerByt, body := proto.SplitMessage(payload)
-
 		var header proto.Header
-		err = json.Unmarshal(headerByt, &header)
+		typ, headerByt, body, err := proto.ParseMessage(payload)
 		if err != nil {
 			r.readErr = err
 			return
 		}
+		header.Type = typ
+
+		if header.Type == proto.TypeStdout || header.Type == proto.TypeStderr {
+			if ended[header.Type] {
+				r.readErr = xerrors.Errorf("server sent %s after it ended", header.Type)
+				return
+			}
+			next := &r.stdoutOffset
+			if header.Type == proto.TypeStderr {
+				next = &r.stderrOffset
+			}
+			// Timestamped and resumable output always has a JSON header,
+			// unlike binary data frames.
+			resumable := r.cmd.ID != "" && !r.cmd.TTY
+			hasOutputHeader := (r.cmd.Paced || resumable) && headerByt != nil
+			var output proto.ServerOutputHeader
+			if hasOutputHeader {
+				output, err = proto.ParseOutputHeader(headerByt)
+				if err != nil {
+					r.readErr = err
+					return
+				}
+			}
+			if hasOutputHeader && r.cmd.Paced {
+				err = r.pacer.wait(ctx, output.Time)
+				if err != nil {
+					r.readErr = err
+					return
+				}
+			}
+			if hasOutputHeader && resumable {
+				body = resumeOutput(next, output.Offset, body)
+			} else {
+				atomic.AddInt64(next, int64(len(body)))
+			}
+		}
 
 		switch header.Type {
 		case proto.TypeStderr:
+			atomic.AddInt64(&r.stats.stderrBytes, int64(len(body)))
 			err = r.stderr.writeCtx(ctx, body)
 			if err != nil {
 				r.readErr = err
 				return
 			}
 		case proto.TypeStdout:
+			atomic.AddInt64(&r.stats.stdoutBytes, int64(len(body)))
 			err = r.stdout.writeCtx(ctx, body)
 			if err != nil {
 				r.readErr = err
 				return
 			}
+		case proto.TypeClipboard:
+			var clipboard proto.ServerClipboardHeader
+			err = json.Unmarshal(headerByt, &clipboard)
+			if err != nil {
+				r.readErr = err
+				return
+			}
+			if r.cmd.OnClipboard != nil {
+				r.cmd.OnClipboard(clipboard.Selection, body)
+			}
+		case proto.TypeBell:
+			if r.cmd.OnBell != nil {
+				r.cmd.OnBell()
+			}
+		case proto.TypeNotify:
+			var notify proto.ServerNotifyHeader
+			err = json.Unmarshal(headerByt, &notify)
+			if err != nil {
+				r.readErr = err
+				return
+			}
+			if r.cmd.OnNotify != nil {
+				r.cmd.OnNotify(notify.Title, notify.Body)
+			}
+		case proto.TypeExtension:
+			var extension proto.ExtensionHeader
+			err = json.Unmarshal(headerByt, &extension)
+			if err != nil {
+				r.readErr = err
+				return
+			}
+			if r.cmd.OnExtension != nil {
+				r.cmd.OnExtension(extension.Namespace, body)
+			}
+		case proto.TypeFrozen:
+			var frozen proto.ServerFrozenHeader
+			err = json.Unmarshal(headerByt, &frozen)
+			if err != nil {
+				r.readErr = err
+				return
+			}
+			if r.cmd.OnFreeze != nil {
+				r.cmd.OnFreeze(frozen.Frozen)
+			}
+		case proto.TypeInputLock:
+			var lock proto.ServerInputLockHeader
+			err = json.Unmarshal(headerByt, &lock)
+			if err != nil {
+				r.readErr = err
+				return
+			}
+			if r.cmd.OnInputLock != nil {
+				r.cmd.OnInputLock(lock.Holder)
+			}
+		case proto.TypeTruncated:
+			var truncated proto.ServerTruncatedHeader
+			err = json.Unmarshal(headerByt, &truncated)
+			if err != nil {
+				r.readErr = err
+				return
+			}
+			if r.cmd.OnTruncate != nil {
+				r.cmd.OnTruncate(truncated.Stream, truncated.Dropped)
+			}
+		case proto.TypeEOF:
+			var eof proto.ServerEOFHeader
+			err = json.Unmarshal(headerByt, &eof)
+			if err != nil {
+				r.readErr = err
+				return
+			}
+			ended[eof.Stream] = true
+			switch eof.Stream {
+			case proto.TypeStdout:
+				r.stdoutErr = r.stdout.closeWrite()
+			case proto.TypeStderr:
+				r.stderrErr = r.stderr.closeWrite()
+			}
+		case proto.TypeWarning:
+			var warning proto.ServerWarningHeader
+			err = json.Unmarshal(headerByt, &warning)
+			if err != nil {
+				r.readErr = err
+				return
+			}
+			if r.cmd.OnWarning != nil {
+				r.cmd.OnWarning(Code(warning.Code), warning.Message)
+			}
+		case proto.TypeResized, proto.TypeAcked:
+			// Resized has the same fields as acked besides the size.
+			var acked proto.ServerAckedHeader
+			err = json.Unmarshal(headerByt, &acked)
+			if err != nil {
+				r.readErr = err
+				return
+			}
+			err = nil
+			if acked.Error != "" {
+				err = xerrors.New(acked.Error)
+			}
+			r.acked(acked.Seq, err)
+		case proto.TypeError:
+			// Errors have the same fields as results.
+			r.readErr = parseResult(headerByt)
+			if r.readErr == nil {
+				r.readErr = xerrors.New("server closed the connection with an error")
+			}
+			var serverErr proto.ServerErrorHeader
+			if json.Unmarshal(headerByt, &serverErr) == nil && serverErr.Seq != 0 {
+				r.acked(serverErr.Seq, r.readErr)
+			}
+			return
 		case proto.TypeExitCode:
 			var exitMsg proto.ServerExitCodeHeader
 			err = json.Unmarshal(headerByt, &exitMsg)
@@ -272,16 +701,71 @@ func (r *remoteProcess) listen(ctx context.Context) {
 			}
 			r.exitMsg = &exitMsg
 			return
+		default:
+			if r.cmd.StrictMessages {
+				r.readErr = codeErrorf(CodeUnknownMessage, "unknown message type %q", header.Type)
+				return
+			}
 		}
 	}
 	// if we get here, the context is done, so use that as the read error
 	r.readErr = ctx.Err()
 }
 
+// resumeOutput drops the part of the body at offset that was already received
+// before a resume and advances next, the offset of the next byte expected.
+// Output the server no longer had when resuming is skipped over.
+func resumeOutput(next *int64, offset int64, body []byte) []byte {
+	expected := atomic.LoadInt64(next)
+	end := offset + int64(len(body))
+	if end <= expected {
+		return nil
+	}
+	if offset < expected {
+		body = body[expected-offset:]
+	}
+	atomic.StoreInt64(next, end)
+	return body
+}
+
+// closeStatus returns the status and reason of the close message that ended a
+// connection with err.
+func closeStatus(err error) (websocket.StatusCode, string) {
+	var closeErr websocket.CloseError
+	if xerrors.As(err, &closeErr) {
+		return closeErr.Code, closeErr.Reason
+	}
+	return websocket.StatusAbnormalClosure, err.Error()
+}
+
 func (r *remoteProcess) Pid() int {
 	return r.pid
 }
 
+// Stats returns the traffic statistics of the process.
+func (r *remoteProcess) Stats() Stats {
+	return r.stats.snapshot()
+}
+
+// OutputOffsets returns how much of each output stream has been received.
+func (r *remoteProcess) OutputOffsets() OutputOffsets {
+	return OutputOffsets{
+		Stdout: atomic.LoadInt64(&r.stdoutOffset),
+		Stderr: atomic.LoadInt64(&r.stderrOffset),
+	}
+}
+
+// AppHint returns the hint the server reported for the command, which for a
+// reattached session is the hint it was created with.
+func (r *remoteProcess) AppHint() AppHint {
+	return r.appHint
+}
+
+// StartInfo returns how the server reported starting the command.
+func (r *remoteProcess) StartInfo() ProcessInfo {
+	return r.info
+}
+
 func (r *remoteProcess) Stdin() io.WriteCloser {
 	if !r.cmd.Stdin {
 		return disabledStdinWriter{}
@@ -289,46 +773,185 @@ func (r *remoteProcess) Stdin() io.WriteCloser {
 	return r.stdin
 }
 
-// Stdout returns a reader for standard out from the process.  You MUST read from
-// this reader even if you don't care about the data to avoid blocking the
-// websocket.
-func (r *remoteProcess) Stdout() io.Reader {
-	return r.stdout.r
+// Stdout returns a reader for standard out from the process.  Output is
+// buffered up to a limit, after which you MUST read from this reader even if you
+// don't care about the data to avoid blocking the websocket, or close it to
+// discard the rest.
+func (r *remoteProcess) Stdout() io.ReadCloser {
+	return r.stdout
 }
 
-// Stdout returns a reader for standard error from the process.  You MUST read from
-// this reader even if you don't care about the data to avoid blocking the
-// websocket.
-func (r *remoteProcess) Stderr() io.Reader {
-	return r.stderr.r
+// Stderr returns a reader for standard error from the process.  Like Stdout it
+// must be read or closed once its buffer fills.
+func (r *remoteProcess) Stderr() io.ReadCloser {
+	return r.stderr
 }
 
+// Resize resizes the process's terminal.  If the server acknowledges resizes
+// it returns once the terminal has been resized, or with the reason it was not.
 func (r *remoteProcess) Resize(ctx context.Context, rows, cols uint16) error {
-	header := proto.ClientResizeHeader{
-		Type: proto.TypeResize,
-		Cols: cols,
-		Rows: rows,
+	return r.control(ctx, r.resizeAcks, "resize", func(seq uint64) interface{} {
+		return proto.ClientResizeHeader{
+			Type: proto.TypeResize,
+			Cols: cols,
+			Rows: rows,
+			Seq:  seq,
+		}
+	})
+}
+
+// control sends the control message built by header, which is given the seq
+// to set.  If acked is set the message is given a seq and control waits for
+// the server to acknowledge it, returning the reason it failed if it did.
+// Otherwise the seq is zero and control returns once the message is sent.
+func (r *remoteProcess) control(ctx context.Context, acked bool, name string, header func(seq uint64) interface{}) error {
+	var (
+		seq uint64
+		ack chan error
+	)
+	if acked {
+		ack = make(chan error, 1)
+		r.ackMutex.Lock()
+		r.ackSeq++
+		seq = r.ackSeq
+		if r.ackWaiters == nil {
+			r.ackWaiters = make(map[uint64]chan error)
+		}
+		r.ackWaiters[seq] = ack
+		r.ackMutex.Unlock()
+		defer func() {
+			r.ackMutex.Lock()
+			delete(r.ackWaiters, seq)
+			r.ackMutex.Unlock()
+		}()
+	}
+	payload, err := json.Marshal(header(seq))
+	if err != nil {
+		return err
+	}
+	err = r.conn.Write(ctx, payload)
+	if err != nil || ack == nil {
+		return err
+	}
+	select {
+	case err = <-ack:
+	case <-r.done:
+		select {
+		case err = <-ack:
+		default:
+			// The exit code may overtake the acknowledgement of a signal
+			// that ended the command.
+			if r.exitMsg == nil {
+				return xerrors.Errorf("connection closed before the %s was acknowledged", name)
+			}
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err != nil {
+		return xerrors.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// acked passes the outcome of the control message with seq to the call
+// waiting for it, if any.
+func (r *remoteProcess) acked(seq uint64, err error) {
+	r.ackMutex.Lock()
+	ack, ok := r.ackWaiters[seq]
+	delete(r.ackWaiters, seq)
+	r.ackMutex.Unlock()
+	if ok {
+		ack <- err
+	}
+}
+
+// Ack acknowledges the output the application has handled.
+func (r *remoteProcess) Ack(ctx context.Context, offsets OutputOffsets) error {
+	header := proto.ClientAckHeader{
+		Type:   proto.TypeAck,
+		Stdout: offsets.Stdout,
+		Stderr: offsets.Stderr,
 	}
 	payload, err := json.Marshal(header)
 	if err != nil {
 		return err
 	}
-	return r.conn.Write(ctx, websocket.MessageBinary, payload)
+	return r.conn.Write(ctx, payload)
+}
+
+// TakeInput takes the session's input lock from whichever client holds it.
+func (r *remoteProcess) TakeInput(ctx context.Context) error {
+	payload, err := json.Marshal(proto.Header{Type: proto.TypeTakeInput})
+	if err != nil {
+		return err
+	}
+	return r.conn.Write(ctx, payload)
+}
+
+// SetTerminalModes asks the server to change the modes of the process'
+// terminal.  If the server acknowledges control messages it returns once the
+// modes are set, or with the reason they were not.
+func (r *remoteProcess) SetTerminalModes(ctx context.Context, modes TerminalModes) error {
+	return r.control(ctx, r.controlAcks, "terminal modes", func(seq uint64) interface{} {
+		return proto.ClientTerminalModesHeader{Type: proto.TypeTerminalModes, Modes: modes, Seq: seq}
+	})
+}
+
+// Signal asks the server to send a signal to the process.  If the server
+// acknowledges control messages it returns once the signal is sent, or with
+// the reason it was not.
+func (r *remoteProcess) Signal(ctx context.Context, sig Signal) error {
+	return r.control(ctx, r.controlAcks, "signal", func(seq uint64) interface{} {
+		return proto.ClientSignalHeader{
+			Type:   proto.TypeSignal,
+			Signal: string(sig),
+			Seq:    seq,
+		}
+	})
 }
 
 func (r *remoteProcess) Wait() error {
 	<-r.done
+	r.keepaliveMutex.Lock()
+	keepaliveErr := r.keepaliveErr
+	r.keepaliveMutex.Unlock()
+	if keepaliveErr != nil {
+		return keepaliveErr
+	}
 	if r.readErr != nil {
+		// The server kills the command once the connection ends.
+		if xerrors.Is(r.readErr, context.Canceled) || xerrors.Is(r.readErr, context.DeadlineExceeded) {
+			return canceledExitError(r.readErr)
+		}
 		return r.readErr
 	}
 	// when listen() closes r.done, either there must be a read error or exitMsg
 	// is set non-nil, so it's safe to access members here.
-	if r.exitMsg.ExitCode != 0 {
-		return ExitError{code: r.exitMsg.ExitCode, error: r.exitMsg.Error}
+	code := r.exitMsg.ExitCode
+	if code == 0 && r.exitMsg.Error != "" {
+		// Older servers report errors without an exit code as 0.
+		code = ExitCodeUnknown
+	}
+	if code != 0 {
+		return ExitError{code: code, error: r.exitMsg.Error}
 	}
 	return nil
 }
 
+// WaitCtx is like Wait but gives up once ctx ends, closing the connection so
+// the listener exits, and returns ctx's error.
+func (r *remoteProcess) WaitCtx(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return r.Wait()
+	case <-ctx.Done():
+		r.cancelListen()
+		<-r.done
+		return ctx.Err()
+	}
+}
+
 func (r *remoteProcess) Close() error {
 	r.cancelListen()
 	<-r.done
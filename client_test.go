@@ -51,7 +51,55 @@ func TestRemoteStdin(t *testing.T) {
 	}
 }
 
-func mockConn(ctx context.Context, t *testing.T, wsepServer *Server, options *Options) (*websocket.Conn, *httptest.Server) {
+func TestRemoteStdinBinary(t *testing.T) {
+	t.Parallel()
+	server, client := net.Pipe()
+	var stdin io.WriteCloser = remoteStdin{
+		conn:   client,
+		binary: true,
+	}
+	go func() {
+		defer client.Close()
+		_, err := stdin.Write([]byte("echo 123\n456"))
+		assert.Success(t, "write to stdin", err)
+	}()
+
+	msg, err := ioutil.ReadAll(server)
+	assert.Success(t, "read from server", err)
+
+	typ, body, ok := proto.ParseDataFrame(msg)
+	assert.True(t, "is data frame", ok)
+	assert.Equal(t, "stdin type", proto.TypeStdin, typ)
+	assert.Equal(t, "stdin body", []byte("echo 123\n456"), body, cmp.Comparer(bytes.Equal))
+}
+
+func TestRemoteJSONData(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+
+	// A client that does not offer binary data frames must still work.
+	execer := remoteExec{conn: newWSConn(ws, false), jsonData: true}
+	process, err := execer.Start(ctx, Command{
+		Command: "cat",
+		Stdin:   true,
+	})
+	assert.Success(t, "start cat", err)
+
+	_, err = process.Stdin().Write([]byte("hello"))
+	assert.Success(t, "write stdin", err)
+	assert.Success(t, "close stdin", process.Stdin().Close())
+
+	stdout, err := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.Equal(t, "stdout", "hello", string(stdout))
+	assert.Success(t, "wait", process.Wait())
+}
+
+func mockConn(ctx context.Context, t testing.TB, wsepServer *Server, options *Options) (*websocket.Conn, *httptest.Server) {
 	mockServerHandler := func(w http.ResponseWriter, r *http.Request) {
 		ws, err := websocket.Accept(w, r, nil)
 		if err != nil {
@@ -176,8 +224,8 @@ func TestRemoteCloseNoData(t *testing.T) {
 	proc, err := execer.Start(ctx, cmd)
 	assert.Success(t, "execer Start", err)
 
-	go io.Copy(io.Discard, proc.Stdout())
-	go io.Copy(io.Discard, proc.Stderr())
+	go io.Copy(ioutil.Discard, proc.Stdout())
+	go io.Copy(ioutil.Discard, proc.Stderr())
 
 	// give it some time to read and discard all data.
 	time.Sleep(100 * time.Millisecond)
@@ -215,7 +263,7 @@ func TestRemoteClosePartialRead(t *testing.T) {
 	proc, err := execer.Start(ctx, cmd)
 	assert.Success(t, "execer Start", err)
 
-	go io.Copy(io.Discard, proc.Stderr())
+	go io.Copy(ioutil.Discard, proc.Stderr())
 
 	o := proc.Stdout()
 	// partially read the first output
@@ -298,3 +346,408 @@ func TestStderrVsStdout(t *testing.T) {
 	assert.Equal(t, "stdout", "stdout-message", strings.TrimSpace(stdout.String()))
 	assert.Equal(t, "stderr", "stderr-message", strings.TrimSpace(stderr.String()))
 }
+
+func TestRemoteStats(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command: "cat",
+		Stdin:   true,
+	})
+	assert.Success(t, "start", err)
+
+	_, err = process.Stdin().Write([]byte("hello"))
+	assert.Success(t, "write stdin", err)
+	assert.Success(t, "close stdin", process.Stdin().Close())
+	stdout, err := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.Equal(t, "stdout", "hello", string(stdout))
+	assert.Success(t, "wait", process.Wait())
+
+	stats, ok := ProcessStats(process)
+	assert.True(t, "has stats", ok)
+	assert.Equal(t, "stdin bytes", int64(5), stats.StdinBytes)
+	assert.Equal(t, "stdout bytes", int64(5), stats.StdoutBytes)
+	// Start, stdin and close stdin.
+	assert.Equal(t, "frames sent", int64(3), stats.FramesSent)
+	// At least the pid, stdout and exit code.
+	assert.True(t, "frames received", stats.FramesReceived >= 3)
+}
+
+func TestRemoteOnDisconnect(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		_, _, err = ws.Read(r.Context())
+		if err != nil {
+			return
+		}
+		err = ws.Write(r.Context(), websocket.MessageBinary, []byte(`{"type":"pid","pid":1}`))
+		if err != nil {
+			return
+		}
+		ws.Close(websocket.StatusGoingAway, "timeout exceeded")
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Success(t, "dial", err)
+
+	type status struct {
+		code   websocket.StatusCode
+		reason string
+	}
+	disconnected := make(chan status, 1)
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command: "sh",
+		OnDisconnect: func(code websocket.StatusCode, reason string) {
+			disconnected <- status{code: code, reason: reason}
+		},
+	})
+	assert.Success(t, "start", err)
+	assert.Error(t, "wait", process.Wait())
+
+	got := <-disconnected
+	assert.Equal(t, "code", websocket.StatusGoingAway, got.code)
+	assert.Equal(t, "reason", "timeout exceeded", got.reason)
+}
+
+func TestRemoteCloseStream(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+
+	// Far more stderr than fits in a message so the read loop would block on it
+	// if it were not discarded.
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", "{ dd if=/dev/zero bs=1000 count=1000 2>/dev/null; } >&2; echo done"},
+	})
+	assert.Success(t, "start", err)
+
+	assert.Success(t, "close stderr", process.Stderr().Close())
+
+	stdout, err := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.Equal(t, "stdout", "done\n", string(stdout))
+	assert.Success(t, "wait", process.Wait())
+}
+
+func TestRemoteExitError(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+
+	// The server's error text comes back with the exit code.
+	process, err := RemoteExecer(ws).Start(ctx, Command{Command: "sh", Args: []string{"-c", "exit 3"}})
+	assert.Success(t, "start", err)
+	exitErr, ok := process.Wait().(ExitError)
+	assert.True(t, "error is ExitError", ok)
+	assert.Equal(t, "exit code", 3, exitErr.ExitCode())
+	assert.Equal(t, "error", "exit status 3", exitErr.Error())
+
+	ws, server = mockConn(ctx, t, nil, nil)
+	defer server.Close()
+	_, err = RemoteExecer(ws).Start(ctx, Command{Command: "wsep-no-such-command"})
+	assert.ErrorContains(t, "start", err, "wsep-no-such-command")
+}
+
+func TestRemoteStrictMessages(t *testing.T) {
+	t.Parallel()
+
+	// A server newer than the client that sends a message the client does not
+	// know after the pid.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close(websocket.StatusNormalClosure, "normal closure")
+		_, _, err = ws.Read(r.Context())
+		if err != nil {
+			return
+		}
+		for _, msg := range []string{
+			`{"type":"pid","pid":1}`,
+			`{"type":"bogus"}`,
+			`{"type":"exit_code","exit_code":0}`,
+		} {
+			err = ws.Write(r.Context(), websocket.MessageBinary, []byte(msg))
+			if err != nil {
+				return
+			}
+		}
+		_, _, _ = ws.Read(r.Context())
+	}))
+	t.Cleanup(server.Close)
+
+	for _, strict := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		assert.Success(t, "dial", err)
+		process, err := RemoteExecer(ws).Start(ctx, Command{Command: "true", StrictMessages: strict})
+		assert.Success(t, "start", err)
+		err = process.Wait()
+		if strict {
+			assert.True(t, "unknown message error", xerrors.Is(err, ErrUnknownMessage))
+		} else {
+			assert.Success(t, "wait", err)
+		}
+	}
+}
+
+func TestRemoteDiscardOutput(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command:       "sh",
+		Args:          []string{"-c", "seq 100000; echo err >&2; exit 3"},
+		DiscardOutput: true,
+	})
+	assert.Success(t, "start", err)
+
+	// The exit code arrives without reading the output.
+	exitErr, ok := process.Wait().(ExitError)
+	assert.True(t, "error is ExitError", ok)
+	assert.Equal(t, "exit code", 3, exitErr.ExitCode())
+
+	stats, _ := ProcessStats(process)
+	assert.Equal(t, "stdout bytes", int64(0), stats.StdoutBytes)
+	assert.Equal(t, "stderr bytes", int64(0), stats.StderrBytes)
+}
+
+func TestWaitContext(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Remote", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// A server that never sends an exit code.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer ws.Close(websocket.StatusNormalClosure, "normal closure")
+			_, _, err = ws.Read(r.Context())
+			if err != nil {
+				return
+			}
+			err = ws.Write(r.Context(), websocket.MessageBinary, []byte(`{"type":"pid","pid":1}`))
+			if err != nil {
+				return
+			}
+			_, _, _ = ws.Read(r.Context())
+		}))
+		defer server.Close()
+
+		ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		assert.Success(t, "dial", err)
+		process, err := RemoteExecer(ws).Start(ctx, Command{Command: "sh"})
+		assert.Success(t, "start", err)
+
+		waitCtx, waitCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer waitCancel()
+		err = WaitContext(waitCtx, process)
+		assert.True(t, "deadline exceeded", xerrors.Is(err, context.DeadlineExceeded))
+	})
+
+	t.Run("Local", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		process, err := LocalExecer{}.Start(ctx, Command{Command: "sleep", Args: []string{"10"}})
+		assert.Success(t, "start", err)
+
+		waitCtx, waitCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer waitCancel()
+		err = WaitContext(waitCtx, process)
+		assert.True(t, "deadline exceeded", xerrors.Is(err, context.DeadlineExceeded))
+	})
+}
+
+func TestRemoteTerm(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	wsepServer := NewServer()
+	defer wsepServer.Close()
+
+	ws, server := mockConn(ctx, t, wsepServer, nil)
+	defer server.Close()
+
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command:   "sh",
+		Args:      []string{"-c", `echo "$TERM $COLORTERM"`},
+		TTY:       true,
+		Term:      "xterm-256color",
+		ColorTerm: "truecolor",
+	})
+	assert.Success(t, "start", err)
+	output, err := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read", err)
+	assert.Equal(t, "terminal", "xterm-256color truecolor", strings.TrimSpace(string(output)))
+	assert.Success(t, "wait", process.Wait())
+}
+
+func TestRemoteResizeAck(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	wsepServer := NewServer()
+	defer wsepServer.Close()
+
+	ws, server := mockConn(ctx, t, wsepServer, nil)
+	defer server.Close()
+
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", "read line; stty size"},
+		TTY:     true,
+		Stdin:   true,
+	})
+	assert.Success(t, "start", err)
+	// The size is applied by the time Resize returns.
+	assert.Success(t, "resize", process.Resize(ctx, 30, 100))
+	_, err = process.Stdin().Write([]byte("\n"))
+	assert.Success(t, "write", err)
+	output, err := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read", err)
+	assert.True(t, "size", strings.Contains(string(output), "30 100"))
+	assert.Success(t, "wait", process.Wait())
+}
+
+func TestRemoteControlAcks(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Acked", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ws, server := mockConn(ctx, t, nil, nil)
+		defer server.Close()
+		process, err := RemoteExecer(ws).Start(ctx, Command{Command: "cat", Stdin: true})
+		assert.Success(t, "start", err)
+		// The server's reason comes back from the call rather than its log.
+		err = process.(signaler).Signal(ctx, Signal("hangup"))
+		assert.ErrorContains(t, "signal", err, "unknown signal")
+		assert.Success(t, "close stdin", process.Stdin().Close())
+		assert.Success(t, "wait", process.Wait())
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// Errors echo the seq of the message that caused them.
+		ws, server := mockConn(ctx, t, nil, nil)
+		defer server.Close()
+		err := ws.Write(ctx, websocket.MessageBinary, []byte(`{"type":"signal","signal":"kill","seq":7}`))
+		assert.Success(t, "write message", err)
+		_, msg, err := ws.Read(ctx)
+		assert.Success(t, "read error message", err)
+		header, _ := proto.SplitMessage(msg)
+		assert.Equal(t, "error", `{"type":"error","code":"not_started","error":"signal sent before command started","seq":7}`, string(header))
+	})
+}
+
+func TestRemoteStartInfo(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	wsepServer := NewServer()
+	defer wsepServer.Close()
+
+	ws, server := mockConn(ctx, t, wsepServer, nil)
+	defer server.Close()
+
+	dir := tempDir(t)
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		ID:         "info",
+		Command:    "true",
+		Shell:      true,
+		WorkingDir: dir,
+	})
+	assert.Success(t, "start", err)
+	info := ProcessStartInfo(process)
+	assert.Equal(t, "working dir", dir, info.WorkingDir)
+	assert.True(t, "user", info.User != "")
+	assert.True(t, "shell", info.Shell != "")
+	assert.Equal(t, "session id", "info", info.SessionID)
+	assert.Success(t, "wait", process.Wait())
+}
+
+func TestRemoteWarnings(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+
+	var codes []Code
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command:    "true",
+		WorkingDir: "/does/not/exist",
+		OnWarning:  func(code Code, _ string) { codes = append(codes, code) },
+	})
+	assert.Success(t, "start", err)
+	assert.Success(t, "wait", process.Wait())
+	assert.Equal(t, "codes", []Code{CodeWorkingDirFallback}, codes)
+}
+
+func TestRemoteLocale(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	wsepServer := NewServer()
+	defer wsepServer.Close()
+
+	ws, server := mockConn(ctx, t, wsepServer, &Options{AcceptEnv: LocaleAcceptEnv()})
+	defer server.Close()
+
+	output, err := Output(ctx, RemoteExecer(ws), Command{
+		Command: "sh",
+		Args:    []string{"-c", `echo "$LANG $LC_TIME $WSEP_SECRET"`},
+		Locale:  []string{"LANG=C.UTF-8", "LC_TIME=C", "WSEP_SECRET=1"},
+	})
+	assert.Success(t, "run", err)
+	assert.Equal(t, "locale", "C.UTF-8 C", strings.TrimSpace(string(output)))
+}
@@ -0,0 +1,90 @@
+package wsep
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// coalescingWriter holds small writes for up to a delay so that a burst of tiny
+// writes, like an interactive shell echoing keystrokes and redrawing its
+// prompt, is passed on as one write instead of one each.  Writes are held for
+// at most the delay after the first of them, and are passed on immediately once
+// size bytes are waiting.
+type coalescingWriter struct {
+	w     io.Writer
+	delay time.Duration
+
+	mutex sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	// err is the error from a flush by the timer and is returned by the next
+	// write.
+	err error
+}
+
+func newCoalescingWriter(w io.Writer, delay time.Duration, size int) *coalescingWriter {
+	return &coalescingWriter{
+		w:     w,
+		delay: delay,
+		buf:   make([]byte, 0, size),
+	}
+}
+
+func (c *coalescingWriter) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if len(c.buf)+len(b) > cap(c.buf) {
+		err := c.flushLocked()
+		if err != nil {
+			return 0, err
+		}
+	}
+	// Large writes gain nothing from waiting.
+	if len(b) >= cap(c.buf) {
+		_, err := c.w.Write(b)
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	c.buf = append(c.buf, b...)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.delay, c.timedFlush)
+	}
+	return len(b), nil
+}
+
+// Flush passes on any held writes.  It must be called once writing is done.
+func (c *coalescingWriter) Flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.flushLocked()
+}
+
+func (c *coalescingWriter) timedFlush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == nil {
+		c.err = c.flushLocked()
+	}
+}
+
+func (c *coalescingWriter) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+	_, err := c.w.Write(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
@@ -0,0 +1,68 @@
+package wsep
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+// messageRecorder records each write as a separate message.
+type messageRecorder struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (m *messageRecorder) Write(b []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messages = append(m.messages, string(b))
+	return len(b), nil
+}
+
+func (m *messageRecorder) get() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string(nil), m.messages...)
+}
+
+func TestCoalescingWriter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Delay", func(t *testing.T) {
+		t.Parallel()
+		var recorder messageRecorder
+		w := newCoalescingWriter(&recorder, 10*time.Millisecond, 64)
+		for _, s := range []string{"a", "b", "c"} {
+			_, err := w.Write([]byte(s))
+			assert.Success(t, "write", err)
+		}
+		assert.Equal(t, "held", 0, len(recorder.get()))
+
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, "coalesced", []string{"abc"}, recorder.get())
+		assert.Success(t, "flush", w.Flush())
+		assert.Equal(t, "nothing left", 1, len(recorder.get()))
+	})
+
+	t.Run("Size", func(t *testing.T) {
+		t.Parallel()
+		var recorder messageRecorder
+		w := newCoalescingWriter(&recorder, time.Hour, 4)
+		_, err := w.Write([]byte("ab"))
+		assert.Success(t, "write", err)
+		_, err = w.Write([]byte("cde"))
+		assert.Success(t, "write", err)
+		large := bytes.Repeat([]byte("x"), 8)
+		_, err = w.Write(large)
+		assert.Success(t, "write", err)
+		assert.Equal(t, "full buffers are sent", []string{"ab", "cde", string(large)}, recorder.get())
+
+		_, err = w.Write([]byte("f"))
+		assert.Success(t, "write", err)
+		assert.Success(t, "flush", w.Flush())
+		assert.Equal(t, "flushed", []string{"ab", "cde", string(large), "f"}, recorder.get())
+	})
+}
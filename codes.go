@@ -0,0 +1,192 @@
+package wsep
+
+import (
+	"os"
+	"os/exec"
+
+	"golang.org/x/xerrors"
+)
+
+//go:generate go run ./internal/gencodes codes.json
+
+// Code is a stable, machine-readable identifier for an error or warning
+// emitted by wsep.  Codes are part of the public contract and are listed in
+// codes.json for consumers outside of Go.
+type Code string
+
+// Severity describes whether a code represents a failure or an advisory.
+type Severity string
+
+const (
+	// SeverityError means the operation failed.
+	SeverityError Severity = "error"
+	// SeverityWarning means the operation succeeded in a degraded way.
+	SeverityWarning Severity = "warning"
+)
+
+const (
+	// CodeInvalidMessage means a message could not be parsed.
+	CodeInvalidMessage Code = "invalid_message"
+	// CodeUnknownMessage means a message had a type the receiver does not
+	// know, which usually means the client and server are different versions.
+	CodeUnknownMessage Code = "unknown_message"
+	// CodeAlreadyStarted means a start message was sent after the command was
+	// already started.
+	CodeAlreadyStarted Code = "already_started"
+	// CodeNotStarted means a message that requires a command was sent before
+	// the command was started.
+	CodeNotStarted Code = "not_started"
+	// CodeStartFailed means the command could not be started for a reason
+	// without a more specific code.
+	CodeStartFailed Code = "start_failed"
+	// CodeCommandNotFound means the command to start does not exist.
+	CodeCommandNotFound Code = "command_not_found"
+	// CodePermissionDenied means the command could not be started because the
+	// user may not run it.
+	CodePermissionDenied Code = "permission_denied"
+	// CodeInvalidCommand means the command can never be started as given,
+	// such as a TTY command with its output redirected.
+	CodeInvalidCommand Code = "invalid_command"
+	// CodeStdinDisabled means stdin was written for a command without stdin
+	// enabled.
+	CodeStdinDisabled Code = "stdin_disabled"
+	// CodeSessionNotFound means the requested session does not exist.
+	CodeSessionNotFound Code = "session_not_found"
+	// CodeForbidden means the connection is not permitted to access the
+	// session.
+	CodeForbidden Code = "forbidden"
+	// CodeTransferFailed means a file could not be uploaded or downloaded.
+	CodeTransferFailed Code = "transfer_failed"
+	// CodeSignalUnsupported means a signal was sent that the command cannot
+	// receive.
+	CodeSignalUnsupported Code = "signal_unsupported"
+	// CodeQuotaExceeded means a session used up its output or stdin quota.
+	CodeQuotaExceeded Code = "quota_exceeded"
+	// CodeStartTimeout means the client did not start a command or make
+	// another request in time after connecting.
+	CodeStartTimeout Code = "start_timeout"
+	// CodeTooManyConnections means the server is serving as many connections
+	// as it allows, in total or from the client's address.
+	CodeTooManyConnections Code = "too_many_connections"
+	// CodeSlowConsumer means the client stopped reading output for longer
+	// than the server allows.
+	CodeSlowConsumer Code = "slow_consumer"
+
+	// CodeWorkingDirFallback means the command's working directory could not
+	// be used so it started in the user's home directory instead.
+	CodeWorkingDirFallback Code = "working_dir_fallback"
+	// CodeTerminalModesFailed means the command started with the default
+	// terminal modes since those asked for could not be set.
+	CodeTerminalModesFailed Code = "terminal_modes_failed"
+	// CodeMessageIgnored means the server skipped a message of a type it does
+	// not know.
+	CodeMessageIgnored Code = "message_ignored"
+	// CodeSessionNotPersistent means a command with a session ID started
+	// without a session, since screen is not installed, so it will not survive
+	// the connection.
+	CodeSessionNotPersistent Code = "session_not_persistent"
+)
+
+// CodeInfo describes a registered code.
+type CodeInfo struct {
+	Code        Code     `json:"code"`
+	Severity    Severity `json:"severity"`
+	Description string   `json:"description"`
+}
+
+// codes is the registry of every code wsep emits.  New codes must be added
+// here and to codes.json (via go generate) or the tests will fail.
+var codes = []CodeInfo{
+	{CodeInvalidMessage, SeverityError, "A message could not be parsed."},
+	{CodeUnknownMessage, SeverityError, "A message had a type the receiver does not know, which usually means the client and server are different versions."},
+	{CodeAlreadyStarted, SeverityError, "A start message was sent after the command was already started."},
+	{CodeNotStarted, SeverityError, "A message that requires a command was sent before the command was started."},
+	{CodeStartFailed, SeverityError, "The command could not be started for a reason without a more specific code."},
+	{CodeCommandNotFound, SeverityError, "The command to start does not exist."},
+	{CodePermissionDenied, SeverityError, "The command could not be started because the user may not run it."},
+	{CodeInvalidCommand, SeverityError, "The command can never be started as given, such as a TTY command with its output redirected."},
+	{CodeStdinDisabled, SeverityError, "Stdin was written for a command without stdin enabled."},
+	{CodeSessionNotFound, SeverityError, "The requested session does not exist."},
+	{CodeForbidden, SeverityError, "The connection is not permitted to access the session."},
+	{CodeTransferFailed, SeverityError, "A file could not be uploaded or downloaded."},
+	{CodeSignalUnsupported, SeverityError, "A signal was sent that the command cannot receive."},
+	{CodeQuotaExceeded, SeverityError, "A session used up its output or stdin quota."},
+	{CodeStartTimeout, SeverityError, "The client did not start a command or make another request in time after connecting."},
+	{CodeTooManyConnections, SeverityError, "The server is serving as many connections as it allows, in total or from the client's address."},
+	{CodeSlowConsumer, SeverityError, "The client stopped reading output for longer than the server allows."},
+	{CodeWorkingDirFallback, SeverityWarning, "The working directory could not be used so the command started in the user's home directory instead."},
+	{CodeTerminalModesFailed, SeverityWarning, "The command started with the default terminal modes since those asked for could not be set."},
+	{CodeMessageIgnored, SeverityWarning, "The server skipped a message of a type it does not know."},
+	{CodeSessionNotPersistent, SeverityWarning, "A command with a session ID started without a session, since screen is not installed, so it will not survive the connection."},
+}
+
+// Codes returns every registered code.
+func Codes() []CodeInfo {
+	return append([]CodeInfo(nil), codes...)
+}
+
+// Errors for the common reasons a command fails to start, which errors.Is
+// matches with any error carrying the same code, including errors sent by a
+// server.
+var (
+	ErrCommandNotFound  error = &Error{Code: CodeCommandNotFound, err: xerrors.New("command not found")}
+	ErrPermissionDenied error = &Error{Code: CodePermissionDenied, err: xerrors.New("permission denied")}
+	ErrInvalidCommand   error = &Error{Code: CodeInvalidCommand, err: xerrors.New("invalid command")}
+)
+
+// ErrUnknownMessage matches errors from a server or client that was sent a
+// message of a type it does not know.
+var ErrUnknownMessage error = &Error{Code: CodeUnknownMessage, err: xerrors.New("unknown message type")}
+
+// Error is an error with a registered code.
+type Error struct {
+	Code Code
+	err  error
+}
+
+// Is reports whether target is an Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Error returns a string describing the error.
+func (e *Error) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// codeErrorf formats an error with the provided code.
+func codeErrorf(code Code, format string, args ...interface{}) error {
+	return &Error{Code: code, err: xerrors.Errorf(format, args...)}
+}
+
+// ErrorCode returns the code of the first Error in err's chain or an empty
+// string if there is none.
+func ErrorCode(err error) Code {
+	var codeErr *Error
+	if xerrors.As(err, &codeErr) {
+		return codeErr.Code
+	}
+	return ""
+}
+
+// startErrorCode classifies an error starting a command.  Codes already
+// classified, such as by a remote execer's server, are kept.
+func startErrorCode(err error) Code {
+	switch code := ErrorCode(err); code {
+	case CodeCommandNotFound, CodePermissionDenied, CodeInvalidCommand:
+		return code
+	}
+	switch {
+	case xerrors.Is(err, exec.ErrNotFound), xerrors.Is(err, os.ErrNotExist):
+		return CodeCommandNotFound
+	case xerrors.Is(err, os.ErrPermission):
+		return CodePermissionDenied
+	}
+	return CodeStartFailed
+}
@@ -0,0 +1,88 @@
+package wsep
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestCodes(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Registered", func(t *testing.T) {
+		t.Parallel()
+
+		// Every Code constant must be in the registry exactly once and vice
+		// versa.
+		declared := map[Code]bool{}
+		file, err := parser.ParseFile(token.NewFileSet(), "codes.go", nil, 0)
+		assert.Success(t, "parse codes.go", err)
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				value := spec.(*ast.ValueSpec)
+				if ident, ok := value.Type.(*ast.Ident); !ok || ident.Name != "Code" {
+					continue
+				}
+				lit := value.Values[0].(*ast.BasicLit)
+				declared[Code(strings.Trim(lit.Value, `"`))] = true
+			}
+		}
+
+		registered := map[Code]bool{}
+		for _, info := range Codes() {
+			assert.True(t, "not registered twice: "+string(info.Code), !registered[info.Code])
+			assert.True(t, "declared: "+string(info.Code), declared[info.Code])
+			assert.True(t, "has description: "+string(info.Code), info.Description != "")
+			assert.True(t, "has severity: "+string(info.Code), info.Severity == SeverityError || info.Severity == SeverityWarning)
+			registered[info.Code] = true
+		}
+		assert.Equal(t, "all declared codes are registered", len(declared), len(registered))
+	})
+
+	t.Run("NoAdHoc", func(t *testing.T) {
+		t.Parallel()
+
+		// Codes may only be created in codes.go.
+		files, err := filepath.Glob("*.go")
+		assert.Success(t, "list files", err)
+		for _, name := range files {
+			if name == "codes.go" || strings.HasSuffix(name, "_test.go") {
+				continue
+			}
+			byt, err := ioutil.ReadFile(name)
+			assert.Success(t, "read "+name, err)
+			assert.True(t, "no ad hoc codes in "+name, !strings.Contains(string(byt), "Code(\""))
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		t.Parallel()
+
+		byt, err := ioutil.ReadFile("codes.json")
+		assert.Success(t, "read codes.json", err)
+		var listed []CodeInfo
+		err = json.Unmarshal(byt, &listed)
+		assert.Success(t, "unmarshal codes.json", err)
+		assert.Equal(t, "codes.json is up to date (run go generate)", Codes(), listed)
+	})
+
+	t.Run("ErrorCode", func(t *testing.T) {
+		t.Parallel()
+
+		err := xerrors.Errorf("wrapped: %w", codeErrorf(CodeNotStarted, "not started"))
+		assert.Equal(t, "code", CodeNotStarted, ErrorCode(err))
+		assert.Equal(t, "no code", Code(""), ErrorCode(xerrors.New("plain")))
+	})
+}
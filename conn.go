@@ -0,0 +1,300 @@
+package wsep
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+// conn is a message-oriented connection that carries wsep messages.  This
+// allows the protocol to run over transports other than WebSockets.
+type conn interface {
+	// Read reads a single message.  If the context ends the connection is
+	// closed.
+	Read(ctx context.Context) ([]byte, error)
+	// Write writes a single message.  It is safe for concurrent use.
+	Write(ctx context.Context, msg []byte) error
+	// WriteBuffers writes the buffers as a single message without joining
+	// them first.  It is safe for concurrent use.
+	WriteBuffers(ctx context.Context, bufs net.Buffers) error
+	// Close closes the connection with a status code and reason.
+	Close(code websocket.StatusCode, reason string) error
+	// SetReadLimit sets the maximum size of a message.
+	SetReadLimit(n int64)
+}
+
+// wsConn is a conn over a WebSocket.
+type wsConn struct {
+	conn *websocket.Conn
+	text *textFrames
+}
+
+// textFrames is the state of a WebSocket that may carry messages as text
+// frames for debugging.
+type textFrames struct {
+	// enabled is non-zero once messages are sent as text frames.  It must be
+	// accessed atomically.
+	enabled int32
+	// limit is the largest decoded message accepted.  It must be accessed
+	// atomically.
+	limit int64
+}
+
+// newWSConn returns a conn over a WebSocket that sends messages as text frames
+// if text is set, and otherwise from the first text frame it reads on.
+func newWSConn(c *websocket.Conn, text bool) wsConn {
+	w := wsConn{conn: c, text: &textFrames{}}
+	if text {
+		w.text.enabled = 1
+	}
+	w.SetReadLimit(maxMessageSize)
+	return w
+}
+
+func (w wsConn) Read(ctx context.Context) ([]byte, error) {
+	typ, msg, err := w.conn.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if typ == websocket.MessageText {
+		// Answer in kind so that debugging can be switched on from the client
+		// alone.
+		atomic.StoreInt32(&w.text.enabled, 1)
+		msg, err = decodeTextMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The WebSocket's own limit allows for the size of text encoding.
+	if limit := atomic.LoadInt64(&w.text.limit); int64(len(msg)) > limit {
+		return nil, xerrors.Errorf("read limited at %d bytes", limit)
+	}
+	return msg, nil
+}
+
+func (w wsConn) Write(ctx context.Context, msg []byte) error {
+	// Writing with a context that already ended closes the connection, which
+	// would lose the reason the caller closes it with.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&w.text.enabled) != 0 {
+		return w.conn.Write(ctx, websocket.MessageText, encodeTextMessage(msg))
+	}
+	return w.conn.Write(ctx, websocket.MessageBinary, msg)
+}
+
+// WriteBuffers sends each buffer as a frame of one fragmented message.
+func (w wsConn) WriteBuffers(ctx context.Context, bufs net.Buffers) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&w.text.enabled) != 0 {
+		var msg []byte
+		for _, buf := range bufs {
+			msg = append(msg, buf...)
+		}
+		return w.Write(ctx, msg)
+	}
+	mw, err := w.conn.Writer(ctx, websocket.MessageBinary)
+	if err != nil {
+		return err
+	}
+	for _, buf := range bufs {
+		if len(buf) == 0 {
+			continue
+		}
+		_, err = mw.Write(buf)
+		if err != nil {
+			_ = mw.Close()
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func (w wsConn) Close(code websocket.StatusCode, reason string) error {
+	return w.conn.Close(code, reason)
+}
+
+func (w wsConn) SetReadLimit(n int64) {
+	atomic.StoreInt64(&w.text.limit, n)
+	w.conn.SetReadLimit(int64(base64.StdEncoding.EncodedLen(int(n))))
+}
+
+// encodeTextMessage converts a message to the form sent in text frames, where
+// the JSON header is left readable and the body is encoded as base64.  Binary
+// data frames are given a JSON header.
+func encodeTextMessage(msg []byte) []byte {
+	header, body := proto.SplitMessage(msg)
+	if typ, data, ok := proto.ParseDataFrame(msg); ok {
+		header, body = []byte(`{"type":"`+typ+`"}`), data
+	}
+	if len(body) == 0 {
+		return header
+	}
+	text := make([]byte, len(header)+1+base64.StdEncoding.EncodedLen(len(body)))
+	copy(text, header)
+	text[len(header)] = '\n'
+	base64.StdEncoding.Encode(text[len(header)+1:], body)
+	return text
+}
+
+// decodeTextMessage reverses encodeTextMessage.
+func decodeTextMessage(text []byte) ([]byte, error) {
+	header, body := proto.SplitMessage(text)
+	if len(body) == 0 {
+		return header, nil
+	}
+	msg := make([]byte, len(header)+1+base64.StdEncoding.DecodedLen(len(body)))
+	copy(msg, header)
+	msg[len(header)] = '\n'
+	n, err := base64.StdEncoding.Decode(msg[len(header)+1:], body)
+	if err != nil {
+		return nil, xerrors.Errorf("decode text message body: %w", err)
+	}
+	return msg[:len(header)+1+n], nil
+}
+
+func (w wsConn) Ping(ctx context.Context) error {
+	return w.conn.Ping(ctx)
+}
+
+// streamConn is a conn over a byte stream such as a unix socket.  Messages are
+// framed with a length prefix.  A close frame carries the status code and
+// reason so that both ends see the same errors as they would over a
+// WebSocket.
+type streamConn struct {
+	rwc io.ReadWriteCloser
+
+	// readLimit must be accessed atomically.
+	readLimit int64
+	// readMutex serializes reads.
+	readMutex sync.Mutex
+	// writeLock is held by one write at a time so frames do not interleave.
+	// It is a channel so that writes waiting on a peer that stopped reading
+	// can give up when their context ends.
+	writeLock chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newStreamConn(rwc io.ReadWriteCloser) *streamConn {
+	return &streamConn{
+		rwc:       rwc,
+		readLimit: maxMessageSize,
+		writeLock: make(chan struct{}, 1),
+	}
+}
+
+func (s *streamConn) Read(ctx context.Context) ([]byte, error) {
+	s.readMutex.Lock()
+	defer s.readMutex.Unlock()
+
+	// Streams cannot be interrupted so close the connection if the context ends
+	// mid-read, the same as a WebSocket does.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.rwc.Close()
+		case <-done:
+		}
+	}()
+
+	msg, err := proto.ReadFrame(s.rwc, atomic.LoadInt64(&s.readLimit))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, xerrors.Errorf("failed to read: %w", ctx.Err())
+		}
+		var closeFrame *proto.CloseFrame
+		if xerrors.As(err, &closeFrame) {
+			return nil, websocket.CloseError{
+				Code:   websocket.StatusCode(closeFrame.Code),
+				Reason: closeFrame.Reason,
+			}
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *streamConn) Write(ctx context.Context, msg []byte) error {
+	if err := s.lockWrite(ctx); err != nil {
+		return err
+	}
+	defer s.unlockWrite()
+	return proto.WriteFrame(s.rwc, msg)
+}
+
+func (s *streamConn) WriteBuffers(ctx context.Context, bufs net.Buffers) error {
+	if err := s.lockWrite(ctx); err != nil {
+		return err
+	}
+	defer s.unlockWrite()
+	return proto.WriteFrameBuffers(s.rwc, bufs)
+}
+
+// lockWrite waits for the write in progress, if any, unless the context ends
+// first.  A write that is itself blocked only ends once the stream closes.
+func (s *streamConn) lockWrite(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case s.writeLock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *streamConn) unlockWrite() {
+	<-s.writeLock
+}
+
+// Close sends a close frame then closes the stream.  The close frame is best
+// effort since the peer may have already gone away.  Subsequent calls return
+// the result of the first.
+func (s *streamConn) Close(code websocket.StatusCode, reason string) error {
+	s.closeOnce.Do(func() {
+		s.writeLock <- struct{}{}
+		_ = proto.WriteCloseFrame(s.rwc, uint16(code), reason)
+		s.unlockWrite()
+		s.closeErr = s.rwc.Close()
+	})
+	return s.closeErr
+}
+
+func (s *streamConn) SetReadLimit(n int64) {
+	atomic.StoreInt64(&s.readLimit, n)
+}
+
+// connWriter writes each call to Write as a single message.
+type connWriter struct {
+	ctx  context.Context
+	conn conn
+}
+
+func (c connWriter) Write(b []byte) (int, error) {
+	err := c.conn.Write(c.ctx, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// WriteBuffers implements proto.BuffersWriter.
+func (c connWriter) WriteBuffers(bufs net.Buffers) error {
+	return c.conn.WriteBuffers(c.ctx, bufs)
+}
@@ -0,0 +1,76 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"cdr.dev/wsep/internal/proto"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTextMessage(t *testing.T) {
+	t.Parallel()
+	var stdout bytes.Buffer
+	_, err := proto.WithDataFrame(&stdout, proto.TypeStdout).Write([]byte("\x00binary\xff"))
+	assert.Success(t, "write data frame", err)
+
+	for _, tcase := range []struct {
+		name, msg, text, decoded string
+	}{
+		{name: "Header", msg: `{"type":"close_stdin"}`, text: `{"type":"close_stdin"}`, decoded: `{"type":"close_stdin"}`},
+		{name: "Body", msg: "{\"type\":\"stdin\"}\nhi\n", text: "{\"type\":\"stdin\"}\naGkK", decoded: "{\"type\":\"stdin\"}\nhi\n"},
+		{name: "DataFrame", msg: stdout.String(), text: "{\"type\":\"stdout\"}\nAGJpbmFyef8=", decoded: "{\"type\":\"stdout\"}\n\x00binary\xff"},
+	} {
+		tcase := tcase
+		t.Run(tcase.name, func(t *testing.T) {
+			t.Parallel()
+			text := encodeTextMessage([]byte(tcase.msg))
+			assert.Equal(t, "text", tcase.text, string(text))
+			decoded, err := decodeTextMessage(text)
+			assert.Success(t, "decode", err)
+			assert.Equal(t, "decoded", []byte(tcase.decoded), decoded, cmp.Comparer(bytes.Equal))
+		})
+	}
+
+	_, err = decodeTextMessage([]byte("{\"type\":\"stdin\"}\nnot base64!"))
+	assert.Error(t, "invalid base64", err)
+}
+
+func TestTextFrames(t *testing.T) {
+	t.Parallel()
+
+	run := func(t *testing.T, execer Execer) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		process, err := execer.Start(ctx, Command{
+			Command: "cat",
+			Stdin:   true,
+		})
+		assert.Success(t, "start cat", err)
+		_, err = process.Stdin().Write([]byte("hello\n"))
+		assert.Success(t, "write stdin", err)
+		assert.Success(t, "close stdin", process.Stdin().Close())
+		stdout, err := ioutil.ReadAll(process.Stdout())
+		assert.Success(t, "read stdout", err)
+		assert.Equal(t, "stdout", "hello\n", string(stdout))
+		assert.Success(t, "wait", process.Wait())
+	}
+
+	t.Run("Server", func(t *testing.T) {
+		t.Parallel()
+		ws, server := mockConn(context.Background(), t, nil, &Options{TextFrames: true})
+		defer server.Close()
+		run(t, RemoteExecer(ws))
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		t.Parallel()
+		ws, server := mockConn(context.Background(), t, nil, nil)
+		defer server.Close()
+		run(t, newRemoteExecer(newWSConn(ws, true)))
+	})
+}
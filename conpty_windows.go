@@ -0,0 +1,248 @@
+//go:build windows
+// +build windows
+
+package wsep
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/xerrors"
+)
+
+// ConPTY is only reachable through kernel32 on Windows 10 1809 and later so it
+// is loaded lazily, as are the attribute list functions syscall does not
+// export.
+var (
+	kernel32                              = syscall.NewLazyDLL("kernel32.dll")
+	procCreatePseudoConsole               = kernel32.NewProc("CreatePseudoConsole")
+	procResizePseudoConsole               = kernel32.NewProc("ResizePseudoConsole")
+	procClosePseudoConsole                = kernel32.NewProc("ClosePseudoConsole")
+	procInitializeProcThreadAttributeList = kernel32.NewProc("InitializeProcThreadAttributeList")
+	procUpdateProcThreadAttribute         = kernel32.NewProc("UpdateProcThreadAttribute")
+	procDeleteProcThreadAttributeList     = kernel32.NewProc("DeleteProcThreadAttributeList")
+)
+
+const (
+	extendedStartupInfoPresent       = 0x00080000
+	createUnicodeEnvironment         = 0x00000400
+	procThreadAttributePseudoConsole = 0x00020016
+)
+
+// startupInfoEx is STARTUPINFOEXW, which syscall does not export.
+type startupInfoEx struct {
+	syscall.StartupInfo
+	attributeList *byte
+}
+
+// conPTY is a pseudoconsole and the ends of its pipes that wsep reads and
+// writes.
+type conPTY struct {
+	// input is written to the console and output is read from it.
+	input  *os.File
+	output *os.File
+
+	mutex sync.Mutex
+	// handle is zero once the pseudoconsole is closed.
+	handle syscall.Handle
+}
+
+// newConPTY creates a pseudoconsole of the given size.
+func newConPTY(rows, cols uint16) (*conPTY, error) {
+	if err := procCreatePseudoConsole.Find(); err != nil {
+		return nil, xerrors.Errorf("ConPTY requires Windows 10 1809 or later: %w", err)
+	}
+	var inRead, inWrite, outRead, outWrite syscall.Handle
+	err := syscall.CreatePipe(&inRead, &inWrite, nil, 0)
+	if err != nil {
+		return nil, xerrors.Errorf("create input pipe: %w", err)
+	}
+	err = syscall.CreatePipe(&outRead, &outWrite, nil, 0)
+	if err != nil {
+		_ = syscall.CloseHandle(inRead)
+		_ = syscall.CloseHandle(inWrite)
+		return nil, xerrors.Errorf("create output pipe: %w", err)
+	}
+
+	var handle syscall.Handle
+	hr, _, _ := procCreatePseudoConsole.Call(
+		coord(rows, cols),
+		uintptr(inRead),
+		uintptr(outWrite),
+		0,
+		uintptr(unsafe.Pointer(&handle)),
+	)
+	// The console holds its own copies of its ends of the pipes, and output
+	// only reaches EOF once every copy is closed.
+	_ = syscall.CloseHandle(inRead)
+	_ = syscall.CloseHandle(outWrite)
+	if hr != 0 {
+		_ = syscall.CloseHandle(inWrite)
+		_ = syscall.CloseHandle(outRead)
+		return nil, xerrors.Errorf("create pseudoconsole: %w", syscall.Errno(hr))
+	}
+	return &conPTY{
+		input:  os.NewFile(uintptr(inWrite), "|0"),
+		output: os.NewFile(uintptr(outRead), "|1"),
+		handle: handle,
+	}, nil
+}
+
+// coord packs a size into the COORD that the pseudoconsole functions take by
+// value.
+func coord(rows, cols uint16) uintptr {
+	return uintptr(cols) | uintptr(rows)<<16
+}
+
+// Resize sets the size of the pseudoconsole.  It does nothing once the
+// pseudoconsole is closed.
+func (c *conPTY) Resize(rows, cols uint16) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.handle == 0 {
+		return nil
+	}
+	hr, _, _ := procResizePseudoConsole.Call(uintptr(c.handle), coord(rows, cols))
+	if hr != 0 {
+		return xerrors.Errorf("resize pseudoconsole: %w", syscall.Errno(hr))
+	}
+	return nil
+}
+
+// Close closes the pseudoconsole, which ends any process still attached to it
+// as if its console window were closed, and lets output reach EOF once it is
+// drained.  Input is closed with it.
+func (c *conPTY) Close() error {
+	c.mutex.Lock()
+	handle := c.handle
+	c.handle = 0
+	c.mutex.Unlock()
+	if handle == 0 {
+		return nil
+	}
+	// Closing can block until output is read so it is done without holding the
+	// mutex.
+	_, _, _ = procClosePseudoConsole.Call(uintptr(handle))
+	return c.input.Close()
+}
+
+// start creates a process attached to the pseudoconsole, as the user token
+// belongs to unless it is zero.  The command line must already be escaped and
+// env is converted with environmentBlock.  The process is created suspended so
+// that it can join a job before it runs and must be started with
+// resumeThread.
+func (c *conPTY) start(token syscall.Token, path, commandLine, dir string, env []string) (*syscall.ProcessInformation, error) {
+	var size uintptr
+	// The first call only reports the size of the list and always fails.
+	_, _, _ = procInitializeProcThreadAttributeList.Call(0, 1, 0, uintptr(unsafe.Pointer(&size)))
+	list := make([]byte, size)
+	ok, _, err := procInitializeProcThreadAttributeList.Call(uintptr(unsafe.Pointer(&list[0])), 1, 0, uintptr(unsafe.Pointer(&size)))
+	if ok == 0 {
+		return nil, xerrors.Errorf("initialize attribute list: %w", err)
+	}
+	defer procDeleteProcThreadAttributeList.Call(uintptr(unsafe.Pointer(&list[0])))
+
+	c.mutex.Lock()
+	handle := c.handle
+	c.mutex.Unlock()
+	ok, _, err = procUpdateProcThreadAttribute.Call(
+		uintptr(unsafe.Pointer(&list[0])),
+		0,
+		procThreadAttributePseudoConsole,
+		uintptr(handle),
+		unsafe.Sizeof(handle),
+		0,
+		0,
+	)
+	if ok == 0 {
+		return nil, xerrors.Errorf("set pseudoconsole attribute: %w", err)
+	}
+
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, xerrors.Errorf("convert path: %w", err)
+	}
+	commandLinep, err := syscall.UTF16PtrFromString(commandLine)
+	if err != nil {
+		return nil, xerrors.Errorf("convert command line: %w", err)
+	}
+	var dirp *uint16
+	if dir != "" {
+		dirp, err = syscall.UTF16PtrFromString(dir)
+		if err != nil {
+			return nil, xerrors.Errorf("convert working directory: %w", err)
+		}
+	}
+	block, err := environmentBlock(env)
+	if err != nil {
+		return nil, err
+	}
+
+	var si startupInfoEx
+	si.Cb = uint32(unsafe.Sizeof(si))
+	si.attributeList = &list[0]
+	var pi syscall.ProcessInformation
+	flags := uint32(extendedStartupInfoPresent | createUnicodeEnvironment | createSuspended)
+	if token != 0 {
+		err = syscall.CreateProcessAsUser(token, pathp, commandLinep, nil, nil, false, flags, &block[0], dirp, &si.StartupInfo, &pi)
+	} else {
+		err = syscall.CreateProcess(pathp, commandLinep, nil, nil, false, flags, &block[0], dirp, &si.StartupInfo, &pi)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("create process: %w", err)
+	}
+	return &pi, nil
+}
+
+// environmentBlock converts variables to the block CreateProcess takes.
+// Names are case-insensitive on Windows so a later variable replaces any
+// earlier one with the same name regardless of case, and the block is sorted
+// as Windows expects.
+func environmentBlock(env []string) ([]uint16, error) {
+	index := make(map[string]int, len(env))
+	vars := make([]string, 0, len(env))
+	for _, kv := range env {
+		key := strings.ToUpper(envName(kv))
+		if i, ok := index[key]; ok {
+			vars[i] = kv
+			continue
+		}
+		index[key] = len(vars)
+		vars = append(vars, kv)
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		return strings.ToUpper(envName(vars[i])) < strings.ToUpper(envName(vars[j]))
+	})
+
+	var block []uint16
+	for _, kv := range vars {
+		s, err := syscall.UTF16FromString(kv)
+		if err != nil {
+			return nil, xerrors.Errorf("environment variable %q contains a NUL", kv)
+		}
+		block = append(block, s...)
+	}
+	// An empty block still needs both terminators.
+	if len(block) == 0 {
+		block = append(block, 0)
+	}
+	return append(block, 0), nil
+}
+
+// envName returns the name of a variable in the form NAME=value.  Variables
+// like "=C:" that track the working directory of each drive start with an
+// equals sign that is part of their name.
+func envName(kv string) string {
+	i := strings.IndexByte(kv, '=')
+	if i == 0 {
+		i = strings.IndexByte(kv[1:], '=') + 1
+	}
+	if i <= 0 {
+		return kv
+	}
+	return kv[:i]
+}
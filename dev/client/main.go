@@ -7,11 +7,10 @@ import (
 	"context"
 	"io"
 	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"cdr.dev/wsep"
+	"cdr.dev/wsep/wsepterm"
 	"github.com/spf13/pflag"
 	"golang.org/x/term"
 	"nhooyr.io/websocket"
@@ -93,30 +92,26 @@ func do(fl *pflag.FlagSet, tty bool, id string, timeout time.Duration) {
 		Stdin:   true,
 		Rows:    uint16(height),
 		Cols:    uint16(width),
-		Env:     []string{"TERM=" + os.Getenv("TERM")},
+		// The server sets these for TTY commands.
+		Term:      os.Getenv("TERM"),
+		ColorTerm: os.Getenv("COLORTERM"),
+		Locale:    wsep.LocaleEnv(),
 	})
 	if err != nil {
 		flog.Fatal("failed to start remote command: %v", err)
 	}
+	if timeout != 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+
 	if tty {
-		ch := make(chan os.Signal, 1)
-		signal.Notify(ch, syscall.SIGWINCH)
-		go func() {
-			for range ch {
-				width, height, err := term.GetSize(int(os.Stdin.Fd()))
-				if err != nil {
-					continue
-				}
-				process.Resize(ctx, uint16(height), uint16(width))
-			}
-		}()
-		ch <- syscall.SIGWINCH
-
-		oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+		err = wsepterm.Attach(ctx, process, os.Stdin, os.Stdout)
 		if err != nil {
-			flog.Fatal("failed to make terminal raw for tty: %w", err)
+			flog.Error("process failed: %v", err)
 		}
-		defer term.Restore(int(os.Stdin.Fd()), oldState)
+		return
 	}
 
 	go io.Copy(os.Stdout, process.Stdout())
@@ -127,14 +122,10 @@ func do(fl *pflag.FlagSet, tty bool, id string, timeout time.Duration) {
 		io.Copy(stdin, os.Stdin)
 	}()
 
-	if timeout != 0 {
-		timer := time.NewTimer(timeout)
-		defer timer.Stop()
-		go func() {
-			<-timer.C
-			conn.Close(websocket.StatusNormalClosure, "normal closure")
-		}()
-	}
+	go func() {
+		<-ctx.Done()
+		conn.Close(websocket.StatusNormalClosure, "normal closure")
+	}()
 
 	err = process.Wait()
 	if err != nil {
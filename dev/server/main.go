@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"net/http"
 	"time"
 
@@ -9,28 +10,54 @@ import (
 	"nhooyr.io/websocket"
 )
 
+var (
+	wsepServer = wsep.NewServer()
+	options    *wsep.Options
+)
+
 func main() {
+	// HTTP/2 is only negotiated over TLS.
+	cert := flag.String("tls-cert", "", "certificate file for serving TLS")
+	key := flag.String("tls-key", "", "key file for serving TLS")
+	flag.Parse()
+
+	var err error
+	options, err = wsep.OptionsFromEnv()
+	if err != nil {
+		flog.Fatal("failed to read options: %v", err)
+	}
+	if options.SessionTimeout == 0 {
+		options.SessionTimeout = 30 * time.Second
+	}
+	options.AcceptEnv = wsep.LocaleAcceptEnv()
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", wsepServer.HealthHandler(wsep.LocalExecer{}))
+	mux.HandleFunc("/", serve)
 	server := http.Server{
 		Addr:    ":8080",
-		Handler: http.HandlerFunc(serve),
+		Handler: mux,
+	}
+	if *cert != "" {
+		err = server.ListenAndServeTLS(*cert, *key)
+	} else {
+		err = server.ListenAndServe()
 	}
-	err := server.ListenAndServe()
 	flog.Fatal("failed to listen: %v", err)
 }
 
 func serve(w http.ResponseWriter, r *http.Request) {
-	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	// WebSockets upgrade HTTP/1 requests so anything over HTTP/2 is a stream.
+	if r.ProtoMajor == 2 {
+		err := wsepServer.ServeHTTP2(w, r, wsep.LocalExecer{}, options)
+		if err != nil {
+			flog.Error("failed to serve execer: %v", err)
+		}
 		return
 	}
-	err = wsep.Serve(r.Context(), ws, wsep.LocalExecer{}, &wsep.Options{
-		SessionTimeout: 30 * time.Second,
-	})
+
+	err := wsepServer.ServeWebSocket(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true}, wsep.LocalExecer{}, options)
 	if err != nil {
 		flog.Error("failed to serve execer: %v", err)
-		ws.Close(websocket.StatusInternalError, "failed to serve execer")
-		return
 	}
-	ws.Close(websocket.StatusNormalClosure, "normal closure")
 }
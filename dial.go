@@ -0,0 +1,61 @@
+package wsep
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+)
+
+// DialOptions configures Dial.
+type DialOptions struct {
+	// TLSConfig is used for wss and https URLs.  It is ignored if HTTPClient is
+	// set.
+	TLSConfig *tls.Config
+	// Header is sent with the handshake.
+	Header http.Header
+	// Token, if set, is sent with the handshake as a bearer token.
+	Token string
+	// HTTPClient performs the handshake.  Defaults to http.DefaultClient, or a
+	// client using TLSConfig if it is set.
+	HTTPClient *http.Client
+	// TextFrames sends messages as text frames with base64 bodies for
+	// debugging.  The server answers in kind.
+	TextFrames bool
+}
+
+// Dial connects to a wsep server over a WebSocket at the ws, wss, http or https
+// URL.  Like RemoteExecer the returned execer can start a single command and
+// closing the process closes the connection.
+func Dial(ctx context.Context, url string, options *DialOptions) (Execer, error) {
+	if options == nil {
+		options = &DialOptions{}
+	}
+	header := options.Header.Clone()
+	if options.Token != "" {
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Authorization", "Bearer "+options.Token)
+	}
+	client := options.HTTPClient
+	if client == nil && options.TLSConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = options.TLSConfig
+		client = &http.Client{Transport: transport}
+	}
+
+	ws, resp, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPClient: client,
+		HTTPHeader: header,
+	})
+	if err != nil {
+		if resp != nil {
+			return nil, xerrors.Errorf("dial %s: handshake failed with %s: %w", url, resp.Status, err)
+		}
+		return nil, xerrors.Errorf("dial %s: %w", url, err)
+	}
+	return newRemoteExecer(newWSConn(ws, options.TextFrames)), nil
+}
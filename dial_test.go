@@ -0,0 +1,49 @@
+package wsep
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"nhooyr.io/websocket"
+)
+
+func TestDial(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		err = Serve(r.Context(), ws, LocalExecer{}, nil)
+		if err != nil {
+			ws.Close(websocket.StatusInternalError, err.Error())
+			return
+		}
+		ws.Close(websocket.StatusNormalClosure, "normal closure")
+	}))
+	t.Cleanup(server.Close)
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	_, err := Dial(ctx, server.URL, &DialOptions{TLSConfig: tlsConfig})
+	assert.True(t, "unauthorized", err != nil && strings.Contains(err.Error(), "401"))
+
+	execer, err := Dial(ctx, server.URL, &DialOptions{TLSConfig: tlsConfig, Token: "secret"})
+	assert.Success(t, "dial", err)
+	process, err := execer.Start(ctx, Command{Command: "echo", Args: []string{"dialed"}})
+	assert.Success(t, "start", err)
+	stdout := captureStdout(process)
+	assert.Success(t, "wait", process.Wait())
+	assert.Equal(t, "stdout", "dialed", <-stdout)
+}
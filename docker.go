@@ -0,0 +1,446 @@
+package wsep
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// DockerExecer executes commands inside a running container using the Docker
+// Engine API.
+type DockerExecer struct {
+	// Container is the name or ID of the container commands run in.
+	Container string
+	// Host is the address of the Docker daemon in the same format as
+	// DOCKER_HOST (unix:// or tcp://).  Defaults to DOCKER_HOST or the local
+	// daemon socket.
+	Host string
+}
+
+// Start executes the given command inside the container.  Close() detaches
+// from the command; Docker offers no way to signal an exec instance so
+// commands without a TTY keep running until they exit on their own.
+func (d DockerExecer) Start(ctx context.Context, c Command) (Process, error) {
+	c = shCommand(c)
+	create := dockerExecConfig{
+		AttachStdin:  c.Stdin,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          c.TTY,
+		Env:          c.Env,
+		Cmd:          append([]string{c.Command}, c.Args...),
+		WorkingDir:   c.WorkingDir,
+	}
+	if c.UID != 0 || c.GID != 0 {
+		create.User = fmt.Sprintf("%d:%d", c.UID, c.GID)
+	}
+	if c.TTY {
+		// This special WSEP_TTY variable helps debug unexpected TTYs.
+		create.Env = append(create.Env, "WSEP_TTY=true")
+	}
+
+	var created dockerIDResponse
+	err := d.request(ctx, http.MethodPost, "/containers/"+url.PathEscape(d.Container)+"/exec", create, &created)
+	if err != nil {
+		return nil, xerrors.Errorf("create exec: %w", err)
+	}
+
+	conn, reader, err := d.hijack(ctx, "/exec/"+created.ID+"/start", dockerExecStart{Tty: c.TTY})
+	if err != nil {
+		return nil, xerrors.Errorf("start exec: %w", err)
+	}
+
+	process := &dockerProcess{
+		ctx:    ctx,
+		execer: d,
+		id:     created.ID,
+		conn:   conn,
+		done:   make(chan struct{}),
+	}
+
+	if c.Stdin {
+		process.stdin = dockerStdin{conn: conn}
+	} else {
+		process.stdin = disabledStdinWriter{}
+	}
+
+	if c.TTY {
+		process.stdout = &notifyReader{r: reader, done: process.done}
+		process.stderr = ioutil.NopCloser(bytes.NewReader(nil))
+	} else {
+		stdoutReader, stdoutWriter := io.Pipe()
+		stderrReader, stderrWriter := io.Pipe()
+		process.stdout = stdoutReader
+		process.stderr = stderrReader
+		go func() {
+			defer close(process.done)
+			err := demuxDockerStream(reader, closedDiscarder{stdoutWriter}, closedDiscarder{stderrWriter})
+			stdoutWriter.CloseWithError(err)
+			stderrWriter.CloseWithError(err)
+		}()
+	}
+
+	// Tear down the attached stream once the context ends.
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-process.done:
+		}
+	}()
+
+	if c.TTY {
+		// The exec must be running before it can be resized.  One that has
+		// finished already cannot be, which is no reason to fail.
+		err = process.Resize(ctx, c.Rows, c.Cols)
+		if err != nil {
+			inspect, inspectErr := process.inspect(ctx)
+			if inspectErr != nil || inspect.Running {
+				_ = conn.Close()
+				return nil, err
+			}
+			flog.Info("not resizing finished exec %s: %v", created.ID, err)
+		}
+	}
+
+	inspect, err := process.inspect(ctx)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	process.pid = inspect.Pid
+
+	return process, nil
+}
+
+type dockerProcess struct {
+	ctx    context.Context
+	execer DockerExecer
+	id     string
+	pid    int
+	conn   net.Conn
+	// done is closed once the output stream from the daemon ends.
+	done chan struct{}
+
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+}
+
+func (d *dockerProcess) Pid() int {
+	return d.pid
+}
+
+func (d *dockerProcess) Stdin() io.WriteCloser {
+	return d.stdin
+}
+
+func (d *dockerProcess) Stdout() io.ReadCloser {
+	return d.stdout
+}
+
+func (d *dockerProcess) Stderr() io.ReadCloser {
+	return d.stderr
+}
+
+func (d *dockerProcess) Resize(ctx context.Context, rows, cols uint16) error {
+	query := url.Values{}
+	query.Set("h", fmt.Sprint(rows))
+	query.Set("w", fmt.Sprint(cols))
+	err := d.execer.request(ctx, http.MethodPost, "/exec/"+d.id+"/resize?"+query.Encode(), nil, nil)
+	if err != nil {
+		return xerrors.Errorf("resize exec: %w", err)
+	}
+	return nil
+}
+
+// Wait polls the daemon until the exec instance stops running.  The exit code
+// is only available through inspection so there is no way to be notified.
+func (d *dockerProcess) Wait() error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		inspect, err := d.inspect(d.ctx)
+		if err != nil {
+			return err
+		}
+		if !inspect.Running {
+			if inspect.ExitCode != 0 {
+				return ExitError{
+					code:  inspect.ExitCode,
+					error: fmt.Sprintf("exit status %d", inspect.ExitCode),
+				}
+			}
+			return nil
+		}
+		select {
+		case <-d.ctx.Done():
+			return canceledExitError(d.ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *dockerProcess) Close() error {
+	return d.conn.Close()
+}
+
+func (d *dockerProcess) inspect(ctx context.Context) (dockerExecInspect, error) {
+	var inspect dockerExecInspect
+	err := d.execer.request(ctx, http.MethodGet, "/exec/"+d.id+"/json", nil, &inspect)
+	if err != nil {
+		return inspect, xerrors.Errorf("inspect exec: %w", err)
+	}
+	return inspect, nil
+}
+
+// lookPath, mkdirAll, and writeFile make the container's filesystem available
+// to screen sessions.
+func (d DockerExecer) lookPath(ctx context.Context, file string) error {
+	return execLookPath(ctx, d, file)
+}
+
+func (d DockerExecer) mkdirAll(ctx context.Context, path string, uid, gid uint32) error {
+	return execMkdirAll(ctx, d, path, uid, gid)
+}
+
+func (d DockerExecer) writeFile(ctx context.Context, name string, data []byte, uid, gid uint32) error {
+	return execWriteFile(ctx, d, name, data, uid, gid)
+}
+
+// dockerStdin writes to the attached stream and half-closes it when stdin is
+// closed so the command sees EOF.
+type dockerStdin struct {
+	conn net.Conn
+}
+
+func (d dockerStdin) Write(b []byte) (int, error) {
+	return d.conn.Write(b)
+}
+
+func (d dockerStdin) Close() error {
+	if cw, ok := d.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return xerrors.Errorf("closing stdin is not supported on this connection")
+}
+
+// notifyReader closes done the first time the underlying reader errors.
+type notifyReader struct {
+	r    io.Reader
+	done chan struct{}
+	once sync.Once
+}
+
+func (n *notifyReader) Read(b []byte) (int, error) {
+	i, err := n.r.Read(b)
+	if err != nil {
+		n.once.Do(func() { close(n.done) })
+	}
+	return i, err
+}
+
+// Close discards the rest of the stream, which must still be read to notice
+// the exec ending.
+func (n *notifyReader) Close() error {
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, n)
+	}()
+	return nil
+}
+
+// demuxDockerStream splits the multiplexed stream Docker uses for commands
+// without a TTY.  Each frame is prefixed with an eight byte header holding the
+// stream type and big-endian payload size.
+func demuxDockerStream(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, header)
+		if xerrors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return xerrors.Errorf("read frame header: %w", err)
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		switch header[0] {
+		case 0, 1:
+			_, err = io.CopyN(stdout, r, size)
+		case 2:
+			_, err = io.CopyN(stderr, r, size)
+		case 3:
+			var msg bytes.Buffer
+			_, err = io.CopyN(&msg, r, size)
+			if err == nil {
+				err = xerrors.Errorf("docker: %s", strings.TrimSpace(msg.String()))
+			}
+		default:
+			err = xerrors.Errorf("unknown stream type %d", header[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type dockerExecConfig struct {
+	AttachStdin  bool     `json:"AttachStdin"`
+	AttachStdout bool     `json:"AttachStdout"`
+	AttachStderr bool     `json:"AttachStderr"`
+	Tty          bool     `json:"Tty"`
+	Env          []string `json:"Env,omitempty"`
+	Cmd          []string `json:"Cmd"`
+	WorkingDir   string   `json:"WorkingDir,omitempty"`
+	User         string   `json:"User,omitempty"`
+}
+
+type dockerExecStart struct {
+	Detach bool `json:"Detach"`
+	Tty    bool `json:"Tty"`
+}
+
+type dockerIDResponse struct {
+	ID string `json:"Id"`
+}
+
+type dockerExecInspect struct {
+	Running  bool `json:"Running"`
+	ExitCode int  `json:"ExitCode"`
+	Pid      int  `json:"Pid"`
+}
+
+type dockerErrorResponse struct {
+	Message string `json:"message"`
+}
+
+// dial connects to the Docker daemon.
+func (d DockerExecer) dial(ctx context.Context) (net.Conn, error) {
+	host := d.Host
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, xerrors.Errorf("parse docker host %q: %w", host, err)
+	}
+	var dialer net.Dialer
+	switch u.Scheme {
+	case "unix":
+		return dialer.DialContext(ctx, "unix", u.Path)
+	case "tcp":
+		return dialer.DialContext(ctx, "tcp", u.Host)
+	default:
+		return nil, xerrors.Errorf("unsupported docker host scheme %q", u.Scheme)
+	}
+}
+
+// request makes an API call to the Docker daemon, encoding in as the request
+// body and decoding the response into out when they are not nil.
+func (d DockerExecer) request(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		byt, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(byt)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://docker"+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.dial(ctx)
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return readDockerError(resp)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// hijack makes an API call that upgrades the connection to a raw stream and
+// returns the connection along with a reader that must be used in place of
+// reading from the connection directly.
+func (d DockerExecer) hijack(ctx context.Context, path string, in interface{}) (net.Conn, *bufio.Reader, error) {
+	byt, err := json.Marshal(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://docker"+path, bytes.NewReader(byt))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := d.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = req.Write(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	// Older daemons respond with 200 but hijack the connection all the same.
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		err = readDockerError(resp)
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, reader, nil
+}
+
+func readDockerError(resp *http.Response) error {
+	var msg dockerErrorResponse
+	err := json.NewDecoder(resp.Body).Decode(&msg)
+	if err != nil || msg.Message == "" {
+		return xerrors.Errorf("docker: %s", resp.Status)
+	}
+	return xerrors.Errorf("docker: %s", msg.Message)
+}
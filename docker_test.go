@@ -0,0 +1,264 @@
+package wsep
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"github.com/google/uuid"
+)
+
+func TestDockerExec(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	testExecer(ctx, t, DockerExecer{Container: "test", Host: fakeDocker(t)})
+}
+
+func TestDockerExecFail(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	testExecerFail(ctx, t, DockerExecer{Container: "test", Host: fakeDocker(t)})
+}
+
+func TestDockerExecTTY(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	execer := DockerExecer{Container: "test", Host: fakeDocker(t)}
+	process, err := execer.Start(ctx, Command{
+		Command: "sh",
+		TTY:     true,
+		Stdin:   true,
+		Rows:    defaultRows,
+		Cols:    defaultCols,
+		Env:     []string{"TERM=linux"},
+	})
+	assert.Success(t, "start command", err)
+
+	expected := writeUnique(t, process)
+	assert.True(t, "find output", checkStdout(t, process, expected, []string{}))
+
+	write(t, process, "exit 3")
+	err = process.Wait()
+	exitErr, ok := err.(ExitError)
+	assert.True(t, "is exit error", ok)
+	assert.Equal(t, "exit code", 3, exitErr.ExitCode())
+}
+
+func TestDockerExecTTYFinished(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// The exec finishes before it is resized, which the daemon refuses.
+	daemon := &fakeDockerDaemon{execs: map[string]*fakeDockerExec{}, finishBeforeResize: true}
+	execer := DockerExecer{Container: "test", Host: serveFakeDocker(t, daemon)}
+	process, err := execer.Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", "exit 3"},
+		TTY:     true,
+	})
+	assert.Success(t, "start command", err)
+	err = process.Wait()
+	exitErr, ok := err.(ExitError)
+	assert.True(t, "is exit error", ok)
+	assert.Equal(t, "exit code", 3, exitErr.ExitCode())
+}
+
+func TestDockerExecMissingContainer(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	_, err := DockerExecer{Container: "missing", Host: fakeDocker(t)}.Start(ctx, Command{
+		Command: "pwd",
+	})
+	assert.Error(t, "start command", err)
+	assert.True(t, "mentions container", strings.Contains(err.Error(), "No such container"))
+}
+
+// fakeDocker serves enough of the Docker Engine API to run exec instances
+// locally and returns the host to pass to DockerExecer.
+func fakeDocker(t *testing.T) string {
+	return serveFakeDocker(t, &fakeDockerDaemon{execs: map[string]*fakeDockerExec{}})
+}
+
+func serveFakeDocker(t *testing.T, daemon *fakeDockerDaemon) string {
+	socket := filepath.Join(tempDir(t), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.Success(t, "listen", err)
+
+	server := httptest.NewUnstartedServer(daemon)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return "unix://" + socket
+}
+
+type fakeDockerDaemon struct {
+	mutex sync.Mutex
+	execs map[string]*fakeDockerExec
+	// finishBeforeResize holds resizes until the exec finishes.
+	finishBeforeResize bool
+}
+
+type fakeDockerExec struct {
+	config   dockerExecConfig
+	process  Process
+	running  bool
+	exitCode int
+	// finished is closed once the exec stops running.
+	finished chan struct{}
+}
+
+func (f *fakeDockerDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "containers" && parts[2] == "exec":
+		if parts[1] != "test" {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(dockerErrorResponse{Message: "No such container: " + parts[1]})
+			return
+		}
+		var config dockerExecConfig
+		_ = json.NewDecoder(r.Body).Decode(&config)
+		id := uuid.NewString()
+		f.mutex.Lock()
+		f.execs[id] = &fakeDockerExec{config: config, finished: make(chan struct{})}
+		f.mutex.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(dockerIDResponse{ID: id})
+	case len(parts) == 3 && parts[0] == "exec":
+		f.mutex.Lock()
+		exec, ok := f.execs[parts[1]]
+		f.mutex.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch parts[2] {
+		case "start":
+			f.start(w, exec)
+		case "resize":
+			if f.finishBeforeResize {
+				<-exec.finished
+			}
+			f.mutex.Lock()
+			running := exec.running
+			f.mutex.Unlock()
+			if !running {
+				w.WriteHeader(http.StatusConflict)
+				_ = json.NewEncoder(w).Encode(dockerErrorResponse{Message: "exec is not running"})
+				return
+			}
+			rows, _ := strconv.Atoi(r.URL.Query().Get("h"))
+			cols, _ := strconv.Atoi(r.URL.Query().Get("w"))
+			_ = exec.process.Resize(r.Context(), uint16(rows), uint16(cols))
+		case "json":
+			f.mutex.Lock()
+			inspect := dockerExecInspect{Running: exec.running, ExitCode: exec.exitCode, Pid: exec.process.Pid()}
+			f.mutex.Unlock()
+			_ = json.NewEncoder(w).Encode(inspect)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeDockerDaemon) start(w http.ResponseWriter, exec *fakeDockerExec) {
+	process, err := LocalExecer{}.Start(context.Background(), Command{
+		Command:    exec.config.Cmd[0],
+		Args:       exec.config.Cmd[1:],
+		TTY:        exec.config.Tty,
+		Stdin:      exec.config.AttachStdin,
+		Rows:       defaultRows,
+		Cols:       defaultCols,
+		Env:        exec.config.Env,
+		WorkingDir: exec.config.WorkingDir,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f.mutex.Lock()
+	exec.process = process
+	exec.running = true
+	f.mutex.Unlock()
+
+	conn, buf, _ := w.(http.Hijacker).Hijack()
+	_, _ = buf.WriteString("HTTP/1.1 101 UPGRADED\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	_ = buf.Flush()
+
+	if exec.config.AttachStdin {
+		go func() {
+			_, _ = io.Copy(process.Stdin(), bufio.NewReader(conn))
+			_ = process.Stdin().Close()
+		}()
+	}
+
+	var writeMutex sync.Mutex
+	copyStream := func(stream byte, r io.Reader) {
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				writeMutex.Lock()
+				if !exec.config.Tty {
+					header := make([]byte, 8)
+					header[0] = stream
+					binary.BigEndian.PutUint32(header[4:], uint32(n))
+					_, _ = conn.Write(header)
+				}
+				_, _ = conn.Write(buf[:n])
+				writeMutex.Unlock()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyStream(1, process.Stdout())
+	}()
+	go func() {
+		defer wg.Done()
+		copyStream(2, process.Stderr())
+	}()
+	go func() {
+		// A TTY will not hit EOF until the process exits.
+		if !exec.config.Tty {
+			wg.Wait()
+		}
+		err := process.Wait()
+		f.mutex.Lock()
+		exec.running = false
+		if exitErr, ok := err.(ExitError); ok {
+			exec.exitCode = exitErr.ExitCode()
+		}
+		f.mutex.Unlock()
+		close(exec.finished)
+		_ = conn.Close()
+	}()
+}
@@ -0,0 +1,177 @@
+package wsep
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Environment variables read by OptionsFromEnv.
+const (
+	// EnvSessionTimeout sets Options.SessionTimeout as a Go duration.
+	EnvSessionTimeout = "WSEP_SESSION_TIMEOUT"
+	// EnvIdleTimeout sets Options.IdleTimeout as a Go duration.
+	EnvIdleTimeout = "WSEP_IDLE_TIMEOUT"
+	// EnvIdleWarning sets Options.IdleWarning as a Go duration.
+	EnvIdleWarning = "WSEP_IDLE_WARNING"
+	// EnvOutputCoalesceDelay sets Options.OutputCoalesceDelay as a Go
+	// duration.
+	EnvOutputCoalesceDelay = "WSEP_OUTPUT_COALESCE_DELAY"
+	// EnvAttachTimeout sets Options.AttachTimeout as a Go duration.
+	EnvAttachTimeout = "WSEP_ATTACH_TIMEOUT"
+	// EnvStartTimeout sets Options.StartTimeout as a Go duration.
+	EnvStartTimeout = "WSEP_START_TIMEOUT"
+	// EnvClientIdleTimeout sets Options.ClientIdleTimeout as a Go duration.
+	EnvClientIdleTimeout = "WSEP_CLIENT_IDLE_TIMEOUT"
+	// EnvSlowConsumerTimeout sets Options.SlowConsumerTimeout as a Go
+	// duration.
+	EnvSlowConsumerTimeout = "WSEP_SLOW_CONSUMER_TIMEOUT"
+	// EnvScreenRetryInterval sets Options.ScreenRetryInterval as a Go
+	// duration.
+	EnvScreenRetryInterval = "WSEP_SCREEN_RETRY_INTERVAL"
+)
+
+// OptionsFromEnv returns options configured by the WSEP_* environment
+// variables so wrappers can be configured without code changes.  Unset
+// variables leave the option at its zero value.  Fields set on the result in
+// code afterward take precedence; use Options.Merge to layer explicit options
+// on top.
+func OptionsFromEnv() (*Options, error) {
+	var options Options
+	for name, field := range map[string]*time.Duration{
+		EnvSessionTimeout:      &options.SessionTimeout,
+		EnvIdleTimeout:         &options.IdleTimeout,
+		EnvIdleWarning:         &options.IdleWarning,
+		EnvOutputCoalesceDelay: &options.OutputCoalesceDelay,
+		EnvAttachTimeout:       &options.AttachTimeout,
+		EnvScreenRetryInterval: &options.ScreenRetryInterval,
+		EnvClientIdleTimeout:   &options.ClientIdleTimeout,
+		EnvStartTimeout:        &options.StartTimeout,
+		EnvSlowConsumerTimeout: &options.SlowConsumerTimeout,
+	} {
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, xerrors.Errorf("parse %s: %w", name, err)
+		}
+		*field = duration
+	}
+	return &options, nil
+}
+
+// Merge returns a copy of the options with every zero field taken from
+// defaults, so options set explicitly in code win over those from elsewhere
+// such as OptionsFromEnv.
+func (o *Options) Merge(defaults *Options) *Options {
+	merged := *o
+	if defaults == nil {
+		return &merged
+	}
+	if merged.SessionTimeout == 0 {
+		merged.SessionTimeout = defaults.SessionTimeout
+	}
+	if merged.Owner == "" {
+		merged.Owner = defaults.Owner
+	}
+	if !merged.Admin {
+		merged.Admin = defaults.Admin
+	}
+	if merged.IdleTimeout == 0 {
+		merged.IdleTimeout = defaults.IdleTimeout
+	}
+	if merged.IdleWarning == 0 {
+		merged.IdleWarning = defaults.IdleWarning
+	}
+	if merged.Audit == nil {
+		merged.Audit = defaults.Audit
+	}
+	if merged.OnExit == nil {
+		merged.OnExit = defaults.OnExit
+	}
+	if merged.OutputCoalesceDelay == 0 {
+		merged.OutputCoalesceDelay = defaults.OutputCoalesceDelay
+	}
+	if merged.ReadLimit == 0 {
+		merged.ReadLimit = defaults.ReadLimit
+	}
+	if merged.FrameRate == 0 {
+		merged.FrameRate = defaults.FrameRate
+	}
+	if merged.FrameBurst == 0 {
+		merged.FrameBurst = defaults.FrameBurst
+	}
+	if !merged.TextFrames {
+		merged.TextFrames = defaults.TextFrames
+	}
+	if merged.ResumeBufferSize == 0 {
+		merged.ResumeBufferSize = defaults.ResumeBufferSize
+	}
+	if merged.JournalDir == "" {
+		merged.JournalDir = defaults.JournalDir
+	}
+	if merged.JournalSize == 0 {
+		merged.JournalSize = defaults.JournalSize
+	}
+	if merged.OutputQuota == 0 {
+		merged.OutputQuota = defaults.OutputQuota
+	}
+	if merged.StdinQuota == 0 {
+		merged.StdinQuota = defaults.StdinQuota
+	}
+	if merged.OutputRate == 0 {
+		merged.OutputRate = defaults.OutputRate
+	}
+	if merged.StdinRate == 0 {
+		merged.StdinRate = defaults.StdinRate
+	}
+	if merged.AttachTimeout == 0 {
+		merged.AttachTimeout = defaults.AttachTimeout
+	}
+	if merged.ScreenRetryInterval == 0 {
+		merged.ScreenRetryInterval = defaults.ScreenRetryInterval
+	}
+	if merged.ScreenConfig == nil {
+		merged.ScreenConfig = defaults.ScreenConfig
+	}
+	if merged.ScreenConfigExtra == nil {
+		merged.ScreenConfigExtra = defaults.ScreenConfigExtra
+	}
+	if merged.MaxOutputBytes == 0 {
+		merged.MaxOutputBytes = defaults.MaxOutputBytes
+	}
+	if merged.OutputTailBytes == 0 {
+		merged.OutputTailBytes = defaults.OutputTailBytes
+	}
+	if merged.StartTimeout == 0 {
+		merged.StartTimeout = defaults.StartTimeout
+	}
+	if merged.ClientIdleTimeout == 0 {
+		merged.ClientIdleTimeout = defaults.ClientIdleTimeout
+	}
+	if merged.SlowConsumerTimeout == 0 {
+		merged.SlowConsumerTimeout = defaults.SlowConsumerTimeout
+	}
+	if !merged.DropSlowConsumers {
+		merged.DropSlowConsumers = defaults.DropSlowConsumers
+	}
+	if merged.CaptureDir == "" {
+		merged.CaptureDir = defaults.CaptureDir
+	}
+	if !merged.StrictMessages {
+		merged.StrictMessages = defaults.StrictMessages
+	}
+	if merged.MaxConnections == 0 {
+		merged.MaxConnections = defaults.MaxConnections
+	}
+	if merged.MaxConnectionsPerAddress == 0 {
+		merged.MaxConnectionsPerAddress = defaults.MaxConnectionsPerAddress
+	}
+	if merged.AcceptEnv == nil {
+		merged.AcceptEnv = defaults.AcceptEnv
+	}
+	return &merged
+}
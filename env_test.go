@@ -0,0 +1,34 @@
+package wsep
+
+import (
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestOptionsFromEnv(t *testing.T) {
+	setenv(t, EnvSessionTimeout, "10m")
+	setenv(t, EnvIdleTimeout, "1h")
+	setenv(t, EnvIdleWarning, "")
+	setenv(t, EnvOutputCoalesceDelay, "2ms")
+	setenv(t, EnvAttachTimeout, "2m")
+
+	options, err := OptionsFromEnv()
+	assert.Success(t, "options from env", err)
+	assert.Equal(t, "session timeout", 10*time.Minute, options.SessionTimeout)
+	assert.Equal(t, "idle timeout", time.Hour, options.IdleTimeout)
+	assert.Equal(t, "idle warning", time.Duration(0), options.IdleWarning)
+	assert.Equal(t, "output coalesce delay", 2*time.Millisecond, options.OutputCoalesceDelay)
+	assert.Equal(t, "attach timeout", 2*time.Minute, options.AttachTimeout)
+
+	// Explicit options take precedence.
+	merged := (&Options{SessionTimeout: time.Minute, Owner: "alice"}).Merge(options)
+	assert.Equal(t, "explicit session timeout", time.Minute, merged.SessionTimeout)
+	assert.Equal(t, "env idle timeout", time.Hour, merged.IdleTimeout)
+	assert.Equal(t, "explicit owner", "alice", merged.Owner)
+
+	setenv(t, EnvIdleTimeout, "soon")
+	_, err = OptionsFromEnv()
+	assert.Error(t, "invalid duration", err)
+}
@@ -2,15 +2,41 @@ package wsep
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"time"
+
+	"golang.org/x/xerrors"
 
 	"cdr.dev/wsep/internal/proto"
 )
 
+// Exit codes with a meaning beyond the command's own exit status.  A command
+// that exits normally reports its own status (0-255).  A command killed by a
+// signal on Unix reports ExitCodeSignalBase plus the signal number, as shells
+// do, so SIGKILL is 137, and one ended by Ctrl+C on Windows reports the same as
+// SIGINT.  A command killed because the context it was started with ended
+// reports ExitCodeCanceled regardless of how it was killed.  These apply to
+// every execer in this package including over a connection.
+const (
+	// ExitCodeUnknown is reported when the exit status could not be
+	// determined.
+	ExitCodeUnknown = -1
+	// ExitCodeCanceled is reported when the command was killed because its
+	// context ended.
+	ExitCodeCanceled = -2
+	// ExitCodeSignalBase is added to the number of the signal that killed the
+	// command.
+	ExitCodeSignalBase = 128
+)
+
 // ExitError is sent when the command terminates.
 type ExitError struct {
 	code  int
 	error string
+	// cause is the underlying error, if any, such as the context error for
+	// ExitCodeCanceled.
+	cause error
 }
 
 // ExitCode returns the exit code of the process.
@@ -18,11 +44,26 @@ func (e ExitError) ExitCode() int {
 	return e.code
 }
 
-// Error returns a string describing why the process errored.
+// Error returns a string describing why the process errored.  For remote
+// processes this is the error the server reported.
 func (e ExitError) Error() string {
+	if e.error == "" {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
 	return e.error
 }
 
+// Unwrap returns the underlying error, if any.
+func (e ExitError) Unwrap() error {
+	return e.cause
+}
+
+// canceledExitError returns the error for a command killed because its
+// context ended with err.
+func canceledExitError(err error) ExitError {
+	return ExitError{code: ExitCodeCanceled, error: err.Error(), cause: err}
+}
+
 // Process represents a started command.
 type Process interface {
 	// Pid is populated immediately during a successful start with the process ID.
@@ -30,51 +71,250 @@ type Process interface {
 	// Stdout returns an io.WriteCloser that will pipe writes to the remote command.
 	// Closure of stdin sends the corresponding close message.
 	Stdin() io.WriteCloser
-	// Stdout returns an io.Reader that is connected to the command's standard output.
-	Stdout() io.Reader
-	// Stderr returns an io.Reader that is connected to the command's standard error.
-	Stderr() io.Reader
+	// Stdout returns an io.ReadCloser that is connected to the command's standard output.
+	// Closing it stops reading the stream without holding up the others.
+	Stdout() io.ReadCloser
+	// Stderr returns an io.ReadCloser that is connected to the command's standard error.
+	// It can be closed like Stdout.
+	Stderr() io.ReadCloser
 	// Resize resizes the TTY if a TTY is enabled.
 	Resize(ctx context.Context, rows, cols uint16) error
 	// Wait returns ExitError when the command terminates with a non-zero exit code.
+	// It returns early if the context the command was started with ends; use
+	// WaitContext to bound a single wait.
 	Wait() error
 	// Close sends a SIGTERM to the process.  To force a shutdown cancel the
 	// context passed into the execer.
 	Close() error
 }
 
+// startWarning is a problem a command started despite.
+type startWarning struct {
+	code    Code
+	message string
+}
+
+// warner is implemented by processes that started differently than asked in a
+// way the user should hear about, such as in another working directory.
+type warner interface {
+	startWarnings() []startWarning
+}
+
+// closedDiscarder writes to a pipe whose reader may be closed, discarding what
+// is written once it is so the process' other streams keep flowing.
+type closedDiscarder struct {
+	w io.Writer
+}
+
+func (d closedDiscarder) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	if xerrors.Is(err, io.ErrClosedPipe) {
+		return len(p), nil
+	}
+	return n, err
+}
+
 // Execer starts commands.
 type Execer interface {
 	Start(ctx context.Context, c Command) (Process, error)
 }
 
+// AppHint describes the class of program a command runs.  wsep does not act on
+// it; it is carried to the execer and reported back to clients so that UIs can
+// choose defaults per application rather than treating every TTY identically.
+type AppHint string
+
+const (
+	// AppHintShell is an interactive shell with a prompt.
+	AppHintShell AppHint = "shell"
+	// AppHintREPL is a line-oriented interpreter or debugger like python or gdb
+	// where local echo and prompt detection are useful.
+	AppHintREPL AppHint = "repl"
+	// AppHintEditor is a full-screen program using the alternate screen where
+	// scrollback is not meaningful.
+	AppHintEditor AppHint = "editor"
+	// AppHintPager is a full-screen program like less that scrolls its own
+	// output.
+	AppHintPager AppHint = "pager"
+)
+
+// ProcessAppHint returns the hint reported for a process started by a remote
+// execer or the empty string for other processes.
+func ProcessAppHint(p Process) AppHint {
+	if h, ok := p.(interface{ AppHint() AppHint }); ok {
+		return h.AppHint()
+	}
+	return ""
+}
+
+// ProcessInfo describes how a command was actually started, which may differ
+// from what was asked for.
+type ProcessInfo struct {
+	// WorkingDir is the directory the command started in after expanding it
+	// and falling back from one it could not start in.
+	WorkingDir string
+	// User is the name of the user the command runs as.
+	User string
+	// Shell is the shell the command runs through, if it runs through one
+	// because it is empty or Shell is set.
+	Shell string
+	// SessionID is the ID the command can be reattached or resumed with.  It
+	// is empty if the command ends with the connection, for example because
+	// screen is not installed to keep a session.
+	SessionID string
+}
+
+// ProcessStartInfo returns what the execer reported about how a process was
+// started.  Fields the execer does not know are empty.
+func ProcessStartInfo(p Process) ProcessInfo {
+	if i, ok := p.(interface{ StartInfo() ProcessInfo }); ok {
+		return i.StartInfo()
+	}
+	return ProcessInfo{}
+}
+
+// ResourceUsage is what a process used of the system's resources.
+type ResourceUsage struct {
+	// UserTime and SystemTime are the CPU time the process spent in user and
+	// kernel mode.
+	UserTime   time.Duration `json:"user_time"`
+	SystemTime time.Duration `json:"system_time"`
+	// MaxRSS is the most memory the process had resident, in bytes, or zero
+	// if it is not known.
+	MaxRSS int64 `json:"max_rss,omitempty"`
+}
+
+// ProcessUsage returns the resources a process used, or false if they are
+// not known, as for processes on the other end of a connection.  It must be
+// called after Wait returns.
+func ProcessUsage(p Process) (ResourceUsage, bool) {
+	if u, ok := p.(interface{ Usage() (ResourceUsage, bool) }); ok {
+		return u.Usage()
+	}
+	return ResourceUsage{}, false
+}
+
+// WaitContext waits for the process like Wait but gives up once ctx ends, in
+// which case the process is closed so nothing is left waiting on it and ctx's
+// error is returned.
+func WaitContext(ctx context.Context, p Process) error {
+	if w, ok := p.(interface{ WaitCtx(context.Context) error }); ok {
+		return w.WaitCtx(ctx)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		_ = p.Close()
+		return ctx.Err()
+	}
+}
+
+// userShellScript runs its arguments with the SHELL of its environment, or
+// /bin/sh if it is unset.
+const userShellScript = `exec "${SHELL:-/bin/sh}" -c "$@"`
+
+// shellCommand rewrites a command with Shell set to run its Command as a script
+// through shell with Args as the script's positional parameters.  An empty
+// shell picks the SHELL of the environment the command runs in, for execers
+// that cannot look up the user's shell themselves.
+func shellCommand(c Command, shell string) Command {
+	if !c.Shell {
+		return c
+	}
+	if shell == "" {
+		c.Args = append([]string{"-c", userShellScript, "sh", c.Command, "sh"}, c.Args...)
+		c.Command = "/bin/sh"
+	} else {
+		c.Args = append([]string{"-c", c.Command, shell}, c.Args...)
+		c.Command = shell
+	}
+	c.Shell = false
+	return c
+}
+
+// loginShellScript starts the login shell passwd lists for the user running it,
+// falling back to SHELL and then /bin/sh, with its arguments.
+const loginShellScript = `shell=$(getent passwd "$(id -u)" 2>/dev/null | cut -d: -f7); exec "${shell:-${SHELL:-/bin/sh}}" -l "$@"`
+
+// loginShellCommand rewrites a command without a Command to start the user's
+// login shell, for execers that cannot look up the user's shell themselves.
+// Commands with Shell set must be rewritten by shellCommand first.
+func loginShellCommand(c Command) Command {
+	if c.Command != "" {
+		return c
+	}
+	c.Args = append([]string{"-c", loginShellScript, "sh"}, c.Args...)
+	c.Command = "/bin/sh"
+	return c
+}
+
+// shCommand rewrites the parts of a command that execers without their own
+// support for them run through /bin/sh: Shell, an empty Command and
+// TerminalModes.
+func shCommand(c Command) Command {
+	return terminalModesCommand(loginShellCommand(shellCommand(c, "")))
+}
+
 // theses maps are needed to prevent an import cycle
 func mapToProtoCmd(c Command) proto.Command {
 	return proto.Command{
-		Command:    c.Command,
-		Args:       c.Args,
-		Stdin:      c.Stdin,
-		TTY:        c.TTY,
-		Rows:       c.Rows,
-		Cols:       c.Cols,
-		UID:        c.UID,
-		GID:        c.GID,
-		Env:        c.Env,
-		WorkingDir: c.WorkingDir,
+		Command:       c.Command,
+		Args:          c.Args,
+		Shell:         c.Shell,
+		Stdin:         c.Stdin,
+		TTY:           c.TTY,
+		Rows:          c.Rows,
+		Cols:          c.Cols,
+		TerminalModes: c.TerminalModes,
+		UID:           c.UID,
+		GID:           c.GID,
+		Env:           c.Env,
+		WorkingDir:    c.WorkingDir,
+		AppHint:       string(c.AppHint),
+		// The callbacks stay on the client; the server only needs to know
+		// what to relay.
+		RelayClipboard: c.OnClipboard != nil,
+		RelayBell:      c.OnBell != nil,
+		RelayNotify:    c.OnNotify != nil,
+		Timestamps:     c.Paced,
+		LowLatency:     c.LowLatency,
+		Acknowledged:   c.Acknowledged,
+		StdoutFile:     c.StdoutFile,
+		StderrFile:     c.StderrFile,
+		TeeOutput:      c.TeeOutput,
+		DiscardOutput:  c.DiscardOutput,
+		LineBuffered:   c.LineBuffered,
+		ExclusiveInput: c.ExclusiveInput,
 	}
 }
 
 func mapToClientCmd(c proto.Command) *Command {
 	return &Command{
-		Command:    c.Command,
-		Args:       c.Args,
-		Stdin:      c.Stdin,
-		TTY:        c.TTY,
-		Rows:       c.Rows,
-		Cols:       c.Cols,
-		UID:        c.UID,
-		GID:        c.GID,
-		Env:        c.Env,
-		WorkingDir: c.WorkingDir,
+		Command:        c.Command,
+		Args:           c.Args,
+		Shell:          c.Shell,
+		Stdin:          c.Stdin,
+		TTY:            c.TTY,
+		Rows:           c.Rows,
+		Cols:           c.Cols,
+		TerminalModes:  c.TerminalModes,
+		UID:            c.UID,
+		GID:            c.GID,
+		Env:            c.Env,
+		WorkingDir:     c.WorkingDir,
+		AppHint:        AppHint(c.AppHint),
+		LowLatency:     c.LowLatency,
+		Acknowledged:   c.Acknowledged,
+		StdoutFile:     c.StdoutFile,
+		StderrFile:     c.StderrFile,
+		TeeOutput:      c.TeeOutput,
+		DiscardOutput:  c.DiscardOutput,
+		LineBuffered:   c.LineBuffered,
+		ExclusiveInput: c.ExclusiveInput,
 	}
 }
@@ -0,0 +1,104 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// ExitInfo describes a command that finished, for Options.OnExit.  Durations
+// are encoded in JSON as nanoseconds.
+type ExitInfo struct {
+	// Owner is the principal behind the connection from Options.Owner.
+	Owner     string   `json:"owner,omitempty"`
+	SessionID string   `json:"session_id,omitempty"`
+	Command   string   `json:"command"`
+	Args      []string `json:"args,omitempty"`
+	Pid       int      `json:"pid,omitempty"`
+	// Started is when the command started and Duration how long it ran.
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	// ExitCode is ExitCodeUnknown if waiting for the command failed, in which
+	// case Error says why.
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+	// Usage is what the command used, or nil if the execer does not know, as
+	// for commands run over another connection.
+	Usage *ResourceUsage `json:"usage,omitempty"`
+}
+
+// newExitInfo describes a process that exited with err.
+func newExitInfo(options *Options, sessionID string, command *Command, process Process, started time.Time, err error) ExitInfo {
+	info := ExitInfo{
+		Owner:     options.Owner,
+		SessionID: sessionID,
+		Command:   command.Command,
+		Args:      command.Args,
+		Pid:       process.Pid(),
+		Started:   started,
+		Duration:  time.Since(started),
+		Error:     errorString(err),
+	}
+	var exitErr ExitError
+	switch {
+	case xerrors.As(err, &exitErr):
+		info.ExitCode = exitErr.ExitCode()
+	case err != nil:
+		info.ExitCode = ExitCodeUnknown
+	}
+	if usage, ok := ProcessUsage(process); ok {
+		info.Usage = &usage
+	}
+	return info
+}
+
+// HTTPExitHook posts each ExitInfo it is given to a URL as JSON, for use as
+// Options.OnExit.  Failures are logged since the command has already exited.
+type HTTPExitHook struct {
+	URL string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// Header is added to each request, for example for authentication.
+	Header http.Header
+}
+
+// OnExit posts the exit.
+func (h *HTTPExitHook) OnExit(ctx context.Context, info ExitInfo) {
+	err := h.post(ctx, info)
+	if err != nil {
+		flog.Error("failed to post exit of %s: %v", info.Command, err)
+	}
+}
+
+func (h *HTTPExitHook) post(ctx context.Context, info ExitInfo) error {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range h.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return xerrors.Errorf("post exit: %s", resp.Status)
+	}
+	return nil
+}
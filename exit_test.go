@@ -0,0 +1,91 @@
+package wsep
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"nhooyr.io/websocket"
+)
+
+func TestOnExit(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	exits := make(chan ExitInfo, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info ExitInfo
+		err := json.NewDecoder(r.Body).Decode(&info)
+		assert.Success(t, "decode", err)
+		assert.Equal(t, "header", "secret", r.Header.Get("Authorization"))
+		exits <- info
+	}))
+	defer webhook.Close()
+	hook := &HTTPExitHook{URL: webhook.URL, Header: http.Header{"Authorization": {"secret"}}}
+
+	ws, server := mockConn(ctx, t, nil, &Options{Owner: "alice", OnExit: hook.OnExit})
+	defer server.Close()
+
+	process, err := RemoteExecer(ws).Start(ctx, Command{Command: "sh", Args: []string{"-c", "sleep 0.1; exit 3"}})
+	assert.Success(t, "start", err)
+	assert.Error(t, "wait", process.Wait())
+
+	select {
+	case info := <-exits:
+		assert.Equal(t, "owner", "alice", info.Owner)
+		assert.Equal(t, "command", "sh", info.Command)
+		assert.Equal(t, "pid", process.Pid(), info.Pid)
+		assert.Equal(t, "exit code", 3, info.ExitCode)
+		assert.True(t, "duration", info.Duration >= 100*time.Millisecond)
+		assert.True(t, "usage", info.Usage != nil)
+	case <-ctx.Done():
+		t.Fatal("exit was not posted")
+	}
+}
+
+func TestOnExitDetached(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	exits := make(chan ExitInfo, 2)
+	options := &Options{
+		Owner:          "alice",
+		SessionTimeout: time.Minute,
+		OnExit: func(_ context.Context, info ExitInfo) {
+			exits <- info
+		},
+	}
+	ws, server := mockConn(ctx, t, newServer(t), options)
+	defer server.Close()
+
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		ID:      "detached",
+		Command: "sh",
+		Args:    []string{"-c", "sleep 0.5; exit 3"},
+	})
+	assert.Success(t, "start", err)
+	// Detaching leaves the command running so it has not exited yet.
+	err = ws.Close(websocket.StatusNormalClosure, "")
+	assert.Success(t, "detach", err)
+
+	select {
+	case info := <-exits:
+		assert.Equal(t, "session id", "detached", info.SessionID)
+		assert.Equal(t, "pid", process.Pid(), info.Pid)
+		assert.Equal(t, "exit code", 3, info.ExitCode)
+		assert.True(t, "duration", info.Duration >= 500*time.Millisecond)
+	case <-ctx.Done():
+		t.Fatal("exit was not reported")
+	}
+	select {
+	case info := <-exits:
+		t.Fatalf("exit reported twice: %+v", info)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,70 @@
+package wsep
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"go.coder.com/flog"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+// ExtensionHandler handles extension messages in a namespace.  send writes an
+// extension message in the same namespace back to the client and remains
+// usable for the lifetime of the connection so handlers may keep it to push
+// messages later.
+type ExtensionHandler func(ctx context.Context, payload []byte, send func(payload []byte) error) error
+
+// HandleExtension registers a handler for extension messages in the
+// namespace, letting embedders carry their own control data over wsep
+// connections.  Handlers run on the connection's read loop so they should hand
+// off long work.  Messages for namespaces without a handler are dropped.
+func (srv *Server) HandleExtension(namespace string, handler ExtensionHandler) {
+	srv.extensionsMutex.Lock()
+	defer srv.extensionsMutex.Unlock()
+	if srv.extensions == nil {
+		srv.extensions = make(map[string]ExtensionHandler)
+	}
+	srv.extensions[namespace] = handler
+}
+
+func (srv *Server) handleExtension(ctx context.Context, namespace string, payload []byte, w io.Writer) {
+	srv.extensionsMutex.RLock()
+	handler, ok := srv.extensions[namespace]
+	srv.extensionsMutex.RUnlock()
+	if !ok {
+		flog.Error("no handler for extension namespace: %s", namespace)
+		return
+	}
+	err := handler(ctx, payload, func(payload []byte) error {
+		return sendExtension(w, namespace, payload)
+	})
+	if err != nil {
+		flog.Error("failed to handle extension %s: %v", namespace, err)
+	}
+}
+
+func sendExtension(w io.Writer, namespace string, payload []byte) error {
+	header, err := json.Marshal(proto.ExtensionHeader{
+		Type:      proto.TypeExtension,
+		Namespace: namespace,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = proto.WithHeader(w, header).Write(payload)
+	return err
+}
+
+// ExtensionSender is implemented by processes started by remote execers to send
+// extension messages to the server's handler for the namespace.  Replies are
+// delivered to Command.OnExtension.
+type ExtensionSender interface {
+	SendExtension(ctx context.Context, namespace string, payload []byte) error
+}
+
+// SendExtension sends an extension message to the server.
+func (r *remoteProcess) SendExtension(ctx context.Context, namespace string, payload []byte) error {
+	return sendExtension(connWriter{ctx: ctx, conn: r.conn}, namespace, payload)
+}
@@ -0,0 +1,47 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestExtension(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	wsepServer := newServer(t)
+	wsepServer.HandleExtension("echo", func(_ context.Context, payload []byte, send func([]byte) error) error {
+		return send(bytes.ToUpper(payload))
+	})
+	ws, server := mockConn(ctx, t, wsepServer, nil)
+	defer server.Close()
+
+	replies := make(chan string, 1)
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command: "cat",
+		Stdin:   true,
+		OnExtension: func(namespace string, payload []byte) {
+			replies <- namespace + ":" + string(payload)
+		},
+	})
+	assert.Success(t, "start", err)
+
+	sender := process.(ExtensionSender)
+	// Unknown namespaces are dropped without affecting the connection.
+	assert.Success(t, "send unknown", sender.SendExtension(ctx, "unknown", []byte("ignored")))
+	assert.Success(t, "send", sender.SendExtension(ctx, "echo", []byte("hello")))
+	select {
+	case reply := <-replies:
+		assert.Equal(t, "reply", "echo:HELLO", reply)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for reply")
+	}
+
+	assert.Success(t, "close stdin", process.Stdin().Close())
+	assert.Success(t, "wait", process.Wait())
+}
@@ -0,0 +1,100 @@
+package wsep
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Health statuses.
+const (
+	// HealthOK means the server is fully functional.
+	HealthOK = "ok"
+	// HealthDegraded means the server runs commands but lacks something, as
+	// listed in Health.Degraded.
+	HealthDegraded = "degraded"
+	// HealthUnavailable means the server cannot reach its execer to run
+	// commands.
+	HealthUnavailable = "unavailable"
+)
+
+// DegradedNoSessions is reported in Health.Degraded when screen is missing, so
+// TTY commands run without a session and end with their connection.
+const DegradedNoSessions = "sessions_not_persistent"
+
+// healthTimeout bounds checking the execer for a health check.
+const healthTimeout = 5 * time.Second
+
+// Health is the state of a server as reported by Server.HealthHandler.
+type Health struct {
+	// Status is HealthOK, HealthDegraded or HealthUnavailable.
+	Status string `json:"status"`
+	// Sessions and Connections count the sessions the server holds and the
+	// connections it is serving.
+	Sessions    int `json:"sessions"`
+	Connections int `json:"connections"`
+	// SlowConsumers is Server.SlowConsumerCount.
+	SlowConsumers int64 `json:"slow_consumers"`
+	// Screen is whether screen was found through the execer to keep sessions.
+	Screen bool `json:"screen"`
+	// Degraded lists what the server is doing without, such as
+	// DegradedNoSessions.
+	Degraded []string `json:"degraded,omitempty"`
+	// Error is why the execer could not be reached if the server is
+	// unavailable.
+	Error string `json:"error,omitempty"`
+}
+
+// Health checks the server and the execer it serves commands with.  Looking
+// for screen through a remote execer runs a command, so this is not free.
+func (srv *Server) Health(ctx context.Context, execer Execer) Health {
+	health := Health{
+		Status:        HealthOK,
+		Sessions:      srv.SessionCount(),
+		Connections:   srv.connections.count(),
+		SlowConsumers: srv.SlowConsumerCount(),
+	}
+	err := lookScreen(ctx, execer)
+	var exitErr ExitError
+	_, remote := execer.(remoteFS)
+	switch {
+	case err == nil:
+		health.Screen = true
+	case remote && !xerrors.As(err, &exitErr):
+		// The lookup failed to run at all rather than finding nothing.
+		health.Status = HealthUnavailable
+		health.Error = err.Error()
+	default:
+		health.Status = HealthDegraded
+		health.Degraded = append(health.Degraded, DegradedNoSessions)
+	}
+	return health
+}
+
+// HealthHandler returns an HTTP handler that responds to GET with the Health
+// of the server as JSON, for orchestrators to probe agents with.  The status
+// is 200 OK unless the server is unavailable, which is 503 Service
+// Unavailable, so a degraded server still passes a plain readiness check.
+func (srv *Server) HealthHandler(execer Execer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method must be GET", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		defer cancel()
+		health := srv.Health(ctx, execer)
+		status := http.StatusOK
+		if health.Status == HealthUnavailable {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(health)
+	})
+}
@@ -0,0 +1,57 @@
+package wsep
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestHealthHandler(t *testing.T) {
+	t.Parallel()
+
+	get := func(t *testing.T, handler http.Handler) (int, Health) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var health Health
+		err := json.NewDecoder(rec.Body).Decode(&health)
+		assert.Success(t, "decode", err)
+		return rec.Code, health
+	}
+
+	t.Run("Local", func(t *testing.T) {
+		t.Parallel()
+		status, health := get(t, newServer(t).HealthHandler(LocalExecer{}))
+		assert.Equal(t, "status", http.StatusOK, status)
+		assert.Equal(t, "sessions", 0, health.Sessions)
+		if _, err := exec.LookPath("screen"); err == nil {
+			assert.Equal(t, "health", HealthOK, health.Status)
+			assert.True(t, "screen", health.Screen)
+		} else {
+			assert.Equal(t, "health", HealthDegraded, health.Status)
+			assert.Equal(t, "degraded", []string{DegradedNoSessions}, health.Degraded)
+		}
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		t.Parallel()
+		server := newServer(t)
+		execer := DockerExecer{Container: "test", Host: "unix://" + filepath.Join(tempDir(t), "missing.sock")}
+
+		status, health := get(t, server.HealthHandler(execer))
+		assert.Equal(t, "status", http.StatusServiceUnavailable, status)
+		assert.Equal(t, "health", HealthUnavailable, health.Status)
+		assert.True(t, "error", health.Error != "")
+	})
+
+	t.Run("Method", func(t *testing.T) {
+		t.Parallel()
+		rec := httptest.NewRecorder()
+		newServer(t).HealthHandler(LocalExecer{}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/healthz", nil))
+		assert.Equal(t, "status", http.StatusMethodNotAllowed, rec.Code)
+	})
+}
@@ -0,0 +1,166 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// http2ContentType identifies a wsep stream carried in an HTTP/2 request.
+const http2ContentType = "application/x-wsep-stream"
+
+// ServeHTTP2 runs the server-side of wsep over the bodies of an HTTP/2 request
+// and its response, for use with DialHTTP2 where WebSockets are blocked.  It
+// must be called from an http.Handler and the handler must not return until
+// ServeHTTP2 yields.  Since the request is the only carrier, HTTP/1 requests
+// are rejected; use Serve for those.
+func (srv *Server) ServeHTTP2(w http.ResponseWriter, r *http.Request, execer Execer, options *Options) error {
+	if r.ProtoMajor != 2 {
+		// Closing the connection spares reading the rest of a body that an
+		// HTTP/1 client may still be streaming.
+		w.Header().Set("Connection", "close")
+		http.Error(w, "HTTP/2 is required", http.StatusHTTPVersionNotSupported)
+		return xerrors.Errorf("unsupported protocol %s", r.Proto)
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return xerrors.New("response writer does not support flushing")
+	}
+	release, err := srv.connections.admit(r.RemoteAddr, options)
+	if err != nil {
+		newConnSummary(r.RemoteAddr).record(options, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return err
+	}
+	defer release()
+	w.Header().Set("Content-Type", http2ContentType)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	c := newStreamConn(&http2Stream{
+		body:    r.Body,
+		writer:  w,
+		flusher: flusher,
+	})
+	err = srv.serve(r.Context(), c, r.RemoteAddr, execer, options)
+	closeWithError(c, err)
+	return err
+}
+
+// http2Stream joins a request body and response writer into a stream.
+type http2Stream struct {
+	body    io.ReadCloser
+	writer  io.Writer
+	flusher http.Flusher
+
+	// mutex guards closed since the response writer must not be used once the
+	// handler returns, which may race with output still being copied.
+	mutex  sync.Mutex
+	closed bool
+}
+
+func (s *http2Stream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *http2Stream) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := s.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	s.flusher.Flush()
+	return n, nil
+}
+
+func (s *http2Stream) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.body.Close()
+}
+
+// DialHTTP2 starts a wsep stream as an HTTP/2 request to a server running
+// ServeHTTP2.  The client must negotiate HTTP/2, which the default client does
+// for https URLs; if it is nil http.DefaultClient is used.  The context only
+// bounds establishing the stream.  Like RemoteExecer the returned execer can
+// start a single command and closing the process ends the request.
+func DialHTTP2(ctx context.Context, url string, client *http.Client) (Execer, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	// The request lives as long as the stream so it cannot use ctx directly.
+	// The request body must be closed on failure too, or an HTTP/1 transport
+	// stays blocked writing it.
+	reqCtx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	fail := func(err error) error {
+		_ = pw.CloseWithError(err)
+		cancel()
+		return err
+	}
+	dialed := make(chan struct{})
+	defer close(dialed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = pw.CloseWithError(ctx.Err())
+			cancel()
+		case <-dialed:
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, url, pr)
+	if err != nil {
+		return nil, fail(err)
+	}
+	req.Header.Set("Content-Type", http2ContentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fail(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		_ = resp.Body.Close()
+		return nil, fail(xerrors.Errorf("unexpected response %s over %s", resp.Status, resp.Proto))
+	}
+
+	return RemoteStreamExecer(&http2ClientStream{
+		body:   resp.Body,
+		pipe:   pw,
+		cancel: cancel,
+	}), nil
+}
+
+// http2ClientStream joins a request body pipe and response body into a stream.
+type http2ClientStream struct {
+	body   io.ReadCloser
+	pipe   *io.PipeWriter
+	cancel func()
+}
+
+func (s *http2ClientStream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *http2ClientStream) Write(p []byte) (int, error) {
+	return s.pipe.Write(p)
+}
+
+func (s *http2ClientStream) Close() error {
+	err := s.pipe.Close()
+	_ = s.body.Close()
+	s.cancel()
+	return err
+}
@@ -0,0 +1,42 @@
+package wsep
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestHTTP2Exec(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	wsepServer := newServer(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = wsepServer.ServeHTTP2(w, r, LocalExecer{}, nil)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	execer, err := DialHTTP2(ctx, server.URL, server.Client())
+	assert.Success(t, "dial", err)
+	testExecer(ctx, t, execer)
+
+	execer, err = DialHTTP2(ctx, server.URL, server.Client())
+	assert.Success(t, "dial", err)
+	testExecerFail(ctx, t, execer)
+
+	// HTTP/1 requests are rejected.
+	http1 := httptest.NewTLSServer(server.Config.Handler)
+	defer http1.Close()
+	dialCtx, dialCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer dialCancel()
+	_, err = DialHTTP2(dialCtx, http1.URL, http1.Client())
+	assert.Error(t, "dial http/1", err)
+	assert.Success(t, "rejected before the deadline", dialCtx.Err())
+}
@@ -0,0 +1,131 @@
+package wsep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultIdleWarning is how long before closing an idle shell the countdown
+	// starts.
+	defaultIdleWarning = time.Minute
+	// idlePollInterval is how often idle shells are checked.
+	idlePollInterval = time.Second
+	// idleCountdownInterval is how often the countdown is repeated.
+	idleCountdownInterval = 10 * time.Second
+)
+
+// prompter is implemented by processes that can tell whether a shell is
+// waiting at its prompt rather than running a job.
+type prompter interface {
+	atPrompt() bool
+}
+
+// idleTracker records when a TTY last saw input or output.  A nil tracker
+// tracks nothing.
+type idleTracker struct {
+	// last is the time of the last activity in nanoseconds and must be
+	// accessed atomically.
+	last int64
+	// paused is non-zero while idle time should not accrue and must be
+	// accessed atomically.
+	paused int32
+}
+
+func newIdleTracker() *idleTracker {
+	return &idleTracker{last: time.Now().UnixNano()}
+}
+
+// touch records activity.
+func (t *idleTracker) touch() {
+	if t == nil {
+		return
+	}
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+// pause stops or resumes accruing idle time.  Resuming counts as activity.
+func (t *idleTracker) pause(paused bool) {
+	if t == nil {
+		return
+	}
+	if paused {
+		atomic.StoreInt32(&t.paused, 1)
+	} else {
+		t.touch()
+		atomic.StoreInt32(&t.paused, 0)
+	}
+}
+
+// idleFor returns how long it has been since the last activity.
+func (t *idleTracker) idleFor() time.Duration {
+	if atomic.LoadInt32(&t.paused) != 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&t.last)))
+}
+
+// reader records activity whenever r produces output.
+func (t *idleTracker) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return idleReader{tracker: t, r: r}
+}
+
+type idleReader struct {
+	tracker *idleTracker
+	r       io.Reader
+}
+
+func (i idleReader) Read(p []byte) (int, error) {
+	n, err := i.r.Read(p)
+	if n > 0 {
+		i.tracker.touch()
+	}
+	return n, err
+}
+
+// cullIdle calls cull once the process has sat idle at its prompt for the
+// timeout, writing a countdown to the terminal during the final warning
+// period.  Processes that cannot tell whether they are at a prompt are judged
+// on activity alone.  Any activity cancels the countdown.
+func cullIdle(ctx context.Context, process Process, tracker *idleTracker, terminal io.Writer, timeout, warning time.Duration, cull func()) {
+	if warning <= 0 {
+		warning = defaultIdleWarning
+	}
+	if warning > timeout {
+		warning = timeout
+	}
+	p, canPrompt := process.(prompter)
+
+	ticker := time.NewTicker(idlePollInterval)
+	defer ticker.Stop()
+	var lastShown time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		idle := tracker.idleFor()
+		if idle < timeout-warning || (canPrompt && !p.atPrompt()) {
+			lastShown = 0
+			continue
+		}
+		remaining := timeout - idle
+		if remaining <= 0 {
+			_, _ = fmt.Fprint(terminal, "\r\nwsep: closing idle shell\r\n")
+			cull()
+			return
+		}
+		if lastShown == 0 || lastShown-remaining >= idleCountdownInterval {
+			lastShown = remaining
+			_, _ = fmt.Fprintf(terminal, "\r\nwsep: idle shell will close in %ds, press any key to keep it open\r\n", int(remaining.Round(time.Second).Seconds()))
+		}
+	}
+}
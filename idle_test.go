@@ -0,0 +1,60 @@
+package wsep
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestIdleCull(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, &Options{
+		IdleTimeout: 3 * time.Second,
+		IdleWarning: 2 * time.Second,
+	})
+	defer server.Close()
+
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command: "sh",
+		TTY:     true,
+		Stdin:   true,
+		Rows:    defaultRows,
+		Cols:    defaultCols,
+		Env:     []string{"TERM=xterm"},
+	})
+	assert.Success(t, "start sh", err)
+
+	var warned, closed bool
+	scanner := bufio.NewScanner(process.Stdout())
+	for scanner.Scan() {
+		line := scanner.Text()
+		warned = warned || strings.Contains(line, "idle shell will close in")
+		closed = closed || strings.Contains(line, "closing idle shell")
+	}
+	assert.True(t, "countdown shown", warned)
+	assert.True(t, "close shown", closed)
+	// The connection is closed so how the process exited is not reported.
+	_ = process.Wait()
+}
+
+func TestIdleTracker(t *testing.T) {
+	t.Parallel()
+
+	tracker := newIdleTracker()
+	tracker.last = time.Now().Add(-time.Hour).UnixNano()
+	assert.True(t, "idle", tracker.idleFor() >= time.Hour)
+	_, _ = tracker.reader(strings.NewReader("output")).Read(make([]byte, 8))
+	assert.True(t, "active after output", tracker.idleFor() < time.Minute)
+
+	var nilTracker *idleTracker
+	nilTracker.touch()
+	r := strings.NewReader("output")
+	assert.True(t, "nil tracker passes reader through", nilTracker.reader(r) == r)
+}
@@ -0,0 +1,111 @@
+package wsep
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// inputTaker is implemented by processes that can take a session's input lock.
+type inputTaker interface {
+	TakeInput(ctx context.Context) error
+}
+
+// TakeInput takes the input lock of the session the process is attached to,
+// which must have been created by a command with ExclusiveInput set, from
+// whichever client holds it.  Only processes started by remote execers can
+// take the lock.
+func TakeInput(ctx context.Context, p Process) error {
+	t, ok := p.(inputTaker)
+	if !ok {
+		return xerrors.Errorf("%T cannot take input", p)
+	}
+	return t.TakeInput(ctx)
+}
+
+// inputLock lets one of the connections attached to a session send input at a
+// time so that people sharing the session do not garble each other's typing.
+// The others only watch until one of them takes the lock over.
+type inputLock struct {
+	mutex  sync.Mutex
+	holder *inputClient
+	// clients are the connections taking part, longest attached first.
+	clients []*inputClient
+}
+
+// inputClient is a connection taking part in an input lock.  A nil client is
+// not subject to any lock and may always send input.
+type inputClient struct {
+	lock *inputLock
+	// notify is called with whether the client holds the lock when it joins
+	// and whenever that changes.  It is called with the lock's mutex held.
+	notify func(holder bool)
+}
+
+// join adds a connection to the lock, giving it the lock if nobody holds it.
+func (l *inputLock) join(notify func(holder bool)) *inputClient {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	c := &inputClient{lock: l, notify: notify}
+	l.clients = append(l.clients, c)
+	if l.holder == nil {
+		l.holder = c
+	}
+	c.notify(l.holder == c)
+	return c
+}
+
+// leave removes the connection from the lock.  If it held the lock, the lock
+// passes to the connection that has been attached the longest.
+func (c *inputClient) leave() {
+	if c == nil {
+		return
+	}
+	l := c.lock
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i, client := range l.clients {
+		if client == c {
+			l.clients = append(l.clients[:i], l.clients[i+1:]...)
+			break
+		}
+	}
+	if l.holder != c {
+		return
+	}
+	l.holder = nil
+	if len(l.clients) > 0 {
+		l.holder = l.clients[0]
+		l.holder.notify(true)
+	}
+}
+
+// take gives the connection the lock, taking it from whoever holds it.
+func (c *inputClient) take() {
+	if c == nil {
+		return
+	}
+	l := c.lock
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.holder == c {
+		return
+	}
+	if l.holder != nil {
+		l.holder.notify(false)
+	}
+	l.holder = c
+	c.notify(true)
+}
+
+// mayWrite returns whether the connection may send input.
+func (c *inputClient) mayWrite() bool {
+	if c == nil {
+		return true
+	}
+	l := c.lock
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.holder == c
+}
@@ -0,0 +1,40 @@
+package wsep
+
+import (
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestInputLock(t *testing.T) {
+	t.Parallel()
+
+	lock := &inputLock{}
+	held := map[string]bool{}
+	join := func(name string) *inputClient {
+		return lock.join(func(holder bool) {
+			held[name] = holder
+		})
+	}
+
+	first := join("first")
+	second := join("second")
+	third := join("third")
+	assert.True(t, "first holds", held["first"] && first.mayWrite())
+	assert.True(t, "second watches", !held["second"] && !second.mayWrite())
+
+	third.take()
+	assert.True(t, "third took over", held["third"] && third.mayWrite())
+	assert.True(t, "first lost", !held["first"] && !first.mayWrite())
+
+	// The lock passes to the connection attached longest.
+	third.leave()
+	assert.True(t, "first holds again", held["first"] && first.mayWrite())
+
+	// Leaving without the lock does not move it.
+	second.leave()
+	assert.True(t, "first still holds", first.mayWrite())
+
+	var unlocked *inputClient
+	assert.True(t, "no lock", unlocked.mayWrite())
+}
@@ -0,0 +1,27 @@
+// Command gencodes writes the registry of wsep error and warning codes as JSON
+// for consumers that cannot import the Go package.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"go.coder.com/flog"
+
+	"cdr.dev/wsep"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		flog.Fatal("usage: gencodes <output>")
+	}
+	byt, err := json.MarshalIndent(wsep.Codes(), "", "  ")
+	if err != nil {
+		flog.Fatal("failed to marshal codes: %v", err)
+	}
+	err = ioutil.WriteFile(os.Args[1], append(byt, '\n'), 0o644)
+	if err != nil {
+		flog.Fatal("failed to write codes: %v", err)
+	}
+}
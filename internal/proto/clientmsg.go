@@ -6,22 +6,186 @@ const (
 	TypeResize     = "resize"
 	TypeStdin      = "stdin"
 	TypeCloseStdin = "close_stdin"
+	TypeSignal     = "signal"
+	// TypeAck acknowledges the output of a command with Acknowledged set.
+	TypeAck = "ack"
+	// TypeTakeInput takes the input lock of a session with ExclusiveInput set
+	// from whichever client holds it.
+	TypeTakeInput = "take_input"
+	// TypeTerminalModes changes the modes of a TTY command's terminal.
+	TypeTerminalModes = "terminal_modes"
+	// TypeTransferSession is an administrative message that does not start a
+	// command.  The server responds with TypeResult.
+	TypeTransferSession = "transfer_session"
+	// TypeShareSession is an administrative message like TypeTransferSession.
+	// The server responds with TypeResult carrying a share token.
+	TypeShareSession = "share_session"
+	// TypeValidate is an administrative message like TypeTransferSession that
+	// checks whether a command could start without starting it.  The server
+	// responds with TypeResult carrying the validation.
+	TypeValidate = "validate"
+	// TypeUpload starts writing a file.  It is followed by any number of
+	// TypeFileData messages then TypeFileEnd, after which the server responds
+	// with TypeResult.
+	TypeUpload  = "upload"
+	TypeFileEnd = "file_end"
+	// TypeDownload requests the contents of a file.  The server responds with
+	// TypeFileInfo, any number of TypeFileData messages, then TypeResult.
+	TypeDownload = "download"
+	// TypeJournal requests the journaled output of a session.  The server
+	// responds like a download.
+	TypeJournal = "journal"
+	// TypeChecksums requests the checksums of every file under a directory.
+	// The server responds like a download where the file data is a list of
+	// checksums in sha256sum format.
+	TypeChecksums = "checksums"
 )
 
-// ClientResizeHeader specifies a terminal window resize request
+// TypeExtension carries an application-defined payload in its body.  It may be
+// sent by either side at any time and is handled by whatever the receiver
+// registered for the namespace.
+const TypeExtension = "extension"
+
+// ExtensionHeader identifies the namespace of an extension message.
+type ExtensionHeader struct {
+	Type      string `json:"type"`
+	Namespace string `json:"namespace"`
+}
+
+// TypeFileData carries a chunk of a file in its body.  It is sent by the client
+// during an upload and by the server during a download.
+const TypeFileData = "file_data"
+
+// ClientResizeHeader specifies a terminal window resize request.  If Seq is
+// set, the server answers with TypeResized carrying the same Seq once the
+// resize is applied or fails.
 type ClientResizeHeader struct {
 	Type string `json:"type"`
 	Rows uint16 `json:"rows"`
 	Cols uint16 `json:"cols"`
+	Seq  uint64 `json:"seq,omitempty"`
 }
 
-// ClientStartHeader specifies a request to start command
-type ClientStartHeader struct {
+// ClientControlHeader holds the Seq any message other than stdin or file data
+// may carry.  An error the message causes echoes it, and control messages
+// other than resize with Seq set are answered with TypeAcked carrying it.
+type ClientControlHeader struct {
+	Type string `json:"type"`
+	Seq  uint64 `json:"seq,omitempty"`
+}
+
+// ClientSignalHeader asks for a signal to be sent to the command.  Signal is
+// "interrupt", "terminate" or "kill".
+type ClientSignalHeader struct {
+	Type   string `json:"type"`
+	Signal string `json:"signal"`
+	Seq    uint64 `json:"seq,omitempty"`
+}
+
+// ClientTerminalModesHeader changes the modes of the command's terminal.
+type ClientTerminalModesHeader struct {
+	Type  string            `json:"type"`
+	Modes map[string]uint32 `json:"modes"`
+	Seq   uint64            `json:"seq,omitempty"`
+}
+
+// ClientAckHeader acknowledges the output before these offsets in each stream.
+type ClientAckHeader struct {
+	Type   string `json:"type"`
+	Stdout int64  `json:"stdout"`
+	Stderr int64  `json:"stderr"`
+}
+
+// ClientTransferSessionHeader requests a change of a session's owner.
+type ClientTransferSessionHeader struct {
+	Type  string `json:"type"`
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+}
+
+// ClientShareSessionHeader requests a token that lets connections with another
+// owner attach to a session.  ExpiresIn is in seconds; zero means the token
+// lasts as long as the session and negative values are refused.
+type ClientShareSessionHeader struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	ReadOnly  bool   `json:"read_only,omitempty"`
+	ExpiresIn int64  `json:"expires_in,omitempty"`
+}
+
+// ClientValidateHeader asks whether a command could start.
+type ClientValidateHeader struct {
 	Type    string  `json:"type"`
-	ID      string  `json:"id"`
 	Command Command `json:"command"`
 }
 
+// ClientUploadHeader requests writing a file.  Mode is the file's permission
+// bits.
+type ClientUploadHeader struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	Mode uint32 `json:"mode"`
+	UID  uint32 `json:"uid"`
+	GID  uint32 `json:"gid"`
+}
+
+// ClientFileEndHeader ends an upload.  If Abort is set the file is discarded.
+type ClientFileEndHeader struct {
+	Type  string `json:"type"`
+	Abort bool   `json:"abort,omitempty"`
+}
+
+// ClientDownloadHeader requests reading a file.
+type ClientDownloadHeader struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	UID  uint32 `json:"uid"`
+	GID  uint32 `json:"gid"`
+}
+
+// ClientJournalHeader requests the journal of the session with the ID.
+type ClientJournalHeader struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// ClientChecksumsHeader requests the checksums of the files under a directory.
+type ClientChecksumsHeader struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	UID  uint32 `json:"uid"`
+	GID  uint32 `json:"gid"`
+}
+
+// ClientStartHeader specifies a request to start command.  Resume, if set,
+// re-attaches to the command without a TTY with the same ID instead of
+// starting one.  Observe attaches to the existing TTY session with the ID
+// read-only, receiving its output without being able to send input.  Token
+// is a share token that lets the client attach to a session with another
+// owner.
+type ClientStartHeader struct {
+	Type    string         `json:"type"`
+	ID      string         `json:"id"`
+	Command Command        `json:"command"`
+	Resume  *ResumeOffsets `json:"resume,omitempty"`
+	Observe bool           `json:"observe,omitempty"`
+	Token   string         `json:"token,omitempty"`
+	// Term and ColorTerm describe the client's terminal and become the TERM
+	// and COLORTERM of a TTY command.
+	Term      string `json:"term,omitempty"`
+	ColorTerm string `json:"color_term,omitempty"`
+	// Locale holds the client's locale variables, which are passed on to the
+	// command if the server accepts them.
+	Locale []string `json:"locale,omitempty"`
+}
+
+// ResumeOffsets are how many bytes of each output stream a client already has
+// so that output is replayed from there.
+type ResumeOffsets struct {
+	Stdout int64 `json:"stdout"`
+	Stderr int64 `json:"stderr"`
+}
+
 // Command represents a runnable command.
 type Command struct {
 	Command    string   `json:"command"`
@@ -34,4 +198,45 @@ type Command struct {
 	GID        uint32   `json:"gid"`
 	Env        []string `json:"env"`
 	WorkingDir string   `json:"working_dir"`
+	AppHint    string   `json:"app_hint,omitempty"`
+	// RelayClipboard asks for OSC 52 sequences in TTY output to be sent as
+	// clipboard messages instead.
+	RelayClipboard bool `json:"relay_clipboard,omitempty"`
+	// RelayBell asks for BEL characters in TTY output to be sent as bell
+	// messages instead.
+	RelayBell bool `json:"relay_bell,omitempty"`
+	// RelayNotify asks for OSC 9 and OSC 777 notifications in TTY output to be
+	// sent as notify messages instead.
+	RelayNotify bool `json:"relay_notify,omitempty"`
+	// Timestamps asks for stdout and stderr messages to carry the time the
+	// output was read so it can be re-emitted with the same pacing.
+	Timestamps bool `json:"timestamps,omitempty"`
+	// BinaryData offers to exchange stdin, stdout and stderr as binary data
+	// frames.  They are only used if the server accepts in its pid message.
+	BinaryData bool `json:"binary_data,omitempty"`
+	// LowLatency asks for TTY output to be sent as soon as it is read rather
+	// than coalesced.
+	LowLatency bool `json:"low_latency,omitempty"`
+	// Acknowledged asks for the output of a command without a TTY but with an
+	// ID to be kept until the client acknowledges it rather than dropping the
+	// oldest, pausing the command while too much is unacknowledged.
+	Acknowledged bool `json:"acknowledged,omitempty"`
+	// StdoutFile and StderrFile redirect output to files where the command
+	// runs, and TeeOutput streams it as well.
+	StdoutFile string `json:"stdout_file,omitempty"`
+	StderrFile string `json:"stderr_file,omitempty"`
+	TeeOutput  bool   `json:"tee_output,omitempty"`
+	// DiscardOutput asks the server not to send stdout or stderr at all.
+	DiscardOutput bool `json:"discard_output,omitempty"`
+	// LineBuffered asks for the output of a command without a TTY to be sent
+	// in whole lines.
+	LineBuffered bool `json:"line_buffered,omitempty"`
+	// ExclusiveInput, on the command that creates a session, lets only one
+	// attached client at a time send input.
+	ExclusiveInput bool `json:"exclusive_input,omitempty"`
+	// Shell runs Command as a script through the user's shell.
+	Shell bool `json:"shell,omitempty"`
+	// TerminalModes are the initial modes of a TTY command's terminal by
+	// name, such as "echo" or "verase".
+	TerminalModes map[string]uint32 `json:"terminal_modes,omitempty"`
 }
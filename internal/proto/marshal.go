@@ -0,0 +1,121 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// The headers of stdin, stdout and stderr messages are encoded and decoded by
+// hand since one is handled for every chunk of data and reflection would
+// dominate the cost of a busy session.  Decoding only takes the fast path for
+// headers in the form encoding/json produces and falls back to encoding/json
+// for anything else.
+
+// typePrefix starts every header encoding/json marshals from this package.
+const typePrefix = `{"type":"`
+
+// timeField follows the type of a timestamped output header.
+const timeField = `,"time":`
+
+// offsetField follows the type or time of an output header with an offset.
+const offsetField = `,"offset":`
+
+// ParseType returns the type of a message header.  Headers with other fields
+// are validated with encoding/json but callers must still decode them into the
+// header's own type to read those fields.
+func ParseType(header []byte) (string, error) {
+	typ, rest, ok := scanType(header)
+	if ok && len(rest) == 1 && rest[0] == '}' {
+		return typ, nil
+	}
+	var h Header
+	err := json.Unmarshal(header, &h)
+	return h.Type, err
+}
+
+// ParseOutputHeader decodes the header of a stdout or stderr message.
+func ParseOutputHeader(header []byte) (ServerOutputHeader, error) {
+	typ, rest, ok := scanType(header)
+	if ok && len(rest) == 1 && rest[0] == '}' {
+		return ServerOutputHeader{Type: typ}, nil
+	}
+	if ok && bytes.HasPrefix(rest, []byte(timeField)) && rest[len(rest)-1] == '}' {
+		digits := rest[len(timeField) : len(rest)-1]
+		time, err := strconv.ParseInt(string(digits), 10, 64)
+		// Only numbers in the form encoding/json writes them take the fast path
+		// since ParseInt accepts some that JSON does not, like "+1" and "01".
+		if err == nil && string(strconv.AppendInt(nil, time, 10)) == string(digits) {
+			return ServerOutputHeader{Type: typ, Time: time}, nil
+		}
+	}
+	var h ServerOutputHeader
+	err := json.Unmarshal(header, &h)
+	return h, err
+}
+
+// WriteOutput writes a stdout or stderr message with the header to w in a
+// single write.
+func WriteOutput(w io.Writer, header ServerOutputHeader, body []byte) error {
+	bufp := messagePool.Get().(*[]byte)
+	prefix := append(appendOutputHeader((*bufp)[:0], header), delimiter)
+	err := writeMessage(w, prefix, body)
+	*bufp = prefix
+	messagePool.Put(bufp)
+	return err
+}
+
+// appendOutputHeader appends a ServerOutputHeader to dst exactly as
+// encoding/json would marshal it.  The type must not need escaping, which holds
+// for every message type.
+func appendOutputHeader(dst []byte, header ServerOutputHeader) []byte {
+	dst = append(append(append(dst, typePrefix...), header.Type...), '"')
+	if header.Time != 0 {
+		dst = strconv.AppendInt(append(dst, timeField...), header.Time, 10)
+	}
+	if header.Offset != 0 {
+		dst = strconv.AppendInt(append(dst, offsetField...), header.Offset, 10)
+	}
+	return append(dst, '}')
+}
+
+// scanType reads the type from the start of a header in the form encoding/json
+// marshals it and returns the rest of the header after it.  ok is false if the
+// header is in any other form.
+func scanType(header []byte) (typ string, rest []byte, ok bool) {
+	if !bytes.HasPrefix(header, []byte(typePrefix)) {
+		return "", nil, false
+	}
+	header = header[len(typePrefix):]
+	end := bytes.IndexByte(header, '"')
+	if end == -1 {
+		return "", nil, false
+	}
+	// Leave escapes, control characters and anything beyond ASCII, which
+	// encoding/json would validate or transform, to encoding/json.
+	for _, c := range header[:end] {
+		if c < 0x20 || c >= 0x80 || c == '\\' {
+			return "", nil, false
+		}
+	}
+	rest = header[end+1:]
+	if len(rest) == 0 || (rest[0] != ',' && rest[0] != '}') {
+		return "", nil, false
+	}
+	return internType(header[:end]), rest, true
+}
+
+// internType converts a type to a string without allocating for the types
+// sent with every chunk of data.
+func internType(b []byte) string {
+	switch string(b) {
+	case TypeStdin:
+		return TypeStdin
+	case TypeStdout:
+		return TypeStdout
+	case TypeStderr:
+		return TypeStderr
+	}
+	return string(b)
+}
@@ -0,0 +1,102 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAppendOutputHeader(t *testing.T) {
+	for _, header := range []ServerOutputHeader{
+		{Type: TypeStdout},
+		{Type: TypeStderr, Time: 1600000000000},
+		{Type: TypeStdout, Time: -1},
+		{Type: TypeStdout, Offset: 65536},
+		{Type: TypeStderr, Time: 1600000000000, Offset: 12},
+	} {
+		expected, err := json.Marshal(header)
+		assert.Success(t, "marshal header", err)
+		assert.Equal(t, "matches encoding/json", string(expected), string(appendOutputHeader(nil, header)))
+
+		parsed, err := ParseOutputHeader(expected)
+		assert.Success(t, "parse header", err)
+		assert.Equal(t, "round trips", header, parsed)
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	err := WriteOutput(b, ServerOutputHeader{Type: TypeStdout, Time: 42, Offset: 7}, []byte("body"))
+	assert.Success(t, "write output", err)
+
+	header, body := SplitMessage(b.Bytes())
+	assert.Equal(t, "header", `{"type":"stdout","time":42,"offset":7}`, string(header))
+	assert.Equal(t, "body", []byte("body"), body, cmp.Comparer(bytes.Equal))
+}
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		typ    string
+		err    bool
+	}{
+		{name: "Fast", header: `{"type":"stdout"}`, typ: TypeStdout},
+		{name: "FastWithFields", header: `{"type":"resize","rows":24,"cols":80}`, typ: TypeResize},
+		{name: "Spaces", header: `{ "type": "stdin" }`, typ: TypeStdin},
+		{name: "TypeLast", header: `{"rows":24,"type":"resize"}`, typ: TypeResize},
+		{name: "Escaped", header: `{"type":"std\u006fut"}`, typ: TypeStdout},
+		{name: "Missing", header: `{}`, typ: ""},
+		{name: "Invalid", header: `{"type":`, err: true},
+		{name: "Empty", header: ``, err: true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			typ, err := ParseType([]byte(test.header))
+			if test.err {
+				assert.Error(t, "parse type", err)
+				return
+			}
+			assert.Success(t, "parse type", err)
+			assert.Equal(t, "type", test.typ, typ)
+		})
+	}
+}
+
+func BenchmarkParseType(b *testing.B) {
+	header := []byte(`{"type":"stdout"}`)
+	b.Run("Hand", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = ParseType(header)
+		}
+	})
+	b.Run("JSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var h Header
+			_ = json.Unmarshal(header, &h)
+		}
+	})
+}
+
+func BenchmarkAppendOutputHeader(b *testing.B) {
+	var buf []byte
+	header := ServerOutputHeader{Type: TypeStdout, Time: 1600000000000}
+	b.Run("Hand", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf = appendOutputHeader(buf[:0], header)
+		}
+	})
+	b.Run("JSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf, _ = json.Marshal(header)
+		}
+	})
+}
@@ -3,6 +3,8 @@ package proto
 import (
 	"bytes"
 	"io"
+	"net"
+	"sync"
 )
 
 // Header is a generic JSON header.
@@ -27,24 +29,120 @@ func SplitMessage(b []byte) (header []byte, body []byte) {
 	return header, body
 }
 
+// BuffersWriter is implemented by writers that can write several buffers as a
+// single message without joining them first, for example with vectored I/O.
+type BuffersWriter interface {
+	WriteBuffers(bufs net.Buffers) error
+}
+
+// minBuffersSize is the smallest body written as separate buffers to a
+// BuffersWriter.  Smaller messages are cheaper to join than to write in parts.
+const minBuffersSize = 4096
+
 type headerWriter struct {
-	w      io.Writer
+	w io.Writer
+	// header includes the delimiter.
 	header []byte
 }
 
-// WithHeader adds the given header to all writes
+// messagePool holds buffers for assembling messages so that writing output does
+// not allocate a new message for every chunk.
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// WithHeader adds the given header to all writes.  If w is a BuffersWriter
+// large bodies are written alongside the header without being copied.
+// Otherwise the message passed to w is reused once Write returns so w must not
+// retain it, as io.Writer requires.
 func WithHeader(w io.Writer, header []byte) io.Writer {
 	return headerWriter{
-		header: header,
+		header: append(header[:len(header):len(header)], delimiter),
 		w:      w,
 	}
 }
 
 func (h headerWriter) Write(b []byte) (int, error) {
-	msg := append(append(h.header, delimiter), b...)
-	_, err := h.w.Write(msg)
+	err := writeMessage(h.w, h.header, b)
 	if err != nil {
 		return 0, err
 	}
 	return len(b), nil
 }
+
+// writeMessage writes prefix followed by body as a single message to w.
+func writeMessage(w io.Writer, prefix, body []byte) error {
+	if bw, ok := w.(BuffersWriter); ok && len(body) >= minBuffersSize {
+		return bw.WriteBuffers(net.Buffers{prefix, body})
+	}
+	bufp := messagePool.Get().(*[]byte)
+	msg := append(append((*bufp)[:0], prefix...), body...)
+	_, err := w.Write(msg)
+	*bufp = msg
+	messagePool.Put(bufp)
+	return err
+}
+
+// Binary data frames carry stream data without a JSON header.  The first byte
+// of the message is the frame type and the rest is the data.  A JSON header
+// always starts with '{' so the two cannot be confused.  They are only sent
+// once both ends have agreed to with Command.BinaryData and
+// ServerPidHeader.BinaryData.
+const (
+	frameStdin byte = iota + 1
+	frameStdout
+	frameStderr
+)
+
+type dataFrameWriter struct {
+	w io.Writer
+	// frame holds the single frame type byte.
+	frame []byte
+}
+
+// WithDataFrame sends each write as a binary data frame of the given type,
+// which must be TypeStdin, TypeStdout or TypeStderr.  Like WithHeader the
+// message passed to w is reused once Write returns.
+func WithDataFrame(w io.Writer, typ string) io.Writer {
+	var frame byte
+	switch typ {
+	case TypeStdin:
+		frame = frameStdin
+	case TypeStdout:
+		frame = frameStdout
+	case TypeStderr:
+		frame = frameStderr
+	default:
+		panic("no data frame for message type " + typ)
+	}
+	return dataFrameWriter{w: w, frame: []byte{frame}}
+}
+
+func (d dataFrameWriter) Write(b []byte) (int, error) {
+	err := writeMessage(d.w, d.frame, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ParseDataFrame returns the message type and data of a binary data frame.  ok
+// is false if the message has a JSON header instead.
+func ParseDataFrame(b []byte) (typ string, data []byte, ok bool) {
+	if len(b) == 0 {
+		return "", nil, false
+	}
+	switch b[0] {
+	case frameStdin:
+		typ = TypeStdin
+	case frameStdout:
+		typ = TypeStdout
+	case frameStderr:
+		typ = TypeStderr
+	default:
+		return "", nil, false
+	}
+	return typ, b[1:], true
+}
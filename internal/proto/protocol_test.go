@@ -2,7 +2,9 @@ package proto
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
+	"net"
 	"testing"
 
 	"cdr.dev/slog/sloggers/slogtest/assert"
@@ -42,3 +44,116 @@ func TestWithHeader(t *testing.T) {
 		assert.Equal(t, "body is expected value", tcase.body, body, bytecmp)
 	}
 }
+
+// buffersRecorder records each message written to it and how many buffers
+// it was written in.
+type buffersRecorder struct {
+	messages [][]byte
+	buffers  []int
+}
+
+func (b *buffersRecorder) Write(msg []byte) (int, error) {
+	b.messages = append(b.messages, append([]byte(nil), msg...))
+	b.buffers = append(b.buffers, 1)
+	return len(msg), nil
+}
+
+func (b *buffersRecorder) WriteBuffers(bufs net.Buffers) error {
+	b.buffers = append(b.buffers, len(bufs))
+	var msg []byte
+	for _, buf := range bufs {
+		msg = append(msg, buf...)
+	}
+	b.messages = append(b.messages, msg)
+	return nil
+}
+
+func TestWithHeaderBuffers(t *testing.T) {
+	var recorder buffersRecorder
+	w := WithHeader(&recorder, []byte("header"))
+	large := bytes.Repeat([]byte("b"), minBuffersSize)
+	_, err := w.Write([]byte("small"))
+	assert.Success(t, "write small body", err)
+	_, err = w.Write(large)
+	assert.Success(t, "write large body", err)
+
+	assert.Equal(t, "small bodies are joined", 1, recorder.buffers[0])
+	assert.Equal(t, "large bodies are not", 2, recorder.buffers[1])
+	for i, body := range [][]byte{[]byte("small"), large} {
+		header, gotBody := SplitMessage(recorder.messages[i])
+		assert.Equal(t, "header", []byte("header"), header, cmp.Comparer(bytes.Equal))
+		assert.Equal(t, "body", body, gotBody, cmp.Comparer(bytes.Equal))
+	}
+}
+
+func TestDataFrame(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	_, err := WithDataFrame(b, TypeStdout).Write([]byte("{body}"))
+	assert.Success(t, "write data frame", err)
+
+	typ, data, ok := ParseDataFrame(b.Bytes())
+	assert.True(t, "is data frame", ok)
+	assert.Equal(t, "type", TypeStdout, typ)
+	assert.Equal(t, "data", []byte("{body}"), data, cmp.Comparer(bytes.Equal))
+
+	_, _, ok = ParseDataFrame([]byte(`{"type":"stdout"}` + "\nbody"))
+	assert.True(t, "json header is not a data frame", !ok)
+}
+
+func TestFrame(t *testing.T) {
+	b := bytes.NewBuffer(nil)
+	err := WriteFrame(b, []byte("header\nbody"))
+	assert.Success(t, "write frame", err)
+	err = WriteFrame(b, []byte("too big"))
+	assert.Success(t, "write frame", err)
+	err = WriteFrameBuffers(b, net.Buffers{[]byte("header\n"), []byte("buffers")})
+	assert.Success(t, "write frame buffers", err)
+	err = WriteCloseFrame(b, 1000, "normal closure")
+	assert.Success(t, "write close frame", err)
+
+	msg, err := ReadFrame(b, 64)
+	assert.Success(t, "read frame", err)
+	assert.Equal(t, "frame is expected value", []byte("header\nbody"), msg, cmp.Comparer(bytes.Equal))
+
+	_, err = ReadFrame(b, 4)
+	assert.Error(t, "frame over limit", err)
+	b.Next(len("too big"))
+
+	msg, err = ReadFrame(b, 64)
+	assert.Success(t, "read frame", err)
+	assert.Equal(t, "buffers are joined", []byte("header\nbuffers"), msg, cmp.Comparer(bytes.Equal))
+
+	_, err = ReadFrame(b, 64)
+	closeFrame, ok := err.(*CloseFrame)
+	assert.True(t, "is close frame", ok)
+	assert.Equal(t, "close code", uint16(1000), closeFrame.Code)
+	assert.Equal(t, "close reason", "normal closure", closeFrame.Reason)
+}
+
+// discardBuffers is a BuffersWriter that discards everything.
+type discardBuffers struct{}
+
+func (discardBuffers) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (discardBuffers) WriteBuffers(net.Buffers) error {
+	return nil
+}
+
+func BenchmarkWithHeader(b *testing.B) {
+	body := make([]byte, 32*1024)
+	for name, dst := range map[string]io.Writer{
+		"Joined":  ioutil.Discard,
+		"Buffers": discardBuffers{},
+	} {
+		w := WithHeader(dst, []byte(`{"type":"stdout"}`))
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = w.Write(body)
+			}
+		})
+	}
+}
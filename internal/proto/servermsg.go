@@ -6,12 +6,71 @@ const (
 	TypeStdout   = "stdout"
 	TypeStderr   = "stderr"
 	TypeExitCode = "exit_code"
+	TypeResult   = "result"
+	TypeFileInfo = "file_info"
+	// TypeClipboard carries data a TTY application copied to the clipboard in
+	// its body.  It is only sent for commands with RelayClipboard set.
+	TypeClipboard = "clipboard"
+	// TypeBell is sent for each BEL in TTY output for commands with RelayBell
+	// set.
+	TypeBell = "bell"
+	// TypeNotify is sent when a TTY application requests a desktop
+	// notification with OSC 9 or OSC 777 for commands with RelayNotify set.
+	TypeNotify = "notify"
+	// TypeFrozen is sent when the session a command is attached to is frozen or
+	// thawed, and on attaching to a frozen session.
+	TypeFrozen = "frozen"
+	// TypeInputLock is sent when a client attached to a session with
+	// ExclusiveInput set gains or loses its input lock, and on attaching.
+	TypeInputLock = "input_lock"
+	// TypeTruncated is sent when a stream ends after output was dropped for
+	// exceeding the server's output cap.  The tail of the stream may follow.
+	TypeTruncated = "truncated"
+	// TypeEOF is sent once all of a stream's output has been sent.  Both
+	// streams end before TypeExitCode unless sending one failed.
+	TypeEOF = "eof"
+	// TypeWarning is sent after the pid when the command started differently
+	// than asked, such as in another working directory.
+	TypeWarning = "warning"
+	// TypeResized acknowledges a resize with Seq set.
+	TypeResized = "resized"
+	// TypeAcked acknowledges any other control message with Seq set.
+	TypeAcked = "acked"
+	// TypeError is sent before the server closes the connection because of a
+	// client's mistake, such as a malformed message.
+	TypeError = "error"
 )
 
-// ServerPidHeader specifies the message send immediately after the request command starts
+// ServerPidHeader specifies the message send immediately after the request command starts.
+// BinaryData accepts the client's offer of binary data frames, after which both
+// ends send stream data that way.  ResizeAcks is set by servers that answer
+// resizes with Seq set and ControlAcks by those that answer other control
+// messages with Seq set.  The remaining fields describe how the command was
+// started and are empty if the server does not know.  SessionID is only set if
+// the command outlives the connection.  Ignored lists the message types a
+// server that skips unknown messages was sent before the command started.
 type ServerPidHeader struct {
-	Type string `json:"type"`
-	Pid  int    `json:"pid"`
+	Type        string   `json:"type"`
+	Pid         int      `json:"pid"`
+	AppHint     string   `json:"app_hint,omitempty"`
+	BinaryData  bool     `json:"binary_data,omitempty"`
+	ResizeAcks  bool     `json:"resize_acks,omitempty"`
+	ControlAcks bool     `json:"control_acks,omitempty"`
+	WorkingDir  string   `json:"working_dir,omitempty"`
+	User        string   `json:"user,omitempty"`
+	Shell       string   `json:"shell,omitempty"`
+	SessionID   string   `json:"session_id,omitempty"`
+	Ignored     []string `json:"ignored,omitempty"`
+}
+
+// ServerOutputHeader is the header of stdout and stderr messages.  Time is
+// when the output was read in milliseconds since the Unix epoch and is only set
+// for commands with Timestamps set.  Offset is the position of the body in its
+// stream and is only set for commands without a TTY that have an ID.
+type ServerOutputHeader struct {
+	Type   string `json:"type"`
+	Time   int64  `json:"time,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
 }
 
 // ServerExitCodeHeader specifies the final message from the server after the command exits
@@ -20,3 +79,113 @@ type ServerExitCodeHeader struct {
 	ExitCode int    `json:"exit_code"`
 	Error    string `json:"error"`
 }
+
+// ServerResultHeader reports the outcome of a request that does not start a
+// command.  Code and Error are empty on success.  Token is the token minted
+// for a share session request and Validation answers a validate request.
+type ServerResultHeader struct {
+	Type       string      `json:"type"`
+	Code       string      `json:"code,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Token      string      `json:"token,omitempty"`
+	Validation *Validation `json:"validation,omitempty"`
+}
+
+// Validation holds the checks of a validate request.
+type Validation struct {
+	Command    Check `json:"command"`
+	WorkingDir Check `json:"working_dir"`
+	User       Check `json:"user"`
+}
+
+// Check is the outcome of one check.  Value is what the check resolved, such
+// as the path of the command, and Error is empty if the check passed.
+type Check struct {
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ServerErrorHeader reports why the server is closing the connection.  It has
+// the same fields as ServerResultHeader, and Seq is that of the message that
+// caused the error if it had one.
+type ServerErrorHeader struct {
+	Type  string `json:"type"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+	Seq   uint64 `json:"seq,omitempty"`
+}
+
+// ServerFileInfoHeader is sent at the start of a download.  Size is -1 if it is
+// unknown.
+type ServerFileInfoHeader struct {
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+}
+
+// ServerClipboardHeader is sent when a TTY application sets the clipboard.
+// Selection is the OSC 52 selection parameter, such as "c" for the clipboard.
+type ServerClipboardHeader struct {
+	Type      string `json:"type"`
+	Selection string `json:"selection"`
+}
+
+// ServerNotifyHeader is sent when a TTY application requests a notification.
+// Title is empty for OSC 9 notifications.
+type ServerNotifyHeader struct {
+	Type  string `json:"type"`
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body"`
+}
+
+// ServerTruncatedHeader reports how many bytes of a stream, "stdout" or
+// "stderr", were dropped.
+type ServerTruncatedHeader struct {
+	Type    string `json:"type"`
+	Stream  string `json:"stream"`
+	Dropped int64  `json:"dropped"`
+}
+
+// ServerEOFHeader reports the end of a stream, "stdout" or "stderr".
+type ServerEOFHeader struct {
+	Type   string `json:"type"`
+	Stream string `json:"stream"`
+}
+
+// ServerWarningHeader reports a problem the command started despite.  Code
+// identifies the problem and is empty from servers that predate codes.
+type ServerWarningHeader struct {
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// ServerResizedHeader acknowledges the resize with the same Seq.  Rows and Cols
+// are the size applied, or Error says why the terminal was not resized.
+type ServerResizedHeader struct {
+	Type  string `json:"type"`
+	Seq   uint64 `json:"seq"`
+	Rows  uint16 `json:"rows"`
+	Cols  uint16 `json:"cols"`
+	Error string `json:"error,omitempty"`
+}
+
+// ServerAckedHeader acknowledges the control message with the same Seq once it
+// is applied, or Error says why it was not.
+type ServerAckedHeader struct {
+	Type  string `json:"type"`
+	Seq   uint64 `json:"seq"`
+	Error string `json:"error,omitempty"`
+}
+
+// ServerInputLockHeader reports whether the client holds the session's input
+// lock.  Input from clients that do not is dropped.
+type ServerInputLockHeader struct {
+	Type   string `json:"type"`
+	Holder bool   `json:"holder"`
+}
+
+// ServerFrozenHeader reports whether the session's processes are stopped.
+type ServerFrozenHeader struct {
+	Type   string `json:"type"`
+	Frozen bool   `json:"frozen"`
+}
@@ -0,0 +1,105 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// closeBit marks a frame as a close frame on stream transports.
+const closeBit = 1 << 31
+
+// CloseFrame is returned by ReadFrame when the peer sent a close frame.
+type CloseFrame struct {
+	Code   uint16
+	Reason string
+}
+
+func (c *CloseFrame) Error() string {
+	return fmt.Sprintf("status = %d and reason = %q", c.Code, c.Reason)
+}
+
+// WriteFrame writes a single message to a stream transport.  Each message is
+// prefixed with its length as a big-endian uint32.  Callers must serialize
+// calls to WriteFrame.
+func WriteFrame(w io.Writer, msg []byte) error {
+	if len(msg) >= closeBit {
+		return fmt.Errorf("message of %d bytes is too large", len(msg))
+	}
+	return writeFrame(w, uint32(len(msg)), msg)
+}
+
+// WriteFrameBuffers is like WriteFrame but takes the message in parts and
+// writes them without joining them first.  When w is a network connection the
+// frame is written with a single vectored write; otherwise it may take several
+// calls to w so callers must make sure nothing else writes to w meanwhile.
+func WriteFrameBuffers(w io.Writer, bufs net.Buffers) error {
+	var size int
+	for _, buf := range bufs {
+		size += len(buf)
+	}
+	if size >= closeBit {
+		return fmt.Errorf("message of %d bytes is too large", size)
+	}
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(size))
+	frame := append(net.Buffers{prefix[:]}, bufs...)
+	_, err := frame.WriteTo(w)
+	return err
+}
+
+// WriteCloseFrame writes a close frame with a status code and reason to a
+// stream transport.  No more frames may be written afterward.
+func WriteCloseFrame(w io.Writer, code uint16, reason string) error {
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	copy(payload[2:], reason)
+	return writeFrame(w, uint32(len(payload))|closeBit, payload)
+}
+
+func writeFrame(w io.Writer, prefix uint32, payload []byte) error {
+	// Write in one call so frames from concurrent writers using a shared
+	// lock-free writer are not interleaved.
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, prefix)
+	copy(frame[4:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a single message from a stream transport.  Messages larger
+// than limit are rejected.  If the peer sent a close frame the error will be a
+// *CloseFrame.
+func ReadFrame(r io.Reader, limit int64) ([]byte, error) {
+	var prefix [4]byte
+	_, err := io.ReadFull(r, prefix[:])
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(prefix[:])
+	isClose := size&closeBit != 0
+	size &^= closeBit
+	if int64(size) > limit {
+		return nil, fmt.Errorf("read limited at %d bytes", limit)
+	}
+
+	msg := make([]byte, size)
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if isClose {
+		if len(msg) < 2 {
+			return nil, fmt.Errorf("close frame of %d bytes is too short", len(msg))
+		}
+		return nil, &CloseFrame{
+			Code:   binary.BigEndian.Uint16(msg),
+			Reason: string(msg[2:]),
+		}
+	}
+	return msg, nil
+}
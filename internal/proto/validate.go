@@ -0,0 +1,41 @@
+package proto
+
+import (
+	"fmt"
+)
+
+// MaxHeaderSize is the largest header accepted in client messages other than
+// start, whose command may carry long arguments and environments.
+const MaxHeaderSize = 4096
+
+// ParseMessage splits a message into its type, header and body, checking that
+// the header is a JSON object with a type.  The header is nil for binary data
+// frames.  Fields other than the type are only checked for being valid JSON;
+// callers decode them into the header's own type.
+func ParseMessage(msg []byte) (typ string, header, body []byte, err error) {
+	if typ, data, ok := ParseDataFrame(msg); ok {
+		return typ, nil, data, nil
+	}
+	header, body = SplitMessage(msg)
+	typ, err = ParseType(header)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("parse header: %w", err)
+	}
+	if typ == "" {
+		return "", nil, nil, fmt.Errorf("header has no type")
+	}
+	return typ, header, body, nil
+}
+
+// ParseClientMessage is like ParseMessage but also limits the size of headers
+// in messages from a client.
+func ParseClientMessage(msg []byte) (typ string, header, body []byte, err error) {
+	typ, header, body, err = ParseMessage(msg)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if typ != TypeStart && len(header) > MaxHeaderSize {
+		return "", nil, nil, fmt.Errorf("%s header of %d bytes is larger than %d", typ, len(header), MaxHeaderSize)
+	}
+	return typ, header, body, nil
+}
@@ -0,0 +1,179 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestParseClientMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		typ  string
+		body string
+		err  bool
+	}{
+		{name: "Body", msg: "{\"type\":\"stdin\"}\nbody", typ: TypeStdin, body: "body"},
+		{name: "NoBody", msg: `{"type":"close_stdin"}`, typ: TypeCloseStdin},
+		{name: "DataFrame", msg: "\x02data", typ: TypeStdout, body: "data"},
+		{name: "NoType", msg: `{"rows":1}`, err: true},
+		{name: "NotObject", msg: `["stdin"]`, err: true},
+		{name: "Null", msg: `null`, err: true},
+		{name: "TypeNotString", msg: `{"type":1}`, err: true},
+		{name: "Truncated", msg: `{"type":"resize","rows":`, err: true},
+		{name: "Garbage", msg: `{"type":"stdin",nonsense}`, err: true},
+		{name: "Empty", msg: ``, err: true},
+		{name: "LargeHeader", msg: `{"type":"resize","pad":"` + strings.Repeat("a", MaxHeaderSize) + `"}`, err: true},
+		{name: "LargeStart", msg: `{"type":"start","pad":"` + strings.Repeat("a", MaxHeaderSize) + `"}`, typ: TypeStart},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			typ, _, body, err := ParseClientMessage([]byte(test.msg))
+			if test.err {
+				assert.Error(t, "parse message", err)
+				return
+			}
+			assert.Success(t, "parse message", err)
+			assert.Equal(t, "type", test.typ, typ)
+			assert.Equal(t, "body", test.body, string(body))
+		})
+	}
+}
+
+// TestParseMessageMutations checks that what ParseMessage accepts is well
+// formed.
+func TestParseMessageMutations(t *testing.T) {
+	f := newMutator(t)
+	for _, seed := range []string{
+		"{\"type\":\"stdin\"}\nbody",
+		`{"type":"resize","rows":24,"cols":80}`,
+		`{"type":"start","id":"a","command":{"command":"sh","args":["-c","true"]}}`,
+		"\x01stdin",
+		`{"type":"stdout"}`,
+		"{\"type\":\"\xff\"}",
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		typ, header, body, err := ParseMessage(msg)
+		if err != nil {
+			return
+		}
+		if typ == "" {
+			t.Fatal("accepted a message without a type")
+		}
+		if header == nil {
+			if len(body) != len(msg)-1 {
+				t.Fatalf("data frame body of %d bytes from a %d byte message", len(body), len(msg))
+			}
+			return
+		}
+		if !json.Valid(header) {
+			t.Fatalf("accepted invalid JSON header %q", header)
+		}
+		if !bytes.HasPrefix(msg, header) {
+			t.Fatalf("header %q is not the start of the message", header)
+		}
+	})
+}
+
+// TestParseTypeMutations checks that the fast path agrees with encoding/json.
+func TestParseTypeMutations(t *testing.T) {
+	f := newMutator(t)
+	for _, seed := range []string{
+		`{"type":"stdout"}`,
+		`{"type":"stdout","time":1600000000000}`,
+		`{"type":"stdout","time":01}`,
+		`{"type":"stdout","time":+1}`,
+		`{"type":"std\nout"}`,
+		`{"type":"stdout",}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, header []byte) {
+		var expectedType Header
+		jsonErr := json.Unmarshal(header, &expectedType)
+		typ, err := ParseType(header)
+		if (err == nil) != (jsonErr == nil) {
+			t.Fatalf("ParseType error %v but encoding/json error %v for %q", err, jsonErr, header)
+		}
+		if err == nil && typ != expectedType.Type {
+			t.Fatalf("ParseType got %q but encoding/json got %q for %q", typ, expectedType.Type, header)
+		}
+
+		var expected ServerOutputHeader
+		jsonErr = json.Unmarshal(header, &expected)
+
+		output, err := ParseOutputHeader(header)
+		if (err == nil) != (jsonErr == nil) {
+			t.Fatalf("ParseOutputHeader error %v but encoding/json error %v for %q", err, jsonErr, header)
+		}
+		if err == nil && output != expected {
+			t.Fatalf("ParseOutputHeader got %+v but encoding/json got %+v for %q", output, expected, header)
+		}
+	})
+}
+
+// mutator stands in for testing.F, which needs Go 1.18.  Fuzz runs the target
+// with every seed added and with random mutations of them, drawn from a fixed
+// seed so failures reproduce.
+type mutator struct {
+	t     *testing.T
+	seeds [][]byte
+}
+
+// mutations is how many mutated inputs Fuzz runs the target with.
+const mutations = 20000
+
+// interesting holds the bytes mutations favor since they matter to JSON.
+const interesting = "{}[]\":,\\\n\t 0123456789+-.eEtrufalsn\xff"
+
+func newMutator(t *testing.T) *mutator {
+	return &mutator{t: t}
+}
+
+// Add adds a seed input.
+func (m *mutator) Add(seed []byte) {
+	m.seeds = append(m.seeds, seed)
+}
+
+// Fuzz runs the target with the seeds and then with mutations of them.
+func (m *mutator) Fuzz(target func(t *testing.T, input []byte)) {
+	for _, seed := range m.seeds {
+		target(m.t, seed)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < mutations; i++ {
+		target(m.t, mutate(rng, m.seeds[rng.Intn(len(m.seeds))]))
+	}
+}
+
+// mutate returns a copy of input with a few bytes inserted, replaced or
+// removed.
+func mutate(rng *rand.Rand, input []byte) []byte {
+	output := append([]byte(nil), input...)
+	for n := 1 + rng.Intn(4); n > 0; n-- {
+		b := interesting[rng.Intn(len(interesting))]
+		if rng.Intn(4) == 0 {
+			b = byte(rng.Intn(256))
+		}
+		switch op := rng.Intn(3); {
+		case op == 0 || len(output) == 0:
+			i := rng.Intn(len(output) + 1)
+			output = append(output[:i], append([]byte{b}, output[i:]...)...)
+		case op == 1:
+			output[rng.Intn(len(output))] = b
+		default:
+			i := rng.Intn(len(output))
+			output = append(output[:i], output[i+1:]...)
+		}
+	}
+	return output
+}
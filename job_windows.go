@@ -0,0 +1,133 @@
+//go:build windows
+// +build windows
+
+package wsep
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procResumeThread             = kernel32.NewProc("ResumeThread")
+)
+
+const (
+	createSuspended                           = 0x00000004
+	processSetQuota                           = 0x00000100
+	jobObjectExtendedLimitInformation         = 9
+	jobObjectLimitKillOnJobClose              = 0x00002000
+	resumeThreadFailed                uintptr = 0xFFFFFFFF
+)
+
+// jobObjectExtendedLimit is JOBOBJECT_EXTENDED_LIMIT_INFORMATION.
+type jobObjectExtendedLimit struct {
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+	IoCounters              [6]uint64
+	ProcessMemoryLimit      uintptr
+	JobMemoryLimit          uintptr
+	PeakProcessMemoryUsed   uintptr
+	PeakJobMemoryUsed       uintptr
+}
+
+// jobObject is a job that kills every process in it when it is closed, so a
+// command and everything it started end together like a Unix process group.
+// Processes a command starts join its job automatically.
+type jobObject struct {
+	mutex sync.Mutex
+	// handle is zero once the job is closed.
+	handle syscall.Handle
+}
+
+func newJobObject() (*jobObject, error) {
+	handle, _, err := procCreateJobObjectW.Call(0, 0)
+	if handle == 0 {
+		return nil, xerrors.Errorf("create job object: %w", err)
+	}
+	limit := jobObjectExtendedLimit{LimitFlags: jobObjectLimitKillOnJobClose}
+	ok, _, err := procSetInformationJobObject.Call(
+		handle,
+		jobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&limit)),
+		unsafe.Sizeof(limit),
+	)
+	if ok == 0 {
+		_ = syscall.CloseHandle(syscall.Handle(handle))
+		return nil, xerrors.Errorf("set job object limits: %w", err)
+	}
+	return &jobObject{handle: syscall.Handle(handle)}, nil
+}
+
+// assign adds a process to the job.
+func (j *jobObject) assign(process syscall.Handle) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.handle == 0 {
+		return xerrors.New("job object is closed")
+	}
+	ok, _, err := procAssignProcessToJobObject.Call(uintptr(j.handle), uintptr(process))
+	if ok == 0 {
+		return xerrors.Errorf("assign process to job object: %w", err)
+	}
+	return nil
+}
+
+// Close kills every process left in the job.
+func (j *jobObject) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.handle == 0 {
+		return nil
+	}
+	err := syscall.CloseHandle(j.handle)
+	j.handle = 0
+	return err
+}
+
+// watch closes the job once the process exits or ctx ends, whichever is first,
+// and then calls exited if it is not nil.  It takes ownership of the process
+// handle.
+func (j *jobObject) watch(ctx context.Context, process syscall.Handle, exited func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = j.Close()
+		case <-done:
+		}
+	}()
+	go func() {
+		_, _ = syscall.WaitForSingleObject(process, syscall.INFINITE)
+		close(done)
+		_ = syscall.CloseHandle(process)
+		// Anything the command left running goes with it.
+		_ = j.Close()
+		if exited != nil {
+			exited()
+		}
+	}()
+}
+
+// resumeThread resumes a thread created suspended.
+func resumeThread(thread syscall.Handle) error {
+	ret, _, err := procResumeThread.Call(uintptr(thread))
+	if ret == resumeThreadFailed {
+		return xerrors.Errorf("resume thread: %w", err)
+	}
+	return nil
+}
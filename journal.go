@@ -0,0 +1,227 @@
+package wsep
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// defaultJournalSize is the default cap on a session's journal including
+	// its backup.
+	defaultJournalSize = 16 << 20
+	// journalRotateInterval is how often journals written by screen are
+	// checked for rotation.
+	journalRotateInterval = 5 * time.Second
+)
+
+// journalPath returns the journal file of the session with the ID.  IDs come
+// from clients so they are hashed rather than used as file names.  The backup
+// has the same path with ".1" appended.
+func journalPath(dir, id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".log")
+}
+
+// journalLimit returns the size at which a journal is rotated, which is half
+// the cap so that a journal and its backup stay within it.
+func journalLimit(options *Options) int64 {
+	size := options.JournalSize
+	if size <= 0 {
+		size = defaultJournalSize
+	}
+	return size / 2
+}
+
+// removeJournal removes a journal and its backup, if any, so a new session
+// with the same ID starts with an empty one.
+func removeJournal(path string) error {
+	for _, name := range []string{path, path + ".1"} {
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// journal appends the output of a command to a file, replacing the backup
+// with it once it reaches the limit.  Failing to write the journal must not
+// fail the command so errors are logged and journaling stops.
+type journal struct {
+	mutex sync.Mutex
+	path  string
+	limit int64
+	// file is nil once journaling has failed.
+	file *os.File
+	size int64
+}
+
+// openJournal starts an empty journal at path.
+func openJournal(path string, limit int64) (*journal, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return nil, xerrors.Errorf("create journal directory: %w", err)
+	}
+	err = removeJournal(path)
+	if err != nil {
+		return nil, xerrors.Errorf("remove old journal: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, xerrors.Errorf("open journal: %w", err)
+	}
+	return &journal{path: path, limit: limit, file: file}, nil
+}
+
+func (j *journal) Write(p []byte) (int, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return len(p), nil
+	}
+	if j.size > 0 && j.size+int64(len(p)) > j.limit {
+		err := j.rotate()
+		if err != nil {
+			j.fail(err)
+			return len(p), nil
+		}
+	}
+	n, err := j.file.Write(p)
+	j.size += int64(n)
+	if err != nil {
+		j.fail(err)
+	}
+	return len(p), nil
+}
+
+// rotate moves the journal to its backup and starts a new one.
+func (j *journal) rotate() error {
+	err := j.file.Close()
+	if err != nil {
+		return err
+	}
+	j.file = nil
+	err = os.Rename(j.path, j.path+".1")
+	if err != nil {
+		return err
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	j.size = 0
+	return err
+}
+
+// fail stops journaling after an error.
+func (j *journal) fail(err error) {
+	flog.Error("failed to write journal %s: %v", j.path, err)
+	if j.file != nil {
+		_ = j.file.Close()
+		j.file = nil
+	}
+}
+
+// Close stops journaling, leaving the journal on disk.
+func (j *journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// rotateJournal replaces the backup of a journal written by another program
+// with the journal whenever it grows past the limit, until ctx ends.  The
+// writer must notice the journal was moved and reopen it, as screen does.
+func rotateJournal(ctx context.Context, path string, limit int64) {
+	ticker := time.NewTicker(journalRotateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.Size() <= limit {
+			continue
+		}
+		err = os.Rename(path, path+".1")
+		if err != nil {
+			flog.Error("failed to rotate journal %s: %v", path, err)
+		}
+	}
+}
+
+// OpenJournal returns the output journaled for the session or command with the
+// ID by a server with Options.JournalDir set to dir, oldest first.  It returns
+// an error satisfying os.IsNotExist if there is none.
+func OpenJournal(dir, id string) (io.ReadCloser, error) {
+	r, _, err := openJournalReader(journalPath(dir, id))
+	return r, err
+}
+
+// openJournalReader returns the contents of a journal's backup followed by the
+// journal, and their combined size.
+func openJournalReader(path string) (io.ReadCloser, int64, error) {
+	var (
+		files   []*os.File
+		readers []io.Reader
+		size    int64
+	)
+	closeAll := func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+	for _, name := range []string{path + ".1", path} {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			closeAll()
+			return nil, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			closeAll()
+			return nil, 0, err
+		}
+		files = append(files, f)
+		// Only what is there now is read so the size is accurate even while
+		// the journal grows.
+		readers = append(readers, io.LimitReader(f, info.Size()))
+		size += info.Size()
+	}
+	if len(files) == 0 {
+		return nil, 0, os.ErrNotExist
+	}
+	return journalReader{Reader: io.MultiReader(readers...), files: files}, size, nil
+}
+
+type journalReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (r journalReader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
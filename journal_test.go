@@ -0,0 +1,72 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestJournal(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	j, err := openJournal(journalPath(dir, "id"), 4)
+	assert.Success(t, "open journal", err)
+	for _, chunk := range []string{"ab", "cd", "ef", "g", "hi"} {
+		_, err = j.Write([]byte(chunk))
+		assert.Success(t, "write journal", err)
+	}
+	assert.Success(t, "close journal", j.Close())
+
+	// The oldest output was discarded once the journal rotated twice.
+	r, err := OpenJournal(dir, "id")
+	assert.Success(t, "open reader", err)
+	contents, err := ioutil.ReadAll(r)
+	assert.Success(t, "read journal", err)
+	assert.Success(t, "close reader", r.Close())
+	assert.Equal(t, "contents", "efghi", string(contents))
+
+	_, err = OpenJournal(dir, "missing")
+	assert.True(t, "missing journal", os.IsNotExist(err))
+}
+
+func TestReadJournal(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	server := newServer(t)
+	options := &Options{JournalDir: tempDir(t), Owner: "alice", SessionTimeout: time.Minute}
+	connect := func(options *Options) Execer {
+		ws, httpServer := mockConn(ctx, t, server, options)
+		t.Cleanup(httpServer.Close)
+		return RemoteExecer(ws)
+	}
+
+	process, err := connect(options).Start(ctx, Command{
+		ID:      "build",
+		Command: "sh",
+		Args:    []string{"-c", "echo out; echo err >&2"},
+	})
+	assert.Success(t, "start command", err)
+	_, err = ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.Success(t, "wait command", process.Wait())
+
+	var buf bytes.Buffer
+	err = connect(options).(SessionAdmin).ReadJournal(ctx, "build", &buf)
+	assert.Success(t, "read journal", err)
+	assert.True(t, "journaled stdout", bytes.Contains(buf.Bytes(), []byte("out\n")))
+	assert.True(t, "journaled stderr", bytes.Contains(buf.Bytes(), []byte("err\n")))
+
+	bob := &Options{JournalDir: options.JournalDir, Owner: "bob"}
+	err = connect(bob).(SessionAdmin).ReadJournal(ctx, "build", &buf)
+	assert.Equal(t, "forbidden", CodeForbidden, ErrorCode(err))
+	err = connect(bob).(SessionAdmin).ReadJournal(ctx, "missing", &buf)
+	assert.Equal(t, "not found", CodeSessionNotFound, ErrorCode(err))
+}
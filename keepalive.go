@@ -0,0 +1,131 @@
+package wsep
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// pinger is implemented by conns that can check the other end is still there.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// KeepaliveError is returned from Wait when the server stopped answering
+// keepalive pings, which usually means the connection is half-open.
+type KeepaliveError struct {
+	// Timeout is how long the unanswered ping waited.
+	Timeout time.Duration
+	err     error
+}
+
+func (e *KeepaliveError) Error() string {
+	return fmt.Sprintf("keepalive ping not answered within %s: %v", e.Timeout, e.err)
+}
+
+func (e *KeepaliveError) Unwrap() error {
+	return e.err
+}
+
+// keepalive pings the server every interval until the context ends.  If a ping
+// goes unanswered the process fails with a KeepaliveError.
+func (r *remoteProcess) keepalive(ctx context.Context, p pinger) {
+	interval := r.cmd.KeepaliveInterval
+	timeout := r.cmd.KeepaliveTimeout
+	if timeout <= 0 {
+		timeout = interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := p.Ping(pingCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			r.keepaliveMutex.Lock()
+			r.keepaliveErr = &KeepaliveError{Timeout: timeout, err: err}
+			r.keepaliveMutex.Unlock()
+			r.cancelListen()
+			return
+		}
+	}
+}
+
+// clientActivity records when a client last sent a message.
+type clientActivity struct {
+	// last is in Unix nanoseconds and must be accessed atomically.
+	last int64
+}
+
+func newClientActivity() *clientActivity {
+	a := &clientActivity{}
+	a.touch()
+	return a
+}
+
+func (a *clientActivity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *clientActivity) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// watchClient fails the connection once the client has sent nothing for
+// timeout.  Once it has been idle for half the timeout, a client that supports
+// pings is pinged, and an answer counts as activity, so only a client that is
+// gone is disconnected.
+func watchClient(ctx context.Context, c conn, activity *clientActivity, timeout time.Duration, fail func(error)) {
+	timer := time.NewTimer(timeout / 2)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		idle := activity.idle()
+		if idle < timeout/2 {
+			timer.Reset(timeout/2 - idle)
+			continue
+		}
+		p, ok := c.(pinger)
+		if !ok && idle < timeout {
+			timer.Reset(timeout - idle)
+			continue
+		}
+		if ok && pingClient(ctx, p, timeout-idle) {
+			activity.touch()
+			timer.Reset(timeout / 2)
+			continue
+		}
+		fail(xerrors.Errorf("client sent nothing for %s", timeout))
+		return
+	}
+}
+
+// pingClient returns whether the client answered a ping within timeout.  A
+// ping that times out closes the connection, so the ping is left running
+// instead for the caller to fail the connection with why before it closes.
+func pingClient(ctx context.Context, p pinger, timeout time.Duration) bool {
+	pinged := make(chan error, 1)
+	go func() {
+		pinged <- p.Ping(ctx)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-pinged:
+		return err == nil
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,129 @@
+package wsep
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+)
+
+func TestKeepalive(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A server that starts the command then never reads again and so never
+	// answers pings, like one behind a half-open connection.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close(websocket.StatusNormalClosure, "normal closure")
+		_, _, err = ws.Read(r.Context())
+		if err != nil {
+			return
+		}
+		err = ws.Write(r.Context(), websocket.MessageBinary, []byte(`{"type":"pid","pid":1}`))
+		if err != nil {
+			return
+		}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Success(t, "dial", err)
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command:           "sh",
+		KeepaliveInterval: 50 * time.Millisecond,
+	})
+	assert.Success(t, "start", err)
+
+	err = process.Wait()
+	var keepaliveErr *KeepaliveError
+	assert.True(t, "keepalive error", xerrors.As(err, &keepaliveErr))
+	assert.Equal(t, "timeout", 50*time.Millisecond, keepaliveErr.Timeout)
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	options := &Options{ClientIdleTimeout: 200 * time.Millisecond}
+	serve := func(t *testing.T) (string, <-chan error) {
+		served := make(chan error, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			err = newServer(t).Serve(r.Context(), ws, LocalExecer{}, options)
+			served <- err
+			closeWithError(newWSConn(ws, false), err)
+		}))
+		t.Cleanup(server.Close)
+		return "ws" + strings.TrimPrefix(server.URL, "http"), served
+	}
+
+	t.Run("Answering", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// A client that sends nothing but answers pings stays connected.
+		url, _ := serve(t)
+		ws, _, err := websocket.Dial(ctx, url, nil)
+		assert.Success(t, "dial", err)
+		process, err := RemoteExecer(ws).Start(ctx, Command{Command: "sleep", Args: []string{"1"}})
+		assert.Success(t, "start", err)
+		assert.Success(t, "wait", process.Wait())
+	})
+
+	t.Run("Gone", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// A client that stops reading never answers pings.
+		url, served := serve(t)
+		ws, _, err := websocket.Dial(ctx, url, nil)
+		assert.Success(t, "dial", err)
+		// Not closed since closing waits for a server that already hung up.
+		err = ws.Write(ctx, websocket.MessageBinary, []byte(`{"type":"start","command":{"command":"sleep","args":["5"]}}`))
+		assert.Success(t, "write start", err)
+		select {
+		case err := <-served:
+			assert.ErrorContains(t, "serve", err, "client sent nothing")
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the connection to close")
+		}
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		client, server := net.Pipe()
+		served := make(chan error, 1)
+		go func() {
+			served <- newServer(t).ServeStream(ctx, server, LocalExecer{}, options)
+		}()
+		process, err := RemoteStreamExecer(client).Start(ctx, Command{Command: "sleep", Args: []string{"5"}})
+		assert.Success(t, "start", err)
+		select {
+		case err := <-served:
+			assert.ErrorContains(t, "serve", err, "client sent nothing")
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the connection to close")
+		}
+		assert.Error(t, "wait", process.Wait())
+	})
+}
@@ -0,0 +1,319 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+)
+
+// Kubernetes exec subprotocols in order of preference.  v5 adds the ability to
+// close stdin.
+const (
+	kubernetesProtocolV5 = "v5.channel.k8s.io"
+	kubernetesProtocolV4 = "v4.channel.k8s.io"
+)
+
+// Kubernetes exec channels.  Every message is prefixed with a single byte
+// indicating its channel.
+const (
+	kubernetesStdin  byte = 0
+	kubernetesStdout byte = 1
+	kubernetesStderr byte = 2
+	kubernetesStatus byte = 3
+	kubernetesResize byte = 4
+	kubernetesClose  byte = 255
+)
+
+// KubernetesExecer executes commands inside a pod's container using the
+// Kubernetes API.  Kubernetes does not report a PID for exec sessions so Pid()
+// always returns zero.  UID and GID cannot be changed; the command runs as the
+// container's user.
+type KubernetesExecer struct {
+	// Host is the base URL of the API server, for example
+	// https://10.0.0.1:6443.
+	Host string
+	// Token is an optional bearer token used to authenticate.
+	Token string
+	// TLSConfig configures the connection to the API server.
+	TLSConfig *tls.Config
+	// Namespace is the pod's namespace.  Defaults to "default".
+	Namespace string
+	// Pod is the name of the pod commands run in.
+	Pod string
+	// Container selects the container within the pod.  It may be omitted for
+	// pods with a single container.
+	Container string
+}
+
+// Start executes the given command inside the pod.
+func (k KubernetesExecer) Start(ctx context.Context, c Command) (Process, error) {
+	if c.UID != 0 || c.GID != 0 {
+		return nil, xerrors.Errorf("kubernetes exec cannot run commands as a different user")
+	}
+	c = shCommand(c)
+
+	env := c.Env
+	if c.TTY {
+		// This special WSEP_TTY variable helps debug unexpected TTYs.
+		env = append(env, "WSEP_TTY=true")
+	}
+	command := append([]string{c.Command}, c.Args...)
+	// Exec has no notion of environment or working directory so wrap the
+	// command to apply them.
+	if len(env) > 0 {
+		command = append(append([]string{"env"}, env...), command...)
+	}
+	if c.WorkingDir != "" {
+		command = append([]string{"sh", "-c", `cd "$1" || exit; shift; exec "$@"`, "sh", c.WorkingDir}, command...)
+	}
+
+	namespace := k.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	query := url.Values{}
+	query["command"] = command
+	query.Set("stdin", strconv.FormatBool(c.Stdin))
+	query.Set("stdout", "true")
+	// The API server rejects requests for stderr when a TTY is enabled.
+	query.Set("stderr", strconv.FormatBool(!c.TTY))
+	query.Set("tty", strconv.FormatBool(c.TTY))
+	if k.Container != "" {
+		query.Set("container", k.Container)
+	}
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/exec?%s",
+		k.Host, url.PathEscape(namespace), url.PathEscape(k.Pod), query.Encode())
+
+	header := http.Header{}
+	if k.Token != "" {
+		header.Set("Authorization", "Bearer "+k.Token)
+	}
+	conn, resp, err := websocket.Dial(ctx, u, &websocket.DialOptions{
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: k.TLSConfig},
+		},
+		HTTPHeader:   header,
+		Subprotocols: []string{kubernetesProtocolV5, kubernetesProtocolV4},
+	})
+	if err != nil {
+		if resp != nil {
+			return nil, xerrors.Errorf("dial exec: %s: %w", resp.Status, err)
+		}
+		return nil, xerrors.Errorf("dial exec: %w", err)
+	}
+	// Frames from the API server are not bounded by our own message size.
+	conn.SetReadLimit(1 << 20)
+
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+	process := &kubernetesProcess{
+		conn:         conn,
+		done:         make(chan struct{}),
+		stdout:       stdoutReader,
+		stdoutWriter: stdoutWriter,
+		stderr:       stderrReader,
+		stderrWriter: stderrWriter,
+	}
+	if c.Stdin {
+		process.stdin = kubernetesStdinWriter{
+			ctx:      ctx,
+			conn:     conn,
+			canClose: conn.Subprotocol() == kubernetesProtocolV5,
+		}
+	} else {
+		process.stdin = disabledStdinWriter{}
+	}
+
+	go process.listen(ctx)
+
+	if c.TTY {
+		err = process.Resize(ctx, c.Rows, c.Cols)
+		if err != nil {
+			_ = process.Close()
+			return nil, err
+		}
+	}
+
+	return process, nil
+}
+
+type kubernetesProcess struct {
+	conn *websocket.Conn
+	// done is closed once the status has been received or the connection
+	// fails.
+	done chan struct{}
+	// exitErr and readErr are not safe to access until done is closed.
+	exitErr error
+	readErr error
+
+	stdin        io.WriteCloser
+	stdout       io.ReadCloser
+	stdoutWriter *io.PipeWriter
+	stderr       io.ReadCloser
+	stderrWriter *io.PipeWriter
+}
+
+// kubernetesStatusMsg is the subset of a metav1.Status sent on the status
+// channel when the command exits.
+type kubernetesStatusMsg struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Details struct {
+		Causes []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"causes"`
+	} `json:"details"`
+}
+
+func (k *kubernetesProcess) listen(ctx context.Context) {
+	defer func() {
+		k.stdoutWriter.CloseWithError(k.readErr)
+		k.stderrWriter.CloseWithError(k.readErr)
+		close(k.done)
+	}()
+
+	for {
+		_, payload, err := k.conn.Read(ctx)
+		if err != nil {
+			k.readErr = xerrors.Errorf("read exec stream: %w", err)
+			return
+		}
+		if len(payload) == 0 {
+			continue
+		}
+		channel, body := payload[0], payload[1:]
+		switch channel {
+		case kubernetesStdout:
+			_, err = closedDiscarder{k.stdoutWriter}.Write(body)
+		case kubernetesStderr:
+			_, err = closedDiscarder{k.stderrWriter}.Write(body)
+		case kubernetesStatus:
+			k.exitErr = parseKubernetesStatus(body)
+			_ = k.conn.Close(websocket.StatusNormalClosure, "normal closure")
+			return
+		}
+		if err != nil {
+			k.readErr = err
+			return
+		}
+	}
+}
+
+// parseKubernetesStatus converts the final status into an exit error.
+func parseKubernetesStatus(body []byte) error {
+	var status kubernetesStatusMsg
+	err := json.Unmarshal(body, &status)
+	if err != nil {
+		return xerrors.Errorf("unmarshal exec status: %w", err)
+	}
+	if status.Status == "Success" {
+		return nil
+	}
+	if status.Reason == "NonZeroExitCode" {
+		for _, cause := range status.Details.Causes {
+			if cause.Reason != "ExitCode" {
+				continue
+			}
+			code, err := strconv.Atoi(cause.Message)
+			if err != nil {
+				break
+			}
+			return ExitError{
+				code:  code,
+				error: fmt.Sprintf("exit status %d", code),
+			}
+		}
+	}
+	return xerrors.Errorf("exec failed: %s", status.Message)
+}
+
+func (k *kubernetesProcess) Pid() int {
+	return 0
+}
+
+func (k *kubernetesProcess) Stdin() io.WriteCloser {
+	return k.stdin
+}
+
+func (k *kubernetesProcess) Stdout() io.ReadCloser {
+	return k.stdout
+}
+
+func (k *kubernetesProcess) Stderr() io.ReadCloser {
+	return k.stderr
+}
+
+func (k *kubernetesProcess) Resize(ctx context.Context, rows, cols uint16) error {
+	payload, err := json.Marshal(struct {
+		Width  uint16
+		Height uint16
+	}{Width: cols, Height: rows})
+	if err != nil {
+		return err
+	}
+	return k.conn.Write(ctx, websocket.MessageBinary, append([]byte{kubernetesResize}, payload...))
+}
+
+func (k *kubernetesProcess) Wait() error {
+	<-k.done
+	if k.exitErr != nil {
+		return k.exitErr
+	}
+	return k.readErr
+}
+
+func (k *kubernetesProcess) Close() error {
+	err := k.conn.Close(websocket.StatusNormalClosure, "normal closure")
+	<-k.done
+	return err
+}
+
+// lookPath, mkdirAll, and writeFile make the container's filesystem available
+// to screen sessions.
+func (k KubernetesExecer) lookPath(ctx context.Context, file string) error {
+	return execLookPath(ctx, k, file)
+}
+
+func (k KubernetesExecer) mkdirAll(ctx context.Context, path string, uid, gid uint32) error {
+	return execMkdirAll(ctx, k, path, uid, gid)
+}
+
+func (k KubernetesExecer) writeFile(ctx context.Context, name string, data []byte, uid, gid uint32) error {
+	return execWriteFile(ctx, k, name, data, uid, gid)
+}
+
+type kubernetesStdinWriter struct {
+	ctx  context.Context
+	conn *websocket.Conn
+	// canClose is set when the negotiated protocol supports closing stdin.
+	canClose bool
+}
+
+func (k kubernetesStdinWriter) Write(b []byte) (int, error) {
+	var msg bytes.Buffer
+	msg.WriteByte(kubernetesStdin)
+	msg.Write(b)
+	err := k.conn.Write(k.ctx, websocket.MessageBinary, msg.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (k kubernetesStdinWriter) Close() error {
+	if !k.canClose {
+		return xerrors.Errorf("the API server does not support closing stdin")
+	}
+	return k.conn.Write(k.ctx, websocket.MessageBinary, []byte{kubernetesClose, kubernetesStdin})
+}
@@ -0,0 +1,183 @@
+package wsep
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"nhooyr.io/websocket"
+)
+
+func TestKubernetesExec(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	testExecer(ctx, t, fakeKubernetes(t))
+}
+
+func TestKubernetesExecFail(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	testExecerFail(ctx, t, fakeKubernetes(t))
+}
+
+func TestKubernetesExecStdin(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	process, err := fakeKubernetes(t).Start(ctx, Command{
+		Command:    "sh",
+		Args:       []string{"-c", `cat; echo "$FOO"; pwd`},
+		Stdin:      true,
+		Env:        []string{"FOO=bar"},
+		WorkingDir: "/",
+	})
+	assert.Success(t, "start command", err)
+	go io.Copy(ioutil.Discard, process.Stderr())
+
+	_, err = process.Stdin().Write([]byte("hello\n"))
+	assert.Success(t, "write stdin", err)
+	err = process.Stdin().Close()
+	assert.Success(t, "close stdin", err)
+
+	stdout, err := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.Equal(t, "stdout", "hello\nbar\n/\n", string(stdout))
+
+	err = process.Wait()
+	assert.Success(t, "wait", err)
+}
+
+func TestKubernetesExecTTY(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	process, err := fakeKubernetes(t).Start(ctx, Command{
+		Command: "sh",
+		TTY:     true,
+		Stdin:   true,
+		Rows:    defaultRows,
+		Cols:    defaultCols,
+		Env:     []string{"TERM=linux"},
+	})
+	assert.Success(t, "start command", err)
+
+	expected := writeUnique(t, process)
+	assert.True(t, "find output", checkStdout(t, process, expected, []string{}))
+	go io.Copy(ioutil.Discard, process.Stdout())
+
+	write(t, process, "exit 3")
+	err = process.Wait()
+	exitErr, ok := err.(ExitError)
+	assert.True(t, "is exit error", ok)
+	assert.Equal(t, "exit code", 3, exitErr.ExitCode())
+}
+
+// fakeKubernetes serves the pod exec endpoint, running commands locally, and
+// returns an execer pointed at it.
+func fakeKubernetes(t *testing.T) KubernetesExecer {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/ns/pods/pod/exec" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{kubernetesProtocolV5},
+		})
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "normal closure")
+		serveKubernetesExec(r, conn)
+	}))
+	t.Cleanup(server.Close)
+
+	return KubernetesExecer{
+		Host:      server.URL,
+		Token:     "token",
+		Namespace: "ns",
+		Pod:       "pod",
+	}
+}
+
+func serveKubernetesExec(r *http.Request, conn *websocket.Conn) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	command := query["command"]
+	process, err := LocalExecer{}.Start(ctx, Command{
+		Command: command[0],
+		Args:    command[1:],
+		TTY:     query.Get("tty") == "true",
+		Stdin:   query.Get("stdin") == "true",
+		Rows:    defaultRows,
+		Cols:    defaultCols,
+	})
+	if err != nil {
+		return
+	}
+
+	go func() {
+		for {
+			_, payload, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			switch payload[0] {
+			case kubernetesStdin:
+				_, _ = process.Stdin().Write(payload[1:])
+			case kubernetesClose:
+				_ = process.Stdin().Close()
+			case kubernetesResize:
+				var size struct{ Width, Height uint16 }
+				_ = json.Unmarshal(payload[1:], &size)
+				_ = process.Resize(ctx, size.Height, size.Width)
+			}
+		}
+	}()
+
+	copyChannel := func(channel byte, r io.Reader) {
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				_ = conn.Write(ctx, websocket.MessageBinary, append([]byte{channel}, buf[:n]...))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyChannel(kubernetesStdout, process.Stdout())
+	}()
+	go func() {
+		defer wg.Done()
+		copyChannel(kubernetesStderr, process.Stderr())
+	}()
+	if query.Get("tty") != "true" {
+		wg.Wait()
+	}
+
+	status := `{"status":"Success"}`
+	err = process.Wait()
+	if exitErr, ok := err.(ExitError); ok {
+		status = fmt.Sprintf(`{"status":"Failure","reason":"NonZeroExitCode","message":"command terminated with non-zero exit code","details":{"causes":[{"reason":"ExitCode","message":"%d"}]}}`, exitErr.ExitCode())
+	}
+	_ = conn.Write(ctx, websocket.MessageBinary, append([]byte{kubernetesStatus}, status...))
+}
@@ -0,0 +1,85 @@
+package wsep
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// _connections counts the connections of the deprecated Serve, which has no
+// Server to count them.
+var _connections connLimiter
+
+// connLimiter counts the connections a server is serving, in total and by the
+// host they come from, to enforce Options.MaxConnections and
+// Options.MaxConnectionsPerAddress.
+type connLimiter struct {
+	mutex  sync.Mutex
+	total  int
+	byHost map[string]int
+}
+
+// admit counts a connection from addr, which is empty if it is not known,
+// unless that would exceed the limits of options.  release must be called once
+// the connection ends.
+func (l *connLimiter) admit(addr string, options *Options) (release func(), err error) {
+	var maxTotal, maxPerHost int
+	if options != nil {
+		maxTotal, maxPerHost = options.MaxConnections, options.MaxConnectionsPerAddress
+	}
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if maxPerHost <= 0 {
+		host = ""
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if maxTotal > 0 && l.total >= maxTotal {
+		return nil, codeErrorf(CodeTooManyConnections, "server is serving its limit of %d connections", maxTotal)
+	}
+	if host != "" && l.byHost[host] >= maxPerHost {
+		return nil, codeErrorf(CodeTooManyConnections, "%s has its limit of %d connections", host, maxPerHost)
+	}
+	l.total++
+	if host != "" {
+		if l.byHost == nil {
+			l.byHost = make(map[string]int)
+		}
+		l.byHost[host]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			l.total--
+			if host == "" {
+				return
+			}
+			l.byHost[host]--
+			if l.byHost[host] == 0 {
+				delete(l.byHost, host)
+			}
+		})
+	}, nil
+}
+
+// count returns how many connections are being served.
+func (l *connLimiter) count() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.total
+}
+
+// streamAddr returns the address of the client at the other end of a stream,
+// or an empty string if the stream is not a network connection.
+func streamAddr(rwc io.ReadWriteCloser) string {
+	if nc, ok := rwc.(interface{ RemoteAddr() net.Addr }); ok && nc.RemoteAddr() != nil {
+		return nc.RemoteAddr().String()
+	}
+	return ""
+}
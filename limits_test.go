@@ -0,0 +1,107 @@
+package wsep
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"nhooyr.io/websocket"
+)
+
+func TestConnLimiter(t *testing.T) {
+	t.Parallel()
+
+	var l connLimiter
+	options := &Options{MaxConnections: 3, MaxConnectionsPerAddress: 1}
+	release, err := l.admit("10.0.0.1:1000", options)
+	assert.Success(t, "first from host", err)
+	_, err = l.admit("10.0.0.1:1001", options)
+	assert.Equal(t, "second from host", CodeTooManyConnections, ErrorCode(err))
+	_, err = l.admit("10.0.0.2:1000", options)
+	assert.Success(t, "other host", err)
+	// Connections without an address only count toward the total.
+	_, err = l.admit("", options)
+	assert.Success(t, "unknown address", err)
+	_, err = l.admit("10.0.0.3:1000", options)
+	assert.Equal(t, "over total", CodeTooManyConnections, ErrorCode(err))
+
+	release()
+	release()
+	_, err = l.admit("10.0.0.1:1001", options)
+	assert.Success(t, "host after release", err)
+}
+
+func TestConnectionLimits(t *testing.T) {
+	t.Parallel()
+
+	t.Run("WebSocket", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		srv := NewServer()
+		defer srv.Close()
+		options := &Options{MaxConnectionsPerAddress: 1}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = srv.ServeWebSocket(w, r, nil, LocalExecer{}, options)
+		}))
+		defer server.Close()
+		url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+		ws, _, err := websocket.Dial(ctx, url, nil)
+		assert.Success(t, "dial", err)
+		_, resp, err := websocket.Dial(ctx, url, nil)
+		assert.Error(t, "dial over limit", err)
+		assert.Equal(t, "status", http.StatusServiceUnavailable, resp.StatusCode)
+
+		// The connection is released once it closes.
+		_ = ws.Close(websocket.StatusNormalClosure, "normal closure")
+		for {
+			ws, _, err = websocket.Dial(ctx, url, nil)
+			if err == nil {
+				break
+			}
+			assert.Success(t, "context", ctx.Err())
+			time.Sleep(10 * time.Millisecond)
+		}
+		_ = ws.Close(websocket.StatusNormalClosure, "normal closure")
+	})
+
+	t.Run("Listener", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		srv := NewServer()
+		defer srv.Close()
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Success(t, "listen", err)
+		sink := &memoryAuditSink{}
+		go func() {
+			_ = srv.ServeListener(ctx, l, LocalExecer{}, &Options{MaxConnections: 1, Audit: sink})
+		}()
+		dial := func() Execer {
+			nc, err := net.Dial("tcp", l.Addr().String())
+			assert.Success(t, "dial", err)
+			return RemoteStreamExecer(nc)
+		}
+
+		process, err := dial().Start(ctx, Command{Command: "sleep", Args: []string{"1"}})
+		assert.Success(t, "start", err)
+		_, err = dial().Start(ctx, Command{Command: "true"})
+		assert.Equal(t, "code", CodeTooManyConnections, ErrorCode(err))
+		assert.Success(t, "wait", process.Wait())
+
+		// The refused connection is summarized for the audit log.
+		var refused bool
+		for _, event := range sink.events() {
+			refused = refused || event.Type == AuditConnection && event.Reason == string(CodeTooManyConnections)
+		}
+		assert.True(t, "summarized", refused)
+	})
+}
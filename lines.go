@@ -0,0 +1,49 @@
+package wsep
+
+import (
+	"bytes"
+	"io"
+)
+
+// lineReader returns only whole lines from a stream so that each read, and so
+// each message, ends at a line boundary.  A partial line is held until it is
+// completed or the stream ends.  Lines longer than size bytes are returned in
+// pieces of that size.
+type lineReader struct {
+	r   io.Reader
+	buf []byte
+	// n is how much of buf is filled.
+	n int
+	// err is the error from r, returned once everything held is read.
+	err error
+}
+
+func newLineReader(r io.Reader, size int) *lineReader {
+	return &lineReader{r: r, buf: make([]byte, size)}
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	for {
+		var end int
+		switch {
+		case l.err != nil:
+			end = l.n
+		case l.n > 0:
+			end = bytes.LastIndexByte(l.buf[:l.n], '\n') + 1
+			if end == 0 && l.n == len(l.buf) {
+				end = l.n
+			}
+		}
+		if end > 0 {
+			n := copy(p, l.buf[:end])
+			l.n = copy(l.buf, l.buf[n:l.n])
+			return n, nil
+		}
+		if l.err != nil {
+			return 0, l.err
+		}
+		var n int
+		n, l.err = l.r.Read(l.buf[l.n:])
+		l.n += n
+	}
+}
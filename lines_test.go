@@ -0,0 +1,42 @@
+package wsep
+
+import (
+	"io"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+// chunkReader returns at most one chunk per read.
+type chunkReader []string
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(*c) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, (*c)[0])
+	(*c)[0] = (*c)[0][n:]
+	if (*c)[0] == "" {
+		*c = (*c)[1:]
+	}
+	return n, nil
+}
+
+func TestLineReader(t *testing.T) {
+	t.Parallel()
+
+	r := newLineReader(&chunkReader{"a", "b\nc", "d\ne\n", "fghijk", "l"}, 4)
+	var reads []string
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		assert.Success(t, "read", err)
+		reads = append(reads, string(buf[:n]))
+	}
+	// Partial lines wait for the rest, long ones are split and the last is
+	// returned at the end.
+	assert.Equal(t, "reads", []string{"ab\n", "cd\n", "e\n", "fghi", "jkl"}, reads)
+}
@@ -0,0 +1,39 @@
+package wsep
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// LocaleAcceptEnv returns patterns for Options.AcceptEnv that accept the
+// variables of a locale, as sshd is commonly configured to with
+// "AcceptEnv LANG LC_*".
+func LocaleAcceptEnv() []string {
+	return []string{"LANG", "LANGUAGE", "LC_*"}
+}
+
+// LocaleEnv returns the variables of this process' locale to forward with
+// Command.Locale.
+func LocaleEnv() []string {
+	return filterEnv(os.Environ(), LocaleAcceptEnv())
+}
+
+// filterEnv returns the variables in env whose names match one of the
+// patterns, which are in the syntax of path.Match.
+func filterEnv(env []string, patterns []string) []string {
+	var accepted []string
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if name == kv || name == "" {
+			continue
+		}
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				accepted = append(accepted, kv)
+				break
+			}
+		}
+	}
+	return accepted
+}
@@ -0,0 +1,33 @@
+package wsep
+
+import (
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestFilterEnv(t *testing.T) {
+	t.Parallel()
+
+	env := []string{"LANG=en_US.UTF-8", "LC_TIME=de_DE.UTF-8", "LD_PRELOAD=/tmp/evil.so", "LC_", "=LANG", "PATH=/bin"}
+	assert.Equal(t, "locale", []string{"LANG=en_US.UTF-8", "LC_TIME=de_DE.UTF-8"}, filterEnv(env, LocaleAcceptEnv()))
+	assert.Equal(t, "none", 0, len(filterEnv(env, nil)))
+}
+
+func TestLocaleEnv(t *testing.T) {
+	setenv(t, "LC_ALL", "C.UTF-8")
+	setenv(t, "WSEP_NOT_LOCALE", "1")
+
+	env := LocaleEnv()
+	assert.True(t, "locale", contains(env, "LC_ALL=C.UTF-8"))
+	assert.True(t, "not locale", !contains(env, "WSEP_NOT_LOCALE=1"))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -3,42 +3,80 @@ package wsep
 import (
 	"io"
 	"os/exec"
-	"syscall"
-
-	"golang.org/x/xerrors"
 )
 
 // LocalExecer executes command on the local system.
 type LocalExecer struct {
 	// ChildProcessPriority overrides the default niceness of all child processes launch by LocalExecer.
 	ChildProcessPriority *int
+	// PAMService, if set, opens a PAM session with this service name around
+	// commands that run as another user so they get the limits, keyrings and
+	// session accounting of a login.  It requires building with the pam tag
+	// and is unavailable on OpenBSD, which has no PAM.
+	PAMService string
+	// LoginSession, if set, starts TTY commands through login(1) on macOS so
+	// they are registered like a Terminal.app session, with a utmpx entry, a
+	// login name and an audit session for per-session keychains, rather than
+	// looking like daemons.  Pid then reports the pid of login.  login always
+	// uses the user's primary group, so TTY commands with any other GID fail
+	// to start.  It is ignored on other systems.
+	LoginSession bool
+	// WindowsCredentials, if set, logs on this user and runs commands as them
+	// on Windows, much as UID and GID do on Unix.  The server must hold the
+	// privilege to assign primary tokens, which services running as
+	// LocalSystem do.  It is ignored on other systems.
+	WindowsCredentials *WindowsCredentials
+}
+
+// WindowsCredentials identify a Windows user to run commands as.
+type WindowsCredentials struct {
+	// Username is the account name, or a user principal name like
+	// user@example.com when Domain is empty.
+	Username string
+	// Domain is the domain of the account or "." for a local account.
+	Domain   string
+	Password string
 }
 
 func (l *localProcess) Stdin() io.WriteCloser {
 	return l.stdin
 }
 
-func (l *localProcess) Stdout() io.Reader {
+func (l *localProcess) Stdout() io.ReadCloser {
 	return l.stdout
 }
 
-func (l *localProcess) Stderr() io.Reader {
+func (l *localProcess) Stderr() io.ReadCloser {
 	return l.stderr
 }
 
 func (l *localProcess) Wait() error {
-	err := l.cmd.Wait()
+	err := l.waitCmd()
+	if l.pam != nil {
+		_ = l.pam.close()
+	}
 	if exitErr, ok := err.(*exec.ExitError); ok {
+		if ctxErr := l.ctx.Err(); ctxErr != nil && killed(exitErr.ProcessState) {
+			return canceledExitError(ctxErr)
+		}
 		return ExitError{
-			code:  exitErr.ExitCode(),
+			code:  exitCode(exitErr.ProcessState),
 			error: exitErr.Error(),
 		}
 	}
 	return err
 }
 
-func (l *localProcess) Close() error {
-	return l.cmd.Process.Signal(syscall.SIGTERM)
+func (l *localProcess) Usage() (ResourceUsage, bool) {
+	state := l.cmd.ProcessState
+	if state == nil {
+		return ResourceUsage{}, false
+	}
+	return ResourceUsage{
+		UserTime:   state.UserTime(),
+		SystemTime: state.SystemTime(),
+		MaxRSS:     maxRSS(state),
+	}, true
 }
 
 func (l *localProcess) Pid() int {
@@ -52,5 +90,5 @@ func (w disabledStdinWriter) Close() error {
 }
 
 func (w disabledStdinWriter) Write(_ []byte) (written int, err error) {
-	return 0, xerrors.Errorf("stdin is not enabled for this command")
+	return 0, codeErrorf(CodeStdinDisabled, "stdin is not enabled for this command")
 }
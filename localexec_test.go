@@ -13,6 +13,7 @@ import (
 
 	"cdr.dev/slog/sloggers/slogtest/assert"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
 )
 
 func TestLocalExec(t *testing.T) {
@@ -77,6 +78,72 @@ func TestExitCode(t *testing.T) {
 	assert.Equal(t, "exit error", exitErr.Error(), "exit status 127")
 }
 
+func TestShellCommand(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	output, err := Output(ctx, LocalExecer{}, Command{
+		Command: `printf '%s|' "$1" "$2"`,
+		Args:    []string{"it's", "$HOME `id`"},
+		Shell:   true,
+	})
+	assert.Success(t, "run shell command", err)
+	assert.Equal(t, "output", "it's|$HOME `id`|", string(output))
+
+	command := shellCommand(Command{Command: "echo $1", Args: []string{"hi"}, Shell: true}, "")
+	assert.Equal(t, "command", "/bin/sh", command.Command)
+	assert.Equal(t, "args", []string{"-c", userShellScript, "sh", "echo $1", "sh", "hi"}, command.Args)
+}
+
+func TestLoginShellCommand(t *testing.T) {
+	t.Parallel()
+
+	command := loginShellCommand(Command{TTY: true})
+	assert.Equal(t, "command", "/bin/sh", command.Command)
+	assert.Equal(t, "args", []string{"-c", loginShellScript, "sh"}, command.Args)
+	assert.Equal(t, "unchanged", Command{Command: "bash"}, loginShellCommand(Command{Command: "bash"}))
+}
+
+func TestExitCodeMapping(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Signal", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		process, err := LocalExecer{}.Start(ctx, Command{
+			Command: "sh",
+			Args:    []string{"-c", "kill -TERM $$"},
+		})
+		assert.Success(t, "start local cmd", err)
+
+		err = process.Wait()
+		exitErr, ok := err.(ExitError)
+		assert.True(t, "error is ExitError", ok)
+		assert.Equal(t, "exit error code", ExitCodeSignalBase+15, exitErr.ExitCode())
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+
+		process, err := LocalExecer{}.Start(ctx, Command{
+			Command: "sleep",
+			Args:    []string{"10"},
+		})
+		assert.Success(t, "start local cmd", err)
+		cancel()
+
+		err = process.Wait()
+		exitErr, ok := err.(ExitError)
+		assert.True(t, "error is ExitError", ok)
+		assert.Equal(t, "exit error code", ExitCodeCanceled, exitErr.ExitCode())
+		assert.True(t, "wraps context error", xerrors.Is(err, context.Canceled))
+	})
+}
+
 func TestStdin(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -6,24 +6,41 @@ package wsep
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"syscall"
+	"unsafe"
 
 	"github.com/creack/pty"
 	"golang.org/x/xerrors"
 )
 
 type localProcess struct {
+	// ctx is the context the process was started with.
+	ctx context.Context
 	// tty may be nil
 	tty *os.File
 	cmd *exec.Cmd
+	// pam may be nil
+	pam *pamSession
+	// warnings are problems the command started despite, such as a working
+	// directory it could not start in.
+	warnings []startWarning
+	// info is how the command was started.
+	info ProcessInfo
+	// exited is closed once a TTY command has exited with waitErr.  TTY
+	// commands are waited for as soon as they start.
+	exited  chan struct{}
+	waitErr error
 
 	stdin  io.WriteCloser
-	stdout io.Reader
-	stderr io.Reader
+	stdout io.ReadCloser
+	stderr io.ReadCloser
 }
 
 func (l *localProcess) Resize(_ context.Context, rows, cols uint16) error {
@@ -36,15 +53,259 @@ func (l *localProcess) Resize(_ context.Context, rows, cols uint16) error {
 	})
 }
 
+func (l *localProcess) Close() error {
+	return l.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// Signal sends SIGINT, SIGTERM or SIGKILL.  An interrupt for a TTY command is
+// typed into the terminal instead so the terminal sends SIGINT to whatever is
+// in the foreground, or passes Ctrl+C on to programs that read it themselves.
+func (l *localProcess) Signal(_ context.Context, sig Signal) error {
+	switch sig {
+	case SignalInterrupt:
+		if l.tty != nil {
+			_, err := l.tty.Write([]byte{ctrlC})
+			return err
+		}
+		return l.cmd.Process.Signal(syscall.SIGINT)
+	case SignalTerminate:
+		return l.cmd.Process.Signal(syscall.SIGTERM)
+	case SignalKill:
+		return l.cmd.Process.Kill()
+	}
+	return codeErrorf(CodeSignalUnsupported, "unknown signal %q", sig)
+}
+
+// waitCmd waits for the command to exit.
+func (l *localProcess) waitCmd() error {
+	if l.exited == nil {
+		return l.cmd.Wait()
+	}
+	<-l.exited
+	return l.waitErr
+}
+
+func (l *localProcess) startWarnings() []startWarning {
+	return l.warnings
+}
+
+func (l *localProcess) StartInfo() ProcessInfo {
+	return l.info
+}
+
+// SetTerminalModes changes the modes of the process' terminal.
+func (l *localProcess) SetTerminalModes(_ context.Context, modes TerminalModes) error {
+	if l.tty == nil {
+		return xerrors.New("command has no terminal")
+	}
+	return setTerminalModes(l.tty, modes)
+}
+
+// atPrompt reports whether the process is the foreground process group of its
+// TTY, which for a shell means it is not running a job.
+func (l *localProcess) atPrompt() bool {
+	if l.tty == nil {
+		return false
+	}
+	conn, err := l.tty.SyscallConn()
+	if err != nil {
+		return true
+	}
+	var (
+		pgrp  int32
+		errno syscall.Errno
+	)
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp)))
+	})
+	// If the foreground is unknown, as on OpenBSD releases that only permit
+	// system calls through libc, fall back to judging by activity alone.
+	if err != nil || errno != 0 {
+		return true
+	}
+	return int(pgrp) == l.cmd.Process.Pid
+}
+
+// exitCode maps the state of an exited process to an exit code, reporting a
+// death by signal as ExitCodeSignalBase plus the signal number.
+func exitCode(state *os.ProcessState) int {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		return ExitCodeSignalBase + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// maxRSS returns the peak resident memory of an exited process in bytes.
+func maxRSS(state *os.ProcessState) int64 {
+	usage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// Only macOS reports it in bytes rather than kilobytes.
+	if runtime.GOOS == "darwin" {
+		return int64(usage.Maxrss)
+	}
+	return int64(usage.Maxrss) * 1024
+}
+
+// killed reports whether the process was killed the way exec.CommandContext
+// kills it when its context ends.
+func killed(state *os.ProcessState) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGKILL
+}
+
+// startPTY starts the command with a terminal of the size, setting its modes
+// before the command runs.  Modes that cannot be set are reported as a warning
+// rather than failing the command.  It returns both ends of the terminal; the
+// caller must close the command's end once the command exits.
+func startPTY(cmd *exec.Cmd, size *pty.Winsize, modes TerminalModes) (*os.File, *os.File, string, error) {
+	// This is pty.StartWithSize except that the modes are set in between
+	// opening the terminal and starting the command, and this process keeps
+	// the command's end open.  Otherwise Linux may fail reads with EIO before
+	// the last of the output is read.
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	err = pty.Setsize(ptmx, size)
+	if err != nil {
+		_ = ptmx.Close()
+		_ = tty.Close()
+		return nil, nil, "", err
+	}
+	var warning string
+	if len(modes) > 0 {
+		err = setTerminalModes(tty, modes)
+		if err != nil {
+			warning = fmt.Sprintf("cannot set terminal modes: %v", err)
+		}
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	err = cmd.Start()
+	if err != nil {
+		_ = ptmx.Close()
+		_ = tty.Close()
+		return nil, nil, "", err
+	}
+	return ptmx, tty, warning, nil
+}
+
+// ptyReader reads the output of a terminal.  Linux fails reads with EIO once
+// nothing holds the command's end of the terminal, which is the end of the
+// output rather than an error.
+type ptyReader struct {
+	tty *os.File
+}
+
+func (p ptyReader) Read(b []byte) (int, error) {
+	n, err := p.tty.Read(b)
+	if xerrors.Is(err, syscall.EIO) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close discards the rest of the output, which must still be read so the
+// command does not block on a full terminal.  The terminal stays open since it
+// is also the command's stdin.
+func (p ptyReader) Close() error {
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, p)
+	}()
+	return nil
+}
+
 // Start executes the given command locally
 func (l LocalExecer) Start(ctx context.Context, c Command) (Process, error) {
 	var (
 		process localProcess
 		err     error
 	)
-	process.cmd = exec.CommandContext(ctx, c.Command, c.Args...)
-	process.cmd.Env = append(os.Environ(), c.Env...)
-	process.cmd.Dir = c.WorkingDir
+	process.ctx = ctx
+	env := os.Environ()
+	path := c.Command
+	shell := os.Getenv("SHELL")
+
+	if c.UID != 0 {
+		// Commands run as another user get that user's home, shell and login
+		// PATH rather than this process'.  Users without a passwd entry keep
+		// this process' environment.
+		if user, ok := lookupTargetUser(ctx, c.UID, c.GID); ok {
+			env = append(env, user.environ()...)
+			shell = user.shell
+			process.info.User = user.name
+			if path == "" {
+				path = user.shell
+			}
+		}
+	}
+	if path == "" {
+		// Users without a passwd entry get the default shell.
+		path = defaultLoginShell
+		if c.UID == 0 {
+			path = currentLoginShell()
+		}
+	}
+	if c.Command == "" {
+		process.info.Shell = path
+	}
+	if c.Shell {
+		if shell == "" {
+			shell = defaultLoginShell
+		}
+		c = shellCommand(c, shell)
+		path = c.Command
+		process.info.Shell = shell
+	}
+	if process.info.User == "" {
+		process.info.User = userName(c.UID)
+	}
+
+	if l.PAMService != "" && c.UID != 0 {
+		process.pam, err = openPAMSession(l.PAMService, c.UID)
+		if err != nil {
+			return nil, xerrors.Errorf("open pam session: %w", err)
+		}
+		env = append(env, process.pam.env()...)
+		defer func() {
+			if err != nil {
+				_ = process.pam.close()
+			}
+		}()
+	}
+	// Explicit variables take precedence over those of the user and PAM.
+	env = append(env, c.Env...)
+
+	if c.UID != 0 {
+		path, err = lookPathEnv(path, env)
+		if err != nil {
+			return nil, xerrors.Errorf("look up command: %w", err)
+		}
+	}
+	process.cmd = exec.CommandContext(ctx, path, c.Args...)
+	if c.Command == "" {
+		// An empty command starts the user's shell as a login shell.
+		process.cmd.Args[0] = "-" + filepath.Base(path)
+	} else {
+		process.cmd.Args[0] = c.Command
+	}
+	process.cmd.Env = env
+	dir, warning := resolveWorkingDir(c.WorkingDir, env, c.UID, c.GID)
+	process.cmd.Dir = dir
+	if warning != "" {
+		process.warnings = append(process.warnings, startWarning{CodeWorkingDirFallback, warning})
+	}
+	process.info.WorkingDir = dir
+	if dir == "" {
+		process.info.WorkingDir, _ = os.Getwd()
+	}
 
 	if c.GID != 0 || c.UID != 0 {
 		process.cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -61,14 +322,35 @@ func (l LocalExecer) Start(ctx context.Context, c Command) (Process, error) {
 	if c.TTY {
 		// This special WSEP_TTY variable helps debug unexpected TTYs.
 		process.cmd.Env = append(process.cmd.Env, "WSEP_TTY=true")
-		process.tty, err = pty.StartWithSize(process.cmd, &pty.Winsize{
+		if l.LoginSession {
+			err = wrapLogin(process.cmd, c.UID, c.GID, c.Command == "")
+			if err != nil {
+				return nil, xerrors.Errorf("start login session: %w", err)
+			}
+		}
+		var (
+			tty     *os.File
+			warning string
+		)
+		process.tty, tty, warning, err = startPTY(process.cmd, &pty.Winsize{
 			Rows: c.Rows,
 			Cols: c.Cols,
-		})
+		}, c.TerminalModes)
 		if err != nil {
 			return nil, xerrors.Errorf("start command with pty: %w", err)
 		}
-		process.stdout = process.tty
+		// The output ends once the command's end of the terminal is closed,
+		// which waits for the command to exit.
+		process.exited = make(chan struct{})
+		go func() {
+			process.waitErr = process.cmd.Wait()
+			_ = tty.Close()
+			close(process.exited)
+		}()
+		if warning != "" {
+			process.warnings = append(process.warnings, startWarning{CodeTerminalModesFailed, warning})
+		}
+		process.stdout = ptyReader{process.tty}
 		process.stderr = ioutil.NopCloser(bytes.NewReader(nil))
 		process.stdin = process.tty
 	} else {
@@ -4,28 +4,334 @@
 package wsep
 
 import (
+	"bytes"
 	"context"
 	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"golang.org/x/xerrors"
 )
 
+const (
+	// defaultConPTYRows and defaultConPTYCols size pseudoconsoles started
+	// without a size since ConPTY rejects an empty one.
+	defaultConPTYRows = 24
+	defaultConPTYCols = 80
+	// statusControlCExit is the NTSTATUS a console process exits with when it
+	// is ended by Ctrl+C.
+	statusControlCExit = 0xC000013A
+)
+
 type localProcess struct {
+	// ctx is the context the process was started with.
+	ctx context.Context
 	// tty may be nil
-	tty uintptr
+	tty *conPTY
 	cmd *exec.Cmd
+	// job holds the command and everything it starts.
+	job *jobObject
+	// pam may be nil
+	pam *pamSession
 
 	stdin  io.WriteCloser
-	stdout io.Reader
-	stderr io.Reader
+	stdout io.ReadCloser
+	stderr io.ReadCloser
 }
 
 func (l *localProcess) Resize(_ context.Context, rows, cols uint16) error {
-	return xerrors.Errorf("Windows local execution is not supported")
+	if l.tty == nil {
+		return nil
+	}
+	return l.tty.Resize(rows, cols)
 }
 
-// Start executes the given command locally
+// Close closes the pseudoconsole of a TTY command, which ends it the way
+// closing its console window would, and kills any other command since Windows
+// has no SIGTERM.  Either way everything the command started is killed once it
+// exits.
+func (l *localProcess) Close() error {
+	if l.tty != nil {
+		return l.tty.Close()
+	}
+	return l.job.Close()
+}
+
+// Signal types Ctrl+C into the console of a TTY command to interrupt it and
+// sends CTRL_BREAK_EVENT to other commands, since Windows only delivers
+// CTRL_C_EVENT to everything attached to a console.  Terminate closes the
+// command as Close does and kill ends its whole process tree at once.
+func (l *localProcess) Signal(_ context.Context, sig Signal) error {
+	switch sig {
+	case SignalInterrupt:
+		if l.tty != nil {
+			_, err := l.tty.input.Write([]byte{ctrlC})
+			return err
+		}
+		return sendCtrlBreak(uint32(l.cmd.Process.Pid))
+	case SignalTerminate:
+		return l.Close()
+	case SignalKill:
+		return l.job.Close()
+	}
+	return codeErrorf(CodeSignalUnsupported, "unknown signal %q", sig)
+}
+
+// exitCode maps the state of an exited process to an exit code, reporting an
+// exit by Ctrl+C as ExitCodeSignalBase plus SIGINT as it would be on Unix.
+// Other NTSTATUS values are reported as they are.
+func exitCode(state *os.ProcessState) int {
+	if uint32(state.ExitCode()) == statusControlCExit {
+		return ExitCodeSignalBase + int(syscall.SIGINT)
+	}
+	return state.ExitCode()
+}
+
+// maxRSS returns zero since Windows does not report the peak memory of an
+// exited process through its state.
+func maxRSS(_ *os.ProcessState) int64 {
+	return 0
+}
+
+// killed reports whether the process was killed the way exec.CommandContext
+// kills it when its context ends, which cannot be told apart from an exit on
+// Windows.
+func killed(_ *os.ProcessState) bool {
+	return true
+}
+
+// waitCmd waits for the command to exit.
+func (l *localProcess) waitCmd() error {
+	return l.cmd.Wait()
+}
+
+// Start executes the given command locally.  TTY commands run in a ConPTY
+// pseudoconsole, which requires Windows 10 1809 or later.  Commands run as the
+// user in WindowsCredentials if set, with that user's default environment
+// instead of this process'.  UID, GID, ChildProcessPriority and PAMService are
+// ignored on Windows and Shell is refused.  Commands run in a job object so that anything they
+// start is killed along with them when they exit, are closed or ctx ends.
 func (l LocalExecer) Start(ctx context.Context, c Command) (Process, error) {
-	return nil, xerrors.Errorf("Windows local execution is not supported")
+	var (
+		process localProcess
+		err     error
+	)
+	process.ctx = ctx
+	env := append(os.Environ(), c.Env...)
+	if c.Shell {
+		return nil, codeErrorf(CodeInvalidCommand, "shell commands are not supported on Windows")
+	}
+
+	var token syscall.Token
+	if l.WindowsCredentials != nil {
+		token, err = l.WindowsCredentials.logon()
+		if err != nil {
+			return nil, xerrors.Errorf("log on %q: %w", l.WindowsCredentials.Username, err)
+		}
+		// The token is only needed to create the process.
+		defer token.Close()
+		env, err = userEnvironment(token)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, c.Env...)
+		// Resolve the command in the user's PATH rather than this process'.
+		c.Command, err = lookPathEnv(c.Command, env)
+		if err != nil {
+			return nil, xerrors.Errorf("look up command: %w", err)
+		}
+	}
+
+	process.job, err = newJobObject()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = process.job.Close()
+		}
+	}()
+
+	if c.TTY {
+		// This special WSEP_TTY variable helps debug unexpected TTYs.
+		env = append(env, "WSEP_TTY=true")
+		process.tty, process.cmd, err = startConPTY(ctx, c, token, env, process.job)
+		if err != nil {
+			return nil, xerrors.Errorf("start command with pty: %w", err)
+		}
+		process.stdout = process.tty.output
+		process.stderr = ioutil.NopCloser(bytes.NewReader(nil))
+		process.stdin = process.tty.input
+		return &process, nil
+	}
+
+	process.cmd = exec.CommandContext(ctx, c.Command, c.Args...)
+	process.cmd.Env = env
+	process.cmd.Dir = c.WorkingDir
+	// Leading a process group of its own lets the command be interrupted
+	// without interrupting this process.
+	process.cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+		Token:         token,
+	}
+
+	if c.Stdin {
+		process.stdin, err = process.cmd.StdinPipe()
+		if err != nil {
+			return nil, xerrors.Errorf("create pipe: %w", err)
+		}
+	} else {
+		process.stdin = disabledStdinWriter{}
+	}
+
+	process.stdout, err = process.cmd.StdoutPipe()
+	if err != nil {
+		return nil, xerrors.Errorf("create pipe: %w", err)
+	}
+
+	process.stderr, err = process.cmd.StderrPipe()
+	if err != nil {
+		return nil, xerrors.Errorf("create pipe: %w", err)
+	}
+
+	err = process.cmd.Start()
+	if err != nil {
+		return nil, xerrors.Errorf("start command: %w", err)
+	}
+	// os/exec cannot create the process suspended so anything it starts in the
+	// moment before it joins the job escapes.
+	var handle syscall.Handle
+	handle, err = syscall.OpenProcess(processSetQuota|syscall.PROCESS_TERMINATE|syscall.SYNCHRONIZE, false, uint32(process.cmd.Process.Pid))
+	if err == nil {
+		err = process.job.assign(handle)
+		if err != nil {
+			_ = syscall.CloseHandle(handle)
+		}
+	}
+	if err != nil {
+		_ = process.cmd.Process.Kill()
+		_ = process.cmd.Wait()
+		return nil, xerrors.Errorf("add command to job: %w", err)
+	}
+	process.job.watch(ctx, handle, nil)
+	return &process, nil
+}
+
+// startConPTY starts the command in a new pseudoconsole and job, as the user
+// token belongs to unless it is zero.  os/exec cannot attach a process to a
+// pseudoconsole so the process is created directly and handed to an exec.Cmd
+// only to be waited on, and is killed when ctx ends as exec.CommandContext
+// would.
+func startConPTY(ctx context.Context, c Command, token syscall.Token, env []string, job *jobObject) (*conPTY, *exec.Cmd, error) {
+	path, err := exec.LookPath(c.Command)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("look up command: %w", err)
+	}
+	rows, cols := c.Rows, c.Cols
+	if rows == 0 || cols == 0 {
+		rows, cols = defaultConPTYRows, defaultConPTYCols
+	}
+	tty, err := newConPTY(rows, cols)
+	if err != nil {
+		return nil, nil, err
+	}
+	pi, err := tty.start(token, path, commandLine(c.Command, c.Args), c.WorkingDir, env)
+	if err != nil {
+		_ = tty.Close()
+		return nil, nil, err
+	}
+	defer syscall.CloseHandle(pi.Thread)
+
+	// The process handle is still open so the pid cannot have been reused.
+	proc, err := os.FindProcess(int(pi.ProcessId))
+	if err == nil {
+		err = job.assign(pi.Process)
+	}
+	if err == nil {
+		err = resumeThread(pi.Thread)
+	}
+	if err != nil {
+		_ = syscall.TerminateProcess(pi.Process, 1)
+		_ = syscall.CloseHandle(pi.Process)
+		_ = tty.Close()
+		return nil, nil, err
+	}
+
+	job.watch(ctx, pi.Process, func() {
+		// Output only reaches EOF once the pseudoconsole is closed, which it is
+		// not by the process exiting.
+		_ = tty.Close()
+	})
+
+	return tty, &exec.Cmd{
+		Path:    path,
+		Args:    append([]string{c.Command}, c.Args...),
+		Env:     env,
+		Dir:     c.WorkingDir,
+		Process: proc,
+	}, nil
+}
+
+// commandLine joins a command and its arguments into a command line that
+// Windows programs parse back into the same arguments.
+func commandLine(command string, args []string) string {
+	parts := make([]string, 0, 1+len(args))
+	parts = append(parts, syscall.EscapeArg(command))
+	for _, arg := range args {
+		parts = append(parts, syscall.EscapeArg(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// lookPathEnv finds a command the way exec.LookPath does but in the PATH and
+// PATHEXT of env rather than this process'.
+func lookPathEnv(file string, env []string) (string, error) {
+	var path, pathext string
+	for _, kv := range env {
+		switch strings.ToUpper(envName(kv)) {
+		case "PATH":
+			path = kv[len("PATH="):]
+		case "PATHEXT":
+			pathext = kv[len("PATHEXT="):]
+		}
+	}
+	exts := []string{".com", ".exe", ".bat", ".cmd"}
+	if pathext != "" {
+		exts = strings.Split(strings.ToLower(pathext), ";")
+	}
+	if strings.ContainsAny(file, `:\/`) {
+		return findExecutable(file, exts)
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		if name, err := findExecutable(filepath.Join(dir, file), exts); err == nil {
+			return name, nil
+		}
+	}
+	return "", xerrors.Errorf("%q: %w", file, exec.ErrNotFound)
+}
+
+// findExecutable returns the file, or the file with the first of exts that
+// exists if it has no extension.
+func findExecutable(file string, exts []string) (string, error) {
+	if filepath.Ext(file) != "" {
+		if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+			return file, nil
+		}
+	}
+	for _, ext := range exts {
+		if ext == "" {
+			continue
+		}
+		if info, err := os.Stat(file + ext); err == nil && info.Mode().IsRegular() {
+			return file + ext, nil
+		}
+	}
+	return "", xerrors.Errorf("%q: %w", file, exec.ErrNotFound)
 }
@@ -0,0 +1,112 @@
+//go:build windows
+// +build windows
+
+package wsep
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestEnvironmentBlock(t *testing.T) {
+	t.Parallel()
+
+	block, err := environmentBlock([]string{"Path=C:\\a", "=C:=C:\\", "b=1", "PATH=C:\\b"})
+	assert.Success(t, "environment block", err)
+	assert.Equal(t, "block", "=C:=C:\\\x00b=1\x00PATH=C:\\b\x00\x00", string(utf16Runes(block)))
+
+	block, err = environmentBlock(nil)
+	assert.Success(t, "empty environment block", err)
+	assert.Equal(t, "empty block", []uint16{0, 0}, block)
+
+	_, err = environmentBlock([]string{"a=\x00"})
+	assert.Error(t, "environment variable with a NUL", err)
+}
+
+// utf16Runes converts a block of UTF-16 without stopping at NULs.
+func utf16Runes(block []uint16) []rune {
+	runes := make([]rune, len(block))
+	for i, c := range block {
+		runes[i] = rune(c)
+	}
+	return runes
+}
+
+func TestConPTY(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	process, err := LocalExecer{}.Start(ctx, Command{
+		Command: "cmd.exe",
+		Args:    []string{"/c", "echo %WSEP_TEST% & exit 3"},
+		Env:     []string{"WSEP_TEST=hello"},
+		TTY:     true,
+		Rows:    24,
+		Cols:    80,
+	})
+	assert.Success(t, "start command", err)
+	assert.Success(t, "resize", process.Resize(ctx, 40, 120))
+
+	stdout, err := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.True(t, "stdout has output", strings.Contains(string(stdout), "hello"))
+
+	err = process.Wait()
+	var exitErr ExitError
+	assert.True(t, "exit error", xerrors.As(err, &exitErr))
+	assert.Equal(t, "exit code", 3, exitErr.ExitCode())
+}
+
+func TestUserEnvironment(t *testing.T) {
+	t.Parallel()
+
+	token, err := syscall.OpenCurrentProcessToken()
+	assert.Success(t, "open token", err)
+	defer token.Close()
+
+	env, err := userEnvironment(token)
+	assert.Success(t, "user environment", err)
+	var found bool
+	for _, kv := range env {
+		if strings.EqualFold(envName(kv), "SystemRoot") {
+			found = true
+		}
+	}
+	assert.True(t, "SystemRoot is set", found)
+}
+
+func TestJobObject(t *testing.T) {
+	t.Parallel()
+
+	job, err := newJobObject()
+	assert.Success(t, "create job", err)
+
+	cmd := exec.Command("ping", "-n", "30", "127.0.0.1")
+	assert.Success(t, "start command", cmd.Start())
+	handle, err := syscall.OpenProcess(processSetQuota|syscall.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid))
+	assert.Success(t, "open process", err)
+	defer syscall.CloseHandle(handle)
+	assert.Success(t, "assign process", job.assign(handle))
+
+	// Closing the job kills what is in it.
+	assert.Success(t, "close job", job.Close())
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		assert.Error(t, "killed", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("process outlived its job")
+	}
+}
@@ -0,0 +1,59 @@
+//go:build darwin
+// +build darwin
+
+package wsep
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+)
+
+// loginProgram registers terminal sessions on macOS.
+const loginProgram = "/usr/bin/login"
+
+// wrapLogin rewrites a TTY command to run through login(1), which records the
+// session in utmpx so who and last list it, sets its login name, and starts an
+// audit session so per-session keychains work as they do in Terminal.app.  The
+// command runs as uid, or as this process' user if it is zero.  login switches
+// to the user itself so the command's own credentials are dropped, and since
+// it always uses the user's primary group any other gid is refused.  A login
+// shell without a working directory keeps its leading dash and other commands
+// run as they would without login.
+func wrapLogin(cmd *exec.Cmd, uid, gid uint32, loginShell bool) error {
+	if _, err := os.Stat(loginProgram); err != nil {
+		return nil
+	}
+	if uid == 0 {
+		uid = uint32(os.Getuid())
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return err
+	}
+	if gid != 0 && u.Gid != strconv.FormatUint(uint64(gid), 10) {
+		return codeErrorf(CodeInvalidCommand, "login sessions run in %s's primary group %s, not gid %d", u.Username, u.Gid, gid)
+	}
+
+	// -p keeps the environment, -f skips authentication which only root or the
+	// user themselves may, and -q skips the message of the day.
+	args := []string{"login", "-pfq"}
+	if !loginShell || cmd.Dir != "" {
+		// Without -l login prefixes the program's name with a dash.
+		args = append(args, "-l")
+	}
+	args = append(args, u.Username)
+	if cmd.Dir != "" {
+		// login changes to the user's home directory so a shell changes back.
+		args = append(args, "/bin/sh", "-c", `cd "$1" || exit; shift; exec "$@"`, "sh", cmd.Dir)
+	}
+	args = append(append(args, cmd.Path), cmd.Args[1:]...)
+
+	cmd.Path = loginProgram
+	cmd.Args = args
+	if cmd.SysProcAttr != nil {
+		cmd.SysProcAttr.Credential = nil
+	}
+	return nil
+}
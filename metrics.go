@@ -0,0 +1,99 @@
+package wsep
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo describes a session and its activity so far.
+type SessionInfo struct {
+	// ID is the ID clients attach to the session with.
+	ID string
+	// Owner is who may attach to the session, or empty if anyone may.
+	Owner string
+	// Command is the command the session was started with.
+	Command string
+	// Started is when the session was created and Uptime how long ago that
+	// was.
+	Started time.Time
+	Uptime  time.Duration
+	// BytesIn counts the stdin written to the session and BytesOut the output
+	// sent from it, summed over every connection attached to it.
+	BytesIn  int64
+	BytesOut int64
+	// Attaches counts every attach to the session, the first included, and
+	// Reconnects those after the first.
+	Attaches   int64
+	Reconnects int64
+}
+
+// sessionMetrics counts the activity of a session across the connections
+// attached to it.  The counters must be accessed atomically and come first so
+// they are aligned on 32-bit platforms.  A nil sessionMetrics counts nothing.
+type sessionMetrics struct {
+	bytesIn  int64
+	bytesOut int64
+	attaches int64
+	started  time.Time
+}
+
+// attached counts an attach.
+func (m *sessionMetrics) attached() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.attaches, 1)
+}
+
+// addIn counts n bytes of stdin.
+func (m *sessionMetrics) addIn(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.bytesIn, int64(n))
+}
+
+// outputReader returns a reader that counts the output read from r.
+func (m *sessionMetrics) outputReader(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &countingReader{r: r, n: &m.bytesOut}
+}
+
+// countingReader adds the bytes read from r to n atomically.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// info returns the session's description under the ID id.
+func (s *Session) info(id string) SessionInfo {
+	s.cond.L.Lock()
+	owner := s.owner
+	s.cond.L.Unlock()
+
+	attaches := atomic.LoadInt64(&s.metrics.attaches)
+	var reconnects int64
+	if attaches > 1 {
+		reconnects = attaches - 1
+	}
+	return SessionInfo{
+		ID:         id,
+		Owner:      owner,
+		Command:    s.command.Command,
+		Started:    s.metrics.started,
+		Uptime:     time.Since(s.metrics.started),
+		BytesIn:    atomic.LoadInt64(&s.metrics.bytesIn),
+		BytesOut:   atomic.LoadInt64(&s.metrics.bytesOut),
+		Attaches:   attaches,
+		Reconnects: reconnects,
+	}
+}
@@ -0,0 +1,194 @@
+package wsep
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+// sessionExportVersion is bumped whenever the export format changes in a way
+// older servers cannot import.
+const sessionExportVersion = 1
+
+// sessionExport is the format of ExportSessions.
+type sessionExport struct {
+	Version  int            `json:"version"`
+	Sessions []sessionState `json:"sessions"`
+}
+
+// sessionState is everything needed to pick a session back up from its screen
+// daemon.
+type sessionState struct {
+	// ID is the ID clients attach with and ScreenID is the name of the screen
+	// session.
+	ID          string        `json:"id"`
+	ScreenID    string        `json:"screen_id"`
+	Command     proto.Command `json:"command"`
+	ConfigFile  string        `json:"config_file"`
+	SocketsDir  string        `json:"sockets_dir"`
+	JournalPath string        `json:"journal_path,omitempty"`
+	Owner       string        `json:"owner,omitempty"`
+	Frozen      bool          `json:"frozen,omitempty"`
+	// Expires is when the session times out if nothing attaches to it.
+	Expires time.Time    `json:"expires"`
+	Shares  []shareState `json:"shares,omitempty"`
+	// Started is when the session was created so its uptime carries over.
+	Started time.Time `json:"started,omitempty"`
+}
+
+type shareState struct {
+	Token    string    `json:"token"`
+	ReadOnly bool      `json:"read_only,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+}
+
+// ExportSessions hands the server's sessions off for ImportSessions on another
+// server, for example to upgrade the process hosting it in place.  The screen
+// daemons keep running but the sessions are closed on this server, ending the
+// connections attached to them, so clients need to reconnect to the new
+// server.  Sessions that are still starting or already closing are left out.
+// Serving should stop before exporting since sessions started afterward are
+// not exported.
+func (srv *Server) ExportSessions() ([]byte, error) {
+	srv.sessionsMutex.Lock()
+	export := sessionExport{Version: sessionExportVersion}
+	var exported []*Session
+	srv.sessions.Range(func(k, rawSession interface{}) bool {
+		s, ok := rawSession.(*Session)
+		if !ok {
+			return true
+		}
+		state, ok := s.handOff(k.(string))
+		if ok {
+			export.Sessions = append(export.Sessions, state)
+			exported = append(exported, s)
+		}
+		return true
+	})
+	srv.sessionsMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range exported {
+		wg.Add(1)
+		go func(s *Session) {
+			defer wg.Done()
+			s.Close("exported")
+		}(s)
+	}
+	wg.Wait()
+
+	data, err := json.Marshal(export)
+	if err != nil {
+		return nil, xerrors.Errorf("marshal sessions: %w", err)
+	}
+	return data, nil
+}
+
+// ImportSessions adds sessions exported by ExportSessions to the server, to be
+// run with the execer and options like those passed to Serve.  Each keeps the
+// owner, share tokens, frozen state and remaining timeout it had on the old
+// server.  Nothing is imported if a session with the same ID already exists.
+func (srv *Server) ImportSessions(data []byte, execer Execer, options *Options) error {
+	var export sessionExport
+	err := json.Unmarshal(data, &export)
+	if err != nil {
+		return xerrors.Errorf("unmarshal sessions: %w", err)
+	}
+	if export.Version != sessionExportVersion {
+		return xerrors.Errorf("unsupported session export version %d", export.Version)
+	}
+
+	sessionOptions := &Options{}
+	if options != nil {
+		*sessionOptions = *options
+	}
+	if sessionOptions.SessionTimeout == 0 {
+		sessionOptions.SessionTimeout = defaultSessionTimeout
+	}
+
+	srv.sessionsMutex.Lock()
+	defer srv.sessionsMutex.Unlock()
+	for _, state := range export.Sessions {
+		if _, ok := srv.sessions.Load(state.ID); ok {
+			return xerrors.Errorf("session %s already exists", state.ID)
+		}
+	}
+	for _, state := range export.Sessions {
+		srv.addSession(state.ID, restoreSession(state, execer, sessionOptions), sessionOptions)
+	}
+	return nil
+}
+
+// handOff marks the session as exported and returns its state, or false if it
+// is not ready.
+func (s *Session) handOff(id string) (sessionState, bool) {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	if s.state != StateReady {
+		return sessionState{}, false
+	}
+	s.handedOff = true
+	return s.stateLocked(id), true
+}
+
+// stateLocked returns the session's state.  The caller must hold cond.L.
+func (s *Session) stateLocked(id string) sessionState {
+	state := sessionState{
+		ID:          id,
+		ScreenID:    s.id,
+		Command:     mapToProtoCmd(*s.command),
+		ConfigFile:  s.configFile,
+		SocketsDir:  s.socketsDir,
+		JournalPath: s.journalPath,
+		Owner:       s.owner,
+		Frozen:      s.frozen,
+		Expires:     s.deadline,
+		Started:     s.metrics.started,
+	}
+	for token, grant := range s.shares {
+		state.Shares = append(state.Shares, shareState{Token: token, ReadOnly: grant.readOnly, Expires: grant.expires})
+	}
+	return state
+}
+
+// restoreSession sets up a session from its exported state.
+func restoreSession(state sessionState, execer Execer, options *Options) *Session {
+	s := &Session{
+		command:     mapToClientCmd(state.Command),
+		cond:        sync.NewCond(&sync.Mutex{}),
+		configFile:  state.ConfigFile,
+		execer:      execer,
+		frozen:      state.Frozen,
+		id:          state.ScreenID,
+		input:       &inputLock{},
+		journalPath: state.JournalPath,
+		options:     options,
+		owner:       state.Owner,
+		quota:       newQuota(options),
+		metrics:     &sessionMetrics{started: state.Started},
+		state:       StateStarting,
+		socketsDir:  state.SocketsDir,
+		daemonUp:    make(chan struct{}),
+	}
+	if s.metrics.started.IsZero() {
+		s.metrics.started = time.Now()
+	}
+	for _, share := range state.Shares {
+		if s.shares == nil {
+			s.shares = make(map[string]shareGrant)
+		}
+		s.shares[share.Token] = shareGrant{readOnly: share.ReadOnly, expires: share.Expires}
+	}
+	// Give clients time to reconnect even if the session was about to time
+	// out when it was exported.
+	timeout := time.Until(state.Expires)
+	if timeout < s.attachTimeout() {
+		timeout = s.attachTimeout()
+	}
+	go s.lifecycle(timeout)
+	return s
+}
@@ -0,0 +1,40 @@
+package wsep
+
+import (
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestExportSessions(t *testing.T) {
+	t.Parallel()
+
+	old := newServer(t)
+	s := storeSession(t, old, "id", &Options{Owner: "alice", SessionTimeout: time.Minute})
+	token, err := old.ShareSession("id", true, time.Hour)
+	assert.Success(t, "share", err)
+
+	data, err := old.ExportSessions()
+	assert.Success(t, "export", err)
+	s.WaitForState(StateDone)
+	assert.True(t, "exported session closed", s.isHandedOff())
+	for old.SessionCount() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server := newServer(t)
+	err = server.ImportSessions(data, LocalExecer{}, nil)
+	assert.Success(t, "import", err)
+	imported, err := server.session("id")
+	assert.Success(t, "imported session", err)
+	assert.Equal(t, "screen session", s.id, imported.id)
+	assert.Equal(t, "owner", "alice", imported.Owner())
+	readOnly, ok := imported.redeemShare(token)
+	assert.True(t, "share token kept", ok && readOnly)
+	_, err = imported.WaitForState(StateReady)
+	assert.Success(t, "ready", err)
+
+	err = server.ImportSessions(data, LocalExecer{}, nil)
+	assert.True(t, "duplicate import fails", err != nil)
+}
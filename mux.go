@@ -0,0 +1,155 @@
+package wsep
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/hashicorp/yamux"
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// ServeMux runs the server-side of wsep over a plain connection (for example
+// TCP or TLS) multiplexed with yamux.  Each logical stream carries a single
+// command as with ServeStream.  The connection is closed once ServeMux yields.
+func (srv *Server) ServeMux(ctx context.Context, nc net.Conn, execer Execer, options *Options) error {
+	session, err := yamux.Server(nc, muxConfig())
+	if err != nil {
+		_ = nc.Close()
+		return xerrors.Errorf("create mux session: %w", err)
+	}
+	defer session.Close()
+
+	err = srv.ServeListener(ctx, session, execer, options)
+	// The client closing the session is a normal closure.
+	if xerrors.Is(err, yamux.ErrSessionShutdown) || xerrors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// ServeMuxListener accepts connections from the listener and serves each with
+// ServeMux until the context ends or the listener fails.  The listener is
+// closed once ServeMuxListener yields.
+func (srv *Server) ServeMuxListener(ctx context.Context, l net.Listener, execer Execer, options *Options) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return xerrors.Errorf("accept: %w", err)
+		}
+		go func() {
+			err := srv.ServeMux(ctx, nc, execer, options)
+			if err != nil && ctx.Err() == nil {
+				flog.Error("failed to serve mux: %v", err)
+			}
+		}()
+	}
+}
+
+// MuxClient runs many commands over a single connection multiplexed with
+// yamux.
+type MuxClient struct {
+	session *yamux.Session
+}
+
+// NewMuxClient creates a client over an established connection to a server
+// running ServeMux.
+func NewMuxClient(nc net.Conn) (*MuxClient, error) {
+	session, err := yamux.Client(nc, muxConfig())
+	if err != nil {
+		return nil, xerrors.Errorf("create mux session: %w", err)
+	}
+	return &MuxClient{session: session}, nil
+}
+
+// DialMux connects to a server running ServeMuxListener over TCP, or TLS if
+// tlsConfig is not nil.
+func DialMux(ctx context.Context, addr string, tlsConfig *tls.Config) (*MuxClient, error) {
+	var (
+		dialer net.Dialer
+		nc     net.Conn
+		err    error
+	)
+	if tlsConfig != nil {
+		nc, err = dialTLS(ctx, &dialer, addr, tlsConfig)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewMuxClient(nc)
+	if err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// dialTLS dials addr over TCP and completes a TLS handshake, both bounded by
+// ctx.  Like tls.Dial the server name defaults to the host dialed.
+func dialTLS(ctx context.Context, dialer *net.Dialer, addr string, config *tls.Config) (net.Conn, error) {
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+	conn := tls.Client(nc, config)
+	handshake := make(chan error, 1)
+	go func() {
+		handshake <- conn.Handshake()
+	}()
+	select {
+	case err = <-handshake:
+	case <-ctx.Done():
+		_ = nc.Close()
+		<-handshake
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Execer opens a new logical stream.  Like RemoteExecer the returned execer can
+// start a single command; closing the process closes only its stream.
+func (m *MuxClient) Execer() (Execer, error) {
+	stream, err := m.session.Open()
+	if err != nil {
+		return nil, xerrors.Errorf("open stream: %w", err)
+	}
+	return RemoteStreamExecer(stream), nil
+}
+
+// Close closes the underlying connection and all of its streams.
+func (m *MuxClient) Close() error {
+	return m.session.Close()
+}
+
+func muxConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	// Log through errors rather than yamux's own logger.
+	config.LogOutput = ioutil.Discard
+	return config
+}
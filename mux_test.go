@@ -0,0 +1,45 @@
+package wsep
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestMuxExec(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Success(t, "listen", err)
+	wsepServer := newServer(t)
+	go func() {
+		_ = wsepServer.ServeMuxListener(ctx, l, LocalExecer{}, nil)
+	}()
+
+	client, err := DialMux(ctx, l.Addr().String(), nil)
+	assert.Success(t, "dial", err)
+	defer client.Close()
+
+	// Run several commands at once over the same connection.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			execer, err := client.Execer()
+			assert.Success(t, "open execer", err)
+			testExecer(ctx, t, execer)
+		}()
+	}
+	wg.Wait()
+
+	execer, err := client.Execer()
+	assert.Success(t, "open execer", err)
+	testExecerFail(ctx, t, execer)
+}
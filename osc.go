@@ -0,0 +1,214 @@
+package wsep
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+const (
+	esc = 0x1b
+	bel = 0x07
+	// maxOSCLength bounds buffered sequences so that relayed payloads fit in a
+	// message.  Longer sequences are passed through untouched.
+	maxOSCLength = maxMessageSize / 2
+)
+
+type oscState int
+
+const (
+	oscNormal oscState = iota
+	// oscEscape means an escape was seen in normal output.
+	oscEscape
+	// oscBody means an OSC sequence is being read.
+	oscBody
+	// oscBodyEscape means an escape was seen inside an OSC sequence which may
+	// begin the string terminator.
+	oscBodyEscape
+)
+
+// oscFilter passes TTY output through while handing complete operating system
+// command sequences (ESC ] code ; payload BEL or ESC \) to handle.  If handle
+// returns true the sequence is removed from the output.  Sequences split across
+// reads are held until they complete.  If bell is set, BEL characters outside
+// of sequences are removed and reported to it instead.
+type oscFilter struct {
+	r      io.Reader
+	handle func(code string, payload []byte) bool
+	bell   func()
+
+	state oscState
+	// seq holds the sequence in progress including its introducer.
+	seq []byte
+	// out holds processed output not yet returned.
+	out bytes.Buffer
+	buf []byte
+}
+
+func newOSCFilter(r io.Reader, handle func(code string, payload []byte) bool, bell func()) *oscFilter {
+	return &oscFilter{
+		r:      r,
+		handle: handle,
+		bell:   bell,
+		buf:    make([]byte, maxMessageSize),
+	}
+}
+
+func (f *oscFilter) Read(p []byte) (int, error) {
+	for f.out.Len() == 0 {
+		n, err := f.r.Read(f.buf)
+		f.process(f.buf[:n])
+		if err != nil {
+			// Nothing more will complete a partial sequence.
+			f.out.Write(f.seq)
+			f.seq = nil
+			f.state = oscNormal
+			if f.out.Len() == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+	return f.out.Read(p)
+}
+
+func (f *oscFilter) process(b []byte) {
+	for _, c := range b {
+		switch f.state {
+		case oscNormal:
+			if c == esc {
+				f.seq = append(f.seq[:0], c)
+				f.state = oscEscape
+				continue
+			}
+			if c == bel && f.bell != nil {
+				f.bell()
+				continue
+			}
+			f.out.WriteByte(c)
+		case oscEscape:
+			if c == ']' {
+				f.seq = append(f.seq, c)
+				f.state = oscBody
+				continue
+			}
+			f.out.Write(f.seq)
+			f.seq = f.seq[:0]
+			f.state = oscNormal
+			f.process([]byte{c})
+		case oscBody:
+			f.seq = append(f.seq, c)
+			switch {
+			case c == bel:
+				f.complete(len(f.seq) - 1)
+			case c == esc:
+				f.state = oscBodyEscape
+			case len(f.seq) > maxOSCLength:
+				f.abort()
+			}
+		case oscBodyEscape:
+			if c == '\\' {
+				f.seq = append(f.seq, c)
+				f.complete(len(f.seq) - 2)
+				continue
+			}
+			// Any other escape aborts the sequence and begins a new one.
+			f.seq = f.seq[:len(f.seq)-1]
+			f.abort()
+			f.seq = append(f.seq[:0], esc)
+			f.state = oscEscape
+			f.process([]byte{c})
+		}
+	}
+}
+
+// complete handles the sequence in seq whose body ends at end.
+func (f *oscFilter) complete(end int) {
+	body := f.seq[2:end]
+	code := body
+	var payload []byte
+	if i := bytes.IndexByte(body, ';'); i >= 0 {
+		code, payload = body[:i], body[i+1:]
+	}
+	if !f.handle(string(code), payload) {
+		f.out.Write(f.seq)
+	}
+	f.seq = f.seq[:0]
+	f.state = oscNormal
+}
+
+// abort passes the sequence in progress through untouched.
+func (f *oscFilter) abort() {
+	f.out.Write(f.seq)
+	f.seq = f.seq[:0]
+	f.state = oscNormal
+}
+
+// newRelayFilter returns a filter that relays the terminal events the command
+// asked for as messages written to w, or nil if it asked for none.
+func newRelayFilter(r io.Reader, command proto.Command, w io.Writer) io.Reader {
+	if !command.RelayClipboard && !command.RelayBell && !command.RelayNotify {
+		return nil
+	}
+	var bell func()
+	if command.RelayBell {
+		bell = func() {
+			_ = sendHeader(w, proto.Header{Type: proto.TypeBell}, nil)
+		}
+	}
+	return newOSCFilter(r, func(code string, payload []byte) bool {
+		switch {
+		case code == "52" && command.RelayClipboard:
+			return relayClipboard(w, payload)
+		case code == "9" && command.RelayNotify:
+			// iTerm2 style: ESC ] 9 ; body.
+			_ = sendHeader(w, proto.ServerNotifyHeader{Type: proto.TypeNotify, Body: string(payload)}, nil)
+			return true
+		case code == "777" && command.RelayNotify:
+			// urxvt style: ESC ] 777 ; notify ; title ; body.
+			parts := strings.SplitN(string(payload), ";", 3)
+			if len(parts) != 3 || parts[0] != "notify" {
+				return false
+			}
+			_ = sendHeader(w, proto.ServerNotifyHeader{Type: proto.TypeNotify, Title: parts[1], Body: parts[2]}, nil)
+			return true
+		}
+		return false
+	}, bell)
+}
+
+// relayClipboard relays an OSC 52 clipboard write as a clipboard message.
+// Clipboard queries are removed since reading the client's clipboard is not
+// supported.
+func relayClipboard(w io.Writer, payload []byte) bool {
+	selection, data := payload, []byte(nil)
+	if i := bytes.IndexByte(payload, ';'); i >= 0 {
+		selection, data = payload[:i], payload[i+1:]
+	}
+	if string(data) == "?" {
+		return true
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return false
+	}
+	_ = sendHeader(w, proto.ServerClipboardHeader{
+		Type:      proto.TypeClipboard,
+		Selection: string(selection),
+	}, decoded)
+	return true
+}
+
+// sendHeader writes a single message with the header and body.
+func sendHeader(w io.Writer, header interface{}, body []byte) error {
+	headerByt, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	_, err = proto.WithHeader(w, headerByt).Write(body)
+	return err
+}
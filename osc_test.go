@@ -0,0 +1,104 @@
+package wsep
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestOSCFilter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		input   string
+		output  string
+		handled []string
+	}{
+		{"Plain", "hello\r\n", "hello\r\n", nil},
+		{"BEL", "a\x1b]52;c;aGk=\x07b", "ab", []string{"52:c;aGk="}},
+		{"ST", "a\x1b]52;c;aGk=\x1b\\b", "ab", []string{"52:c;aGk="}},
+		{"Unhandled", "a\x1b]0;title\x07b", "a\x1b]0;title\x07b", []string{"0:title"}},
+		{"CSI", "\x1b[31mred\x1b[0m", "\x1b[31mred\x1b[0m", nil},
+		{"Aborted", "\x1b]52;c\x1b[0m", "\x1b]52;c\x1b[0m", nil},
+		{"Unterminated", "a\x1b]52;c;aGk=", "a\x1b]52;c;aGk=", nil},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			var handled []string
+			// Read a byte at a time so every sequence is split across reads.
+			filter := newOSCFilter(iotest.OneByteReader(strings.NewReader(test.input)), func(code string, payload []byte) bool {
+				handled = append(handled, code+":"+string(payload))
+				return code == "52"
+			}, nil)
+			output, err := ioutil.ReadAll(filter)
+			assert.Success(t, "read", err)
+			assert.Equal(t, "output", test.output, string(output))
+			assert.Equal(t, "handled", test.handled, handled)
+		})
+	}
+}
+
+func TestOSCFilterBell(t *testing.T) {
+	t.Parallel()
+
+	var bells int
+	filter := newOSCFilter(strings.NewReader("a\x07b\x1b]0;title\x07c"), func(string, []byte) bool {
+		return false
+	}, func() {
+		bells++
+	})
+	output, err := ioutil.ReadAll(filter)
+	assert.Success(t, "read", err)
+	// BEL terminating a sequence is not a bell.
+	assert.Equal(t, "output", "ab\x1b]0;title\x07c", string(output))
+	assert.Equal(t, "bells", 1, bells)
+}
+
+func TestTerminalRelay(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+
+	var (
+		selection, data string
+		bells           int
+		notifications   []string
+	)
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command: "printf",
+		Args:    []string{`a\033]52;c;aGVsbG8=\007b\007c\033]9;done\007d\033]777;notify;build;failed\033\\e`},
+		TTY:     true,
+		Rows:    defaultRows,
+		Cols:    defaultCols,
+		OnClipboard: func(s string, d []byte) {
+			selection, data = s, string(d)
+		},
+		OnBell: func() {
+			bells++
+		},
+		OnNotify: func(title, body string) {
+			notifications = append(notifications, title+":"+body)
+		},
+	})
+	assert.Success(t, "start", err)
+	output, err := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.Success(t, "wait", process.Wait())
+
+	assert.Equal(t, "output", "abcde", string(output))
+	assert.Equal(t, "selection", "c", selection)
+	assert.Equal(t, "data", "hello", data)
+	assert.Equal(t, "bells", 1, bells)
+	assert.Equal(t, "notifications", []string{":done", "build:failed"}, notifications)
+}
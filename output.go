@@ -0,0 +1,78 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+)
+
+// maxOutputSize bounds how much output Output and CombinedOutput buffer.
+const maxOutputSize = 16 << 20
+
+// ErrOutputTruncated is returned by Output and CombinedOutput along with the
+// first 16 MiB of output when a command that otherwise succeeded produced
+// more.
+var ErrOutputTruncated = xerrors.New("output exceeded 16 MiB and was truncated")
+
+// Output runs the command to completion and returns its standard output.
+// Standard error is discarded.  A non-zero exit is returned as ExitError.  The
+// command must not enable Stdin.
+func Output(ctx context.Context, execer Execer, c Command) ([]byte, error) {
+	stdout := &cappedBuffer{max: maxOutputSize}
+	err := runToCompletion(ctx, execer, c, stdout, ioutil.Discard)
+	if err == nil && stdout.truncated {
+		err = ErrOutputTruncated
+	}
+	return stdout.buf.Bytes(), err
+}
+
+// CombinedOutput is like Output but returns standard output and standard error
+// interleaved as they arrive.
+func CombinedOutput(ctx context.Context, execer Execer, c Command) ([]byte, error) {
+	combined := &lockedCappedBuffer{b: cappedBuffer{max: maxOutputSize}}
+	err := runToCompletion(ctx, execer, c, combined, combined)
+	if err == nil && combined.b.truncated {
+		err = ErrOutputTruncated
+	}
+	return combined.b.buf.Bytes(), err
+}
+
+// runToCompletion starts the command, copies both streams until they end, then
+// waits for it.
+func runToCompletion(ctx context.Context, execer Execer, c Command, stdout, stderr io.Writer) error {
+	if c.Stdin {
+		return xerrors.New("stdin cannot be enabled when collecting output")
+	}
+	process, err := execer.Start(ctx, c)
+	if err != nil {
+		return err
+	}
+	var output errgroup.Group
+	output.Go(func() error {
+		_, err := io.Copy(stdout, process.Stdout())
+		return err
+	})
+	output.Go(func() error {
+		_, err := io.Copy(stderr, process.Stderr())
+		return err
+	})
+	// Errors reading output surface through Wait.
+	_ = output.Wait()
+	return process.Wait()
+}
+
+// lockedCappedBuffer is a cappedBuffer safe for concurrent writes.
+type lockedCappedBuffer struct {
+	mutex sync.Mutex
+	b     cappedBuffer
+}
+
+func (l *lockedCappedBuffer) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.b.Write(p)
+}
@@ -0,0 +1,36 @@
+package wsep
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestOutput(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+	output, err := Output(ctx, RemoteExecer(ws), Command{
+		Command: "sh",
+		Args:    []string{"-c", "echo out; echo err >&2"},
+	})
+	assert.Success(t, "output", err)
+	assert.Equal(t, "stdout only", "out\n", string(output))
+
+	output, err = CombinedOutput(ctx, LocalExecer{}, Command{
+		Command: "sh",
+		Args:    []string{"-c", "echo out; sleep 0.1; echo err >&2; exit 2"},
+	})
+	exitErr, ok := err.(ExitError)
+	assert.True(t, "error is ExitError", ok)
+	assert.Equal(t, "exit code", 2, exitErr.ExitCode())
+	assert.Equal(t, "combined", "out\nerr\n", string(output))
+
+	_, err = Output(ctx, LocalExecer{}, Command{Command: "cat", Stdin: true})
+	assert.Error(t, "stdin", err)
+}
@@ -0,0 +1,101 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// pacer delays output so that it is delivered with the same gaps between
+// chunks as when the server read it.
+type pacer struct {
+	// origin is the server time of the first output in milliseconds and start
+	// is when it was delivered locally.
+	origin int64
+	start  time.Time
+}
+
+// wait blocks until output stamped with the server time stamp, in
+// milliseconds, is due.  Output without a stamp is due immediately.
+func (p *pacer) wait(ctx context.Context, stamp int64) error {
+	if stamp == 0 {
+		return nil
+	}
+	if p.start.IsZero() {
+		p.origin = stamp
+		p.start = time.Now()
+		return nil
+	}
+	due := p.start.Add(time.Duration(stamp-p.origin) * time.Millisecond)
+	return sleepUntil(ctx, due)
+}
+
+// sleepUntil blocks until t or the context ends.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Frame is a chunk of recorded output.
+type Frame struct {
+	Time time.Time `json:"time"`
+	Data []byte    `json:"data"`
+}
+
+// Recording is an io.Writer that notes when each write happened so the output
+// can be replayed with its original pacing, for example by copying the output
+// of a Paced command into it.  It is safe for concurrent use and can be
+// marshaled to JSON.
+type Recording struct {
+	mutex  sync.Mutex
+	Frames []Frame `json:"frames"`
+}
+
+func (r *Recording) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Frames = append(r.Frames, Frame{Time: time.Now(), Data: data})
+	return len(p), nil
+}
+
+// Replay writes the recorded output to w with the gaps between frames divided
+// by speed, so 2 plays back twice as fast.  A speed of zero or less plays back
+// in real time.
+func (r *Recording) Replay(ctx context.Context, w io.Writer, speed float64) error {
+	if speed <= 0 {
+		speed = 1
+	}
+	r.mutex.Lock()
+	frames := append([]Frame(nil), r.Frames...)
+	r.mutex.Unlock()
+	if len(frames) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	for _, frame := range frames {
+		offset := time.Duration(float64(frame.Time.Sub(frames[0].Time)) / speed)
+		err := sleepUntil(ctx, start.Add(offset))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(frame.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestPaced(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", "echo a; sleep 0.5; echo b"},
+		Paced:   true,
+	})
+	assert.Success(t, "start", err)
+
+	var recording Recording
+	_, err = io.Copy(&recording, process.Stdout())
+	assert.Success(t, "copy", err)
+	assert.Success(t, "wait", process.Wait())
+
+	assert.Equal(t, "frames", 2, len(recording.Frames))
+	assert.True(t, "paced", recording.Frames[1].Time.Sub(recording.Frames[0].Time) >= 400*time.Millisecond)
+}
+
+func TestRecordingReplay(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	recording := Recording{Frames: []Frame{
+		{Time: start, Data: []byte("a")},
+		{Time: start.Add(400 * time.Millisecond), Data: []byte("b")},
+	}}
+
+	var out bytes.Buffer
+	replayStart := time.Now()
+	err := recording.Replay(ctx, &out, 2)
+	assert.Success(t, "replay", err)
+	elapsed := time.Since(replayStart)
+	assert.Equal(t, "output", "ab", out.String())
+	assert.True(t, "half speed gap", elapsed >= 200*time.Millisecond && elapsed < 400*time.Millisecond)
+}
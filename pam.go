@@ -0,0 +1,125 @@
+//go:build pam && cgo && !windows && !openbsd
+// +build pam,cgo,!windows,!openbsd
+
+package wsep
+
+/*
+#cgo LDFLAGS: -lpam
+#include <security/pam_appl.h>
+#include <stdlib.h>
+
+// wsep_conv answers informational messages and fails on prompts since there is
+// nobody to answer them.
+static int wsep_conv(int n, const struct pam_message **msg, struct pam_response **resp, void *data) {
+	int i;
+	if (n <= 0) {
+		return PAM_CONV_ERR;
+	}
+	for (i = 0; i < n; i++) {
+		if (msg[i]->msg_style != PAM_ERROR_MSG && msg[i]->msg_style != PAM_TEXT_INFO) {
+			return PAM_CONV_ERR;
+		}
+	}
+	*resp = calloc(n, sizeof(struct pam_response));
+	if (*resp == NULL) {
+		return PAM_BUF_ERR;
+	}
+	return PAM_SUCCESS;
+}
+
+static struct pam_conv wsep_pam_conv = { wsep_conv, NULL };
+
+static int wsep_pam_start(const char *service, const char *user, pam_handle_t **handle) {
+	return pam_start(service, user, &wsep_pam_conv, handle);
+}
+*/
+import "C"
+
+import (
+	"os/user"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/xerrors"
+)
+
+// pamSession is an open PAM session for a user.
+type pamSession struct {
+	handle  *C.pam_handle_t
+	environ []string
+}
+
+// openPAMSession establishes credentials and opens a session for the user so
+// that limits, keyrings and accounting are applied the same as a login.
+func openPAMSession(service string, uid uint32) (*pamSession, error) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, xerrors.Errorf("look up user: %w", err)
+	}
+
+	cService := C.CString(service)
+	defer C.free(unsafe.Pointer(cService))
+	cUser := C.CString(u.Username)
+	defer C.free(unsafe.Pointer(cUser))
+
+	var handle *C.pam_handle_t
+	rc := C.wsep_pam_start(cService, cUser, &handle)
+	if rc != C.PAM_SUCCESS {
+		return nil, xerrors.Errorf("start pam: code %d", int(rc))
+	}
+	s := &pamSession{handle: handle}
+
+	rc = C.pam_setcred(handle, C.PAM_ESTABLISH_CRED)
+	if rc != C.PAM_SUCCESS {
+		err = s.errorf("establish credentials", rc)
+		C.pam_end(handle, rc)
+		return nil, err
+	}
+	rc = C.pam_open_session(handle, 0)
+	if rc != C.PAM_SUCCESS {
+		err = s.errorf("open session", rc)
+		C.pam_setcred(handle, C.PAM_DELETE_CRED)
+		C.pam_end(handle, rc)
+		return nil, err
+	}
+
+	s.environ = s.getenvlist()
+	return s, nil
+}
+
+// env returns the environment the PAM modules set for the session.
+func (s *pamSession) env() []string {
+	return s.environ
+}
+
+// close closes the session and releases its credentials.
+func (s *pamSession) close() error {
+	rc := C.pam_close_session(s.handle, 0)
+	var err error
+	if rc != C.PAM_SUCCESS {
+		err = s.errorf("close session", rc)
+	}
+	C.pam_setcred(s.handle, C.PAM_DELETE_CRED)
+	C.pam_end(s.handle, rc)
+	return err
+}
+
+func (s *pamSession) getenvlist() []string {
+	list := C.pam_getenvlist(s.handle)
+	if list == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(list))
+
+	var environ []string
+	entries := (*[1 << 20]*C.char)(unsafe.Pointer(list))
+	for i := 0; entries[i] != nil; i++ {
+		environ = append(environ, C.GoString(entries[i]))
+		C.free(unsafe.Pointer(entries[i]))
+	}
+	return environ
+}
+
+func (s *pamSession) errorf(op string, rc C.int) error {
+	return xerrors.Errorf("pam %s: %s", op, C.GoString(C.pam_strerror(s.handle, rc)))
+}
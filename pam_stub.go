@@ -0,0 +1,24 @@
+//go:build !pam || !cgo || windows || openbsd
+// +build !pam !cgo windows openbsd
+
+package wsep
+
+import (
+	"golang.org/x/xerrors"
+)
+
+// pamSession is unavailable without the pam build tag, and on Windows and
+// OpenBSD which have no PAM.
+type pamSession struct{}
+
+func openPAMSession(_ string, _ uint32) (*pamSession, error) {
+	return nil, xerrors.New("PAM sessions require building with the pam tag and cgo on a system with PAM")
+}
+
+func (s *pamSession) env() []string {
+	return nil
+}
+
+func (s *pamSession) close() error {
+	return nil
+}
@@ -0,0 +1,132 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+// pipeSize bounds how much of a stream is buffered before the read loop
+// blocks waiting for the caller to read.
+const pipeSize = 4 * maxMessageSize
+
+// pipe is a bounded buffer between the read loop, which writes each message of
+// a stream into it, and the caller reading that stream.  Closing the read end
+// discards the rest of the stream so the read loop is never held up by it.
+type pipe struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+	// closed is set once the reader closes the pipe.
+	closed bool
+	// err is returned to the reader once the buffer drains after the writer
+	// closes the pipe.
+	err error
+
+	// readable and writable wake a blocked reader or writer.  They hold at
+	// most one pending wakeup so signaling never blocks.
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newPipe() *pipe {
+	return &pipe{
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+// signal wakes whoever is waiting on ch, if anyone.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// writeCtx buffers data, blocking while the buffer is full until the reader
+// makes room or the context ends.  Data for a closed pipe is discarded.
+func (p *pipe) writeCtx(ctx context.Context, data []byte) error {
+	for len(data) > 0 {
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			return nil
+		}
+		if p.err != nil {
+			p.mutex.Unlock()
+			return io.ErrClosedPipe
+		}
+		n := pipeSize - p.buf.Len()
+		if n > len(data) {
+			n = len(data)
+		}
+		if n > 0 {
+			p.buf.Write(data[:n])
+			data = data[n:]
+		}
+		p.mutex.Unlock()
+
+		if n > 0 {
+			signal(p.readable)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.writable:
+		}
+	}
+	return nil
+}
+
+// closeWrite ends the stream; the reader sees io.EOF once it drains the buffer.
+func (p *pipe) closeWrite() error {
+	p.mutex.Lock()
+	if p.err == nil {
+		p.err = io.EOF
+	}
+	p.mutex.Unlock()
+	signal(p.readable)
+	return nil
+}
+
+func (p *pipe) Read(b []byte) (int, error) {
+	for {
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if p.buf.Len() > 0 {
+			n, _ := p.buf.Read(b)
+			remaining := p.buf.Len()
+			p.mutex.Unlock()
+			signal(p.writable)
+			// Pass the wakeup on in case another reader is waiting.
+			if remaining > 0 {
+				signal(p.readable)
+			}
+			return n, nil
+		}
+		if p.err != nil {
+			err := p.err
+			p.mutex.Unlock()
+			return 0, err
+		}
+		p.mutex.Unlock()
+		<-p.readable
+	}
+}
+
+// Close stops reading the stream and discards anything buffered or still to
+// come.
+func (p *pipe) Close() error {
+	p.mutex.Lock()
+	p.closed = true
+	p.buf = bytes.Buffer{}
+	p.mutex.Unlock()
+	signal(p.writable)
+	signal(p.readable)
+	return nil
+}
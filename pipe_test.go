@@ -0,0 +1,118 @@
+package wsep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestPipe(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Bounded", func(t *testing.T) {
+		t.Parallel()
+		p := newPipe()
+
+		// Filling the buffer does not block but writing past it does.
+		err := p.writeCtx(context.Background(), make([]byte, pipeSize))
+		assert.Success(t, "fill", err)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err = p.writeCtx(ctx, []byte("x"))
+		assert.Equal(t, "blocked", context.DeadlineExceeded, err)
+
+		// Reading makes room.
+		go func() {
+			_, _ = io.CopyN(ioutil.Discard, p, pipeSize)
+		}()
+		err = p.writeCtx(context.Background(), []byte("x"))
+		assert.Success(t, "write after read", err)
+	})
+
+	t.Run("EOF", func(t *testing.T) {
+		t.Parallel()
+		p := newPipe()
+		go func() {
+			_ = p.writeCtx(context.Background(), []byte("hello"))
+			_ = p.closeWrite()
+		}()
+		data, err := ioutil.ReadAll(p)
+		assert.Success(t, "read all", err)
+		assert.Equal(t, "data", "hello", string(data))
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		t.Parallel()
+		p := newPipe()
+		assert.Success(t, "close", p.Close())
+		// Writes are discarded rather than blocking or failing.
+		err := p.writeCtx(context.Background(), make([]byte, 2*pipeSize))
+		assert.Success(t, "write", err)
+		_, err = p.Read(make([]byte, 1))
+		assert.Equal(t, "read", io.ErrClosedPipe, err)
+	})
+}
+
+func BenchmarkPipe(b *testing.B) {
+	for _, size := range []int{64, 4096, maxMessageSize} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			p := newPipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_, _ = io.Copy(ioutil.Discard, p)
+			}()
+			data := make([]byte, size)
+			ctx := context.Background()
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = p.writeCtx(ctx, data)
+			}
+			_ = p.closeWrite()
+			<-done
+		})
+	}
+}
+
+// BenchmarkRemoteStdout compares reading a large output, like cat largefile,
+// over binary data frames and over messages with JSON headers.
+func BenchmarkRemoteStdout(b *testing.B) {
+	b.Run("Binary", func(b *testing.B) {
+		benchmarkRemoteStdout(b, false)
+	})
+	b.Run("JSON", func(b *testing.B) {
+		benchmarkRemoteStdout(b, true)
+	})
+}
+
+func benchmarkRemoteStdout(b *testing.B, jsonData bool) {
+	const size = 10 << 20
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.SetBytes(size)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ws, server := mockConn(ctx, b, nil, nil)
+		execer := remoteExec{conn: newWSConn(ws, false), jsonData: jsonData}
+		process, err := execer.Start(ctx, Command{
+			Command: "head",
+			Args:    []string{"-c", fmt.Sprint(size), "/dev/zero"},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, process.Stderr())
+		}()
+		_, _ = io.Copy(ioutil.Discard, process.Stdout())
+		_ = process.Wait()
+		server.Close()
+	}
+}
@@ -0,0 +1,98 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// quota enforces Options.OutputQuota, StdinQuota, OutputRate and StdinRate.
+// Sessions and commands that can be reconnected keep theirs across
+// connections so that reconnecting does not reset it.  A nil quota allows
+// everything.
+type quota struct {
+	output byteQuota
+	stdin  byteQuota
+}
+
+// newQuota returns the quota configured by the options, or nil if they do not
+// configure any.
+func newQuota(options *Options) *quota {
+	if options.OutputQuota <= 0 && options.StdinQuota <= 0 && options.OutputRate <= 0 && options.StdinRate <= 0 {
+		return nil
+	}
+	return &quota{
+		output: byteQuota{
+			name:   "output",
+			limit:  options.OutputQuota,
+			budget: newFrameBudget(options.OutputRate, 0),
+		},
+		stdin: byteQuota{
+			name:   "stdin",
+			limit:  options.StdinQuota,
+			budget: newFrameBudget(options.StdinRate, 0),
+		},
+	}
+}
+
+// takeStdin accounts for n bytes of stdin.
+func (q *quota) takeStdin(ctx context.Context, n int) error {
+	if q == nil {
+		return nil
+	}
+	return q.stdin.take(ctx, n)
+}
+
+// outputWriter returns a writer of output messages to w that accounts for
+// them, calling fail with the error once the quota is exceeded.
+func (q *quota) outputWriter(ctx context.Context, w io.Writer, fail func(error)) io.Writer {
+	if q == nil {
+		return w
+	}
+	return &quotaWriter{ctx: ctx, w: w, quota: &q.output, fail: fail}
+}
+
+// byteQuota counts the bytes of a stream against a limit and paces them to a
+// rate.
+type byteQuota struct {
+	name  string
+	limit int64
+	// mutex guards the fields below and serializes waiting for the budget.
+	mutex  sync.Mutex
+	used   int64
+	budget *frameBudget
+}
+
+// take waits until n more bytes are within the rate and counts them.  It fails
+// with CodeQuotaExceeded if they would exceed the limit.
+func (q *byteQuota) take(ctx context.Context, n int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.limit > 0 && q.used+int64(n) > q.limit {
+		return codeErrorf(CodeQuotaExceeded, "%s quota of %d bytes exceeded", q.name, q.limit)
+	}
+	err := q.budget.waitN(ctx, n)
+	if err != nil {
+		return err
+	}
+	q.used += int64(n)
+	return nil
+}
+
+// quotaWriter accounts for each message written.  Messages count whole,
+// headers included, since the quota is meant to bound bandwidth.
+type quotaWriter struct {
+	ctx   context.Context
+	w     io.Writer
+	quota *byteQuota
+	fail  func(error)
+}
+
+func (q *quotaWriter) Write(p []byte) (int, error) {
+	err := q.quota.take(q.ctx, len(p))
+	if err != nil {
+		q.fail(err)
+		return 0, err
+	}
+	return q.w.Write(p)
+}
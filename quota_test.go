@@ -0,0 +1,60 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestQuota(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Output", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		ws, server := mockConn(ctx, t, nil, &Options{OutputQuota: 4096})
+		defer server.Close()
+		process, err := RemoteExecer(ws).Start(ctx, Command{Command: "head", Args: []string{"-c", "1000000", "/dev/zero"}})
+		assert.Success(t, "start command", err)
+		go io.Copy(ioutil.Discard, process.Stderr())
+		out, _ := ioutil.ReadAll(process.Stdout())
+		assert.True(t, "output stopped", len(out) <= 4096)
+		assert.Equal(t, "code", CodeQuotaExceeded, ErrorCode(process.Wait()))
+	})
+
+	t.Run("Stdin", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		ws, server := mockConn(ctx, t, nil, &Options{StdinQuota: 4})
+		defer server.Close()
+		process, err := RemoteExecer(ws).Start(ctx, Command{Command: "cat", Stdin: true})
+		assert.Success(t, "start command", err)
+		go io.Copy(ioutil.Discard, process.Stdout())
+		go io.Copy(ioutil.Discard, process.Stderr())
+		_, err = process.Stdin().Write([]byte("hello"))
+		assert.Success(t, "write stdin", err)
+		assert.Equal(t, "code", CodeQuotaExceeded, ErrorCode(process.Wait()))
+	})
+
+	t.Run("Rate", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		q := newQuota(&Options{OutputRate: 10000})
+		start := time.Now()
+		// A second's worth is allowed at once, after which the rate applies.
+		for _, n := range []int{10000, 5000, 5000} {
+			assert.Success(t, "take", q.output.take(ctx, n))
+		}
+		assert.True(t, "paced", time.Since(start) >= 400*time.Millisecond)
+		assert.True(t, "no quota", newQuota(&Options{}) == nil)
+	})
+}
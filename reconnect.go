@@ -0,0 +1,328 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// reconnectMinBackoff and reconnectMaxBackoff bound the delay between
+	// attempts to re-dial a dropped connection.
+	reconnectMinBackoff = 250 * time.Millisecond
+	reconnectMaxBackoff = 5 * time.Second
+)
+
+// DialFunc returns an execer over a new connection to a wsep server, for
+// example by calling Dial.
+type DialFunc func(ctx context.Context) (Execer, error)
+
+// reconnectingProcess is a Process that re-attaches to its session whenever the
+// connection to the server drops.
+type reconnectingProcess struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	dial    DialFunc
+	command Command
+
+	stdoutReader *io.PipeReader
+	stdoutWriter *io.PipeWriter
+	stderrReader *io.PipeReader
+	stderrWriter *io.PipeWriter
+
+	// mutex guards the fields below.
+	mutex sync.Mutex
+	// process is the process attached over the current connection.
+	process Process
+	// replaced is closed when process is replaced or the process exits.
+	replaced chan struct{}
+	// rows and cols are the last size set so it can be restored on reconnect.
+	rows, cols uint16
+	// stdinClosed is set once stdin is closed.
+	stdinClosed bool
+	// previous sums the stats of processes that have been replaced, including
+	// the reconnect count.
+	previous Stats
+
+	done chan struct{}
+	// err is the result of Wait.  It is only safe to read once done is closed.
+	err error
+}
+
+// NewReconnectingProcess starts the command over a connection from dial and
+// returns a Process that transparently re-dials and re-attaches with the
+// command's ID whenever the connection fails, so callers see one continuous
+// process.  The command must have an ID since only those can be re-attached.
+// Output a TTY produced while disconnected is redrawn by the session rather
+// than replayed, while the output of other commands continues from the last
+// byte received.  Reconnecting continues until the process exits, Close is
+// called, ctx ends, or the server fails the command with an error code other
+// than CodeTooManyConnections, such as a command without a TTY being gone from
+// the server.
+func NewReconnectingProcess(ctx context.Context, dial DialFunc, command Command) (Process, error) {
+	if command.ID == "" {
+		return nil, xerrors.New("reconnecting commands require an ID")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &reconnectingProcess{
+		ctx:     ctx,
+		cancel:  cancel,
+		dial:    dial,
+		command: command,
+		rows:    command.Rows,
+		cols:    command.Cols,
+		done:    make(chan struct{}),
+	}
+	r.stdoutReader, r.stdoutWriter = io.Pipe()
+	r.stderrReader, r.stderrWriter = io.Pipe()
+
+	process, err := r.start()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r.process = process
+	r.replaced = make(chan struct{})
+	go r.run(process)
+	return r, nil
+}
+
+// start dials and attaches to the session at the last known size.
+func (r *reconnectingProcess) start() (Process, error) {
+	execer, err := r.dial(r.ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("dial: %w", err)
+	}
+	command := r.command
+	r.mutex.Lock()
+	command.Rows, command.Cols = r.rows, r.cols
+	r.mutex.Unlock()
+	return execer.Start(r.ctx, command)
+}
+
+// run relays output from each attached process in turn, reconnecting until
+// the process exits or the context ends.
+func (r *reconnectingProcess) run(process Process) {
+	defer close(r.done)
+	for {
+		var output errgroup.Group
+		output.Go(func() error {
+			return relay(r.stdoutWriter, process.Stdout())
+		})
+		output.Go(func() error {
+			return relay(r.stderrWriter, process.Stderr())
+		})
+		_ = output.Wait()
+		err := process.Wait()
+
+		// Getting an exit code means the process itself is done rather than the
+		// connection.
+		var exitErr ExitError
+		if err == nil || xerrors.As(err, &exitErr) || !retryable(err) || r.ctx.Err() != nil {
+			r.finish(err)
+			return
+		}
+
+		// A command without a TTY picks up where the output stopped.
+		if offsets, ok := ProcessOutputOffsets(process); ok && !r.command.TTY {
+			r.command.ResumeFrom = &offsets
+		}
+		process, err = r.reconnect()
+		if err != nil {
+			r.finish(err)
+			return
+		}
+	}
+}
+
+// relay copies a stream of the attached process.  If the caller closed its end
+// the rest of the stream is discarded so it cannot hold up the connection.
+func relay(w io.Writer, stream io.ReadCloser) error {
+	_, err := io.Copy(w, stream)
+	if err != nil {
+		_ = stream.Close()
+	}
+	return err
+}
+
+// reconnect attaches to the session over a new connection, backing off
+// between failed attempts until the context ends.
+func (r *reconnectingProcess) reconnect() (Process, error) {
+	backoff := reconnectMinBackoff
+	for {
+		process, err := r.start()
+		if err == nil {
+			r.mutex.Lock()
+			if r.stdinClosed {
+				_ = process.Stdin().Close()
+			}
+			if old, ok := ProcessStats(r.process); ok {
+				r.previous = r.previous.add(old)
+			}
+			r.previous.Reconnects++
+			r.process = process
+			close(r.replaced)
+			r.replaced = make(chan struct{})
+			r.mutex.Unlock()
+			return process, nil
+		}
+		if !retryable(err) {
+			return nil, err
+		}
+		select {
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+// retryable reports whether err may go away on a new connection.  Errors the
+// server reported with a code are final, except for being over the connection
+// limit which a dropped connection may briefly leave the server at.
+func retryable(err error) bool {
+	code := ErrorCode(err)
+	return code == "" || code == CodeTooManyConnections
+}
+
+// finish records the result of Wait and ends the output streams.
+func (r *reconnectingProcess) finish(err error) {
+	r.mutex.Lock()
+	close(r.replaced)
+	r.replaced = nil
+	r.mutex.Unlock()
+	r.err = err
+	_ = r.stdoutWriter.Close()
+	_ = r.stderrWriter.Close()
+}
+
+// current returns the attached process and a channel closed once it is
+// replaced.  The channel is nil after the process exits.
+func (r *reconnectingProcess) current() (Process, chan struct{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.process, r.replaced
+}
+
+func (r *reconnectingProcess) Pid() int {
+	process, _ := r.current()
+	return process.Pid()
+}
+
+// StartInfo returns how the attached process was started.
+func (r *reconnectingProcess) StartInfo() ProcessInfo {
+	process, _ := r.current()
+	return ProcessStartInfo(process)
+}
+
+// Stats returns the traffic statistics summed across every connection.
+func (r *reconnectingProcess) Stats() Stats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	current, _ := ProcessStats(r.process)
+	return r.previous.add(current)
+}
+
+func (r *reconnectingProcess) Stdin() io.WriteCloser {
+	return reconnectingStdin{r: r}
+}
+
+func (r *reconnectingProcess) Stdout() io.ReadCloser {
+	return r.stdoutReader
+}
+
+func (r *reconnectingProcess) Stderr() io.ReadCloser {
+	return r.stderrReader
+}
+
+func (r *reconnectingProcess) Resize(ctx context.Context, rows, cols uint16) error {
+	r.mutex.Lock()
+	r.rows, r.cols = rows, cols
+	process := r.process
+	r.mutex.Unlock()
+	// A failure here is most likely a dropped connection in which case the
+	// size is applied on reconnect.
+	_ = process.Resize(ctx, rows, cols)
+	return nil
+}
+
+// Signal signals the attached process.  Unlike resizing a signal is not
+// repeated after a reconnect since the process may have acted on it already.
+func (r *reconnectingProcess) Signal(ctx context.Context, sig Signal) error {
+	process, _ := r.current()
+	return SignalProcess(ctx, process, sig)
+}
+
+// Ack acknowledges output through the attached process.  Acknowledging is
+// idempotent so output acknowledged while disconnected can be acknowledged
+// again once reconnected.
+func (r *reconnectingProcess) Ack(ctx context.Context, offsets OutputOffsets) error {
+	process, _ := r.current()
+	return AckOutput(ctx, process, offsets)
+}
+
+// TakeInput takes the input lock through the attached process.  The lock is
+// not taken again after a reconnect since another client may have taken it
+// since.
+func (r *reconnectingProcess) TakeInput(ctx context.Context) error {
+	process, _ := r.current()
+	return TakeInput(ctx, process)
+}
+
+// SetTerminalModes changes the terminal modes through the attached process.
+// They are not set again after a reconnect.
+func (r *reconnectingProcess) SetTerminalModes(ctx context.Context, modes TerminalModes) error {
+	process, _ := r.current()
+	return SetTerminalModes(ctx, process, modes)
+}
+
+func (r *reconnectingProcess) Wait() error {
+	<-r.done
+	return r.err
+}
+
+func (r *reconnectingProcess) Close() error {
+	r.cancel()
+	process, _ := r.current()
+	err := process.Close()
+	<-r.done
+	return err
+}
+
+// reconnectingStdin writes to whichever process is attached, retrying writes
+// that fail because the connection dropped once it is re-established.
+type reconnectingStdin struct {
+	r *reconnectingProcess
+}
+
+func (s reconnectingStdin) Write(p []byte) (int, error) {
+	var written int
+	for {
+		process, replaced := s.r.current()
+		n, err := process.Stdin().Write(p[written:])
+		written += n
+		if err == nil || replaced == nil {
+			return written, err
+		}
+		select {
+		case <-s.r.ctx.Done():
+			return written, err
+		case <-replaced:
+		}
+	}
+}
+
+func (s reconnectingStdin) Close() error {
+	s.r.mutex.Lock()
+	defer s.r.mutex.Unlock()
+	s.r.stdinClosed = true
+	return s.r.process.Stdin().Close()
+}
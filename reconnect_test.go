@@ -0,0 +1,146 @@
+package wsep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"nhooyr.io/websocket"
+)
+
+func TestReconnectingProcess(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Reconnect", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, command := newSession(t)
+		dialer := newDroppingDialer(t, newServer(t), &Options{SessionTimeout: time.Minute})
+
+		process, err := NewReconnectingProcess(ctx, dialer.dial, command)
+		assert.Success(t, "start", err)
+		expected := writeUnique(t, process)
+		assert.True(t, "find initial output", checkStdout(t, process, expected, []string{}))
+
+		// Drop the connection; the process should re-attach on its own.
+		dialer.drop()
+		expected = writeUnique(t, process)
+		assert.True(t, "find reconnected output", checkStdout(t, process, expected, []string{}))
+		assert.Equal(t, "dialed twice", 2, dialer.dials())
+		stats, ok := ProcessStats(process)
+		assert.True(t, "has stats", ok)
+		assert.Equal(t, "reconnects", int64(1), stats.Reconnects)
+
+		// Exiting the shell ends the process rather than reconnecting.
+		write(t, process, "exit")
+		assert.Success(t, "wait", process.Wait())
+	})
+
+	t.Run("NoTTY", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		dialer := newDroppingDialer(t, newServer(t), &Options{SessionTimeout: time.Minute})
+
+		process, err := NewReconnectingProcess(ctx, dialer.dial, Command{
+			ID:      "build",
+			Command: "sh",
+			Args:    []string{"-c", "for i in $(seq 1 40); do echo $i; sleep 0.02; done"},
+		})
+		assert.Success(t, "start", err)
+		go io.Copy(ioutil.Discard, process.Stderr())
+
+		// Drop the connection part way through the output.
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			dialer.drop()
+		}()
+
+		output, err := ioutil.ReadAll(process.Stdout())
+		assert.Success(t, "read output", err)
+		assert.Success(t, "wait", process.Wait())
+
+		var expected strings.Builder
+		for i := 1; i <= 40; i++ {
+			fmt.Fprintf(&expected, "%d\n", i)
+		}
+		assert.Equal(t, "output without gaps or repeats", expected.String(), string(output))
+		stats, _ := ProcessStats(process)
+		assert.Equal(t, "reconnects", int64(1), stats.Reconnects)
+	})
+
+	t.Run("NoID", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, command := newSession(t)
+		command.ID = ""
+		_, err := NewReconnectingProcess(ctx, func(ctx context.Context) (Execer, error) {
+			t.Fatal("should not dial")
+			return nil, nil
+		}, command)
+		assert.Error(t, "no id", err)
+	})
+}
+
+// droppingDialer dials a server for a reconnecting process and can drop the
+// connection it dialed last.  httptest.Server.CloseClientConnections cannot do
+// this since it ignores the hijacked connections WebSockets run over.
+type droppingDialer struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+func newDroppingDialer(t *testing.T, server *Server, options *Options) *droppingDialer {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = server.ServeWebSocket(w, r, nil, LocalExecer{}, options)
+	}))
+	t.Cleanup(httpServer.Close)
+	return &droppingDialer{t: t, server: httpServer}
+}
+
+func (d *droppingDialer) dial(ctx context.Context) (Execer, error) {
+	var dialer net.Dialer
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := dialer.DialContext(ctx, network, addr)
+			if err == nil {
+				d.mutex.Lock()
+				d.conns = append(d.conns, c)
+				d.mutex.Unlock()
+			}
+			return c, err
+		},
+	}}
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(d.server.URL, "http"), &websocket.DialOptions{HTTPClient: client})
+	if err != nil {
+		return nil, err
+	}
+	return RemoteExecer(ws), nil
+}
+
+// drop closes the last dialed connection without a close handshake.
+func (d *droppingDialer) drop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	assert.True(d.t, "dialed before drop", len(d.conns) > 0)
+	_ = d.conns[len(d.conns)-1].Close()
+}
+
+func (d *droppingDialer) dials() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.conns)
+}
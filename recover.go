@@ -0,0 +1,172 @@
+package wsep
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// screenDir is where sessions keep screen's configuration, sockets and their
+// saved state.
+func screenDir() string {
+	return filepath.Join(os.TempDir(), "coder-screen")
+}
+
+// stateDir is where sessions save their state for RecoverSessions.
+func stateDir() string {
+	return filepath.Join(screenDir(), "sessions")
+}
+
+// persist starts saving the session's state so that a restarted server can
+// recover it.
+func (s *Session) persist(id string) {
+	s.cond.L.Lock()
+	s.name = id
+	s.stateFile = filepath.Join(stateDir(), s.id+".json")
+	s.cond.L.Unlock()
+	s.saveState()
+}
+
+// saveState writes the session's state if it is persisted.  Failures are
+// logged since they only affect recovering the session.
+func (s *Session) saveState() {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+	s.cond.L.Lock()
+	path := s.stateFile
+	state := s.stateLocked(s.name)
+	s.cond.L.Unlock()
+	if path == "" {
+		return
+	}
+	err := writeState(path, state)
+	if err != nil {
+		flog.Error("failed to save state of session %s: %v", state.ID, err)
+	}
+}
+
+// writeState replaces the file at path with the state.  The state includes
+// share tokens so only the server's user may read it.
+func writeState(path string, state sessionState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Sessions keep their own directories next to this one which their users
+	// need to reach.
+	err = os.MkdirAll(screenDir(), 0o755)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	err = ioutil.WriteFile(temp, data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// removeState deletes the session's saved state once it closes.
+func (s *Session) removeState() {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+	s.cond.L.Lock()
+	path := s.stateFile
+	s.stateFile = ""
+	s.cond.L.Unlock()
+	if path == "" {
+		return
+	}
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		flog.Error("failed to remove state of session %s: %v", s.id, err)
+	}
+}
+
+// RecoverSessions picks up the sessions a previous server process on this
+// machine left running, so that clients can reattach to them by ID after the
+// server restarts rather than getting new sessions.  Like ImportSessions the
+// sessions are run with the execer and options, and each gets the full
+// session timeout for clients to reconnect.  Only sessions run by execers
+// without their own filesystem are recovered, and only while their screen
+// daemon is still running.  It returns how many sessions were recovered.
+func (srv *Server) RecoverSessions(execer Execer, options *Options) (int, error) {
+	files, err := filepath.Glob(filepath.Join(stateDir(), "*.json"))
+	if err != nil {
+		return 0, xerrors.Errorf("list saved sessions: %w", err)
+	}
+
+	sessionOptions := &Options{}
+	if options != nil {
+		*sessionOptions = *options
+	}
+	if sessionOptions.SessionTimeout == 0 {
+		sessionOptions.SessionTimeout = defaultSessionTimeout
+	}
+
+	srv.sessionsMutex.Lock()
+	defer srv.sessionsMutex.Unlock()
+	var recovered int
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return recovered, xerrors.Errorf("read saved session: %w", err)
+		}
+		var state sessionState
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			flog.Error("failed to parse saved session %s: %v", file, err)
+			continue
+		}
+		if _, ok := srv.sessions.Load(state.ID); ok {
+			continue
+		}
+		if !screenRunning(state.SocketsDir, state.ScreenID) {
+			_ = os.Remove(file)
+			continue
+		}
+		state.Expires = time.Now().Add(sessionOptions.SessionTimeout)
+		srv.addSession(state.ID, restoreSession(state, execer, sessionOptions), sessionOptions)
+		recovered++
+	}
+	return recovered, nil
+}
+
+// screenRunning returns whether the daemon of the screen session is running.
+// Its socket is named after its PID and the session, and is left behind if
+// the daemon is killed.
+func screenRunning(socketsDir, screenID string) bool {
+	sockets, err := filepath.Glob(filepath.Join(socketsDir, "*."+screenID))
+	if err != nil {
+		return false
+	}
+	for _, socket := range sockets {
+		pid, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(socket), "."+screenID))
+		if err != nil {
+			continue
+		}
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			continue
+		}
+		// The daemon may run as another user, in which case it cannot be
+		// signaled but is still running.
+		err = process.Signal(syscall.Signal(0))
+		if err == nil || xerrors.Is(err, os.ErrPermission) {
+			return true
+		}
+	}
+	return false
+}
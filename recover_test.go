@@ -0,0 +1,52 @@
+package wsep
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestScreenRunning(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	err := ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(os.Getpid())+".live"), nil, 0o600)
+	assert.Success(t, "live socket", err)
+	// PIDs never get this high so nothing is running with it.
+	err = ioutil.WriteFile(filepath.Join(dir, "2147483647.dead"), nil, 0o600)
+	assert.Success(t, "dead socket", err)
+
+	assert.True(t, "live", screenRunning(dir, "live"))
+	assert.True(t, "dead", !screenRunning(dir, "dead"))
+	assert.True(t, "missing", !screenRunning(dir, "missing"))
+}
+
+func TestSaveSessionState(t *testing.T) {
+	t.Parallel()
+
+	s := NewSession(&Command{Command: "sh"}, LocalExecer{}, &Options{Owner: "alice", SessionTimeout: time.Minute})
+	_, err := s.WaitForState(StateReady)
+	assert.Success(t, "session ready", err)
+	s.persist("id")
+	s.setOwner("bob")
+
+	path := filepath.Join(stateDir(), s.id+".json")
+	data, err := ioutil.ReadFile(path)
+	assert.Success(t, "read state", err)
+	var state sessionState
+	err = json.Unmarshal(data, &state)
+	assert.Success(t, "unmarshal state", err)
+	assert.Equal(t, "id", "id", state.ID)
+	assert.Equal(t, "screen id", s.id, state.ScreenID)
+	assert.Equal(t, "owner", "bob", state.Owner)
+
+	s.Close("test")
+	_, err = os.Stat(path)
+	assert.True(t, "state removed", os.IsNotExist(err))
+}
@@ -0,0 +1,221 @@
+package wsep
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+)
+
+// redirectScript opens the file, creating any missing parent directories,
+// prints an empty line once it is open, then writes stdin to it.
+const redirectScript = `mkdir -p "$(dirname "$1")" && exec 3> "$1" && echo && exec cat >&3`
+
+// redirectingExecer starts commands with their output written to the files
+// named by Command.StdoutFile and Command.StderrFile.  The files are written
+// through the execer as the command's user so that they are created where the
+// command runs and owned by that user.
+type redirectingExecer struct {
+	Execer
+}
+
+func (e redirectingExecer) Start(ctx context.Context, c Command) (Process, error) {
+	if c.StdoutFile == "" && c.StderrFile == "" {
+		return e.Execer.Start(ctx, c)
+	}
+	var stdout, stderr *outputFile
+	closeFiles := func() {
+		for _, f := range []*outputFile{stdout, stderr} {
+			if f != nil {
+				f.release()
+			}
+		}
+	}
+	var err error
+	if c.StdoutFile != "" {
+		stdout, err = openOutputFile(ctx, e.Execer, c.StdoutFile, c.UID, c.GID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case c.StderrFile == c.StdoutFile:
+		// Both streams share the file like 2>&1 rather than overwriting
+		// each other.
+		stderr = stdout
+		stderr.retain()
+	case c.StderrFile != "":
+		stderr, err = openOutputFile(ctx, e.Execer, c.StderrFile, c.UID, c.GID)
+		if err != nil {
+			closeFiles()
+			return nil, err
+		}
+	}
+
+	process, err := e.Execer.Start(ctx, c)
+	if err != nil {
+		closeFiles()
+		return nil, err
+	}
+	return &redirectedProcess{
+		Process: process,
+		stdout:  redirectReader(process.Stdout(), stdout, c.TeeOutput),
+		stderr:  redirectReader(process.Stderr(), stderr, c.TeeOutput),
+	}, nil
+}
+
+// outputFile writes output to a file through a shell started by an execer.
+// Writing never fails so that the command is not disturbed; errors are logged
+// and the rest of the output is discarded.
+type outputFile struct {
+	path    string
+	process Process
+	stderr  <-chan string
+
+	// mutex guards the fields below and serializes writes.
+	mutex sync.Mutex
+	// refs counts the streams writing to the file.
+	refs int
+	// failed is set once writing has failed.
+	failed bool
+}
+
+// openOutputFile creates or truncates the file at path as the user.
+func openOutputFile(ctx context.Context, execer Execer, path string, uid, gid uint32) (*outputFile, error) {
+	process, err := execer.Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", redirectScript, "sh", path},
+		Stdin:   true,
+		UID:     uid,
+		GID:     gid,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("redirect output to %s: %w", path, err)
+	}
+	stderr := captureAll(process.Stderr())
+	stdout := bufio.NewReader(process.Stdout())
+	_, err = stdout.ReadString('\n')
+	if err != nil {
+		err = process.Wait()
+		if message := <-stderr; message != "" {
+			return nil, xerrors.Errorf("redirect output to %s: %s", path, message)
+		}
+		return nil, xerrors.Errorf("redirect output to %s: %w", path, err)
+	}
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, stdout)
+	}()
+	return &outputFile{path: path, process: process, stderr: stderr, refs: 1}, nil
+}
+
+func (f *outputFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.failed {
+		return len(p), nil
+	}
+	_, err := f.process.Stdin().Write(p)
+	if err != nil {
+		f.failed = true
+		flog.Error("failed to write output to %s: %v", f.path, err)
+	}
+	return len(p), nil
+}
+
+// retain adds a stream writing to the file.
+func (f *outputFile) retain() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.refs++
+}
+
+// release removes a stream writing to the file and finishes writing it once
+// there are none left.
+func (f *outputFile) release() {
+	f.mutex.Lock()
+	f.refs--
+	last := f.refs == 0
+	f.mutex.Unlock()
+	if !last {
+		return
+	}
+	_ = f.process.Stdin().Close()
+	err := f.process.Wait()
+	if message := <-f.stderr; err != nil {
+		flog.Error("failed to write output to %s: %v: %s", f.path, err, message)
+	}
+}
+
+// redirectReader returns a reader of r that writes everything read to f.  The
+// output is only returned by the reader as well if tee is set.  f is released
+// once r ends.
+func redirectReader(r io.ReadCloser, f *outputFile, tee bool) io.ReadCloser {
+	if f == nil {
+		return r
+	}
+	return &redirectedReader{r: r, file: f, tee: tee}
+}
+
+type redirectedReader struct {
+	r    io.ReadCloser
+	file *outputFile
+	tee  bool
+	once sync.Once
+}
+
+func (r *redirectedReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.r.Read(p)
+		if n > 0 {
+			_, _ = r.file.Write(p[:n])
+		}
+		if err != nil {
+			r.once.Do(r.file.release)
+			if !r.tee {
+				n = 0
+			}
+			return n, err
+		}
+		if r.tee {
+			return n, nil
+		}
+	}
+}
+
+// Close stops reading, and so writing to f, and releases f.
+func (r *redirectedReader) Close() error {
+	err := r.r.Close()
+	r.once.Do(r.file.release)
+	return err
+}
+
+// redirectedProcess is a process with its output redirected to files.
+type redirectedProcess struct {
+	Process
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+}
+
+func (p *redirectedProcess) Stdout() io.ReadCloser {
+	return p.stdout
+}
+
+func (p *redirectedProcess) Stderr() io.ReadCloser {
+	return p.stderr
+}
+
+func (p *redirectedProcess) Signal(ctx context.Context, sig Signal) error {
+	return SignalProcess(ctx, p.Process, sig)
+}
+
+func (p *redirectedProcess) StartInfo() ProcessInfo {
+	return ProcessStartInfo(p.Process)
+}
+
+func (p *redirectedProcess) Usage() (ResourceUsage, bool) {
+	return ProcessUsage(p.Process)
+}
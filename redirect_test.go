@@ -0,0 +1,101 @@
+package wsep
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestRedirectOutput(t *testing.T) {
+	t.Parallel()
+
+	run := func(ctx context.Context, t *testing.T, execer Execer, command Command) (string, string) {
+		process, err := execer.Start(ctx, command)
+		assert.Success(t, "start command", err)
+		stderr := captureAll(process.Stderr())
+		stdout, err := ioutil.ReadAll(process.Stdout())
+		assert.Success(t, "read stdout", err)
+		// Wait closes the pipes, so the output is read first.
+		streamed := <-stderr
+		assert.Success(t, "wait", process.Wait())
+		return string(stdout), streamed
+	}
+	readFile := func(t *testing.T, name string) string {
+		contents, err := ioutil.ReadFile(name)
+		assert.Success(t, "read file", err)
+		return string(contents)
+	}
+	command := Command{Command: "sh", Args: []string{"-c", "echo out; echo err >&2"}}
+
+	t.Run("Redirect", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		dir := tempDir(t)
+		command := command
+		command.StdoutFile = filepath.Join(dir, "logs", "out.log")
+		command.StderrFile = filepath.Join(dir, "logs", "err.log")
+		stdout, stderr := run(ctx, t, redirectingExecer{LocalExecer{}}, command)
+		assert.Equal(t, "streamed stdout", "", stdout)
+		assert.Equal(t, "streamed stderr", "", stderr)
+		assert.Equal(t, "stdout file", "out\n", readFile(t, command.StdoutFile))
+		assert.Equal(t, "stderr file", "err\n", readFile(t, command.StderrFile))
+	})
+
+	t.Run("Tee", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		command := command
+		command.StdoutFile = filepath.Join(tempDir(t), "out.log")
+		command.TeeOutput = true
+		stdout, stderr := run(ctx, t, redirectingExecer{LocalExecer{}}, command)
+		assert.Equal(t, "streamed stdout", "out\n", stdout)
+		assert.Equal(t, "streamed stderr", "err", stderr)
+		assert.Equal(t, "stdout file", "out\n", readFile(t, command.StdoutFile))
+	})
+
+	t.Run("Combined", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		command := command
+		command.StdoutFile = filepath.Join(tempDir(t), "build.log")
+		command.StderrFile = command.StdoutFile
+		run(ctx, t, redirectingExecer{LocalExecer{}}, command)
+		contents := readFile(t, command.StdoutFile)
+		assert.True(t, "both streams", contents == "out\nerr\n" || contents == "err\nout\n")
+	})
+
+	t.Run("Remote", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		ws, server := mockConn(ctx, t, nil, nil)
+		defer server.Close()
+		command := command
+		command.StdoutFile = filepath.Join(tempDir(t), "out.log")
+		stdout, _ := run(ctx, t, RemoteExecer(ws), command)
+		assert.Equal(t, "streamed stdout", "", stdout)
+		assert.Equal(t, "stdout file", "out\n", readFile(t, command.StdoutFile))
+	})
+
+	t.Run("Unwritable", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		command := command
+		command.StdoutFile = "/dev/null/out.log"
+		_, err := redirectingExecer{LocalExecer{}}.Start(ctx, command)
+		assert.Error(t, "start command", err)
+	})
+}
@@ -0,0 +1,170 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"go.coder.com/flog"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+// SessionRegistry records which server in a pool owns each session, so that
+// whichever server a client reaches can route it to the one running the
+// session.  It is shared by the servers, for example backed by Redis, while
+// each server still keeps its own sessions.
+type SessionRegistry interface {
+	// Claim records node as the owner of the session unless another node
+	// owns it, and returns the owner.  Servers claim their sessions again
+	// every half session timeout, so implementations should forget claims
+	// that are not renewed for longer than the session timeout in case a
+	// server goes away without releasing them.
+	Claim(ctx context.Context, id, node string) (string, error)
+	// Lookup returns the node owning the session, or an empty string if none
+	// does.
+	Lookup(ctx context.Context, id string) (string, error)
+	// Release forgets the session if node owns it.
+	Release(ctx context.Context, id, node string) error
+}
+
+// Cluster configures a server to share sessions with the other servers in a
+// pool.
+type Cluster struct {
+	Registry SessionRegistry
+	// Node is the name of this server, such as its address, as the other
+	// servers pass it to Dial.
+	Node string
+	// Dial connects to another server to forward a client to a session it
+	// owns, for example with RemoteExecer over a websocket.  The connection
+	// should authenticate so that the other server uses owner as its
+	// Options.Owner.
+	Dial func(ctx context.Context, node string, owner string) (Execer, error)
+}
+
+// JoinCluster makes the server share sessions with other servers through the
+// registry.  Clients attaching to a session another server owns are forwarded
+// to it.  It must be called before serving.
+func (srv *Server) JoinCluster(cluster Cluster) {
+	srv.cluster = &cluster
+}
+
+// forwardSession forwards a client attaching to a session owned by another
+// server, relaying session messages to w.  It returns a nil process if this
+// server owns the session, claiming it unless the client only observes.
+func (srv *Server) forwardSession(ctx context.Context, header proto.ClientStartHeader, command *Command, options *Options, w io.Writer) (Process, error) {
+	if srv.cluster == nil {
+		return nil, nil
+	}
+	var (
+		node string
+		err  error
+	)
+	if header.Observe {
+		node, err = srv.cluster.Registry.Lookup(ctx, header.ID)
+	} else {
+		node, err = srv.cluster.Registry.Claim(ctx, header.ID, srv.cluster.Node)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("look up session %s: %w", header.ID, err)
+	}
+	if node == "" || node == srv.cluster.Node {
+		return nil, nil
+	}
+
+	execer, err := srv.cluster.Dial(ctx, node, options.Owner)
+	if err != nil {
+		return nil, xerrors.Errorf("dial %s for session %s: %w", node, header.ID, err)
+	}
+	forwarded := *command
+	forwarded.ID = header.ID
+	forwarded.Observe = header.Observe
+	forwarded.ShareToken = header.Token
+	forwarded.OnFreeze = func(frozen bool) {
+		_ = sendHeader(w, proto.ServerFrozenHeader{Type: proto.TypeFrozen, Frozen: frozen}, nil)
+	}
+	forwarded.OnInputLock = func(holder bool) {
+		_ = sendHeader(w, proto.ServerInputLockHeader{Type: proto.TypeInputLock, Holder: holder}, nil)
+	}
+	forwarded.OnWarning = func(code Code, message string) {
+		_ = sendHeader(w, proto.ServerWarningHeader{Type: proto.TypeWarning, Code: string(code), Message: message}, nil)
+	}
+	return execer.Start(ctx, forwarded)
+}
+
+// claimSession keeps the server's claim on a session until it closes.
+func (srv *Server) claimSession(id string, s *Session) {
+	if srv.cluster == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		s.Wait()
+	}()
+	ticker := time.NewTicker(s.options.SessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		_, err := srv.cluster.Registry.Claim(ctx, id, srv.cluster.Node)
+		if err != nil && ctx.Err() == nil {
+			flog.Error("failed to claim session %s: %v", id, err)
+		}
+		select {
+		case <-ctx.Done():
+			srv.releaseSession(id)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// releaseSession gives up the server's claim on a session.
+func (srv *Server) releaseSession(id string) {
+	if srv.cluster == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultAttachTimeout)
+	defer cancel()
+	err := srv.cluster.Registry.Release(ctx, id, srv.cluster.Node)
+	if err != nil {
+		flog.Error("failed to release session %s: %v", id, err)
+	}
+}
+
+// MemorySessionRegistry is a SessionRegistry for servers in the same process.
+type MemorySessionRegistry struct {
+	mutex  sync.Mutex
+	owners map[string]string
+}
+
+// NewMemorySessionRegistry returns an empty registry.
+func NewMemorySessionRegistry() *MemorySessionRegistry {
+	return &MemorySessionRegistry{owners: make(map[string]string)}
+}
+
+func (r *MemorySessionRegistry) Claim(_ context.Context, id, node string) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if owner, ok := r.owners[id]; ok {
+		return owner, nil
+	}
+	r.owners[id] = node
+	return node, nil
+}
+
+func (r *MemorySessionRegistry) Lookup(_ context.Context, id string) (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.owners[id], nil
+}
+
+func (r *MemorySessionRegistry) Release(_ context.Context, id, node string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.owners[id] == node {
+		delete(r.owners, id)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package wsep
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestClusterForwarding(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	registry := NewMemorySessionRegistry()
+	owner := newServer(t)
+	owner.JoinCluster(Cluster{Registry: registry, Node: "owner"})
+	_, err := registry.Claim(ctx, "id", "owner")
+	assert.Success(t, "claim", err)
+
+	var dialed string
+	server := newServer(t)
+	server.JoinCluster(Cluster{
+		Registry: registry,
+		Node:     "other",
+		Dial: func(ctx context.Context, node string, _ string) (Execer, error) {
+			dialed = node
+			ws, httpServer := mockConn(ctx, t, owner, nil)
+			t.Cleanup(httpServer.Close)
+			return RemoteExecer(ws), nil
+		},
+	})
+
+	ws, httpServer := mockConn(ctx, t, server, nil)
+	defer httpServer.Close()
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		ID:      "id",
+		Command: "sh",
+		Args:    []string{"-c", "echo hello"},
+		TTY:     true,
+	})
+	assert.Success(t, "start", err)
+	out, err := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.True(t, "output forwarded", strings.Contains(string(out), "hello"))
+	assert.Equal(t, "dialed owner", "owner", dialed)
+	assert.Equal(t, "server count", 0, server.SessionCount())
+}
@@ -0,0 +1,352 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+const (
+	defaultExecTimeout   = 30 * time.Second
+	defaultExecMaxOutput = 1 << 20
+	// maxExecRequestSize bounds the request body including stdin.
+	maxExecRequestSize = 1 << 20
+	// eventsContentType is the media type of the NDJSON event stream.
+	eventsContentType = "application/x-ndjson"
+)
+
+// ExecRequest is the body of a request to ExecHandler.
+type ExecRequest struct {
+	Command    string   `json:"command"`
+	Args       []string `json:"args,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	WorkingDir string   `json:"working_dir,omitempty"`
+	UID        uint32   `json:"uid,omitempty"`
+	GID        uint32   `json:"gid,omitempty"`
+	// Stdin is written to the command's standard input if not empty.
+	Stdin string `json:"stdin,omitempty"`
+	// Timeout in milliseconds lowers the handler's timeout for this request.
+	Timeout int64 `json:"timeout,omitempty"`
+}
+
+// ExecResponse is the body of a response from ExecHandler.
+type ExecResponse struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+	// Truncated is set if either stream exceeded the output limit.
+	Truncated bool `json:"truncated,omitempty"`
+	// TimedOut is set if the command was killed for running too long.
+	TimedOut bool `json:"timed_out,omitempty"`
+	// Code and Error describe a failure to run the command.
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ExecOutputEvent is a line of the NDJSON stream ExecHandler responds with to
+// requests that accept application/x-ndjson, carrying output as soon as it is
+// read.
+type ExecOutputEvent struct {
+	// Stream is "stdout" or "stderr".
+	Stream string `json:"stream"`
+	// Time is when the output was read in milliseconds since the Unix epoch.
+	Time int64 `json:"time"`
+	// Offset is the position of Data in its stream in bytes.
+	Offset int64 `json:"offset"`
+	// Data is the output with invalid UTF-8 replaced.  Characters split
+	// between reads are kept whole.
+	Data string `json:"data"`
+}
+
+// ExecExitEvent is the last line of the NDJSON stream.  Unlike output events
+// it has no stream.  The fields mean the same as those of ExecResponse.
+type ExecExitEvent struct {
+	Time     int64  `json:"time"`
+	ExitCode int    `json:"exit_code"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ExecHandlerOptions configures ExecHandler.
+type ExecHandlerOptions struct {
+	// Timeout bounds how long a command may run.  Defaults to 30 seconds.
+	Timeout time.Duration
+	// MaxOutput bounds how many bytes of each stream are returned.  Defaults to
+	// 1 MiB.  Streamed output is not bounded.
+	MaxOutput int
+}
+
+// ExecHandler returns an HTTP handler that runs the command in a POSTed
+// ExecRequest to completion and responds with an ExecResponse, for automation
+// that does not want to speak the streaming protocol.  Requests that accept
+// application/x-ndjson are instead streamed an ExecOutputEvent for each chunk
+// of output followed by an ExecExitEvent, one JSON object per line, so that
+// log pipelines can ingest them directly.  Authentication is left to the
+// caller.
+func ExecHandler(execer Execer, options *ExecHandlerOptions) http.Handler {
+	if options == nil {
+		options = &ExecHandlerOptions{}
+	}
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	maxOutput := options.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = defaultExecMaxOutput
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeExecResponse(w, http.StatusMethodNotAllowed, ExecResponse{Error: "method must be POST"})
+			return
+		}
+		var req ExecRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxExecRequestSize)).Decode(&req)
+		if err != nil {
+			writeExecResponse(w, http.StatusBadRequest, ExecResponse{
+				Code:  string(CodeInvalidMessage),
+				Error: "decode request: " + err.Error(),
+			})
+			return
+		}
+		if req.Command == "" {
+			writeExecResponse(w, http.StatusBadRequest, ExecResponse{
+				Code:  string(CodeInvalidMessage),
+				Error: "command is required",
+			})
+			return
+		}
+
+		reqTimeout := timeout
+		if req.Timeout > 0 && time.Duration(req.Timeout)*time.Millisecond < reqTimeout {
+			reqTimeout = time.Duration(req.Timeout) * time.Millisecond
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), reqTimeout)
+		defer cancel()
+
+		if strings.Contains(r.Header.Get("Accept"), eventsContentType) {
+			streamEvents(ctx, w, execer, req)
+			return
+		}
+
+		resp, err := runOnce(ctx, execer, req, maxOutput)
+		if err != nil {
+			writeExecResponse(w, http.StatusInternalServerError, ExecResponse{
+				Code:  string(startErrorCode(err)),
+				Error: err.Error(),
+			})
+			return
+		}
+		writeExecResponse(w, http.StatusOK, resp)
+	})
+}
+
+// runOnce runs the request to completion.  Only a failure to start is returned
+// as an error; everything else is reported in the response.
+func runOnce(ctx context.Context, execer Execer, req ExecRequest, maxOutput int) (ExecResponse, error) {
+	process, err := startRequest(ctx, execer, req)
+	if err != nil {
+		return ExecResponse{}, err
+	}
+
+	stdout := &cappedBuffer{max: maxOutput}
+	stderr := &cappedBuffer{max: maxOutput}
+	var output errgroup.Group
+	output.Go(func() error {
+		_, err := io.Copy(stdout, process.Stdout())
+		return err
+	})
+	output.Go(func() error {
+		_, err := io.Copy(stderr, process.Stderr())
+		return err
+	})
+	// Output errors are expected when the command is killed and otherwise
+	// surface through Wait.
+	_ = output.Wait()
+	err = process.Wait()
+
+	resp := ExecResponse{
+		Stdout:    stdout.buf.String(),
+		Stderr:    stderr.buf.String(),
+		Truncated: stdout.truncated || stderr.truncated,
+		TimedOut:  xerrors.Is(ctx.Err(), context.DeadlineExceeded),
+	}
+	resp.ExitCode, resp.Error = exitStatus(err)
+	return resp, nil
+}
+
+// streamEvents runs the request to completion like runOnce but streams its
+// output as events.
+func streamEvents(ctx context.Context, w http.ResponseWriter, execer Execer, req ExecRequest) {
+	process, err := startRequest(ctx, execer, req)
+	if err != nil {
+		writeExecResponse(w, http.StatusInternalServerError, ExecResponse{
+			Code:  string(startErrorCode(err)),
+			Error: err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", eventsContentType)
+	w.WriteHeader(http.StatusOK)
+	events := &eventWriter{enc: json.NewEncoder(w)}
+	events.flusher, _ = w.(http.Flusher)
+	var output errgroup.Group
+	output.Go(func() error {
+		return events.copy(process.Stdout(), proto.TypeStdout)
+	})
+	output.Go(func() error {
+		return events.copy(process.Stderr(), proto.TypeStderr)
+	})
+	_ = output.Wait()
+	err = process.Wait()
+
+	exit := ExecExitEvent{
+		Time:     time.Now().UnixNano() / int64(time.Millisecond),
+		TimedOut: xerrors.Is(ctx.Err(), context.DeadlineExceeded),
+	}
+	exit.ExitCode, exit.Error = exitStatus(err)
+	_ = events.write(exit)
+}
+
+// startRequest starts the request's command and writes its stdin, if any.
+func startRequest(ctx context.Context, execer Execer, req ExecRequest) (Process, error) {
+	process, err := execer.Start(ctx, Command{
+		Command:    req.Command,
+		Args:       req.Args,
+		Env:        req.Env,
+		WorkingDir: req.WorkingDir,
+		UID:        req.UID,
+		GID:        req.GID,
+		Stdin:      req.Stdin != "",
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("start command: %w", err)
+	}
+	if req.Stdin != "" {
+		go func() {
+			_, _ = io.Copy(process.Stdin(), strings.NewReader(req.Stdin))
+			_ = process.Stdin().Close()
+		}()
+	}
+	return process, nil
+}
+
+// exitStatus returns the exit code of a command from the result of Wait and,
+// if it did not exit on its own, why.
+func exitStatus(err error) (int, string) {
+	var exitErr ExitError
+	switch {
+	case xerrors.As(err, &exitErr):
+		return exitErr.ExitCode(), ""
+	case err != nil:
+		return ExitCodeUnknown, err.Error()
+	}
+	return 0, ""
+}
+
+// eventWriter writes events as lines of JSON, flushing each so that it is
+// delivered immediately.  It is safe for concurrent use.
+type eventWriter struct {
+	mutex   sync.Mutex
+	enc     *json.Encoder
+	flusher http.Flusher
+}
+
+func (e *eventWriter) write(event interface{}) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	err := e.enc.Encode(event)
+	if err == nil && e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return err
+}
+
+// copy writes the output of a stream as events until it ends.
+func (e *eventWriter) copy(r io.Reader, stream string) error {
+	buf := make([]byte, 32*1024)
+	var (
+		offset int64
+		// held is the length of an incomplete character at the start of
+		// buf left over from the last read.
+		held int
+	)
+	for {
+		n, err := r.Read(buf[held:])
+		n += held
+		complete := n
+		if err == nil {
+			complete = completeRunes(buf[:n])
+		}
+		if complete > 0 {
+			werr := e.write(ExecOutputEvent{
+				Stream: stream,
+				Time:   time.Now().UnixNano() / int64(time.Millisecond),
+				Offset: offset,
+				Data:   string(buf[:complete]),
+			})
+			if werr != nil {
+				return werr
+			}
+			offset += int64(complete)
+		}
+		held = copy(buf, buf[complete:n])
+		if xerrors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// completeRunes returns the length of p without a trailing incomplete UTF-8
+// sequence.
+func completeRunes(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if utf8.FullRune(p[i:]) {
+				return len(p)
+			}
+			return i
+		}
+	}
+	return len(p)
+}
+
+func writeExecResponse(w http.ResponseWriter, status int, resp ExecResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// cappedBuffer keeps the first max bytes written to it and discards the rest.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	room := c.max - c.buf.Len()
+	if len(p) > room {
+		c.truncated = true
+		c.buf.Write(p[:room])
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
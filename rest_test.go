@@ -0,0 +1,128 @@
+package wsep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestExecHandler(t *testing.T) {
+	t.Parallel()
+
+	post := func(t *testing.T, options *ExecHandlerOptions, req ExecRequest) (int, ExecResponse) {
+		server := httptest.NewServer(ExecHandler(&LocalExecer{}, options))
+		t.Cleanup(server.Close)
+
+		body, err := json.Marshal(req)
+		assert.Success(t, "marshal request", err)
+		res, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+		assert.Success(t, "post", err)
+		defer res.Body.Close()
+
+		var resp ExecResponse
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		assert.Success(t, "decode response", err)
+		return res.StatusCode, resp
+	}
+
+	t.Run("Output", func(t *testing.T) {
+		t.Parallel()
+
+		status, resp := post(t, nil, ExecRequest{
+			Command: "sh",
+			Args:    []string{"-c", "cat; echo err >&2; exit 3"},
+			Stdin:   "hello",
+		})
+		assert.Equal(t, "status", http.StatusOK, status)
+		assert.Equal(t, "stdout", "hello", resp.Stdout)
+		assert.Equal(t, "stderr", "err\n", resp.Stderr)
+		assert.Equal(t, "exit code", 3, resp.ExitCode)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		t.Parallel()
+
+		status, resp := post(t, &ExecHandlerOptions{MaxOutput: 4}, ExecRequest{
+			Command: "echo",
+			Args:    []string{"truncated"},
+		})
+		assert.Equal(t, "status", http.StatusOK, status)
+		assert.Equal(t, "stdout", "trun", resp.Stdout)
+		assert.True(t, "truncated", resp.Truncated)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		t.Parallel()
+
+		start := time.Now()
+		status, resp := post(t, &ExecHandlerOptions{Timeout: 100 * time.Millisecond}, ExecRequest{
+			Command: "sleep",
+			Args:    []string{"10"},
+		})
+		assert.Equal(t, "status", http.StatusOK, status)
+		assert.True(t, "timed out", resp.TimedOut)
+		assert.True(t, "killed early", time.Since(start) < 5*time.Second)
+	})
+
+	t.Run("NoCommand", func(t *testing.T) {
+		t.Parallel()
+
+		status, resp := post(t, nil, ExecRequest{})
+		assert.Equal(t, "status", http.StatusBadRequest, status)
+		assert.Equal(t, "code", string(CodeInvalidMessage), resp.Code)
+	})
+
+	t.Run("StartFailed", func(t *testing.T) {
+		t.Parallel()
+
+		status, resp := post(t, nil, ExecRequest{Command: "/does/not/exist"})
+		assert.Equal(t, "status", http.StatusInternalServerError, status)
+		assert.Equal(t, "code", string(CodeCommandNotFound), resp.Code)
+	})
+
+	t.Run("Events", func(t *testing.T) {
+		t.Parallel()
+
+		server := httptest.NewServer(ExecHandler(&LocalExecer{}, nil))
+		t.Cleanup(server.Close)
+		body, err := json.Marshal(ExecRequest{
+			Command: "sh",
+			// The character is split between reads.
+			Args: []string{"-c", `printf '\303'; sleep 0.1; printf '\251'; echo err >&2; exit 3`},
+		})
+		assert.Success(t, "marshal request", err)
+		req, err := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(body))
+		assert.Success(t, "new request", err)
+		req.Header.Set("Accept", "application/x-ndjson")
+		res, err := http.DefaultClient.Do(req)
+		assert.Success(t, "post", err)
+		defer res.Body.Close()
+		assert.Equal(t, "content type", "application/x-ndjson", res.Header.Get("Content-Type"))
+
+		output := map[string]string{}
+		var exit ExecExitEvent
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			var event ExecOutputEvent
+			err = json.Unmarshal(scanner.Bytes(), &event)
+			assert.Success(t, "decode event", err)
+			if event.Stream == "" {
+				err = json.Unmarshal(scanner.Bytes(), &exit)
+				assert.Success(t, "decode exit", err)
+				continue
+			}
+			assert.Equal(t, "offset", int64(len(output[event.Stream])), event.Offset)
+			output[event.Stream] += event.Data
+		}
+		assert.Success(t, "scan", scanner.Err())
+		assert.Equal(t, "stdout", "\u00e9", output["stdout"])
+		assert.Equal(t, "stderr", "err\n", output["stderr"])
+		assert.Equal(t, "exit code", 3, exit.ExitCode)
+	})
+}
@@ -0,0 +1,475 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+// defaultResumeBufferSize is how much of each output stream of a resumable
+// command is kept for replay unless Options.ResumeBufferSize is set.
+const defaultResumeBufferSize = 1 << 20
+
+// OutputOffsets are positions in a command's output streams, counted in bytes
+// from the start of each stream.
+type OutputOffsets struct {
+	Stdout int64
+	Stderr int64
+}
+
+// ProcessOutputOffsets returns how much output a process started by a remote
+// execer has received, which for a resumable command is where
+// Command.ResumeFrom should resume it.  It returns false for other processes.
+func ProcessOutputOffsets(p Process) (OutputOffsets, bool) {
+	if o, ok := p.(interface{ OutputOffsets() OutputOffsets }); ok {
+		return o.OutputOffsets(), true
+	}
+	return OutputOffsets{}, false
+}
+
+// acker is implemented by processes whose output can be acknowledged.
+type acker interface {
+	Ack(ctx context.Context, offsets OutputOffsets) error
+}
+
+// AckOutput tells the server the output before the offsets has been handled,
+// for example shipped somewhere durable, so it no longer needs to be kept for
+// a command with Acknowledged set.  Offsets count from the start of each
+// stream, like those from ProcessOutputOffsets.  Only processes started by
+// remote execers can acknowledge output.
+func AckOutput(ctx context.Context, p Process, offsets OutputOffsets) error {
+	a, ok := p.(acker)
+	if !ok {
+		return xerrors.Errorf("%T cannot acknowledge output", p)
+	}
+	return a.Ack(ctx, offsets)
+}
+
+// outputLog keeps the most recent output of a stream so that it can be read
+// again from an offset by a client that lost its connection.
+type outputLog struct {
+	cond *sync.Cond
+	// size is how many bytes are kept.  The log may briefly hold up to twice
+	// as much so that old output is not shifted out on every write.
+	size int
+	// start is the offset of the first byte in buf.  It and the fields below
+	// are not safe to access outside of cond.L.
+	start int64
+	buf   []byte
+	// closed is set once the stream has ended.
+	closed bool
+	// retain keeps output until it is acknowledged instead of dropping the
+	// oldest, blocking writes while size bytes are unacknowledged.
+	retain bool
+	// acked is the offset up to which the client acknowledged the output.
+	acked int64
+}
+
+func newOutputLog(size int, retain bool) *outputLog {
+	return &outputLog{cond: sync.NewCond(&sync.Mutex{}), size: size, retain: retain}
+}
+
+// Write appends to the log, dropping the oldest output beyond its size or, if
+// output is retained, waiting for it to be acknowledged.
+func (l *outputLog) Write(p []byte) (int, error) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if l.retain {
+			for l.retain && l.unacked() >= int64(l.size) {
+				l.cond.Wait()
+			}
+			if l.retain && int64(n) > int64(l.size)-l.unacked() {
+				n = int(int64(l.size) - l.unacked())
+			}
+		}
+		l.buf = append(l.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		l.trim()
+		l.cond.Broadcast()
+	}
+	return written, nil
+}
+
+// unacked returns how much output has not been acknowledged.
+func (l *outputLog) unacked() int64 {
+	return l.start + int64(len(l.buf)) - l.acked
+}
+
+// trim drops old output once there is more than twice the size, or only
+// acknowledged output if output is retained.
+func (l *outputLog) trim() {
+	over := len(l.buf) - l.size
+	if l.retain && int64(over) > l.acked-l.start {
+		over = int(l.acked - l.start)
+	}
+	if over > l.size {
+		l.buf = append(l.buf[:0], l.buf[over:]...)
+		l.start += int64(over)
+	}
+}
+
+// ack acknowledges the output before offset so that retained output can be
+// dropped.
+func (l *outputLog) ack(offset int64) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	if end := l.start + int64(len(l.buf)); offset > end {
+		offset = end
+	}
+	if offset > l.acked {
+		l.acked = offset
+		l.cond.Broadcast()
+	}
+}
+
+// release stops retaining output, unblocking writes, for when nothing will
+// acknowledge it any more.
+func (l *outputLog) release() {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	l.retain = false
+	l.cond.Broadcast()
+}
+
+// close marks the end of the stream.
+func (l *outputLog) close() {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+}
+
+// reader returns a reader of the log from offset, or from the oldest output
+// kept if that has been dropped.  It reads until the stream ends or ctx does.
+func (l *outputLog) reader(ctx context.Context, offset int64) *outputLogReader {
+	go func() {
+		// Wake up readers when the context ends.
+		<-ctx.Done()
+		l.cond.L.Lock()
+		defer l.cond.L.Unlock()
+		l.cond.Broadcast()
+	}()
+	return &outputLogReader{ctx: ctx, log: l, offset: offset}
+}
+
+type outputLogReader struct {
+	ctx context.Context
+	log *outputLog
+	// offset is the position of the next byte to read.
+	offset int64
+	// lines makes reads return whole lines like a lineReader.
+	lines bool
+	// closed is set once the reader is closed.  It is guarded by the log's
+	// lock.
+	closed bool
+}
+
+func (r *outputLogReader) Read(p []byte) (int, error) {
+	_, n, err := r.read(p)
+	return n, err
+}
+
+// read is like Read but also returns the offset of the data read.
+func (r *outputLogReader) read(p []byte) (int64, int, error) {
+	l := r.log
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	for r.ctx.Err() == nil && !r.closed && !l.closed && !r.ready(len(p)) {
+		l.cond.Wait()
+	}
+	if err := r.ctx.Err(); err != nil {
+		return r.offset, 0, err
+	}
+	if r.closed {
+		return r.offset, 0, io.ErrClosedPipe
+	}
+	if r.offset < l.start {
+		r.offset = l.start
+	}
+	if r.offset >= l.start+int64(len(l.buf)) {
+		return r.offset, 0, io.EOF
+	}
+	offset := r.offset
+	data := l.buf[offset-l.start:]
+	if r.lines && !l.closed {
+		if len(data) > len(p) {
+			data = data[:len(p)]
+		}
+		if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+			data = data[:i+1]
+		}
+	}
+	n := copy(p, data)
+	r.offset += int64(n)
+	return offset, n, nil
+}
+
+// Close ends reads from the reader.  The log keeps its output for others.
+func (r *outputLogReader) Close() error {
+	l := r.log
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	r.closed = true
+	l.cond.Broadcast()
+	return nil
+}
+
+// ready returns whether a read of up to size bytes can return.  It must be
+// called with cond.L held.
+func (r *outputLogReader) ready(size int) bool {
+	l := r.log
+	offset := r.offset
+	if offset < l.start {
+		offset = l.start
+	}
+	if offset >= l.start+int64(len(l.buf)) {
+		return false
+	}
+	available := l.buf[offset-l.start:]
+	if !r.lines || len(available) >= size {
+		return true
+	}
+	return bytes.IndexByte(available, '\n') >= 0
+}
+
+// resumableCommand is a command without a TTY that keeps running when its
+// connection drops and logs its output so a client can resume it from where it
+// left off.  It is closed once nothing has been attached for the session
+// timeout.
+type resumableCommand struct {
+	process Process
+	cancel  context.CancelFunc
+	stdout  *outputLog
+	stderr  *outputLog
+	// journal, if not nil, records the output on disk as well.
+	journal *journal
+	// expired is called once the command is closed for having nothing
+	// attached.
+	expired func()
+	// quota is shared by every connection attached to the command.
+	quota *quota
+
+	done chan struct{}
+	// err is the result of Wait.  It is only safe to read once done is closed.
+	err error
+
+	// mutex guards the fields below.
+	mutex sync.Mutex
+	// owner identifies who may attach to the command like a session's owner.
+	owner string
+	// attached counts the connections attached to the command.
+	attached int
+	// timer closes the command once it expires.  It only runs while nothing
+	// is attached.
+	timer *time.Timer
+	// timeout is how long the command is kept with nothing attached.
+	timeout time.Duration
+}
+
+// startResumable starts a resumable command with the provided ID.  Unlike other
+// commands it does not end with the connection that started it, so it reports
+// its own exit to Options.OnExit.  Its output is also written to the journal
+// if it is not nil.
+func startResumable(id string, command Command, execer Execer, options *Options, j *journal, expired func()) (*resumableCommand, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	process, err := execer.Start(ctx, command)
+	if err != nil {
+		cancel()
+		if j != nil {
+			_ = j.Close()
+		}
+		return nil, err
+	}
+	started := time.Now()
+	size := options.ResumeBufferSize
+	if size <= 0 {
+		size = defaultResumeBufferSize
+	}
+	r := &resumableCommand{
+		process: process,
+		cancel:  cancel,
+		stdout:  newOutputLog(size, command.Acknowledged),
+		stderr:  newOutputLog(size, command.Acknowledged),
+		journal: j,
+		expired: expired,
+		quota:   newQuota(options),
+		done:    make(chan struct{}),
+		owner:   options.Owner,
+		timeout: options.SessionTimeout,
+	}
+	r.timer = time.AfterFunc(r.timeout, r.close)
+
+	go func() {
+		var output errgroup.Group
+		output.Go(func() error {
+			defer r.stdout.close()
+			_, err := io.Copy(r.logWriter(r.stdout), process.Stdout())
+			return err
+		})
+		output.Go(func() error {
+			defer r.stderr.close()
+			_, err := io.Copy(r.logWriter(r.stderr), process.Stderr())
+			return err
+		})
+		_ = output.Wait()
+		if r.journal != nil {
+			_ = r.journal.Close()
+		}
+		r.err = process.Wait()
+		close(r.done)
+		if options.OnExit != nil {
+			options.OnExit(context.Background(), newExitInfo(options, id, &command, process, started, r.err))
+		}
+	}()
+	return r, nil
+}
+
+// logWriter returns a writer to the output log that also writes to the
+// journal, if any.  Both streams share the journal in the order they arrive.
+func (r *resumableCommand) logWriter(log *outputLog) io.Writer {
+	if r.journal == nil {
+		return log
+	}
+	return io.MultiWriter(log, r.journal)
+}
+
+// attach returns a view of the command for a connection that replays output
+// from the offsets.  The command is kept until ctx ends and the session
+// timeout passes with nothing else attached.
+func (r *resumableCommand) attach(ctx context.Context, offsets proto.ResumeOffsets) Process {
+	r.mutex.Lock()
+	r.attached++
+	r.timer.Stop()
+	r.mutex.Unlock()
+	go func() {
+		<-ctx.Done()
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.attached--
+		if r.attached == 0 {
+			r.timer.Reset(r.timeout)
+		}
+	}()
+	return &resumedProcess{
+		ctx:     ctx,
+		command: r,
+		stdout:  r.stdout.reader(ctx, offsets.Stdout),
+		stderr:  r.stderr.reader(ctx, offsets.Stderr),
+	}
+}
+
+// close kills the command if it is still running and forgets it.
+func (r *resumableCommand) close() {
+	r.cancel()
+	r.stdout.release()
+	r.stderr.release()
+	if r.expired != nil {
+		r.expired()
+	}
+}
+
+// ack acknowledges output the client has handled so it need not be retained.
+func (r *resumableCommand) ack(offsets proto.ResumeOffsets) {
+	r.stdout.ack(offsets.Stdout)
+	r.stderr.ack(offsets.Stderr)
+}
+
+// ownedBy returns whether the provided owner may attach to the command.
+func (r *resumableCommand) ownedBy(owner string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.owner == "" || r.owner == owner
+}
+
+// resumedProcess is a connection's view of a resumable command.  Its output
+// starts from where the client asked to resume and it only waits for the
+// command while the connection lasts.
+type resumedProcess struct {
+	ctx     context.Context
+	command *resumableCommand
+	stdout  *outputLogReader
+	stderr  *outputLogReader
+}
+
+func (p *resumedProcess) Pid() int {
+	return p.command.process.Pid()
+}
+
+func (p *resumedProcess) Stdin() io.WriteCloser {
+	return p.command.process.Stdin()
+}
+
+func (p *resumedProcess) Stdout() io.ReadCloser {
+	return p.stdout
+}
+
+func (p *resumedProcess) Stderr() io.ReadCloser {
+	return p.stderr
+}
+
+func (p *resumedProcess) Resize(ctx context.Context, rows, cols uint16) error {
+	return p.command.process.Resize(ctx, rows, cols)
+}
+
+func (p *resumedProcess) Signal(ctx context.Context, sig Signal) error {
+	return SignalProcess(ctx, p.command.process, sig)
+}
+
+func (p *resumedProcess) StartInfo() ProcessInfo {
+	return ProcessStartInfo(p.command.process)
+}
+
+func (p *resumedProcess) Usage() (ResourceUsage, bool) {
+	return ProcessUsage(p.command.process)
+}
+
+func (p *resumedProcess) Wait() error {
+	select {
+	case <-p.command.done:
+		return p.command.err
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// Close closes the command itself rather than only detaching from it.
+func (p *resumedProcess) Close() error {
+	return p.command.process.Close()
+}
+
+// copyFromLog sends the output read from a resumable command's log as messages
+// carrying their offset and, if timestamps is set, the time they were sent.
+func copyFromLog(r *outputLogReader, w io.Writer, typ string, timestamps bool) error {
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	buf := *bufp
+	for {
+		offset, n, err := r.read(buf)
+		if n > 0 {
+			header := proto.ServerOutputHeader{Type: typ, Offset: offset}
+			if timestamps {
+				header.Time = time.Now().UnixNano() / int64(time.Millisecond)
+			}
+			if werr := proto.WriteOutput(w, header, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestOutputLog(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	log := newOutputLog(4, false)
+	_, _ = log.Write([]byte("abcdef"))
+
+	// Offsets still held are replayed from there.
+	r := log.reader(ctx, 2)
+	buf := make([]byte, 16)
+	offset, n, err := r.read(buf)
+	assert.Success(t, "read", err)
+	assert.Equal(t, "offset", int64(2), offset)
+	assert.Equal(t, "data", "cdef", string(buf[:n]))
+
+	// Writing past twice the size drops the oldest output, which readers skip.
+	_, _ = log.Write([]byte("ghi"))
+	offset, n, err = log.reader(ctx, 1).read(buf)
+	assert.Success(t, "read dropped", err)
+	assert.Equal(t, "skipped offset", int64(5), offset)
+	assert.Equal(t, "kept data", "fghi", string(buf[:n]))
+
+	log.close()
+	rest, err := ioutil.ReadAll(r)
+	assert.Success(t, "read to end", err)
+	assert.Equal(t, "rest", "ghi", string(rest))
+
+	// Readers give up once their context ends.
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = newOutputLog(4, false).reader(ctx, 0).Read(buf)
+	assert.Equal(t, "canceled", context.Canceled, err)
+	_, err = log.reader(context.Background(), 9).Read(buf)
+	assert.Equal(t, "end", io.EOF, err)
+}
+
+func TestOutputLogRetain(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	log := newOutputLog(4, true)
+	_, _ = log.Write([]byte("abcd"))
+
+	// Writes wait while the size is unacknowledged.
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		_, _ = log.Write([]byte("ef"))
+	}()
+	select {
+	case <-written:
+		t.Fatal("write did not wait for an ack")
+	case <-time.After(50 * time.Millisecond):
+	}
+	log.ack(2)
+	<-written
+
+	// Unacknowledged output is never dropped.
+	_, n, err := log.reader(ctx, 0).read(make([]byte, 16))
+	assert.Success(t, "read", err)
+	assert.Equal(t, "kept data", 6, n)
+
+	// Nothing waits for acks once the log is released.
+	log.release()
+	_, err = log.Write([]byte("ghijklmnop"))
+	assert.Success(t, "write released", err)
+}
+
+func TestOutputLogLines(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	log := newOutputLog(16, false)
+	r := log.reader(ctx, 0)
+	r.lines = true
+	_, _ = log.Write([]byte("ab\ncd"))
+
+	buf := make([]byte, 16)
+	offset, n, err := r.read(buf)
+	assert.Success(t, "read", err)
+	assert.Equal(t, "line", "ab\n", string(buf[:n]))
+
+	// The partial line is held until it is completed.
+	read := make(chan string)
+	go func() {
+		offset, n, _ = r.read(buf)
+		read <- string(buf[:n])
+	}()
+	select {
+	case <-read:
+		t.Fatal("partial line was read")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, _ = log.Write([]byte("e\nf"))
+	assert.Equal(t, "completed line", "cde\n", <-read)
+	assert.Equal(t, "offset", int64(3), offset)
+
+	// The rest is read once the stream ends.
+	log.close()
+	_, n, err = r.read(buf)
+	assert.Success(t, "read rest", err)
+	assert.Equal(t, "rest", "f", string(buf[:n]))
+}
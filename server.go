@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
-	"os/exec"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.coder.com/flog"
@@ -27,6 +32,147 @@ const (
 // Options allows configuring the server.
 type Options struct {
 	SessionTimeout time.Duration
+	// Owner identifies the authenticated principal behind the connection.
+	// Sessions remember the owner of the connection that created them and only
+	// connections with the same owner may attach to an owned session.
+	Owner string
+	// Admin permits administrative messages (like transferring a session) for
+	// sessions owned by someone else.
+	Admin bool
+	// IdleTimeout closes TTY commands that sit at an idle prompt with no input
+	// or output for this long, along with their session if any.  It is
+	// disabled when zero.
+	IdleTimeout time.Duration
+	// IdleWarning is how long before an idle TTY closes that a countdown is
+	// written into the terminal.  Defaults to a minute.
+	IdleWarning time.Duration
+	// Audit receives an event for each command and transfer.
+	Audit AuditSink
+	// OnExit, if set, is called when a command finishes, after its exit code
+	// is sent, so orchestration can react without polling.  Sessions and
+	// commands with IDs are reported when they finish whether or not a client
+	// is attached, with an unknown exit code for sessions since screen does
+	// not report it.  Other commands are reported from their connection, which
+	// is not done until it returns, so slow handlers should hand the exit off.
+	// HTTPExitHook posts exits to a webhook.
+	OnExit func(ctx context.Context, info ExitInfo)
+	// OutputCoalesceDelay holds TTY output for up to this long so that bursts
+	// of small writes are sent as one message.  A few milliseconds cuts the
+	// messages an interactive shell sends considerably at the cost of that
+	// much latency.  It is disabled when zero and for commands with LowLatency
+	// set.
+	OutputCoalesceDelay time.Duration
+	// ReadLimit is the size in bytes of the largest message accepted from a
+	// client.  Larger messages close the connection.  Defaults to 64000, the
+	// largest message wsep clients send.
+	ReadLimit int64
+	// FrameRate limits how many messages per second are read from a client,
+	// with bursts of up to FrameBurst, which defaults to FrameRate.  Reading is
+	// delayed rather than failed so a client over budget is slowed down by
+	// backpressure.  It is unlimited when zero.
+	FrameRate  float64
+	FrameBurst int
+	// TextFrames sends WebSocket messages as text frames, with readable JSON
+	// headers and base64 bodies, so that browser developer tools and proxies
+	// can show the traffic.  The server also switches to text frames once a
+	// client sends one.
+	TextFrames bool
+	// ResumeBufferSize is how many bytes of each output stream of a command
+	// without a TTY but with an ID are kept for clients that resume it.
+	// Output older than that is lost to a client that reconnects too late.
+	// Defaults to 1 MiB.
+	ResumeBufferSize int
+	// JournalDir, if set, is where the output of each session and each command
+	// without a TTY but with an ID is journaled, so it can be read with
+	// OpenJournal or by clients with SessionAdmin.ReadJournal even after
+	// being disconnected for longer than the output kept in memory.  Journals
+	// are left on disk after their session closes until a session with the
+	// same ID starts.  Sessions run by execers with their own filesystem, such
+	// as containers, are not journaled.
+	JournalDir string
+	// OutputQuota and StdinQuota cap the bytes of output messages sent and
+	// stdin received for each command, or each session across its
+	// connections.  The connection is closed with CodeQuotaExceeded once one
+	// is used up.  OutputRate and StdinRate limit them to bytes per second,
+	// with bursts of up to a second's worth, by pausing output and reading
+	// stdin.  All are unlimited when zero.
+	OutputQuota int64
+	StdinQuota  int64
+	OutputRate  float64
+	StdinRate   float64
+	// JournalSize caps the size in bytes of each journal.  Once a journal
+	// reaches half of it the older half is discarded.  Defaults to 16 MiB.
+	JournalSize int64
+	// AttachTimeout bounds starting a session's screen daemon, attaching to it
+	// and each command sent to it, and is how long a new session waits for
+	// its first attach.  Defaults to 30 seconds.
+	AttachTimeout time.Duration
+	// ScreenConfig replaces the screen configuration of sessions, which
+	// defaults to DefaultScreenConfig, and ScreenConfigExtra adds lines to it,
+	// for example to set the scrollback, escape key or status line.
+	ScreenConfig      []string
+	ScreenConfigExtra []string
+	// ScreenRetryInterval is how often a screen command that failed is retried
+	// until AttachTimeout.  Defaults to 250 milliseconds.
+	ScreenRetryInterval time.Duration
+	// MaxOutputBytes caps the output streamed for each command across stdout
+	// and stderr.  Once it is reached the rest of the output is read but not
+	// sent, and a truncated message reports how much was dropped when each
+	// stream ends.  Commands without a TTY but with an ID are not capped since
+	// clients resume them by offset.  It is unlimited when zero.
+	MaxOutputBytes int64
+	// OutputTailBytes is how much of the end of each stream is still sent
+	// after its truncated message when MaxOutputBytes was reached, since the
+	// end of a log is often what explains a failure.
+	OutputTailBytes int
+	// StartTimeout closes connections whose client has not started a command
+	// or made another request this long after connecting, with
+	// CodeStartTimeout.  It is disabled when zero.
+	StartTimeout time.Duration
+	// ClientIdleTimeout closes connections whose client has sent nothing for
+	// this long, so that half-open connections do not hold their command or
+	// session until TCP gives up.  WebSocket clients are pinged halfway there
+	// and count as active if they answer, but clients over a stream must send
+	// a message within it.  It is disabled when zero.
+	ClientIdleTimeout time.Duration
+	// SlowConsumerTimeout is how long a write to the client may block before
+	// the client counts as a slow consumer, one that stopped reading while
+	// output backs up behind it.  The first time a connection's client does,
+	// Server.SlowConsumerCount goes up and an AuditSlowConsumer event is
+	// recorded.  It is disabled when zero.
+	SlowConsumerTimeout time.Duration
+	// DropSlowConsumers closes the connection of a slow consumer with
+	// CodeSlowConsumer rather than leaving its command blocked on output.
+	DropSlowConsumers bool
+	// CaptureDir, if set, records every message of each connection to a file
+	// of its own in this directory as CaptureRecord JSON lines, with the time
+	// and direction, for debugging protocol issues between mismatched client
+	// and server builds offline.  Headers have tokens, passwords and
+	// environment values scrubbed and bodies are left out.  Captures are not
+	// rotated, so only set it while debugging.
+	CaptureDir string
+	// StrictMessages closes the connection with CodeUnknownMessage when a
+	// client sends a message of a type the server does not know, so that a
+	// client newer than the server is noticed.  By default such messages are
+	// skipped instead: types skipped before the command starts are listed in
+	// its pid message and later ones are sent as warnings, once each.
+	StrictMessages bool
+	// MaxConnections caps how many connections the server serves at once and
+	// MaxConnectionsPerAddress how many of them may come from one host, as a
+	// backstop against a client such as a browser with many tabs open.
+	// Connections beyond them are closed with CodeTooManyConnections, or
+	// refused with 503 Service Unavailable by ServeHTTP2 and ServeWebSocket.
+	// Only connections whose address is known count toward
+	// MaxConnectionsPerAddress: those served by ServeHTTP2, ServeWebSocket
+	// and ServeListener, and streams that are network connections.  Both are
+	// unlimited when zero.
+	MaxConnections           int
+	MaxConnectionsPerAddress int
+	// AcceptEnv lists the variables clients may forward with Command.Locale
+	// as patterns in the syntax of path.Match, like sshd's AcceptEnv.
+	// LocaleAcceptEnv returns patterns for the variables of a locale.  None
+	// are accepted when it is empty.
+	AcceptEnv []string
 }
 
 // _sessions is a global map of sessions that exists for backwards
@@ -38,11 +184,19 @@ var _sessions sync.Map
 // Server should be used instead which locally maintains the mutex.
 var _sessionsMutex sync.Mutex
 
+// _resumables is a global map of resumable commands that exists for backwards
+// compatibility.  Server should be used instead which locally maintains the
+// map.
+var _resumables sync.Map
+
+// _slowConsumers counts the slow consumers of the deprecated Serve.
+var _slowConsumers int64
+
 // Serve runs the server-side of wsep.
 // Deprecated: Use Server.Serve() instead.
 func Serve(ctx context.Context, c *websocket.Conn, execer Execer, options *Options) error {
-	srv := Server{sessions: &_sessions, sessionsMutex: &_sessionsMutex}
-	return srv.Serve(ctx, c, execer, options)
+	srv := Server{sessions: &_sessions, sessionsMutex: &_sessionsMutex, resumables: &_resumables, connections: &_connections, slowConsumers: &_slowConsumers}
+	return srv.serveAdmitted(ctx, newWSConn(c, options != nil && options.TextFrames), "", execer, options)
 }
 
 // Server runs the server-side of wsep.  The execer may be another wsep
@@ -50,6 +204,21 @@ func Serve(ctx context.Context, c *websocket.Conn, execer Execer, options *Optio
 type Server struct {
 	sessions      *sync.Map
 	sessionsMutex *sync.Mutex
+	// resumables holds resumable commands by ID.  It is also guarded by
+	// sessionsMutex.
+	resumables *sync.Map
+
+	extensionsMutex sync.RWMutex
+	extensions      map[string]ExtensionHandler
+
+	// cluster is set if the server shares sessions with other servers.
+	cluster *Cluster
+
+	// connections counts the connections being served.
+	connections *connLimiter
+	// slowConsumers counts connections whose client stopped reading.  It
+	// must be accessed atomically.
+	slowConsumers *int64
 }
 
 // NewServer returns as new wsep server.
@@ -57,6 +226,9 @@ func NewServer() *Server {
 	return &Server{
 		sessions:      &sync.Map{},
 		sessionsMutex: &sync.Mutex{},
+		resumables:    &sync.Map{},
+		connections:   &connLimiter{},
+		slowConsumers: new(int64),
 	}
 }
 
@@ -70,7 +242,81 @@ func (srv *Server) SessionCount() int {
 	return i
 }
 
-// Close closes all sessions.
+// SlowConsumerCount returns how many connections have had a client stop
+// reading for Options.SlowConsumerTimeout.
+func (srv *Server) SlowConsumerCount() int64 {
+	return atomic.LoadInt64(srv.slowConsumers)
+}
+
+// ListSessions describes the server's sessions, sorted by ID.
+func (srv *Server) ListSessions() []SessionInfo {
+	var sessions []SessionInfo
+	srv.sessions.Range(func(k, rawSession interface{}) bool {
+		if s, ok := rawSession.(*Session); ok {
+			sessions = append(sessions, s.info(k.(string)))
+		}
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// TransferSession changes the owner of a session so that connections for the
+// new owner may attach to it while the previous owner no longer can.
+func (srv *Server) TransferSession(id string, owner string) error {
+	s, err := srv.session(id)
+	if err != nil {
+		return err
+	}
+	s.setOwner(owner)
+	return nil
+}
+
+// FreezeSession stops every process in a session and pauses its timeouts so
+// it can be suspended, for example while a workspace is paused, without losing
+// its state.  Attached clients are told the session is frozen.  The session
+// stays frozen until ThawSession is called.
+func (srv *Server) FreezeSession(id string) error {
+	s, err := srv.session(id)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.attachTimeout())
+	defer cancel()
+	return s.Freeze(ctx)
+}
+
+// ThawSession resumes a session stopped by FreezeSession.
+func (srv *Server) ThawSession(id string) error {
+	s, err := srv.session(id)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.attachTimeout())
+	defer cancel()
+	return s.Thaw(ctx)
+}
+
+// session returns the session with the provided ID.
+func (srv *Server) session(id string) (*Session, error) {
+	rawSession, ok := srv.sessions.Load(id)
+	if !ok {
+		return nil, codeErrorf(CodeSessionNotFound, "session %s not found", id)
+	}
+	s, ok := rawSession.(*Session)
+	if !ok {
+		return nil, xerrors.Errorf("found invalid type in session map for ID %s", id)
+	}
+	return s, nil
+}
+
+// defaultSessionTimeout is the session timeout if Options.SessionTimeout is not
+// set.
+const defaultSessionTimeout = 5 * time.Minute
+
+// Close closes all sessions and resumable commands.
 func (srv *Server) Close() {
 	srv.sessions.Range(func(k, rawSession interface{}) bool {
 		if s, ok := rawSession.(*Session); ok {
@@ -78,36 +324,263 @@ func (srv *Server) Close() {
 		}
 		return true
 	})
+	srv.resumables.Range(func(k, rawCommand interface{}) bool {
+		if r, ok := rawCommand.(*resumableCommand); ok {
+			r.close()
+		}
+		return true
+	})
 }
 
 // Serve runs the server-side of wsep.  The execer may be another wsep
 // connection for chaining.  Use LocalExecer for local command execution.  The
 // web socket will not be closed automatically; the caller must call Close() on
-// the web socket (ideally with a reason) once Serve yields.
+// the web socket (ideally with a reason) once Serve yields.  Serve only yields
+// once everything it started for the connection has stopped using it.
 func (srv *Server) Serve(ctx context.Context, c *websocket.Conn, execer Execer, options *Options) error {
-	// The process will get killed when the connection context ends.
+	return srv.serveAdmitted(ctx, newWSConn(c, options != nil && options.TextFrames), "", execer, options)
+}
+
+// ServeWebSocket accepts a WebSocket from the request with the accept options
+// and serves it like Serve, closing it with the error (if any) as the reason
+// once Serve yields.  Unlike Serve it knows the client's address and refuses
+// connections beyond the limits of the options with 503 Service Unavailable
+// before accepting them.
+func (srv *Server) ServeWebSocket(w http.ResponseWriter, r *http.Request, accept *websocket.AcceptOptions, execer Execer, options *Options) error {
+	release, err := srv.connections.admit(r.RemoteAddr, options)
+	if err != nil {
+		newConnSummary(r.RemoteAddr).record(options, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return err
+	}
+	defer release()
+	ws, err := websocket.Accept(w, r, accept)
+	if err != nil {
+		return xerrors.Errorf("accept websocket: %w", err)
+	}
+	c := newWSConn(ws, options != nil && options.TextFrames)
+	err = srv.serve(r.Context(), c, r.RemoteAddr, execer, options)
+	closeWithError(c, err)
+	return err
+}
+
+// ServeStream runs the server-side of wsep over a byte stream such as a unix
+// socket, for use with RemoteStreamExecer.  Unlike Serve the stream is closed
+// once ServeStream yields, with the error (if any) as the close reason, since
+// the caller has no other way to send the reason.
+func (srv *Server) ServeStream(ctx context.Context, rwc io.ReadWriteCloser, execer Execer, options *Options) error {
+	c := newStreamConn(rwc)
+	err := srv.serveAdmitted(ctx, c, streamAddr(rwc), execer, options)
+	closeWithError(c, err)
+	return err
+}
+
+// ServeListener accepts connections from the listener and serves each with
+// ServeStream until the context ends or the listener fails.  The listener is
+// closed once ServeListener yields.
+func (srv *Server) ServeListener(ctx context.Context, l net.Listener, execer Execer, options *Options) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return xerrors.Errorf("accept: %w", err)
+		}
+		go func() {
+			err := srv.ServeStream(ctx, nc, execer, options)
+			if err != nil {
+				flog.Error("failed to serve stream: %v", err)
+			}
+		}()
+	}
+}
+
+// closeWithError closes the connection with a status and reason derived from
+// the error returned from serving it.
+func closeWithError(c conn, err error) {
+	if err == nil {
+		_ = c.Close(websocket.StatusNormalClosure, "normal closure")
+		return
+	}
+	// Max reason string length is 123.
+	reason := err.Error()
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	status := websocket.StatusInternalError
+	switch ErrorCode(err) {
+	case CodeQuotaExceeded, CodeSlowConsumer:
+		status = websocket.StatusPolicyViolation
+	case CodeTooManyConnections:
+		status = websocket.StatusTryAgainLater
+	}
+	_ = c.Close(status, reason)
+}
+
+// serveAdmitted serves the connection from addr, which is empty if it is not
+// known, unless the limits of options refuse it.
+func (srv *Server) serveAdmitted(ctx context.Context, c conn, addr string, execer Execer, options *Options) error {
+	release, err := srv.connections.admit(addr, options)
+	if err != nil {
+		newConnSummary(addr).record(options, err)
+		sendError(c, err)
+		return err
+	}
+	defer release()
+	return srv.serve(ctx, c, addr, execer, options)
+}
+
+// serve serves the connection from addr, which is empty if it is not known.
+func (srv *Server) serve(ctx context.Context, c conn, addr string, execer Execer, options *Options) (err error) {
+	// The summary is recorded last so that it sees the command exit and the
+	// final error.
+	summary := newConnSummary(addr)
+	defer func() {
+		summary.record(options, err)
+	}()
+	if options != nil && options.CaptureDir != "" {
+		captured, end, captureErr := newCaptureConn(c, options.CaptureDir)
+		if captureErr != nil {
+			flog.Error("failed to capture connection: %v", captureErr)
+		} else {
+			c = captured
+			defer func() {
+				end(err)
+			}()
+		}
+	}
+	// The process will get killed when the connection context ends, after
+	// which the goroutines serving the connection finish before it is
+	// returned to the caller.
+	ctx, cancel := context.WithCancel(ctx)
+	// The goroutine is labeled for profiles once the command is known, which
+	// the caller's goroutine should not keep.
+	defer pprof.SetGoroutineLabels(ctx)
+	var tasks taskGroup
+	defer func() {
+		cancel()
+		if !tasks.wait(drainTimeout) {
+			flog.Error("connection goroutines still running %s after it ended", drainTimeout)
+		}
+	}()
+	// failed holds an error that ended the connection from outside the read
+	// loop, such as an exceeded quota, which explains the close better than the
+	// interrupted read.
+	failed := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case failed <- err:
+			// Canceling a read closes the connection, so the error has to be
+			// sent first.
+			sendError(c, err)
+			cancel()
+		default:
+		}
+	}
+	defer func() {
+		select {
+		case err = <-failed:
+			return
+		default:
+		}
+		sendError(c, err)
+	}()
 
 	if options == nil {
 		options = &Options{}
 	}
 	if options.SessionTimeout == 0 {
-		options.SessionTimeout = 5 * time.Minute
+		options.SessionTimeout = defaultSessionTimeout
 	}
 
-	c.SetReadLimit(maxMessageSize)
+	readLimit := options.ReadLimit
+	if readLimit <= 0 {
+		readLimit = maxMessageSize
+	}
+	c.SetReadLimit(readLimit)
+	activity := newClientActivity()
+	if options.ClientIdleTimeout > 0 {
+		tasks.Go(func() {
+			watchClient(ctx, c, activity, options.ClientIdleTimeout, fail)
+		})
+	}
+	// requested is closed once the client asks for something, which it must do
+	// within StartTimeout.
+	requested := make(chan struct{})
+	if options.StartTimeout > 0 {
+		tasks.Go(func() {
+			timer := time.NewTimer(options.StartTimeout)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				fail(codeErrorf(CodeStartTimeout, "nothing was requested within %s of connecting", options.StartTimeout))
+			case <-requested:
+			case <-ctx.Done():
+			}
+		})
+	}
 	var (
 		header    proto.Header
 		process   Process
-		wsNetConn = websocket.NetConn(ctx, c, websocket.MessageBinary)
+		upload    *fileUpload
+		idle      *idleTracker
+		msgWriter = connWriter{ctx: ctx, conn: c}
+		budget    = newFrameBudget(options.FrameRate, options.FrameBurst)
+		usage     *quota
+		metrics   *sessionMetrics
+		input     *inputClient
+		observing bool
+		// inSession is set if the command is attached to a session, whose
+		// screen daemon keeps the terminal modes it started with.
+		inSession bool
+		// ignored holds the unknown message types skipped so far, and
+		// ignoredTypes those skipped before the command started.
+		ignored      = make(map[string]bool)
+		ignoredTypes []string
+		// seq is that of the message being handled, which an error it
+		// causes echoes.
+		seq uint64
 	)
+	if timeout := options.SlowConsumerTimeout; timeout > 0 {
+		var once sync.Once
+		msgWriter.conn = slowConsumerConn{conn: c, timeout: timeout, onSlow: func() {
+			once.Do(func() {
+				atomic.AddInt64(srv.slowConsumers, 1)
+				summary.slowConsumer(options, timeout)
+				if options.DropSlowConsumers {
+					fail(codeErrorf(CodeSlowConsumer, "client read no output for %s", timeout))
+				}
+			})
+		}}
+	}
+	defer func() {
+		if upload != nil {
+			_ = upload.abort()
+		}
+	}()
+	defer func() {
+		if err != nil && seq != 0 {
+			err = &seqError{seq: seq, err: err}
+		}
+	}()
 
 	for {
+		seq = 0
 		if err := ctx.Err(); err != nil {
 			return err
 		}
-		_, byt, err := c.Read(ctx)
+		if err := budget.wait(ctx); err != nil {
+			return err
+		}
+		byt, err := c.Read(ctx)
 		if xerrors.Is(err, io.EOF) {
 			return nil
 		}
@@ -121,26 +594,41 @@ func (srv *Server) Serve(ctx context.Context, c *websocket.Conn, execer Execer,
 			}
 			return nil
 		}
+		activity.touch()
 
-		headerByt, bodyByt := proto.SplitMessage(byt)
-		err = json.Unmarshal(headerByt, &header)
+		typ, headerByt, bodyByt, err := proto.ParseClientMessage(byt)
 		if err != nil {
-			return xerrors.Errorf("unmarshal header: %w", err)
+			return codeErrorf(CodeInvalidMessage, "invalid message: %w", err)
+		}
+		header.Type = typ
+		if typ != proto.TypeStart && typ != proto.TypeStdin && typ != proto.TypeFileData && headerByt != nil {
+			var control proto.ClientControlHeader
+			if json.Unmarshal(headerByt, &control) == nil {
+				seq = control.Seq
+			}
 		}
 
 		switch header.Type {
 		case proto.TypeStart:
-			if process != nil {
-				return errors.New("command already started")
+			if process != nil || upload != nil {
+				return codeErrorf(CodeAlreadyStarted, "command already started")
 			}
 
 			var header proto.ClientStartHeader
 			err = json.Unmarshal(byt, &header)
 			if err != nil {
-				return xerrors.Errorf("unmarshal start header: %w", err)
+				return codeErrorf(CodeInvalidMessage, "unmarshal start header: %w", err)
 			}
 
 			command := mapToClientCmd(header.Command)
+			// Observers watch the session's terminal.
+			if header.Observe {
+				command.TTY = true
+			}
+			// Goroutines inherit the labels of the goroutine that starts them,
+			// so everything started for the command from here on, including
+			// its session, is attributed to it in CPU and goroutine profiles.
+			pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels("session_id", header.ID, "command", command.Command)))
 
 			if command.TTY {
 				// If rows and cols are not provided, default to 80x24.
@@ -152,84 +640,611 @@ func (srv *Server) Serve(ctx context.Context, c *websocket.Conn, execer Execer,
 					flog.Info("cols not provided, defaulting to 24")
 					command.Cols = defaultCols
 				}
+				command.Env = append(terminalEnv(header), command.Env...)
 			}
+			// Forwarded variables are the weakest so the command's own
+			// override them.
+			command.Env = append(filterEnv(header.Locale, options.AcceptEnv), command.Env...)
 
-			// Only TTYs with IDs can be reconnected.
-			if command.TTY && header.ID != "" {
-				process, err = srv.withSession(ctx, header.ID, command, execer, options)
-			} else {
-				process, err = execer.Start(ctx, *command)
+			if command.TTY && (command.StdoutFile != "" || command.StderrFile != "") {
+				return codeErrorf(CodeInvalidCommand, "start command: output of TTY commands cannot be redirected")
 			}
-			if err != nil {
+
+			if header.Observe && header.ID == "" {
+				return codeErrorf(CodeInvalidMessage, "observe sent without a session id")
+			}
+
+			// Commands with IDs can be reconnected, TTYs through a session and
+			// others by resuming their output.
+			var (
+				warnings  []startWarning
+				forwarded bool
+			)
+			switch {
+			case command.TTY && header.ID != "":
+				process, err = srv.forwardSession(ctx, header, command, options, msgWriter)
+				forwarded = process != nil
+				if process == nil && err == nil {
+					process, warnings, err = srv.withSession(ctx, header, command, execer, options)
+				}
+			case header.ID != "":
+				process, err = srv.withResumable(ctx, header.ID, command, header.Resume, redirectingExecer{execer}, options)
+			default:
+				process, err = redirectingExecer{execer}.Start(ctx, *command)
+			}
+			// Retrying cannot resume a command that is gone so say so.
+			if ErrorCode(err) == CodeSessionNotFound {
 				return err
 			}
+			if err != nil {
+				return codeErrorf(startErrorCode(err), "start command: %w", err)
+			}
+			started := time.Now()
+
+			// Sessions and resumable commands outlive the connection so they
+			// report their own exit, as forwarded sessions do on their server.
+			_, resumed := process.(*resumedProcess)
+			_, sessionErr := srv.session(header.ID)
+			reportExit := !resumed && !forwarded && !(command.TTY && header.ID != "" && sessionErr == nil)
+
+			// Sessions and resumable commands keep their quota across
+			// connections.
+			usage = newQuota(options)
+			if resumed, ok := process.(*resumedProcess); ok {
+				usage = resumed.command.quota
+			} else if s, err := srv.session(header.ID); command.TTY && header.ID != "" && err == nil {
+				usage = s.quota
+				metrics = s.metrics
+			}
 
-			err = sendPID(ctx, process.Pid(), wsNetConn)
+			// Only sessions and resumable commands outlive the connection,
+			// which a session is not if screen is missing.  Forwarded
+			// sessions report their own ID.
+			info := ProcessStartInfo(process)
+			if _, ok := process.(*resumedProcess); ok {
+				info.SessionID = header.ID
+			} else if _, err := srv.session(header.ID); command.TTY && header.ID != "" && err == nil {
+				info.SessionID = header.ID
+			}
+			err = sendPID(ctx, process.Pid(), command.AppHint, header.Command.BinaryData, info, ignoredTypes, msgWriter)
 			if err != nil {
 				return xerrors.Errorf("failed to send pid %d: %w", process.Pid(), err)
 			}
+			if w, ok := process.(warner); ok {
+				warnings = append(warnings, w.startWarnings()...)
+			}
+			for _, warning := range warnings {
+				err = sendHeader(msgWriter, proto.ServerWarningHeader{
+					Type:    proto.TypeWarning,
+					Code:    string(warning.code),
+					Message: warning.message,
+				}, nil)
+				if err != nil {
+					return xerrors.Errorf("failed to send warning: %w", err)
+				}
+			}
+			audit(ctx, options, AuditEvent{
+				Type:      AuditStart,
+				SessionID: header.ID,
+				Command:   command.Command,
+				Args:      command.Args,
+				UID:       command.UID,
+				GID:       command.GID,
+				Pid:       process.Pid(),
+			})
+			summary.started(header.ID, command, process.Pid())
+
+			// Idle warnings are written from another goroutine so they are
+			// cut off once stdout ends.
+			var terminal *endingWriter
+			if command.TTY && options.IdleTimeout > 0 {
+				idle = newIdleTracker()
+				w, err := stdoutWriter(msgWriter)
+				if err != nil {
+					return err
+				}
+				terminal = &endingWriter{w: w}
+				id := header.ID
+				tasks.Go(func() {
+					cullIdle(ctx, process, idle, terminal, options.IdleTimeout, options.IdleWarning, func() {
+						// Closing the connection kills the process but a
+						// session would otherwise outlive it.
+						if s, err := srv.session(id); id != "" && err == nil {
+							s.Close("idle")
+						}
+						cancel()
+					})
+				})
+			}
+
+			observing = header.Observe
+			inSession = command.TTY && header.ID != ""
+			if s, err := srv.session(header.ID); command.TTY && header.ID != "" && err == nil && s.command.ExclusiveInput && !observing {
+				input = s.input.join(func(holder bool) {
+					_ = sendHeader(msgWriter, proto.ServerInputLockHeader{Type: proto.TypeInputLock, Holder: holder}, nil)
+				})
+				tasks.Go(func() {
+					<-ctx.Done()
+					input.leave()
+				})
+			}
+
+			if s, err := srv.session(header.ID); command.TTY && header.ID != "" && err == nil {
+				tasks.Go(func() {
+					s.watchFrozen(ctx, func(frozen bool) {
+						// A frozen shell is not idle.
+						idle.pause(frozen)
+						_ = sendHeader(msgWriter, proto.ServerFrozenHeader{Type: proto.TypeFrozen, Frozen: frozen}, nil)
+					})
+				})
+			}
 
+			stdout := metrics.outputReader(summary.outputReader(idle.reader(process.Stdout())))
+			if command.TTY {
+				if filter := newRelayFilter(stdout, header.Command, msgWriter); filter != nil {
+					stdout = filter
+				}
+			}
+
+			var coalesceDelay time.Duration
+			if command.TTY && !command.LowLatency {
+				coalesceDelay = options.OutputCoalesceDelay
+			}
+			output := usage.outputWriter(ctx, msgWriter, fail)
+			copyStream := func(r io.Reader, typ string) error {
+				if header.Command.Timestamps {
+					return copyWithTimestamps(r, output, typ)
+				}
+				if header.Command.BinaryData {
+					return copyMessages(r, proto.WithDataFrame(output, typ), coalesceDelay)
+				}
+				headerByt, err := json.Marshal(proto.Header{Type: typ})
+				if err != nil {
+					return err
+				}
+				return copyMessages(r, proto.WithHeader(output, headerByt), coalesceDelay)
+			}
+			limit := newOutputLimit(options.MaxOutputBytes)
+			copyOutput := func(r io.Reader, typ string) error {
+				if header.Command.DiscardOutput {
+					// The output is still read so the command does not block
+					// writing it.
+					_, err := io.Copy(ioutil.Discard, r)
+					return err
+				}
+				// Resumed output keeps its JSON header so that it can carry
+				// its offset.
+				if log, ok := r.(*outputLogReader); ok {
+					log.lines = header.Command.LineBuffered
+					return copyFromLog(log, output, typ, header.Command.Timestamps)
+				}
+				if header.Command.LineBuffered && !command.TTY {
+					r = newLineReader(r, maxMessageSize-maxOutputHeaderSize)
+				}
+				if limit == nil {
+					return copyStream(r, typ)
+				}
+				capped := &cappedReader{r: r, limit: limit, tailSize: options.OutputTailBytes}
+				err := copyStream(capped, typ)
+				if err != nil || !capped.over {
+					return err
+				}
+				if dropped := capped.dropped(); dropped > 0 {
+					err = sendHeader(output, proto.ServerTruncatedHeader{
+						Type:    proto.TypeTruncated,
+						Stream:  typ,
+						Dropped: dropped,
+					}, nil)
+					if err != nil {
+						return err
+					}
+				}
+				return copyStream(bytes.NewReader(capped.tail), typ)
+			}
+			// Each stream ends with an EOF once all of its output is sent, and
+			// the exit code follows both so that clients never see the exit
+			// before the last of the output.
 			var outputgroup errgroup.Group
 			outputgroup.Go(func() error {
-				return copyWithHeader(process.Stdout(), wsNetConn, proto.Header{Type: proto.TypeStdout})
+				err := copyOutput(stdout, proto.TypeStdout)
+				terminal.end()
+				if err != nil {
+					return err
+				}
+				return sendEOF(msgWriter, proto.TypeStdout)
 			})
 			outputgroup.Go(func() error {
-				return copyWithHeader(process.Stderr(), wsNetConn, proto.Header{Type: proto.TypeStderr})
+				err := copyOutput(summary.outputReader(process.Stderr()), proto.TypeStderr)
+				if err != nil {
+					return err
+				}
+				return sendEOF(msgWriter, proto.TypeStderr)
 			})
 
-			go func() {
+			tasks.Go(func() {
 				// Wait for the readers to close which happens when the connection
 				// closes or the process dies.
 				_ = outputgroup.Wait()
 				err := process.Wait()
-				_ = sendExitCode(ctx, err, wsNetConn)
-			}()
+				event := AuditEvent{Type: AuditExit, SessionID: header.ID, Pid: process.Pid(), Error: errorString(err)}
+				if exitErr, ok := err.(ExitError); ok {
+					event.ExitCode = exitErr.ExitCode()
+				}
+				// The connection may be gone but the exit should still be recorded.
+				audit(context.Background(), options, event)
+				summary.exited(err)
+				_ = sendExitCode(ctx, err, msgWriter)
+				if reportExit && options.OnExit != nil {
+					// The connection may be gone but the exit should still be
+					// reported.
+					options.OnExit(context.Background(), newExitInfo(options, header.ID, command, process, started, err))
+				}
+			})
+
+		case proto.TypeTransferSession:
+			var header proto.ClientTransferSessionHeader
+			err = json.Unmarshal(byt, &header)
+			if err != nil {
+				return codeErrorf(CodeInvalidMessage, "unmarshal transfer session header: %w", err)
+			}
+			err = srv.transferSession(header, options)
+			audit(ctx, options, AuditEvent{Type: AuditTransferSession, SessionID: header.ID, NewOwner: header.Owner, Error: errorString(err)})
+			err = sendResult(ctx, err, msgWriter)
+			if err != nil {
+				return xerrors.Errorf("send result: %w", err)
+			}
+
+		case proto.TypeShareSession:
+			var header proto.ClientShareSessionHeader
+			err = json.Unmarshal(byt, &header)
+			if err != nil {
+				return codeErrorf(CodeInvalidMessage, "unmarshal share session header: %w", err)
+			}
+			token, err := srv.shareSession(header, options)
+			audit(ctx, options, AuditEvent{Type: AuditShareSession, SessionID: header.ID, Error: errorString(err)})
+			result := resultHeader(err)
+			result.Token = token
+			err = sendHeader(msgWriter, result, nil)
+			if err != nil {
+				return xerrors.Errorf("send result: %w", err)
+			}
+
+		case proto.TypeValidate:
+			var header proto.ClientValidateHeader
+			err = json.Unmarshal(byt, &header)
+			if err != nil {
+				return codeErrorf(CodeInvalidMessage, "unmarshal validate header: %w", err)
+			}
+			validation, err := ValidateCommand(ctx, execer, *mapToClientCmd(header.Command))
+			result := resultHeader(err)
+			if err == nil {
+				result.Validation = mapToProtoValidation(validation)
+			}
+			err = sendHeader(msgWriter, result, nil)
+			if err != nil {
+				return xerrors.Errorf("send result: %w", err)
+			}
+
+		case proto.TypeUpload:
+			if process != nil || upload != nil {
+				return codeErrorf(CodeAlreadyStarted, "upload sent after command or upload started")
+			}
+			var header proto.ClientUploadHeader
+			err = json.Unmarshal(byt, &header)
+			if err != nil {
+				return codeErrorf(CodeInvalidMessage, "unmarshal upload header: %w", err)
+			}
+			upload = startUpload(ctx, execer, header)
+		case proto.TypeFileData:
+			if upload == nil {
+				return codeErrorf(CodeNotStarted, "file data sent before upload started")
+			}
+			upload.write(bodyByt)
+		case proto.TypeFileEnd:
+			if upload == nil {
+				return codeErrorf(CodeNotStarted, "file end sent before upload started")
+			}
+			var header proto.ClientFileEndHeader
+			err = json.Unmarshal(byt, &header)
+			if err != nil {
+				return codeErrorf(CodeInvalidMessage, "unmarshal file end header: %w", err)
+			}
+			if header.Abort {
+				err = upload.abort()
+			} else {
+				err = upload.finish()
+			}
+			audit(ctx, options, AuditEvent{Type: AuditUpload, Path: upload.path, Error: errorString(err)})
+			upload = nil
+			err = sendResult(ctx, err, msgWriter)
+			if err != nil {
+				return xerrors.Errorf("send result: %w", err)
+			}
+		case proto.TypeDownload:
+			if process != nil || upload != nil {
+				return codeErrorf(CodeAlreadyStarted, "download sent after command or upload started")
+			}
+			var header proto.ClientDownloadHeader
+			err = json.Unmarshal(byt, &header)
+			if err != nil {
+				return codeErrorf(CodeInvalidMessage, "unmarshal download header: %w", err)
+			}
+			err = streamDownload(ctx, execer, header, msgWriter)
+			audit(ctx, options, AuditEvent{Type: AuditDownload, Path: header.Path, UID: header.UID, GID: header.GID, Error: errorString(err)})
+			err = sendResult(ctx, err, msgWriter)
+			if err != nil {
+				return xerrors.Errorf("download: %w", err)
+			}
+		case proto.TypeJournal:
+			if process != nil || upload != nil {
+				return codeErrorf(CodeAlreadyStarted, "journal sent after command or upload started")
+			}
+			var header proto.ClientJournalHeader
+			err = json.Unmarshal(byt, &header)
+			if err != nil {
+				return codeErrorf(CodeInvalidMessage, "unmarshal journal header: %w", err)
+			}
+			err = srv.streamJournal(header, options, msgWriter)
+			audit(ctx, options, AuditEvent{Type: AuditJournal, SessionID: header.ID, Error: errorString(err)})
+			err = sendResult(ctx, err, msgWriter)
+			if err != nil {
+				return xerrors.Errorf("journal: %w", err)
+			}
+		case proto.TypeChecksums:
+			if process != nil || upload != nil {
+				return codeErrorf(CodeAlreadyStarted, "checksums sent after command or upload started")
+			}
+			var header proto.ClientChecksumsHeader
+			err = json.Unmarshal(byt, &header)
+			if err != nil {
+				return codeErrorf(CodeInvalidMessage, "unmarshal checksums header: %w", err)
+			}
+			err = checksums(ctx, execer, header, msgWriter)
+			if err != nil {
+				return xerrors.Errorf("checksums: %w", err)
+			}
+
+		case proto.TypeExtension:
+			// Extension messages carry a payload after the header.
+			var header proto.ExtensionHeader
+			err = json.Unmarshal(headerByt, &header)
+			if err != nil {
+				return codeErrorf(CodeInvalidMessage, "unmarshal extension header: %w", err)
+			}
+			srv.handleExtension(ctx, header.Namespace, bodyByt, msgWriter)
 
 		case proto.TypeResize:
 			if process == nil {
-				return errors.New("resize sent before command started")
+				return codeErrorf(CodeNotStarted, "resize sent before command started")
+			}
+			if observing {
+				return codeErrorf(CodeForbidden, "resize sent by an observer")
 			}
 
 			var header proto.ClientResizeHeader
 			err = json.Unmarshal(byt, &header)
 			if err != nil {
-				return xerrors.Errorf("unmarshal resize header: %w", err)
+				return codeErrorf(CodeInvalidMessage, "unmarshal resize header: %w", err)
 			}
 
+			// Only the holder of a session's input lock may resize it.
+			if !input.mayWrite() {
+				if header.Seq != 0 {
+					_ = sendHeader(msgWriter, proto.ServerResizedHeader{
+						Type:  proto.TypeResized,
+						Seq:   header.Seq,
+						Error: errInputLocked.Error(),
+					}, nil)
+				}
+				break
+			}
+			idle.touch()
 			err = process.Resize(ctx, header.Rows, header.Cols)
+			// Clients waiting for an acknowledgement get the error rather
+			// than losing the connection.
+			if header.Seq == 0 {
+				if err != nil {
+					return xerrors.Errorf("resize: %w", err)
+				}
+				break
+			}
+			resized := proto.ServerResizedHeader{Type: proto.TypeResized, Seq: header.Seq}
+			if err != nil {
+				resized.Error = err.Error()
+			} else {
+				resized.Rows, resized.Cols = header.Rows, header.Cols
+			}
+			err = sendHeader(msgWriter, resized, nil)
+			if err != nil {
+				return xerrors.Errorf("send resized: %w", err)
+			}
+		case proto.TypeSignal:
+			if process == nil {
+				return codeErrorf(CodeNotStarted, "signal sent before command started")
+			}
+			if observing {
+				return codeErrorf(CodeForbidden, "signal sent by an observer")
+			}
+
+			var header proto.ClientSignalHeader
+			err = json.Unmarshal(byt, &header)
+			if err != nil {
+				return codeErrorf(CodeInvalidMessage, "unmarshal signal header: %w", err)
+			}
+
+			if !input.mayWrite() {
+				err = sendAcked(msgWriter, header.Seq, errInputLocked)
+				if err != nil {
+					return xerrors.Errorf("send acked: %w", err)
+				}
+				break
+			}
+			// A command that cannot receive the signal is no reason to end the
+			// connection.
+			err = SignalProcess(ctx, process, Signal(header.Signal))
+			if err != nil {
+				flog.Error("failed to signal command: %v", err)
+			}
+			err = sendAcked(msgWriter, header.Seq, err)
+			if err != nil {
+				return xerrors.Errorf("send acked: %w", err)
+			}
+		case proto.TypeTerminalModes:
+			if process == nil {
+				return codeErrorf(CodeNotStarted, "terminal modes sent before command started")
+			}
+			if observing {
+				return codeErrorf(CodeForbidden, "terminal modes sent by an observer")
+			}
+
+			var header proto.ClientTerminalModesHeader
+			err = json.Unmarshal(byt, &header)
 			if err != nil {
-				return xerrors.Errorf("resize: %w", err)
+				return codeErrorf(CodeInvalidMessage, "unmarshal terminal modes header: %w", err)
+			}
+
+			switch {
+			case inSession:
+				err = xerrors.New("sessions keep the terminal modes they started with")
+			case !input.mayWrite():
+				err = errInputLocked
+			default:
+				err = SetTerminalModes(ctx, process, TerminalModes(header.Modes))
+				if err != nil {
+					flog.Error("failed to set terminal modes: %v", err)
+				}
+			}
+			err = sendAcked(msgWriter, header.Seq, err)
+			if err != nil {
+				return xerrors.Errorf("send acked: %w", err)
+			}
+		case proto.TypeAck:
+			if process == nil {
+				return codeErrorf(CodeNotStarted, "ack sent before command started")
 			}
+
+			var header proto.ClientAckHeader
+			err = json.Unmarshal(byt, &header)
+			if err != nil {
+				return codeErrorf(CodeInvalidMessage, "unmarshal ack header: %w", err)
+			}
+
+			// Output of other commands is not retained so there is nothing to
+			// acknowledge.
+			if resumed, ok := process.(*resumedProcess); ok {
+				resumed.command.ack(proto.ResumeOffsets{Stdout: header.Stdout, Stderr: header.Stderr})
+			}
+		case proto.TypeTakeInput:
+			if process == nil {
+				return codeErrorf(CodeNotStarted, "take input sent before command started")
+			}
+			if observing {
+				return codeErrorf(CodeForbidden, "take input sent by an observer")
+			}
+			// Sessions on other servers arbitrate input there.
+			if input == nil {
+				_ = TakeInput(ctx, process)
+			}
+			input.take()
 		case proto.TypeStdin:
-			_, err := io.Copy(process.Stdin(), bytes.NewReader(bodyByt))
+			if process == nil {
+				return codeErrorf(CodeNotStarted, "stdin sent before command started")
+			}
+			if observing {
+				return codeErrorf(CodeForbidden, "stdin sent by an observer")
+			}
+			if !input.mayWrite() {
+				break
+			}
+			idle.touch()
+			if err := usage.takeStdin(ctx, len(bodyByt)); err != nil {
+				return err
+			}
+			metrics.addIn(len(bodyByt))
+			summary.addIn(len(bodyByt))
+			_, err := process.Stdin().Write(bodyByt)
 			if err != nil {
 				return xerrors.Errorf("read stdin: %w", err)
 			}
 		case proto.TypeCloseStdin:
+			if process == nil {
+				return codeErrorf(CodeNotStarted, "close stdin sent before command started")
+			}
+			if observing {
+				return codeErrorf(CodeForbidden, "close stdin sent by an observer")
+			}
 			err = process.Stdin().Close()
+			// Clients waiting for an acknowledgement get the error rather
+			// than losing the connection.
+			if seq == 0 {
+				if err != nil {
+					return xerrors.Errorf("close stdin: %w", err)
+				}
+				break
+			}
+			err = sendAcked(msgWriter, seq, err)
 			if err != nil {
-				return xerrors.Errorf("close stdin: %w", err)
+				return xerrors.Errorf("send acked: %w", err)
 			}
 		default:
-			flog.Error("unrecognized header type: %s", header.Type)
+			if options.StrictMessages {
+				return codeErrorf(CodeUnknownMessage, "unknown message type %q", header.Type)
+			}
+			if ignored[header.Type] {
+				continue
+			}
+			ignored[header.Type] = true
+			flog.Info("ignoring unknown message type %q", header.Type)
+			if process == nil {
+				ignoredTypes = append(ignoredTypes, header.Type)
+				continue
+			}
+			err = sendHeader(msgWriter, proto.ServerWarningHeader{
+				Type:    proto.TypeWarning,
+				Code:    string(CodeMessageIgnored),
+				Message: fmt.Sprintf("server ignored unknown message type %q", header.Type),
+			}, nil)
+			if err != nil {
+				return xerrors.Errorf("failed to send warning: %w", err)
+			}
+			continue
+		}
+
+		select {
+		case <-requested:
+		default:
+			close(requested)
 		}
 	}
 }
 
-// withSession runs the command in a session if screen is available.
-func (srv *Server) withSession(ctx context.Context, id string, command *Command, execer Execer, options *Options) (Process, error) {
+// withSession runs the command in a session if screen is available, or else
+// runs it normally and returns a warning saying so.
+func (srv *Server) withSession(ctx context.Context, header proto.ClientStartHeader, command *Command, execer Execer, options *Options) (Process, []startWarning, error) {
+	id, observe := header.ID, header.Observe
 	// If screen is not installed spawn the command normally.
-	_, err := exec.LookPath("screen")
+	err := lookScreen(ctx, execer)
+	if err != nil && observe {
+		return nil, nil, codeErrorf(CodeSessionNotFound, "session %s not found", id)
+	}
 	if err != nil {
 		flog.Info("`screen` could not be found; session %s will not persist", id)
-		return execer.Start(ctx, *command)
+		srv.releaseSession(id)
+		process, err := execer.Start(ctx, *command)
+		if err != nil {
+			return nil, nil, err
+		}
+		return process, []startWarning{{
+			code:    CodeSessionNotPersistent,
+			message: fmt.Sprintf("screen not found; session %s will not persist", id),
+		}}, nil
 	}
 
 	var s *Session
 	srv.sessionsMutex.Lock()
 	if rawSession, ok := srv.sessions.Load(id); ok {
 		if s, ok = rawSession.(*Session); !ok {
-			return nil, xerrors.Errorf("found invalid type in session map for ID %s", id)
+			return nil, nil, xerrors.Errorf("found invalid type in session map for ID %s", id)
 		}
 	}
 
@@ -244,27 +1259,205 @@ func (srv *Server) withSession(ctx context.Context, id string, command *Command,
 		}
 	}
 
+	if s != nil && !s.ownedBy(options.Owner) {
+		// Others may attach with a share token from the owner.
+		readOnly, ok := s.redeemShare(header.Token)
+		if !ok {
+			srv.sessionsMutex.Unlock()
+			return nil, nil, codeErrorf(CodeForbidden, "session %s belongs to another owner", id)
+		}
+		if readOnly && !observe {
+			srv.sessionsMutex.Unlock()
+			return nil, nil, codeErrorf(CodeForbidden, "share token for session %s only permits observing", id)
+		}
+	}
+
+	// Observers only watch sessions that already exist.
+	if s == nil && observe {
+		srv.sessionsMutex.Unlock()
+		return nil, nil, codeErrorf(CodeSessionNotFound, "session %s not found", id)
+	}
+
 	if s == nil {
 		s = NewSession(command, execer, options)
-		srv.sessions.Store(id, s)
-		go func() { // Remove the session from the map once it closes.
-			defer srv.sessions.Delete(id)
-			s.Wait()
-		}()
+		if _, remote := execer.(remoteFS); options.JournalDir != "" && !remote {
+			path := journalPath(options.JournalDir, id)
+			err = os.MkdirAll(options.JournalDir, 0o700)
+			if err == nil {
+				err = removeJournal(path)
+			}
+			if err != nil {
+				flog.Error("failed to prepare journal for session %s: %v", id, err)
+			} else {
+				s.journalPath = path
+			}
+		}
+		srv.addSession(id, s, options)
 	}
 
 	srv.sessionsMutex.Unlock()
 
-	return s.Attach(ctx)
+	// Attaching runs whatever the session was created with so report its hint
+	// rather than the one in this request.
+	command.AppHint = s.command.AppHint
+
+	process, err := s.Attach(ctx)
+	return process, nil, err
+}
+
+// addSession adds a session to the map until it closes, rotating its journal
+// if it has one.  The caller must hold sessionsMutex.
+func (srv *Server) addSession(id string, s *Session, options *Options) {
+	journalCtx, stopJournal := context.WithCancel(context.Background())
+	if s.journalPath != "" {
+		go rotateJournal(journalCtx, s.journalPath, journalLimit(options))
+	}
+	srv.sessions.Store(id, s)
+	if _, remote := s.execer.(remoteFS); !remote {
+		s.persist(id)
+	}
+	go srv.claimSession(id, s)
+	go s.reportExit(id)
+	go func() { // Remove the session from the map once it closes.
+		defer srv.sessions.Delete(id)
+		defer stopJournal()
+		s.Wait()
+	}()
 }
 
-func sendExitCode(_ context.Context, err error, conn net.Conn) error {
+// withResumable attaches to the resumable command with the ID, starting it
+// unless the client asked to resume it.  Output is replayed from the offsets in
+// resume if set.
+func (srv *Server) withResumable(ctx context.Context, id string, command *Command, resume *proto.ResumeOffsets, execer Execer, options *Options) (Process, error) {
+	srv.sessionsMutex.Lock()
+	defer srv.sessionsMutex.Unlock()
+
+	var r *resumableCommand
+	if rawCommand, ok := srv.resumables.Load(id); ok {
+		if r, ok = rawCommand.(*resumableCommand); !ok {
+			return nil, xerrors.Errorf("found invalid type in resumable map for ID %s", id)
+		}
+	}
+	if r == nil && resume != nil {
+		return nil, codeErrorf(CodeSessionNotFound, "command %s not found", id)
+	}
+	if r != nil && !r.ownedBy(options.Owner) {
+		return nil, codeErrorf(CodeForbidden, "command %s belongs to another owner", id)
+	}
+
+	if r == nil {
+		var j *journal
+		if options.JournalDir != "" {
+			var err error
+			j, err = openJournal(journalPath(options.JournalDir, id), journalLimit(options))
+			if err != nil {
+				flog.Error("failed to open journal for command %s: %v", id, err)
+			}
+		}
+		var err error
+		r, err = startResumable(id, *command, execer, options, j, func() {
+			srv.sessionsMutex.Lock()
+			defer srv.sessionsMutex.Unlock()
+			if rawCommand, ok := srv.resumables.Load(id); ok && rawCommand == r {
+				srv.resumables.Delete(id)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		srv.resumables.Store(id, r)
+	}
+
+	var offsets proto.ResumeOffsets
+	if resume != nil {
+		offsets = *resume
+	}
+	return r.attach(ctx, offsets), nil
+}
+
+// streamJournal sends the journal of a session like a download.  Journals of
+// sessions that have closed can only be read by admins since their owner is
+// no longer known.
+func (srv *Server) streamJournal(header proto.ClientJournalHeader, options *Options, conn io.Writer) error {
+	owned := false
+	if s, err := srv.session(header.ID); err == nil {
+		owned = s.ownedBy(options.Owner)
+	} else if rawCommand, ok := srv.resumables.Load(header.ID); ok {
+		if r, ok := rawCommand.(*resumableCommand); ok {
+			owned = r.ownedBy(options.Owner)
+		}
+	} else if !options.Admin {
+		return codeErrorf(CodeSessionNotFound, "session %s not found", header.ID)
+	}
+	if !owned && !options.Admin {
+		return codeErrorf(CodeForbidden, "session %s belongs to another owner", header.ID)
+	}
+	if options.JournalDir == "" {
+		return codeErrorf(CodeSessionNotFound, "no journal for session %s", header.ID)
+	}
+
+	r, size, err := openJournalReader(journalPath(options.JournalDir, header.ID))
+	if os.IsNotExist(err) {
+		return codeErrorf(CodeSessionNotFound, "no journal for session %s", header.ID)
+	}
+	if err != nil {
+		return codeErrorf(CodeTransferFailed, "open journal for session %s: %w", header.ID, err)
+	}
+	defer r.Close()
+	info, err := json.Marshal(proto.ServerFileInfoHeader{Type: proto.TypeFileInfo, Size: size})
+	if err != nil {
+		return err
+	}
+	_, err = proto.WithHeader(conn, info).Write(nil)
+	if err != nil {
+		return err
+	}
+	return copyWithHeader(r, conn, proto.Header{Type: proto.TypeFileData})
+}
+
+// sendEOF reports that all of a stream's output has been sent.
+func sendEOF(conn io.Writer, stream string) error {
+	return sendHeader(conn, proto.ServerEOFHeader{Type: proto.TypeEOF, Stream: stream}, nil)
+}
+
+// endingWriter passes writes on until end is called, after which they are
+// dropped.  A nil endingWriter only ends.
+type endingWriter struct {
+	w     io.Writer
+	mutex sync.Mutex
+	ended bool
+}
+
+func (e *endingWriter) Write(b []byte) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.ended {
+		return len(b), nil
+	}
+	return e.w.Write(b)
+}
+
+// end drops later writes, waiting for any write in progress.
+func (e *endingWriter) end() {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	e.ended = true
+	e.mutex.Unlock()
+}
+
+func sendExitCode(_ context.Context, err error, conn io.Writer) error {
 	exitCode := 0
 	errorStr := ""
 	if err != nil {
+		// Errors without an exit code, such as failing to wait for the
+		// process, still tell the client why the command ended.
+		exitCode = ExitCodeUnknown
 		errorStr = err.Error()
 	}
-	if exitErr, ok := err.(ExitError); ok {
+	var exitErr ExitError
+	if xerrors.As(err, &exitErr) {
 		exitCode = exitErr.ExitCode()
 	}
 	header, err := json.Marshal(proto.ServerExitCodeHeader{
@@ -279,8 +1472,123 @@ func sendExitCode(_ context.Context, err error, conn net.Conn) error {
 	return err
 }
 
-func sendPID(_ context.Context, pid int, conn net.Conn) error {
-	header, err := json.Marshal(proto.ServerPidHeader{Type: proto.TypePid, Pid: pid})
+// transferSession handles a request to transfer a session, only permitting it
+// if the connection owns the session or is an admin.
+func (srv *Server) transferSession(header proto.ClientTransferSessionHeader, options *Options) error {
+	s, err := srv.session(header.ID)
+	if err != nil {
+		return err
+	}
+	if !options.Admin && !s.ownedBy(options.Owner) {
+		return codeErrorf(CodeForbidden, "session %s belongs to another owner", header.ID)
+	}
+	s.setOwner(header.Owner)
+	return nil
+}
+
+// errorFrameTimeout bounds sending an error to a peer that may not be reading.
+const errorFrameTimeout = time.Second
+
+// sendError tells the peer why the connection is about to close.  Only errors
+// with a code are sent since the rest are failures of the connection itself.
+func sendError(c conn, err error) {
+	code := ErrorCode(err)
+	if code == "" {
+		return
+	}
+	errHeader := proto.ServerErrorHeader{Type: proto.TypeError, Code: string(code), Error: err.Error()}
+	var seqErr *seqError
+	if xerrors.As(err, &seqErr) {
+		errHeader.Seq = seqErr.seq
+	}
+	header, err := json.Marshal(errHeader)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), errorFrameTimeout)
+	defer cancel()
+	_ = c.Write(ctx, header)
+}
+
+// seqError is an error caused by a message with a seq, which the error message
+// sent to the client echoes.
+type seqError struct {
+	seq uint64
+	err error
+}
+
+func (e *seqError) Error() string {
+	return e.err.Error()
+}
+
+func (e *seqError) Unwrap() error {
+	return e.err
+}
+
+// errInputLocked is reported to clients whose input is dropped because another
+// client holds the session's input lock.
+var errInputLocked = xerrors.New("another client holds the input lock")
+
+// sendAcked acknowledges a control message with seq set, reporting err if it
+// was not applied.  Messages without seq are not acknowledged.
+func sendAcked(conn io.Writer, seq uint64, err error) error {
+	if seq == 0 {
+		return nil
+	}
+	acked := proto.ServerAckedHeader{Type: proto.TypeAcked, Seq: seq}
+	if err != nil {
+		acked.Error = err.Error()
+	}
+	return sendHeader(conn, acked, nil)
+}
+
+// sendResult reports the outcome of a request that does not start a command.
+func sendResult(_ context.Context, err error, conn io.Writer) error {
+	header, err := json.Marshal(resultHeader(err))
+	if err != nil {
+		return err
+	}
+	_, err = proto.WithHeader(conn, header).Write(nil)
+	return err
+}
+
+// resultHeader returns the result message reporting err.
+func resultHeader(err error) proto.ServerResultHeader {
+	result := proto.ServerResultHeader{Type: proto.TypeResult}
+	if err != nil {
+		result.Code = string(ErrorCode(err))
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// terminalEnv returns the variables describing the client's terminal for a TTY
+// command.  They come before the command's own so those take precedence.
+func terminalEnv(header proto.ClientStartHeader) []string {
+	var env []string
+	if header.Term != "" {
+		env = append(env, "TERM="+header.Term)
+	}
+	if header.ColorTerm != "" {
+		env = append(env, "COLORTERM="+header.ColorTerm)
+	}
+	return env
+}
+
+func sendPID(_ context.Context, pid int, hint AppHint, binary bool, info ProcessInfo, ignored []string, conn io.Writer) error {
+	header, err := json.Marshal(proto.ServerPidHeader{
+		Type:        proto.TypePid,
+		Pid:         pid,
+		AppHint:     string(hint),
+		BinaryData:  binary,
+		ResizeAcks:  true,
+		ControlAcks: true,
+		WorkingDir:  info.WorkingDir,
+		User:        info.User,
+		Shell:       info.Shell,
+		SessionID:   info.SessionID,
+		Ignored:     ignored,
+	})
 	if err != nil {
 		return err
 	}
@@ -288,15 +1596,73 @@ func sendPID(_ context.Context, pid int, conn net.Conn) error {
 	return err
 }
 
+// stdoutWriter returns a writer that sends each write as stdout.
+func stdoutWriter(w io.Writer) (io.Writer, error) {
+	headerByt, err := json.Marshal(proto.Header{Type: proto.TypeStdout})
+	if err != nil {
+		return nil, err
+	}
+	return proto.WithHeader(w, headerByt), nil
+}
+
+// maxOutputHeaderSize bounds the size of an output message's header and
+// delimiter, including a timestamp.
+const maxOutputHeaderSize = 64
+
+// copyBufferPool holds buffers for copying output into messages.  They are as
+// large as a message allows so that fast output takes as few as possible.
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, maxMessageSize-maxOutputHeaderSize)
+		return &buf
+	},
+}
+
+// copyWithTimestamps is like copyWithHeader but stamps each message with the
+// time its output was read.
+func copyWithTimestamps(r io.Reader, w io.Writer, typ string) error {
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	buf := *bufp
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			stamp := time.Now().UnixNano() / int64(time.Millisecond)
+			if werr := proto.WriteOutput(w, proto.ServerOutputHeader{Type: typ, Time: stamp}, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if xerrors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func copyWithHeader(r io.Reader, w io.Writer, header proto.Header) error {
 	headerByt, err := json.Marshal(header)
 	if err != nil {
 		return err
 	}
-	wr := proto.WithHeader(w, headerByt)
-	_, err = io.Copy(wr, r)
+	return copyMessages(r, proto.WithHeader(w, headerByt), 0)
+}
+
+// copyMessages copies r to w, which sends each write as a message.  If delay is
+// positive small writes are coalesced for up to that long first.
+func copyMessages(r io.Reader, w io.Writer, delay time.Duration) error {
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	if delay <= 0 {
+		_, err := io.CopyBuffer(w, r, *bufp)
+		return err
+	}
+	coalescer := newCoalescingWriter(w, delay, len(*bufp))
+	_, err := io.CopyBuffer(coalescer, r, *bufp)
+	flushErr := coalescer.Flush()
 	if err != nil {
 		return err
 	}
-	return nil
+	return flushErr
 }
@@ -0,0 +1,349 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+func TestServerProtocolErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		msg     string
+		options *Options
+	}{
+		{name: "NotJSON", msg: "not json"},
+		{name: "NoType", msg: `{"rows":1}`},
+		{name: "UnknownType", msg: `{"type":"bogus"}`, options: &Options{StrictMessages: true}},
+		{name: "LargeHeader", msg: `{"type":"resize","pad":"` + strings.Repeat("a", proto.MaxHeaderSize) + `"}`},
+		{name: "StdinBeforeStart", msg: `{"type":"stdin"}`},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			ws, server := mockConn(ctx, t, nil, test.options)
+			defer server.Close()
+			err := ws.Write(ctx, websocket.MessageBinary, []byte(test.msg))
+			assert.Success(t, "write message", err)
+
+			_, msg, err := ws.Read(ctx)
+			assert.Success(t, "read error message", err)
+			var header proto.ServerErrorHeader
+			err = json.Unmarshal(msg, &header)
+			assert.Success(t, "unmarshal error message", err)
+			assert.Equal(t, "type", proto.TypeError, header.Type)
+			assert.True(t, "has a code", header.Code != "")
+			assert.True(t, "has an error", header.Error != "")
+		})
+	}
+
+	t.Run("Start", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ws, server := mockConn(ctx, t, nil, nil)
+		defer server.Close()
+		_, err := RemoteExecer(ws).Start(ctx, Command{Command: "/does/not/exist"})
+		assert.Equal(t, "not found", CodeCommandNotFound, ErrorCode(err))
+		assert.True(t, "is not found", xerrors.Is(err, ErrCommandNotFound))
+		assert.True(t, "is not permission denied", !xerrors.Is(err, ErrPermissionDenied))
+
+		ws, server = mockConn(ctx, t, nil, nil)
+		defer server.Close()
+		_, err = RemoteExecer(ws).Start(ctx, Command{Command: "/dev/null"})
+		assert.True(t, "is permission denied", xerrors.Is(err, ErrPermissionDenied))
+
+		ws, server = mockConn(ctx, t, nil, nil)
+		defer server.Close()
+		_, err = RemoteExecer(ws).Start(ctx, Command{Command: "sh", TTY: true, StdoutFile: "/tmp/out.log"})
+		assert.True(t, "is invalid", xerrors.Is(err, ErrInvalidCommand))
+	})
+
+	t.Run("ObserveMissingSession", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ws, server := mockConn(ctx, t, nil, nil)
+		defer server.Close()
+		_, err := RemoteExecer(ws).Start(ctx, Command{ID: "missing", Command: "sh", TTY: true, Observe: true})
+		assert.Equal(t, "not found", CodeSessionNotFound, ErrorCode(err))
+	})
+}
+
+func TestServerExitAfterOutput(t *testing.T) {
+	t.Parallel()
+
+	// Each line is written separately so output races the exit.
+	script := `i=0; while [ $i -lt 200 ]; do echo "out $i"; echo "err $i" >&2; i=$((i+1)); done`
+	tests := []struct {
+		name    string
+		command proto.Command
+		options *Options
+	}{
+		{name: "Pipes", command: proto.Command{Command: "sh", Args: []string{"-c", script}}},
+		{name: "Binary", command: proto.Command{Command: "sh", Args: []string{"-c", script}, BinaryData: true}},
+		{
+			name:    "Coalesced",
+			command: proto.Command{Command: "sh", Args: []string{"-c", script}, TTY: true, Rows: 24, Cols: 80},
+			options: &Options{OutputCoalesceDelay: time.Millisecond},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			for i := 0; i < 20; i++ {
+				ws, server := mockConn(ctx, t, nil, test.options)
+				start, err := json.Marshal(proto.ClientStartHeader{Type: proto.TypeStart, Command: test.command})
+				assert.Success(t, "marshal start", err)
+				err = ws.Write(ctx, websocket.MessageBinary, start)
+				assert.Success(t, "write start", err)
+
+				output := make(map[string]*bytes.Buffer)
+				ended := make(map[string]bool)
+				for {
+					_, msg, err := ws.Read(ctx)
+					assert.Success(t, "read message", err)
+					typ, headerByt, body, err := proto.ParseMessage(msg)
+					assert.Success(t, "parse message", err)
+					if typ == proto.TypeExitCode {
+						break
+					}
+					switch typ {
+					case proto.TypeStdout, proto.TypeStderr:
+						assert.True(t, typ+" before its end", !ended[typ])
+						if output[typ] == nil {
+							output[typ] = &bytes.Buffer{}
+						}
+						output[typ].Write(body)
+					case proto.TypeEOF:
+						var eof proto.ServerEOFHeader
+						assert.Success(t, "unmarshal eof", json.Unmarshal(headerByt, &eof))
+						assert.True(t, eof.Stream+" ends once", !ended[eof.Stream])
+						ended[eof.Stream] = true
+					}
+				}
+				assert.True(t, "stdout ended", ended[proto.TypeStdout])
+				assert.True(t, "stderr ended", ended[proto.TypeStderr])
+				if test.command.TTY {
+					assert.True(t, "last output", strings.Contains(output[proto.TypeStdout].String(), "err 199"))
+				} else {
+					assert.Equal(t, "stdout lines", 200, strings.Count(output[proto.TypeStdout].String(), "\n"))
+					assert.Equal(t, "stderr lines", 200, strings.Count(output[proto.TypeStderr].String(), "\n"))
+				}
+				_ = ws.Close(websocket.StatusNormalClosure, "")
+				server.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkCopyWithHeader(b *testing.B) {
+	data := make([]byte, 1<<20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// Hide WriteTo so the output is copied in chunks like a process pipe.
+		r := struct{ io.Reader }{bytes.NewReader(data)}
+		err := copyWithHeader(r, ioutil.Discard, proto.Header{Type: proto.TypeStdout})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestServeGoroutines(t *testing.T) {
+	// Not parallel so that only this test's connections are being served.
+	tests := []struct {
+		name    string
+		command Command
+		options *Options
+	}{
+		{name: "Exit", command: Command{Command: "true"}},
+		{name: "Streaming", command: Command{Command: "yes"}},
+		{name: "Idle", command: Command{Command: "sh", TTY: true, Stdin: true}, options: &Options{IdleTimeout: time.Minute}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			before := serveGoroutines()
+			client, server := net.Pipe()
+			served := make(chan struct{})
+			go func() {
+				defer close(served)
+				_ = NewServer().ServeStream(ctx, server, LocalExecer{}, test.options)
+			}()
+
+			process, err := RemoteStreamExecer(client).Start(ctx, test.command)
+			assert.Success(t, "start", err)
+			_, err = process.Stdout().Read(make([]byte, 1))
+			if test.command.Command != "true" {
+				assert.Success(t, "read stdout", err)
+			}
+			// Ending the connection mid-stream kills the command.
+			assert.Success(t, "close", client.Close())
+			select {
+			case <-served:
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for serving to end")
+			}
+			if leaked := serveGoroutines(); len(leaked) > len(before) {
+				t.Fatalf("goroutines still running after serving ended:\n%s", strings.Join(leaked, "\n\n"))
+			}
+		})
+	}
+}
+
+// serveGoroutines returns the stacks of goroutines started to serve
+// connections.
+func serveGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	var stacks []string
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(stack, "wsep.(*Server).serve.func") {
+			stacks = append(stacks, stack)
+		}
+	}
+	return stacks
+}
+
+func TestServerStartTimeout(t *testing.T) {
+	t.Parallel()
+	options := &Options{StartTimeout: 100 * time.Millisecond}
+
+	t.Run("Idle", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ws, server := mockConn(ctx, t, nil, options)
+		defer server.Close()
+		_, msg, err := ws.Read(ctx)
+		assert.Success(t, "read error message", err)
+		var header proto.ServerErrorHeader
+		err = json.Unmarshal(msg, &header)
+		assert.Success(t, "unmarshal error message", err)
+		assert.Equal(t, "code", string(CodeStartTimeout), header.Code)
+	})
+
+	t.Run("Started", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// The timeout no longer applies once the command starts.
+		ws, server := mockConn(ctx, t, nil, options)
+		defer server.Close()
+		process, err := RemoteExecer(ws).Start(ctx, Command{Command: "sleep", Args: []string{"0.3"}})
+		assert.Success(t, "start", err)
+		assert.Success(t, "wait", process.Wait())
+	})
+}
+
+func TestServerProfileLabels(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	wsepServer := NewServer()
+	defer wsepServer.Close()
+	ws, server := mockConn(ctx, t, wsepServer, nil)
+	defer server.Close()
+	process, err := RemoteExecer(ws).Start(ctx, Command{ID: "profile-labels", Command: "sleep", Args: []string{"0.5"}})
+	assert.Success(t, "start", err)
+
+	// The goroutines serving the command are labeled with it.
+	var profile bytes.Buffer
+	err = pprof.Lookup("goroutine").WriteTo(&profile, 1)
+	assert.Success(t, "write profile", err)
+	assert.True(t, "labeled", strings.Contains(profile.String(), `"session_id":"profile-labels"`))
+	assert.True(t, "command", strings.Contains(profile.String(), `"command":"sleep"`))
+	assert.Success(t, "wait", process.Wait())
+}
+
+func TestServerUnknownMessages(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Strict", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ws, server := mockConn(ctx, t, nil, &Options{StrictMessages: true})
+		defer server.Close()
+		err := ws.Write(ctx, websocket.MessageBinary, []byte(`{"type":"bogus"}`))
+		assert.Success(t, "write message", err)
+		_, msg, err := ws.Read(ctx)
+		assert.Success(t, "read error message", err)
+		var header proto.ServerErrorHeader
+		err = json.Unmarshal(msg, &header)
+		assert.Success(t, "unmarshal error message", err)
+		assert.Equal(t, "code", string(CodeUnknownMessage), header.Code)
+	})
+
+	t.Run("Ignore", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// Types skipped before the start come with the pid and later ones as
+		// warnings, each once.
+		ws, server := mockConn(ctx, t, nil, nil)
+		defer server.Close()
+		for i := 0; i < 2; i++ {
+			err := ws.Write(ctx, websocket.MessageBinary, []byte(`{"type":"before"}`))
+			assert.Success(t, "write message", err)
+		}
+		warnings := make(chan string, 10)
+		process, err := RemoteExecer(ws).Start(ctx, Command{
+			Command:   "cat",
+			Stdin:     true,
+			OnWarning: func(code Code, message string) { warnings <- string(code) + ": " + message },
+		})
+		assert.Success(t, "start", err)
+		for i := 0; i < 2; i++ {
+			err = ws.Write(ctx, websocket.MessageBinary, []byte(`{"type":"after"}`))
+			assert.Success(t, "write message", err)
+		}
+		assert.Success(t, "close stdin", process.Stdin().Close())
+		assert.Success(t, "wait", process.Wait())
+		close(warnings)
+		var got []string
+		for warning := range warnings {
+			got = append(got, warning)
+		}
+		assert.Equal(t, "warnings", []string{
+			`message_ignored: server ignored unknown message type "before"`,
+			`message_ignored: server ignored unknown message type "after"`,
+		}, got)
+	})
+}
@@ -3,9 +3,15 @@ package wsep
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -45,12 +51,27 @@ type Session struct {
 	error error
 	// execer is used to spawn the session and ready commands.
 	execer Execer
+	// freezeMutex serializes freezing and thawing.
+	freezeMutex sync.Mutex
+	// frozen is true while the session's processes are stopped.  It is not safe
+	// to access outside of cond.L.
+	frozen bool
+	// handedOff is set once the session has been exported to another server,
+	// after which closing it leaves the screen daemon running.  It is not safe
+	// to access outside of cond.L.
+	handedOff bool
+	// journalPath, if set, is where screen journals the session's output.  It
+	// is set before the first attach.
+	journalPath string
 	// id holds the id of the session for both creating and attaching.  This is
 	// generated uniquely for each session (rather than using the ID provided by
 	// the client) because without control of the daemon we do not have its PID
 	// and without the PID screen will do partial matching.  Enforcing a UUID
 	// should guarantee we match on the right session.
 	id string
+	// input arbitrates input between attached connections if the command has
+	// ExclusiveInput set.
+	input *inputLock
 	// mutex prevents concurrent attaches to the session.  This is necessary since
 	// screen will happily spawn two separate sessions with the same name if
 	// multiple attaches happen in a close enough interval.  We are not able to
@@ -60,40 +81,94 @@ type Session struct {
 	mutex sync.Mutex
 	// options holds options for configuring the session.
 	options *Options
+	// owner identifies who may attach to the session.  Anyone may attach if it
+	// is empty.  It is not safe to access outside of cond.L.
+	owner string
+	// shares are the share tokens minted for the session.  It is not safe to
+	// access outside of cond.L.
+	shares map[string]shareGrant
+	// quota is shared by every connection attached to the session.
+	quota *quota
+	// metrics counts the session's activity for ListSessions.
+	metrics *sessionMetrics
 	// socketsDir is the location of the directory where screen should put its
 	// sockets.
 	socketsDir string
+	// name is the ID clients attach to the session with and stateFile is where
+	// the session's state is saved for RecoverSessions, if it is.  They are
+	// not safe to access outside of cond.L.
+	name      string
+	stateFile string
+	// saveMutex serializes saving the session's state.
+	saveMutex sync.Mutex
+	// daemonUp is closed once the screen daemon has been started, after which
+	// the session closes if the daemon exits.
+	daemonUp   chan struct{}
+	daemonOnce sync.Once
 	// state holds the current session state.  It is not safe to access this
 	// outside of cond.L.
 	state State
 	// timer will close the session when it expires.  The timer will be reset as
 	// long as there are active connections.
 	timer *time.Timer
+	// deadline is when the timer expires.  It is not safe to access outside of
+	// cond.L.
+	deadline time.Time
 }
 
-const attachTimeout = 30 * time.Second
+const (
+	// defaultAttachTimeout is the attach timeout if Options.AttachTimeout is
+	// not set.
+	defaultAttachTimeout = 30 * time.Second
+	// defaultScreenRetryInterval is how often screen commands are retried if
+	// Options.ScreenRetryInterval is not set.
+	defaultScreenRetryInterval = 250 * time.Millisecond
+)
+
+// attachTimeout bounds starting the screen daemon, attaching to it and each
+// screen command.
+func (s *Session) attachTimeout() time.Duration {
+	if s.options.AttachTimeout > 0 {
+		return s.options.AttachTimeout
+	}
+	return defaultAttachTimeout
+}
+
+// screenRetryInterval is how often a failing screen command is retried.
+func (s *Session) screenRetryInterval() time.Duration {
+	if s.options.ScreenRetryInterval > 0 {
+		return s.options.ScreenRetryInterval
+	}
+	return defaultScreenRetryInterval
+}
 
 // NewSession sets up a new session.  Any errors with starting are returned on
 // Attach().  The session will close itself if nothing is attached for the
 // duration of the session timeout.
 func NewSession(command *Command, execer Execer, options *Options) *Session {
-	tempdir := filepath.Join(os.TempDir(), "coder-screen")
+	tempdir := userScreenDir(command.UID)
 	s := &Session{
 		command:    command,
 		cond:       sync.NewCond(&sync.Mutex{}),
-		configFile: filepath.Join(tempdir, "config"),
+		configFile: screenConfigFile(tempdir, options),
 		execer:     execer,
 		id:         uuid.NewString(),
+		input:      &inputLock{},
 		options:    options,
+		owner:      options.Owner,
+		quota:      newQuota(options),
+		metrics:    &sessionMetrics{started: time.Now()},
 		state:      StateStarting,
 		socketsDir: filepath.Join(tempdir, "sockets"),
+		daemonUp:   make(chan struct{}),
 	}
-	go s.lifecycle()
+	go s.lifecycle(s.attachTimeout())
 	return s
 }
 
-// lifecycle manages the lifecycle of the session.
-func (s *Session) lifecycle() {
+// lifecycle manages the lifecycle of the session.  The session closes if
+// nothing attaches within the timeout.
+func (s *Session) lifecycle(timeout time.Duration) {
 	err := s.ensureSettings()
 	if err != nil {
 		s.setState(StateDone, xerrors.Errorf("ensure settings: %w", err))
@@ -103,18 +178,42 @@ func (s *Session) lifecycle() {
 	// The initial timeout for starting up is set here and will probably be far
 	// shorter than the session timeout in most cases.  It should be at least long
 	// enough for the first screen attach to be able to start up the daemon.
-	s.timer = time.AfterFunc(attachTimeout, func() {
+	s.cond.L.Lock()
+	s.timer = time.AfterFunc(timeout, func() {
 		s.Close("session timeout")
 	})
+	s.deadline = time.Now().Add(timeout)
+	// An imported session may already be frozen.
+	if s.frozen {
+		s.timer.Stop()
+	}
+	s.cond.L.Unlock()
 
 	s.setState(StateReady, nil)
+	go s.watchDaemon()
 
-	// Handle the close event by asking screen to quit the session.  We have no
-	// way of knowing when the daemon process dies so the Go side will not get
-	// cleaned up until the timeout if the process gets killed externally (for
-	// example via `exit`).
+	// Handle the close event by asking screen to quit the session.  The daemon
+	// may be gone already if it was killed externally (for example via `exit`)
+	// which watchDaemon noticed.
 	s.WaitForState(StateClosing)
 	s.timer.Stop()
+	s.removeState()
+	// The screen daemon now belongs to the server the session was exported to.
+	if s.isHandedOff() {
+		s.setState(StateDone, xerrors.New("session was exported"))
+		return
+	}
+	// A stopped screen daemon would never act on the quit.
+	s.freezeMutex.Lock()
+	if s.isFrozen() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.attachTimeout())
+		err = s.signal(ctx, "CONT")
+		cancel()
+		if err != nil {
+			flog.Error("failed to thaw session %s: %v", s.id, err)
+		}
+	}
+	s.freezeMutex.Unlock()
 	// If the command errors that the session is already gone that is fine.
 	err = s.sendCommand(context.Background(), "quit", []string{"No screen session found"})
 	if err != nil {
@@ -131,7 +230,7 @@ func (s *Session) lifecycle() {
 // retried until successful, the timeout is reached, or the context ends (in
 // which case the context error is returned).
 func (s *Session) sendCommand(ctx context.Context, command string, successErrors []string) error {
-	ctx, cancel := context.WithTimeout(ctx, attachTimeout)
+	ctx, cancel := context.WithTimeout(ctx, s.attachTimeout())
 	defer cancel()
 	run := func() (bool, error) {
 		process, err := s.execer.Start(ctx, Command{
@@ -169,7 +268,7 @@ func (s *Session) sendCommand(ctx context.Context, command string, successErrors
 	}
 
 	// Then run on a timer.
-	ticker := time.NewTicker(250 * time.Millisecond)
+	ticker := time.NewTicker(s.screenRetryInterval())
 	defer ticker.Stop()
 
 	for {
@@ -215,9 +314,10 @@ func (s *Session) Attach(ctx context.Context) (Process, error) {
 	// -q disables the "New screen..." message that appears for five seconds when
 	// creating a new session with -RR.
 	// -c is the flag for the config file.
+	command := shCommand(*s.command)
 	process, err := s.execer.Start(ctx, Command{
 		Command:    "screen",
-		Args:       append([]string{"-S", s.id, "-xRRqc", s.configFile, s.command.Command}, s.command.Args...),
+		Args:       append([]string{"-S", s.id, "-xRRqc", s.configFile, command.Command}, command.Args...),
 		TTY:        s.command.TTY,
 		Rows:       s.command.Rows,
 		Cols:       s.command.Cols,
@@ -232,6 +332,13 @@ func (s *Session) Attach(ctx context.Context) (Process, error) {
 		return nil, err
 	}
 
+	// A frozen daemon will not answer until it is thawed but the attach will
+	// complete once it is.
+	if s.isFrozen() {
+		s.metrics.attached()
+		return process, nil
+	}
+
 	// Version seems to be the only command without a side effect so use it to
 	// wait for the session to come up.
 	err = s.sendCommand(ctx, "version", nil)
@@ -239,18 +346,101 @@ func (s *Session) Attach(ctx context.Context) (Process, error) {
 		cancel()
 		return nil, err
 	}
+	s.daemonOnce.Do(func() { close(s.daemonUp) })
+
+	// Logging is configured on every attach since there is no telling whether
+	// this one created the daemon, and repeating it has no effect.
+	if s.journalPath != "" {
+		for _, command := range []string{"logfile flush 1", fmt.Sprintf("logfile %q", s.journalPath), "log on"} {
+			err = s.sendCommand(ctx, command, nil)
+			if err != nil {
+				flog.Error("failed to journal session %s: %v", s.id, err)
+				break
+			}
+		}
+	}
+
+	s.metrics.attached()
+	return process, nil
+}
+
+// daemonPollInterval is how often a session checks that its screen daemon is
+// still running.
+const daemonPollInterval = 2 * time.Second
+
+// watchDaemon closes the session once its screen daemon exits, for example
+// because the shell in it exited, rather than leaving it until the timeout.
+func (s *Session) watchDaemon() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		s.waitForStateOrContext(ctx, StateClosing)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-s.daemonUp:
+	}
 
-	return process, err
+	ticker := time.NewTicker(daemonPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// A stopped daemon is still there.
+		if s.isFrozen() {
+			continue
+		}
+		// Attaching restarts a missing daemon so wait for any attach to finish.
+		s.mutex.Lock()
+		running := s.daemonRunning(ctx)
+		s.mutex.Unlock()
+		if !running {
+			s.Close("screen daemon exited")
+			return
+		}
+	}
+}
+
+// daemonRunning returns whether the screen daemon is running.  It errs on the
+// side of running if that cannot be determined.
+func (s *Session) daemonRunning(ctx context.Context) bool {
+	if _, remote := s.execer.(remoteFS); !remote {
+		return screenRunning(s.socketsDir, s.id)
+	}
+	process, err := s.execer.Start(ctx, Command{
+		Command: "screen",
+		Args:    []string{"-ls", s.id},
+		UID:     s.command.UID,
+		GID:     s.command.GID,
+		Env:     append(s.command.Env, "SCREENDIR="+s.socketsDir),
+	})
+	if err != nil {
+		return true
+	}
+	stdout := captureAll(process.Stdout())
+	// screen -ls exits with an error even when it lists sessions.
+	_ = process.Wait()
+	output := <-stdout
+	if ctx.Err() != nil {
+		return true
+	}
+	return strings.Contains(output, "."+s.id)
 }
 
 // heartbeat keeps the session alive while the provided context is not done.
 func (s *Session) heartbeat(ctx context.Context) {
 	// We just connected so reset the timer now in case it is near the end.
-	s.timer.Reset(s.options.SessionTimeout)
+	s.resetTimer()
 
 	// Reset when the connection closes to ensure the session stays up for the
 	// full timeout.
-	defer s.timer.Reset(s.options.SessionTimeout)
+	defer s.resetTimer()
 
 	heartbeat := time.NewTicker(s.options.SessionTimeout / 2)
 	defer heartbeat.Stop()
@@ -268,16 +458,162 @@ func (s *Session) heartbeat(ctx context.Context) {
 		if state > StateReady {
 			return
 		}
+		s.resetTimer()
+	}
+}
+
+// resetTimer restarts the session timeout unless the session is frozen.
+func (s *Session) resetTimer() {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	if !s.frozen {
 		s.timer.Reset(s.options.SessionTimeout)
+		s.deadline = time.Now().Add(s.options.SessionTimeout)
+	}
+}
+
+// Freeze stops every process in the session and pauses the session timeout
+// until Thaw is called, leaving the session otherwise intact.
+func (s *Session) Freeze(ctx context.Context) error {
+	s.freezeMutex.Lock()
+	defer s.freezeMutex.Unlock()
+
+	state, err := s.WaitForState(StateReady)
+	if state > StateReady {
+		return err
+	}
+	if s.isFrozen() {
+		return nil
+	}
+	err = s.signal(ctx, "STOP")
+	if err != nil {
+		return xerrors.Errorf("stop session: %w", err)
+	}
+
+	s.cond.L.Lock()
+	s.timer.Stop()
+	s.frozen = true
+	s.cond.Broadcast()
+	s.cond.L.Unlock()
+	s.saveState()
+	return nil
+}
+
+// Thaw resumes a frozen session and restarts its timeout.
+func (s *Session) Thaw(ctx context.Context) error {
+	s.freezeMutex.Lock()
+	defer s.freezeMutex.Unlock()
+
+	if !s.isFrozen() {
+		return nil
+	}
+	err := s.signal(ctx, "CONT")
+	if err != nil {
+		return xerrors.Errorf("continue session: %w", err)
+	}
+
+	s.cond.L.Lock()
+	s.frozen = false
+	s.timer.Reset(s.options.SessionTimeout)
+	s.deadline = time.Now().Add(s.options.SessionTimeout)
+	s.cond.Broadcast()
+	s.cond.L.Unlock()
+	s.saveState()
+	return nil
+}
+
+// isFrozen returns whether the session is frozen.
+func (s *Session) isFrozen() bool {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	return s.frozen
+}
+
+// isHandedOff returns whether the session was exported to another server.
+func (s *Session) isHandedOff() bool {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	return s.handedOff
+}
+
+// watchFrozen calls fn with the frozen state whenever it changes until the
+// context ends or the session closes, starting with the current state if the
+// session is already frozen.
+func (s *Session) watchFrozen(ctx context.Context, fn func(frozen bool)) {
+	go func() {
+		// Wake up when the context ends.
+		defer s.cond.Broadcast()
+		<-ctx.Done()
+	}()
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	frozen := false
+	for {
+		for ctx.Err() == nil && s.state <= StateReady && s.frozen == frozen {
+			s.cond.Wait()
+		}
+		if ctx.Err() != nil || s.state > StateReady {
+			return
+		}
+		frozen = s.frozen
+		s.cond.L.Unlock()
+		fn(frozen)
+		s.cond.L.Lock()
 	}
 }
 
+// signal sends the signal to the screen daemon and all of its descendants.
+func (s *Session) signal(ctx context.Context, signal string) error {
+	return runShell(ctx, s.execer, nil, signalTreeScript, signal, s.id)
+}
+
+// signalTreeScript signals the screen daemon for the session named $2 and
+// every process below it with $1.  The daemon renames itself to SCREEN which
+// distinguishes it from attached clients.
+const signalTreeScript = `tree() {
+  for pid in "$@"; do
+    echo "$pid"
+    tree $(pgrep -P "$pid")
+  done
+}
+pids=$(tree $(pgrep -f "^SCREEN -S $2 "))
+if [ -z "$pids" ]; then
+  echo "no processes found for session $2" >&2
+  exit 1
+fi
+kill -"$1" $pids
+`
+
 // Wait waits for the session to close.  The underlying process might still be
 // exiting.
 func (s *Session) Wait() {
 	s.WaitForState(StateClosing)
 }
 
+// reportExit calls Options.OnExit once the session is done, unless it was
+// handed off to the server it was exported to.  screen does not pass on the
+// exit code of the command so it is unknown and the error says why the session
+// closed.
+func (s *Session) reportExit(id string) {
+	if s.options.OnExit == nil {
+		return
+	}
+	_, err := s.WaitForState(StateDone)
+	if s.isHandedOff() {
+		return
+	}
+	s.options.OnExit(context.Background(), ExitInfo{
+		Owner:     s.Owner(),
+		SessionID: id,
+		Command:   s.command.Command,
+		Args:      s.command.Args,
+		Started:   s.metrics.started,
+		Duration:  time.Since(s.metrics.started),
+		ExitCode:  ExitCodeUnknown,
+		Error:     errorString(err),
+	})
+}
+
 // Close attempts to gracefully kill the session's underlying process then waits
 // for the process to exit.  If the session does not exit in a timely manner it
 // forcefully kills the process.
@@ -286,9 +622,117 @@ func (s *Session) Close(reason string) {
 	s.WaitForState(StateDone)
 }
 
+// Owner returns the owner of the session.
+func (s *Session) Owner() string {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	return s.owner
+}
+
+// ownedBy returns whether the provided owner may attach to the session.
+func (s *Session) ownedBy(owner string) bool {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	return s.owner == "" || s.owner == owner
+}
+
+// setOwner transfers the session to a new owner, revoking the share tokens
+// minted by the previous one.
+func (s *Session) setOwner(owner string) {
+	s.cond.L.Lock()
+	s.owner = owner
+	s.shares = nil
+	s.cond.L.Unlock()
+	s.saveState()
+}
+
 // ensureSettings writes config settings and creates the socket directory.
 func (s *Session) ensureSettings() error {
-	settings := []string{
+	settings := []byte(strings.Join(screenConfig(s.options), "\n"))
+
+	// The directories belong to the command's user, since screen refuses
+	// sockets in a directory it does not own, and only that user may enter
+	// them.
+	uid, gid := s.command.UID, s.command.GID
+	userDir := filepath.Dir(s.socketsDir)
+
+	// Screen runs wherever the execer runs commands which might not be the
+	// local filesystem.
+	if fs, ok := s.execer.(remoteFS); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), s.attachTimeout())
+		defer cancel()
+		for _, dir := range []string{userDir, s.socketsDir} {
+			err := fs.mkdirAll(ctx, dir, uid, gid)
+			if err != nil {
+				return err
+			}
+		}
+		return fs.writeFile(ctx, s.configFile, settings, uid, gid)
+	}
+
+	// Others need to pass through the shared directory to reach their own.
+	err := os.MkdirAll(screenDir(), 0o755)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{userDir, s.socketsDir} {
+		err = ensurePrivateDir(dir, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+	err = ioutil.WriteFile(s.configFile, settings, 0o600)
+	if err != nil {
+		return err
+	}
+	// WriteFile keeps the permissions of an existing file.
+	err = os.Chmod(s.configFile, 0o600)
+	if err != nil {
+		return err
+	}
+	return chown(s.configFile, uid, gid)
+}
+
+// userScreenDir is the directory of the sessions of commands run as the UID.
+func userScreenDir(uid uint32) string {
+	return filepath.Join(screenDir(), strconv.FormatUint(uint64(uid), 10))
+}
+
+// ensurePrivateDir creates a directory with 0700 permissions owned by uid and
+// gid, or makes an existing one so.  The shared temporary directory is
+// writable by anyone so a directory that is really a symlink is refused.
+func ensurePrivateDir(dir string, uid, gid uint32) error {
+	err := os.Mkdir(dir, 0o700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return xerrors.Errorf("%s is not a directory", dir)
+	}
+	err = os.Chmod(dir, 0o700)
+	if err != nil {
+		return err
+	}
+	return chown(dir, uid, gid)
+}
+
+// chown gives the file the owner uid and gid unless both are zero, in which
+// case it keeps the owner it was created with.
+func chown(name string, uid, gid uint32) error {
+	if uid == 0 && gid == 0 {
+		return nil
+	}
+	return os.Chown(name, int(uid), int(gid))
+}
+
+// DefaultScreenConfig returns the screen configuration sessions use unless
+// Options.ScreenConfig replaces it.
+func DefaultScreenConfig() []string {
+	return []string{
 		// Tell screen not to handle motion for xterm* terminals which allows
 		// scrolling the terminal via the mouse wheel or scroll bar (by default
 		// screen uses it to cycle through the command history).  There does not
@@ -311,17 +755,27 @@ func (s *Session) ensureSettings() error {
 		// again copy mode will work just fine).
 		"escape ^Ss",
 	}
+}
 
-	dir := filepath.Join(os.TempDir(), "coder-screen")
-	config := filepath.Join(dir, "config")
-	socketdir := filepath.Join(dir, "sockets")
-
-	err := os.MkdirAll(socketdir, 0o700)
-	if err != nil {
-		return err
+// screenConfig returns the screen configuration for sessions with the options.
+func screenConfig(options *Options) []string {
+	config := options.ScreenConfig
+	if config == nil {
+		config = DefaultScreenConfig()
 	}
+	return append(append([]string(nil), config...), options.ScreenConfigExtra...)
+}
 
-	return os.WriteFile(config, []byte(strings.Join(settings, "\n")), 0o644)
+// screenConfigFile returns where in dir the screen configuration for sessions
+// with the options is written.  Sessions share the file unless their options
+// customize the configuration, in which case each configuration gets its own
+// so that sessions with different options do not overwrite each other's.
+func screenConfigFile(dir string, options *Options) string {
+	if options.ScreenConfig == nil && len(options.ScreenConfigExtra) == 0 {
+		return filepath.Join(dir, "config")
+	}
+	sum := sha256.Sum256([]byte(strings.Join(screenConfig(options), "\n")))
+	return filepath.Join(dir, "config-"+hex.EncodeToString(sum[:8]))
 }
 
 // setState sets and broadcasts the provided state if it is greater than the
@@ -381,3 +835,90 @@ func captureStdout(process Process) <-chan string {
 	}()
 	return stdout
 }
+
+// remoteFS is implemented by execers that run commands somewhere other than
+// the local filesystem (for example inside a container) so that screen can be
+// located and configured where it will actually run.
+type remoteFS interface {
+	// lookPath returns an error if the named program cannot be found.
+	lookPath(ctx context.Context, file string) error
+	// mkdirAll creates a directory and any missing parents, giving the
+	// directory 0700 permissions and, unless they are zero, the owner uid and
+	// gid.
+	mkdirAll(ctx context.Context, path string, uid, gid uint32) error
+	// writeFile writes data to the named file, creating it if necessary, with
+	// 0600 permissions and, unless they are zero, the owner uid and gid.
+	writeFile(ctx context.Context, name string, data []byte, uid, gid uint32) error
+}
+
+// lookScreen returns an error if screen cannot be found where the execer runs
+// commands.
+func lookScreen(ctx context.Context, execer Execer) error {
+	if fs, ok := execer.(remoteFS); ok {
+		return fs.lookPath(ctx, "screen")
+	}
+	_, err := exec.LookPath("screen")
+	return err
+}
+
+// execLookPath implements remoteFS.lookPath by running a shell through the
+// execer.
+func execLookPath(ctx context.Context, execer Execer, file string) error {
+	return runShell(ctx, execer, nil, `command -v "$1"`, file)
+}
+
+// execMkdirAll implements remoteFS.mkdirAll by running a shell through the
+// execer.
+func execMkdirAll(ctx context.Context, execer Execer, path string, uid, gid uint32) error {
+	return runShell(ctx, execer, nil, `mkdir -p -m 700 "$1" && chmod 700 "$1"`+chownScript(uid, gid), path, fmt.Sprint(uid), fmt.Sprint(gid))
+}
+
+// execWriteFile implements remoteFS.writeFile by running a shell through the
+// execer.
+func execWriteFile(ctx context.Context, execer Execer, name string, data []byte, uid, gid uint32) error {
+	return runShell(ctx, execer, data, `cat > "$1" && chmod 600 "$1"`+chownScript(uid, gid), name, fmt.Sprint(uid), fmt.Sprint(gid))
+}
+
+// chownScript continues a script to give $1 the owner $2 and group $3 unless
+// both are zero, in which case it keeps the owner it was created with.
+func chownScript(uid, gid uint32) string {
+	if uid == 0 && gid == 0 {
+		return ""
+	}
+	return ` && chown "$2:$3" "$1"`
+}
+
+// runShell runs a shell script through the execer, piping stdin to it if not
+// nil.  Positional arguments start at $1.
+func runShell(ctx context.Context, execer Execer, stdin []byte, script string, args ...string) error {
+	process, err := execer.Start(ctx, Command{
+		Command: "sh",
+		Args:    append([]string{"-c", script, "sh"}, args...),
+		Stdin:   stdin != nil,
+	})
+	if err != nil {
+		return err
+	}
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, process.Stderr())
+	}()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, process.Stdout())
+	}()
+	if stdin != nil {
+		_, err = process.Stdin().Write(stdin)
+		if err != nil {
+			err = xerrors.Errorf("write stdin: %w", err)
+		} else if err = process.Stdin().Close(); err != nil {
+			err = xerrors.Errorf("close stdin: %w", err)
+		}
+		if err != nil {
+			// The script may never see the end of its input so it is stopped,
+			// but it is still waited for so nothing is left behind.
+			_ = process.Close()
+			_ = process.Wait()
+			return err
+		}
+	}
+	return process.Wait()
+}
@@ -0,0 +1,214 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"cdr.dev/wsep/internal/proto"
+)
+
+// storeSession adds a session to the server without attaching to it.  This
+// does not require screen.
+func storeSession(t *testing.T, server *Server, id string, options *Options) *Session {
+	s := NewSession(&Command{Command: "sh"}, LocalExecer{}, options)
+	_, err := s.WaitForState(StateReady)
+	assert.Success(t, "session ready", err)
+	server.sessions.Store(id, s)
+	go func() {
+		defer server.sessions.Delete(id)
+		s.Wait()
+	}()
+	return s
+}
+
+func TestTransferSession(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	server := newServer(t)
+	s := storeSession(t, server, "id", &Options{Owner: "alice", SessionTimeout: time.Minute})
+
+	admin := func(options *Options) SessionAdmin {
+		ws, httpServer := mockConn(ctx, t, server, options)
+		t.Cleanup(httpServer.Close)
+		return RemoteExecer(ws).(SessionAdmin)
+	}
+
+	bob := admin(&Options{Owner: "bob"})
+	err := bob.TransferSession(ctx, "id", "bob")
+	assert.Equal(t, "forbidden", CodeForbidden, ErrorCode(err))
+	err = bob.TransferSession(ctx, "missing", "bob")
+	assert.Equal(t, "not found", CodeSessionNotFound, ErrorCode(err))
+	assert.Equal(t, "owner unchanged", "alice", s.Owner())
+
+	alice := admin(&Options{Owner: "alice"})
+	err = alice.TransferSession(ctx, "id", "carol")
+	assert.Success(t, "transfer", err)
+	assert.Equal(t, "new owner", "carol", s.Owner())
+	err = alice.TransferSession(ctx, "id", "alice")
+	assert.Equal(t, "no longer owner", CodeForbidden, ErrorCode(err))
+
+	err = admin(&Options{Admin: true}).TransferSession(ctx, "id", "dave")
+	assert.Success(t, "admin transfer", err)
+	assert.Equal(t, "admin owner", "dave", s.Owner())
+
+	err = server.TransferSession("id", "erin")
+	assert.Success(t, "server transfer", err)
+	assert.Equal(t, "server owner", "erin", s.Owner())
+	assert.True(t, "only owner attaches", s.ownedBy("erin") && !s.ownedBy("dave"))
+}
+
+func TestShareSession(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	server := newServer(t)
+	s := storeSession(t, server, "id", &Options{Owner: "alice", SessionTimeout: time.Minute})
+
+	admin := func(options *Options) SessionAdmin {
+		ws, httpServer := mockConn(ctx, t, server, options)
+		t.Cleanup(httpServer.Close)
+		return RemoteExecer(ws).(SessionAdmin)
+	}
+
+	_, err := admin(&Options{Owner: "bob"}).ShareSession(ctx, "id", false, time.Minute)
+	assert.Equal(t, "forbidden", CodeForbidden, ErrorCode(err))
+
+	alice := admin(&Options{Owner: "alice"})
+	token, err := alice.ShareSession(ctx, "id", true, time.Minute)
+	assert.Success(t, "share", err)
+	readOnly, ok := s.redeemShare(token)
+	assert.True(t, "read-only token", ok && readOnly)
+	_, ok = s.redeemShare("bogus")
+	assert.True(t, "unknown token", !ok)
+
+	_, err = alice.ShareSession(ctx, "id", false, -time.Second)
+	assert.Error(t, "negative ttl", err)
+	_, err = alice.(remoteExec).requestResult(ctx, proto.ClientShareSessionHeader{
+		Type:      proto.TypeShareSession,
+		ID:        "id",
+		ExpiresIn: -1,
+	})
+	assert.Error(t, "negative expires_in", err)
+
+	brief, err := alice.ShareSession(ctx, "id", false, time.Millisecond)
+	assert.Success(t, "share briefly", err)
+	s.cond.L.Lock()
+	grant := s.shares[brief]
+	s.cond.L.Unlock()
+	assert.True(t, "sub-second ttl expires", !grant.expires.IsZero())
+
+	expired, err := server.ShareSession("id", false, time.Nanosecond)
+	assert.Success(t, "server share", err)
+	time.Sleep(time.Millisecond)
+	_, ok = s.redeemShare(expired)
+	assert.True(t, "expired token", !ok)
+
+	err = server.TransferSession("id", "bob")
+	assert.Success(t, "transfer", err)
+	_, ok = s.redeemShare(token)
+	assert.True(t, "revoked by transfer", !ok)
+}
+
+func TestListSessions(t *testing.T) {
+	t.Parallel()
+
+	server := newServer(t)
+	assert.Equal(t, "no sessions", 0, len(server.ListSessions()))
+
+	other := storeSession(t, server, "b", &Options{SessionTimeout: time.Minute})
+	s := storeSession(t, server, "a", &Options{Owner: "alice", SessionTimeout: time.Minute})
+	s.metrics.attached()
+	s.metrics.attached()
+	s.metrics.addIn(3)
+	_, err := io.Copy(ioutil.Discard, s.metrics.outputReader(strings.NewReader("hello")))
+	assert.Success(t, "read output", err)
+
+	sessions := server.ListSessions()
+	assert.Equal(t, "count", 2, len(sessions))
+	info := sessions[0]
+	assert.Equal(t, "id", "a", info.ID)
+	assert.Equal(t, "owner", "alice", info.Owner)
+	assert.Equal(t, "command", "sh", info.Command)
+	assert.Equal(t, "bytes in", int64(3), info.BytesIn)
+	assert.Equal(t, "bytes out", int64(5), info.BytesOut)
+	assert.Equal(t, "attaches", int64(2), info.Attaches)
+	assert.Equal(t, "reconnects", int64(1), info.Reconnects)
+	assert.True(t, "uptime", info.Uptime > 0 && !info.Started.IsZero())
+	assert.Equal(t, "unattached", int64(0), sessions[1].Reconnects)
+
+	// Closed sessions drop out of the list.
+	for _, s := range []*Session{s, other} {
+		s.Close("test")
+		s.Wait()
+	}
+	for len(server.ListSessions()) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionDaemonExit(t *testing.T) {
+	t.Parallel()
+
+	// The session never starts screen so its daemon looks gone.
+	s := NewSession(&Command{Command: "sh"}, LocalExecer{}, &Options{SessionTimeout: time.Minute})
+	_, err := s.WaitForState(StateReady)
+	assert.Success(t, "session ready", err)
+	s.daemonOnce.Do(func() { close(s.daemonUp) })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.WaitForState(StateDone)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session did not close after its daemon exited")
+	}
+}
+
+func TestScreenConfig(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "default", DefaultScreenConfig(), screenConfig(&Options{}))
+	extra := &Options{ScreenConfigExtra: []string{"defscrollback 10000"}}
+	assert.Equal(t, "extra", append(DefaultScreenConfig(), "defscrollback 10000"), screenConfig(extra))
+	replaced := &Options{ScreenConfig: []string{"escape ^Aa"}, ScreenConfigExtra: []string{"hardstatus on"}}
+	assert.Equal(t, "replaced", []string{"escape ^Aa", "hardstatus on"}, screenConfig(replaced))
+
+	dir := userScreenDir(0)
+	assert.Equal(t, "shared file", filepath.Join(dir, "config"), screenConfigFile(dir, &Options{}))
+	assert.True(t, "own file", screenConfigFile(dir, extra) != screenConfigFile(dir, replaced))
+	assert.Equal(t, "stable file", screenConfigFile(dir, extra), screenConfigFile(dir, &Options{ScreenConfigExtra: []string{"defscrollback 10000"}}))
+}
+
+func TestPrivateDir(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(tempDir(t), "user")
+	err := os.Mkdir(dir, 0o777)
+	assert.Success(t, "mkdir", err)
+	err = ensurePrivateDir(dir, 0, 0)
+	assert.Success(t, "existing", err)
+	info, err := os.Stat(dir)
+	assert.Success(t, "stat", err)
+	assert.Equal(t, "mode", os.FileMode(0o700), info.Mode().Perm())
+
+	link := filepath.Join(tempDir(t), "link")
+	err = os.Symlink(dir, link)
+	assert.Success(t, "symlink", err)
+	err = ensurePrivateDir(link, 0, 0)
+	assert.Error(t, "symlink", err)
+
+	assert.True(t, "per user", userScreenDir(1000) != userScreenDir(1001))
+}
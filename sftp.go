@@ -0,0 +1,115 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+)
+
+// sftpScript runs the first SFTP server it finds in the usual locations.
+const sftpScript = `for p in /usr/lib/openssh/sftp-server /usr/libexec/openssh/sftp-server /usr/lib/ssh/sftp-server /usr/libexec/sftp-server; do
+	[ -x "$p" ] && exec "$p"
+done
+command -v sftp-server >/dev/null 2>&1 && exec sftp-server
+echo "sftp-server not found" >&2
+exit 127`
+
+// SFTPOptions configures an SFTP subsystem.
+type SFTPOptions struct {
+	// UID and GID set the user the SFTP server runs as, which determines the
+	// files it can access.
+	UID uint32
+	GID uint32
+	// ServerPath overrides the location of the SFTP server.  By default the
+	// locations OpenSSH installs it to are searched followed by PATH.
+	ServerPath string
+}
+
+// StartSFTP starts an SFTP server through the execer and returns a stream
+// speaking the SFTP protocol, for use with SFTP clients such as the one in
+// github.com/pkg/sftp.  With a remote execer the protocol is tunneled over the
+// wsep connection.  Closing the stream stops the server.
+func StartSFTP(ctx context.Context, execer Execer, opts *SFTPOptions) (io.ReadWriteCloser, error) {
+	return startSFTP(ctx, execer, opts)
+}
+
+func startSFTP(ctx context.Context, execer Execer, opts *SFTPOptions) (*sftpStream, error) {
+	if opts == nil {
+		opts = &SFTPOptions{}
+	}
+	command := Command{
+		Command: "sh",
+		Args:    []string{"-c", sftpScript},
+		Stdin:   true,
+		UID:     opts.UID,
+		GID:     opts.GID,
+	}
+	if opts.ServerPath != "" {
+		command.Command = opts.ServerPath
+		command.Args = nil
+	}
+	process, err := execer.Start(ctx, command)
+	if err != nil {
+		return nil, codeErrorf(CodeStartFailed, "start sftp server: %w", err)
+	}
+	go func() {
+		// The server logs to stderr which would otherwise block it.
+		_, _ = io.Copy(ioutil.Discard, process.Stderr())
+	}()
+	return &sftpStream{process: process}, nil
+}
+
+// ServeSFTP serves the SFTP protocol on rwc, such as an SSH subsystem channel,
+// by relaying it to an SFTP server started through the execer.  It yields once
+// either side closes.
+func ServeSFTP(ctx context.Context, rwc io.ReadWriteCloser, execer Execer, opts *SFTPOptions) error {
+	stream, err := startSFTP(ctx, execer, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	var group errgroup.Group
+	group.Go(func() error {
+		_, err := io.Copy(stream, rwc)
+		// Closing stdin tells the server the client is gone.
+		_ = stream.process.Stdin().Close()
+		return err
+	})
+	group.Go(func() error {
+		_, err := io.Copy(rwc, stream)
+		_ = rwc.Close()
+		return err
+	})
+	err = group.Wait()
+	if err != nil {
+		return xerrors.Errorf("relay sftp: %w", err)
+	}
+	return nil
+}
+
+// sftpStream joins the stdin and stdout of an SFTP server process.
+type sftpStream struct {
+	process Process
+}
+
+func (s *sftpStream) Read(p []byte) (int, error) {
+	return s.process.Stdout().Read(p)
+}
+
+func (s *sftpStream) Write(p []byte) (int, error) {
+	return s.process.Stdin().Write(p)
+}
+
+// Close stops the server.  The server was asked to stop so how it exits is not
+// interesting and no error is returned.
+func (s *sftpStream) Close() error {
+	// The server exits once stdin closes but stop it in case it is stuck.
+	_ = s.process.Stdin().Close()
+	_ = s.process.Close()
+	_ = s.process.Wait()
+	return nil
+}
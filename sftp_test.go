@@ -0,0 +1,60 @@
+package wsep
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestSFTP(t *testing.T) {
+	t.Parallel()
+	if !haveSFTPServer() {
+		t.Skip("sftp-server is not installed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+
+	stream, err := StartSFTP(ctx, RemoteExecer(ws), nil)
+	assert.Success(t, "start sftp", err)
+	defer stream.Close()
+
+	// SSH_FXP_INIT for version 3 should be answered with SSH_FXP_VERSION.
+	_, err = stream.Write([]byte{0, 0, 0, 5, 1, 0, 0, 0, 3})
+	assert.Success(t, "write init", err)
+	var length uint32
+	err = binary.Read(stream, binary.BigEndian, &length)
+	assert.Success(t, "read length", err)
+	packet := make([]byte, length)
+	_, err = io.ReadFull(stream, packet)
+	assert.Success(t, "read version", err)
+	assert.Equal(t, "packet type", byte(2), packet[0])
+	assert.Equal(t, "version", uint32(3), binary.BigEndian.Uint32(packet[1:5]))
+}
+
+func TestSFTPNotFound(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	_, err := StartSFTP(ctx, LocalExecer{}, &SFTPOptions{ServerPath: "/does/not/exist"})
+	assert.Equal(t, "start error", CodeStartFailed, ErrorCode(err))
+}
+
+func haveSFTPServer() bool {
+	for _, p := range []string{"/usr/lib/openssh/sftp-server", "/usr/libexec/openssh/sftp-server", "/usr/lib/ssh/sftp-server", "/usr/libexec/sftp-server"} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	_, err := exec.LookPath("sftp-server")
+	return err == nil
+}
@@ -0,0 +1,111 @@
+package wsep
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+// shareGrant is what a share token permits.
+type shareGrant struct {
+	readOnly bool
+	// expires is zero if the token lasts as long as the session.
+	expires time.Time
+}
+
+// ShareSession mints a token that lets connections with another owner attach
+// to the session.  A read-only token only lets them observe it.  The token
+// expires after ttl, or lasts as long as the session if ttl is zero, and is
+// revoked when the session changes owner.  A negative ttl is an error.
+func (srv *Server) ShareSession(id string, readOnly bool, ttl time.Duration) (string, error) {
+	s, err := srv.session(id)
+	if err != nil {
+		return "", err
+	}
+	return s.share(readOnly, ttl)
+}
+
+// shareSession mints a share token for a connection that owns the session or
+// has admin rights.
+func (srv *Server) shareSession(header proto.ClientShareSessionHeader, options *Options) (string, error) {
+	s, err := srv.session(header.ID)
+	if err != nil {
+		return "", err
+	}
+	if !options.Admin && !s.ownedBy(options.Owner) {
+		return "", codeErrorf(CodeForbidden, "session %s belongs to another owner", header.ID)
+	}
+	return s.share(header.ReadOnly, time.Duration(header.ExpiresIn)*time.Second)
+}
+
+// share mints a token for the session.
+func (s *Session) share(readOnly bool, ttl time.Duration) (string, error) {
+	if ttl < 0 {
+		return "", xerrors.Errorf("share token ttl %s is negative", ttl)
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", xerrors.Errorf("generate token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	grant := shareGrant{readOnly: readOnly}
+	if ttl > 0 {
+		grant.expires = time.Now().Add(ttl)
+	}
+
+	s.cond.L.Lock()
+	if s.shares == nil {
+		s.shares = make(map[string]shareGrant)
+	}
+	s.shares[token] = grant
+	s.cond.L.Unlock()
+	s.saveState()
+	return token, nil
+}
+
+// redeemShare returns whether the token lets a connection attach to the
+// session, and whether only to observe it.
+func (s *Session) redeemShare(token string) (readOnly bool, ok bool) {
+	if token == "" {
+		return false, false
+	}
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	grant, ok := s.shares[token]
+	if !ok {
+		return false, false
+	}
+	if !grant.expires.IsZero() && time.Now().After(grant.expires) {
+		delete(s.shares, token)
+		return false, false
+	}
+	return grant.readOnly, true
+}
+
+// ShareSession asks the server for a token that lets connections with another
+// owner attach to a session by setting Command.ShareToken.  The connection must
+// own the session or have admin rights.  Connections with a read-only token
+// must set Command.Observe.
+func (r remoteExec) ShareSession(ctx context.Context, id string, readOnly bool, ttl time.Duration) (string, error) {
+	if ttl < 0 {
+		return "", xerrors.Errorf("share token ttl %s is negative", ttl)
+	}
+	result, err := r.requestResult(ctx, proto.ClientShareSessionHeader{
+		Type:     proto.TypeShareSession,
+		ID:       id,
+		ReadOnly: readOnly,
+		// Rounding down would turn a ttl under a second into zero, which
+		// never expires.
+		ExpiresIn: int64((ttl + time.Second - 1) / time.Second),
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.Token, nil
+}
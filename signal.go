@@ -0,0 +1,54 @@
+package wsep
+
+import (
+	"context"
+)
+
+// Signal is a request to a running command that means the same thing on every
+// platform.  Each execer delivers it in the closest native way.
+type Signal string
+
+const (
+	// SignalInterrupt asks the command to stop what it is doing, as Ctrl+C
+	// does.  It is SIGINT on Unix.  For TTY commands it is typed into the
+	// terminal as Ctrl+C so it reaches whatever is in the foreground.
+	SignalInterrupt Signal = "interrupt"
+	// SignalTerminate asks the command to exit.  It is SIGTERM on Unix.  On
+	// Windows, which has no equivalent, it closes the console of a TTY command
+	// and kills other commands.
+	SignalTerminate Signal = "terminate"
+	// SignalKill ends the command immediately.  It is SIGKILL on Unix and
+	// kills the command's whole process tree on Windows.
+	SignalKill Signal = "kill"
+)
+
+// ctrlC is typed into the terminal of a TTY command to interrupt it.
+const ctrlC = 0x03
+
+// valid reports whether the signal is one of the defined signals.
+func (s Signal) valid() bool {
+	switch s {
+	case SignalInterrupt, SignalTerminate, SignalKill:
+		return true
+	}
+	return false
+}
+
+// signaler is implemented by processes that can be signaled.
+type signaler interface {
+	Signal(ctx context.Context, sig Signal) error
+}
+
+// SignalProcess sends a signal to a process.  Processes started by
+// LocalExecer and remote execers can be signaled; others return an error with
+// CodeSignalUnsupported.
+func SignalProcess(ctx context.Context, p Process, sig Signal) error {
+	if !sig.valid() {
+		return codeErrorf(CodeSignalUnsupported, "unknown signal %q", sig)
+	}
+	s, ok := p.(signaler)
+	if !ok {
+		return codeErrorf(CodeSignalUnsupported, "%T cannot be signaled", p)
+	}
+	return s.Signal(ctx, sig)
+}
@@ -0,0 +1,71 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestSignalProcess(t *testing.T) {
+	t.Parallel()
+
+	interrupt := func(ctx context.Context, t *testing.T, execer Execer, command Command) {
+		process, err := execer.Start(ctx, command)
+		assert.Success(t, "start command", err)
+		go io.Copy(ioutil.Discard, process.Stdout())
+		go io.Copy(ioutil.Discard, process.Stderr())
+
+		assert.Success(t, "interrupt", SignalProcess(ctx, process, SignalInterrupt))
+		err = process.Wait()
+		exitErr, ok := err.(ExitError)
+		assert.True(t, "error is ExitError", ok)
+		assert.Equal(t, "exit code", ExitCodeSignalBase+2, exitErr.ExitCode())
+	}
+
+	t.Run("Local", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		interrupt(ctx, t, LocalExecer{}, Command{Command: "sleep", Args: []string{"10"}})
+	})
+
+	t.Run("TTY", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// The interrupt is typed as Ctrl+C so the terminal sends it to the
+		// foreground.  sleep is started directly since a shell that has
+		// forked it but not yet run it can lose the interrupt.
+		interrupt(ctx, t, LocalExecer{}, Command{Command: "sleep", Args: []string{"10"}, TTY: true})
+	})
+
+	t.Run("Remote", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ws, server := mockConn(ctx, t, nil, nil)
+		defer server.Close()
+		interrupt(ctx, t, RemoteExecer(ws), Command{Command: "sleep", Args: []string{"10"}})
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+
+		err := SignalProcess(ctx, (*cachedProcess)(nil), SignalInterrupt)
+		assert.Equal(t, "code", CodeSignalUnsupported, ErrorCode(err))
+
+		process, err := LocalExecer{}.Start(ctx, Command{Command: "true"})
+		assert.Success(t, "start command", err)
+		err = SignalProcess(ctx, process, Signal("hangup"))
+		assert.Equal(t, "unknown signal code", CodeSignalUnsupported, ErrorCode(err))
+		_ = process.Wait()
+	})
+}
@@ -0,0 +1,44 @@
+//go:build windows
+// +build windows
+
+package wsep
+
+import (
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	procGenerateConsoleCtrlEvent = kernel32.NewProc("GenerateConsoleCtrlEvent")
+	procAttachConsole            = kernel32.NewProc("AttachConsole")
+	procFreeConsole              = kernel32.NewProc("FreeConsole")
+)
+
+const ctrlBreakEvent = 1
+
+// consoleMutex serializes borrowing the consoles of commands since a process
+// can only be attached to one console at a time.
+var consoleMutex sync.Mutex
+
+// sendCtrlBreak sends CTRL_BREAK_EVENT to the process group a command leads.
+// Events only reach processes that share a console with this one so if this
+// process has no console the command's is borrowed for the moment it takes.
+func sendCtrlBreak(pid uint32) error {
+	consoleMutex.Lock()
+	defer consoleMutex.Unlock()
+	ok, _, _ := procGenerateConsoleCtrlEvent.Call(ctrlBreakEvent, uintptr(pid))
+	if ok != 0 {
+		return nil
+	}
+	ok, _, err := procAttachConsole.Call(uintptr(pid))
+	if ok == 0 {
+		return xerrors.Errorf("attach console: %w", err)
+	}
+	defer procFreeConsole.Call()
+	ok, _, err = procGenerateConsoleCtrlEvent.Call(ctrlBreakEvent, uintptr(pid))
+	if ok == 0 {
+		return xerrors.Errorf("generate console event: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package wsep
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// slowConsumerConn calls onSlow whenever a write to the client blocks longer
+// than timeout, which means the client stopped reading and output is backing
+// up behind it.
+type slowConsumerConn struct {
+	conn
+	timeout time.Duration
+	onSlow  func()
+}
+
+func (c slowConsumerConn) Write(ctx context.Context, msg []byte) error {
+	timer := time.AfterFunc(c.timeout, c.onSlow)
+	defer timer.Stop()
+	return c.conn.Write(ctx, msg)
+}
+
+func (c slowConsumerConn) WriteBuffers(ctx context.Context, bufs net.Buffers) error {
+	timer := time.AfterFunc(c.timeout, c.onSlow)
+	defer timer.Stop()
+	return c.conn.WriteBuffers(ctx, bufs)
+}
+
+// slowConsumer audits that the connection's client stopped reading.
+func (s *connSummary) slowConsumer(options *Options, timeout time.Duration) {
+	s.mutex.Lock()
+	event := s.event
+	s.mutex.Unlock()
+	audit(context.Background(), options, AuditEvent{
+		Type:       AuditSlowConsumer,
+		SessionID:  event.SessionID,
+		Command:    event.Command,
+		Args:       event.Args,
+		Pid:        event.Pid,
+		RemoteAddr: event.RemoteAddr,
+		DurationMS: timeout.Milliseconds(),
+	})
+}
@@ -0,0 +1,49 @@
+package wsep
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestSlowConsumer(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	srv := NewServer()
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Success(t, "listen", err)
+	sink := &memoryAuditSink{}
+	go func() {
+		_ = srv.ServeListener(ctx, l, LocalExecer{}, &Options{
+			Audit:               sink,
+			SlowConsumerTimeout: 100 * time.Millisecond,
+			DropSlowConsumers:   true,
+		})
+	}()
+	nc, err := net.Dial("tcp", l.Addr().String())
+	assert.Success(t, "dial", err)
+
+	// Leaving stdout unread stops the client reading the connection once its
+	// buffers fill.
+	process, err := RemoteStreamExecer(nc).Start(ctx, Command{Command: "yes"})
+	assert.Success(t, "start", err)
+	defer process.Close()
+
+	var slow, dropped bool
+	for !dropped {
+		assert.Success(t, "context", ctx.Err())
+		time.Sleep(10 * time.Millisecond)
+		for _, event := range sink.events() {
+			slow = slow || event.Type == AuditSlowConsumer && event.Command == "yes"
+			dropped = dropped || event.Type == AuditConnection && event.Reason == string(CodeSlowConsumer)
+		}
+	}
+	assert.True(t, "slow consumer event", slow)
+	assert.Equal(t, "count", int64(1), srv.SlowConsumerCount())
+}
@@ -0,0 +1,90 @@
+package wsep
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// Stats counts the traffic of a process started by a remote execer.
+type Stats struct {
+	// StdinBytes, StdoutBytes and StderrBytes count the bytes of each stream.
+	StdinBytes  int64
+	StdoutBytes int64
+	StderrBytes int64
+	// FramesSent and FramesReceived count protocol messages of any type.
+	FramesSent     int64
+	FramesReceived int64
+	// Reconnects counts how many times a reconnecting process re-attached.
+	Reconnects int64
+}
+
+// add returns the sum of two stats.
+func (s Stats) add(o Stats) Stats {
+	return Stats{
+		StdinBytes:     s.StdinBytes + o.StdinBytes,
+		StdoutBytes:    s.StdoutBytes + o.StdoutBytes,
+		StderrBytes:    s.StderrBytes + o.StderrBytes,
+		FramesSent:     s.FramesSent + o.FramesSent,
+		FramesReceived: s.FramesReceived + o.FramesReceived,
+		Reconnects:     s.Reconnects + o.Reconnects,
+	}
+}
+
+// ProcessStats returns the traffic statistics of a process started by a remote
+// execer, or false for other processes.
+func ProcessStats(p Process) (Stats, bool) {
+	if s, ok := p.(interface{ Stats() Stats }); ok {
+		return s.Stats(), true
+	}
+	return Stats{}, false
+}
+
+// processStats holds counters that must be accessed atomically.
+type processStats struct {
+	stdinBytes     int64
+	stdoutBytes    int64
+	stderrBytes    int64
+	framesSent     int64
+	framesReceived int64
+}
+
+func (s *processStats) snapshot() Stats {
+	return Stats{
+		StdinBytes:     atomic.LoadInt64(&s.stdinBytes),
+		StdoutBytes:    atomic.LoadInt64(&s.stdoutBytes),
+		StderrBytes:    atomic.LoadInt64(&s.stderrBytes),
+		FramesSent:     atomic.LoadInt64(&s.framesSent),
+		FramesReceived: atomic.LoadInt64(&s.framesReceived),
+	}
+}
+
+// countingConn counts the messages passing through a conn.
+type countingConn struct {
+	conn
+	stats *processStats
+}
+
+func (c countingConn) Read(ctx context.Context) ([]byte, error) {
+	msg, err := c.conn.Read(ctx)
+	if err == nil {
+		atomic.AddInt64(&c.stats.framesReceived, 1)
+	}
+	return msg, err
+}
+
+func (c countingConn) Write(ctx context.Context, msg []byte) error {
+	err := c.conn.Write(ctx, msg)
+	if err == nil {
+		atomic.AddInt64(&c.stats.framesSent, 1)
+	}
+	return err
+}
+
+func (c countingConn) WriteBuffers(ctx context.Context, bufs net.Buffers) error {
+	err := c.conn.WriteBuffers(ctx, bufs)
+	if err == nil {
+		atomic.AddInt64(&c.stats.framesSent, 1)
+	}
+	return err
+}
@@ -0,0 +1,234 @@
+package wsep
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+// DirSyncer is implemented by remote execers to push a local directory to the
+// remote, uploading only the files whose contents differ.
+type DirSyncer interface {
+	// Sync recursively uploads the files under local to remote.  Files on the
+	// remote that do not exist locally are left in place.
+	Sync(ctx context.Context, local, remote string, opts *SyncOptions) error
+}
+
+// SyncOptions configures a directory sync.
+type SyncOptions struct {
+	// Include limits the sync to files matching at least one of the patterns.
+	// Patterns use path.Match syntax and match either the slash-separated path
+	// relative to the directory or the file's base name.
+	Include []string
+	// Exclude skips files and directories matching any of the patterns.  It
+	// takes precedence over Include.
+	Exclude []string
+	// UID and GID set the user the sync runs as on the remote.
+	UID uint32
+	GID uint32
+	// Synced is called with the relative path of each file after it is
+	// uploaded.
+	Synced func(path string)
+}
+
+// Sync uploads the files under local that are missing or differ on the remote.
+func (r remoteExec) Sync(ctx context.Context, local, remote string, opts *SyncOptions) error {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+	localSums, err := localChecksums(local, opts)
+	if err != nil {
+		return xerrors.Errorf("checksum local files: %w", err)
+	}
+	remoteSums, err := r.checksums(ctx, remote, opts)
+	if err != nil {
+		return xerrors.Errorf("checksum remote files: %w", err)
+	}
+
+	for rel, sum := range localSums {
+		if remoteSums[rel] == sum {
+			continue
+		}
+		err = r.syncFile(ctx, filepath.Join(local, filepath.FromSlash(rel)), path.Join(remote, rel), opts)
+		if err != nil {
+			return err
+		}
+		if opts.Synced != nil {
+			opts.Synced(rel)
+		}
+	}
+	return nil
+}
+
+func (r remoteExec) syncFile(ctx context.Context, local, remote string, opts *SyncOptions) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return xerrors.Errorf("open %s: %w", local, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return xerrors.Errorf("stat %s: %w", local, err)
+	}
+	return r.Upload(ctx, f, remote, &TransferOptions{
+		Mode: info.Mode().Perm(),
+		UID:  opts.UID,
+		GID:  opts.GID,
+	})
+}
+
+// checksums returns the checksums of the files under dir on the remote keyed by
+// their slash-separated relative path.
+func (r remoteExec) checksums(ctx context.Context, dir string, opts *SyncOptions) (map[string]string, error) {
+	header, err := json.Marshal(proto.ClientChecksumsHeader{
+		Type: proto.TypeChecksums,
+		Path: dir,
+		UID:  opts.UID,
+		GID:  opts.GID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = r.conn.Write(ctx, header)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = r.receiveFile(ctx, &buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseChecksums(&buf), nil
+}
+
+// parseChecksums parses the output of sha256sum.  Lines it does not understand,
+// such as escaped names, are skipped which causes those files to be uploaded.
+func parseChecksums(r io.Reader) map[string]string {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < sha256.Size*2+3 || line[sha256.Size*2] != ' ' {
+			continue
+		}
+		sum := line[:sha256.Size*2]
+		name := strings.TrimPrefix(line[sha256.Size*2+2:], "./")
+		sums[name] = sum
+	}
+	return sums
+}
+
+// localChecksums returns the checksums of the files under dir that pass the
+// filters keyed by their slash-separated relative path.
+func localChecksums(dir string, opts *SyncOptions) (map[string]string, error) {
+	sums := make(map[string]string)
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if matchAny(opts.Exclude, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if len(opts.Include) > 0 && !matchAny(opts.Include, rel) {
+			return nil
+		}
+		sums[rel], err = checksumFile(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+func checksumFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// matchAny reports whether the relative path or its base name matches any of
+// the patterns.
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checksumsScript prints the checksum of every file under the directory or
+// nothing if the directory does not exist yet.
+const checksumsScript = `[ -d "$1" ] || exit 0
+cd "$1" || exit
+if command -v sha256sum >/dev/null 2>&1; then
+	exec find . -type f -exec sha256sum {} +
+fi
+exec find . -type f -exec shasum -a 256 {} +`
+
+// checksums streams the checksums of a directory read through the execer
+// followed by the result.
+func checksums(ctx context.Context, execer Execer, header proto.ClientChecksumsHeader, conn io.Writer) error {
+	process, err := execer.Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", checksumsScript, "sh", header.Path},
+		UID:     header.UID,
+		GID:     header.GID,
+	})
+	if err != nil {
+		err = codeErrorf(CodeTransferFailed, "checksum %s: %w", header.Path, err)
+		return sendResult(ctx, err, conn)
+	}
+	stderr := captureAll(process.Stderr())
+	err = copyWithHeader(process.Stdout(), conn, proto.Header{Type: proto.TypeFileData})
+	if err != nil {
+		_, _ = io.Copy(ioutil.Discard, process.Stdout())
+	}
+	waitErr := process.Wait()
+	if err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		err = transferError("checksum", header.Path, err, <-stderr)
+	}
+	return sendResult(ctx, err, conn)
+}
@@ -0,0 +1,78 @@
+package wsep
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestSync(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	local := tempDir(t)
+	writeFile(t, filepath.Join(local, "same"), "same")
+	writeFile(t, filepath.Join(local, "changed"), "new")
+	writeFile(t, filepath.Join(local, "nested", "added"), "added")
+	writeFile(t, filepath.Join(local, "debug.log"), "excluded")
+	writeFile(t, filepath.Join(local, ".git", "HEAD"), "excluded")
+
+	remote := filepath.Join(tempDir(t), "remote")
+	writeFile(t, filepath.Join(remote, "same"), "same")
+	writeFile(t, filepath.Join(remote, "changed"), "old")
+	writeFile(t, filepath.Join(remote, "extra"), "extra")
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+	execer := RemoteExecer(ws)
+
+	var synced []string
+	err := execer.(DirSyncer).Sync(ctx, local, remote, &SyncOptions{
+		Exclude: []string{".git", "*.log"},
+		Synced: func(path string) {
+			synced = append(synced, path)
+		},
+	})
+	assert.Success(t, "sync", err)
+	sort.Strings(synced)
+	assert.Equal(t, "synced files", []string{"changed", "nested/added"}, synced)
+
+	for name, want := range map[string]string{
+		"same":         "same",
+		"changed":      "new",
+		"nested/added": "added",
+		"extra":        "extra",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(remote, filepath.FromSlash(name)))
+		assert.Success(t, "read "+name, err)
+		assert.Equal(t, name, want, string(got))
+	}
+	_, err = os.Stat(filepath.Join(remote, "debug.log"))
+	assert.True(t, "excluded file", os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(remote, ".git"))
+	assert.True(t, "excluded directory", os.IsNotExist(err))
+}
+
+func TestParseChecksums(t *testing.T) {
+	t.Parallel()
+
+	sum := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	sums := parseChecksums(strings.NewReader(sum + "  ./a/b\n" + sum + " *./c\ngarbage\n"))
+	assert.Equal(t, "checksums", map[string]string{"a/b": sum, "c": sum}, sums)
+}
+
+func writeFile(t *testing.T, name, contents string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(name), 0o755)
+	assert.Success(t, "mkdir", err)
+	err = ioutil.WriteFile(name, []byte(contents), 0o644)
+	assert.Success(t, "write file", err)
+}
@@ -0,0 +1,44 @@
+package wsep
+
+import (
+	"sync"
+	"time"
+)
+
+// drainTimeout bounds how long serving a connection waits for its goroutines
+// once it ends.  They all stop with the connection's context, so this only
+// guards against a process that ignores it.
+const drainTimeout = 5 * time.Second
+
+// taskGroup tracks the goroutines serving a connection so that serving it
+// does not return while they still use the connection.
+type taskGroup struct {
+	wg sync.WaitGroup
+}
+
+// Go runs f in a goroutine tracked by the group.
+func (g *taskGroup) Go(f func()) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		f()
+	}()
+}
+
+// wait waits up to timeout for the group's goroutines to finish and returns
+// whether they did.
+func (g *taskGroup) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,108 @@
+package wsep
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// TerminalModes are settings of a TTY command's terminal, like the modes of an
+// SSH pty-req.  Flags such as "echo", "icanon" and "isig" are on when
+// non-zero.  Control characters such as "verase" and "vintr" are set to the
+// character with the code, or disabled when it is zero or 255.  Unknown modes
+// are ignored.
+type TerminalModes map[string]uint32
+
+// terminalFlags and terminalChars are the modes that can be set, with the
+// names stty knows them by.
+var (
+	terminalFlags = []string{
+		"echo", "echoe", "echok", "echonl", "echoctl", "echoke", "icanon", "iexten", "isig", "noflsh", "tostop",
+		"icrnl", "igncr", "inlcr", "istrip", "ixon", "ixoff", "ixany", "imaxbel", "iutf8",
+		"opost", "onlcr", "ocrnl", "onocr", "onlret",
+	}
+	terminalChars = map[string]string{
+		"vintr":    "intr",
+		"vquit":    "quit",
+		"verase":   "erase",
+		"vkill":    "kill",
+		"veof":     "eof",
+		"veol":     "eol",
+		"veol2":    "eol2",
+		"vstart":   "start",
+		"vstop":    "stop",
+		"vsusp":    "susp",
+		"vreprint": "rprnt",
+		"vwerase":  "werase",
+		"vlnext":   "lnext",
+	}
+)
+
+// terminalModer is implemented by processes whose terminal modes can be
+// changed while they run.
+type terminalModer interface {
+	SetTerminalModes(ctx context.Context, modes TerminalModes) error
+}
+
+// SetTerminalModes changes the modes of the terminal of a TTY process, for
+// example to turn echo off while a password is typed.  Processes started by
+// remote execers and TTY processes started by LocalExecer on Linux and macOS
+// support it; sessions keep the modes they started with.
+func SetTerminalModes(ctx context.Context, p Process, modes TerminalModes) error {
+	m, ok := p.(terminalModer)
+	if !ok {
+		return xerrors.Errorf("%T cannot set terminal modes", p)
+	}
+	return m.SetTerminalModes(ctx, modes)
+}
+
+// sttySettings returns the modes as arguments to stty, one setting each.
+// Control characters are written in caret notation, which every stty
+// understands, and printable ones are skipped.
+func sttySettings(modes TerminalModes) []string {
+	var settings []string
+	for _, name := range terminalFlags {
+		value, ok := modes[name]
+		if !ok {
+			continue
+		}
+		if value == 0 {
+			name = "-" + name
+		}
+		settings = append(settings, name)
+	}
+	for mode, name := range terminalChars {
+		value, ok := modes[mode]
+		switch {
+		case !ok:
+		case value == 0 || value == 255:
+			settings = append(settings, name+" undef")
+		case value < 32:
+			settings = append(settings, name+" ^"+string(rune(value+'@')))
+		case value == 127:
+			settings = append(settings, name+" ^?")
+		}
+	}
+	sort.Strings(settings)
+	return settings
+}
+
+// terminalModesScript runs stty with each setting in $1, separated by commas,
+// then runs its remaining arguments.  Settings stty does not know are skipped.
+const terminalModesScript = `set -f; IFS=,; for s in $1; do IFS=' '; stty $s 2>/dev/null; done; shift; exec "$@"`
+
+// terminalModesCommand rewrites a TTY command with TerminalModes set to set
+// them with stty before it runs, for execers that cannot set them themselves.
+// It must not have an empty Command.
+func terminalModesCommand(c Command) Command {
+	if !c.TTY || len(c.TerminalModes) == 0 {
+		return c
+	}
+	settings := strings.Join(sttySettings(c.TerminalModes), ",")
+	c.Args = append([]string{"-c", terminalModesScript, "sh", settings, c.Command}, c.Args...)
+	c.Command = "/bin/sh"
+	c.TerminalModes = nil
+	return c
+}
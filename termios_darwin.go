@@ -0,0 +1,18 @@
+//go:build darwin
+// +build darwin
+
+package wsep
+
+import (
+	"syscall"
+)
+
+// tcflag is the type of the flag fields of syscall.Termios.
+type tcflag = uint64
+
+const (
+	ioctlGetTermios = syscall.TIOCGETA
+	ioctlSetTermios = syscall.TIOCSETA
+	// vdisable disables a control character.
+	vdisable = 0xff
+)
@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package wsep
+
+import (
+	"syscall"
+)
+
+// tcflag is the type of the flag fields of syscall.Termios.
+type tcflag = uint32
+
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+	// vdisable disables a control character.
+	vdisable = 0
+)
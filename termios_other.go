@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package wsep
+
+import (
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+// setTerminalModes is only implemented on Linux and macOS.
+func setTerminalModes(_ *os.File, _ TerminalModes) error {
+	return xerrors.New("terminal modes are not supported on this platform")
+}
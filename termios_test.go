@@ -0,0 +1,19 @@
+package wsep
+
+import (
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestSttySettings(t *testing.T) {
+	t.Parallel()
+
+	settings := sttySettings(TerminalModes{"echo": 0, "icanon": 1, "verase": 127, "vintr": 3, "vsusp": 0, "veof": 'x', "bogus": 1})
+	assert.Equal(t, "settings", []string{"-echo", "erase ^?", "icanon", "intr ^C", "susp undef"}, settings)
+
+	command := terminalModesCommand(Command{Command: "vim", Args: []string{"file"}, TTY: true, TerminalModes: TerminalModes{"echo": 0}})
+	assert.Equal(t, "command", "/bin/sh", command.Command)
+	assert.Equal(t, "args", []string{"-c", terminalModesScript, "sh", "-echo", "vim", "file"}, command.Args)
+	assert.Equal(t, "no tty", Command{Command: "ls"}, terminalModesCommand(Command{Command: "ls"}))
+}
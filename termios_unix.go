@@ -0,0 +1,111 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package wsep
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/xerrors"
+)
+
+// termiosFlag is a flag in one of the flag fields of termios.
+type termiosFlag struct {
+	field func(t *syscall.Termios) *tcflag
+	bit   tcflag
+}
+
+var (
+	iflag = func(t *syscall.Termios) *tcflag { return &t.Iflag }
+	oflag = func(t *syscall.Termios) *tcflag { return &t.Oflag }
+	lflag = func(t *syscall.Termios) *tcflag { return &t.Lflag }
+
+	termiosFlags = map[string]termiosFlag{
+		"echo":    {lflag, syscall.ECHO},
+		"echoe":   {lflag, syscall.ECHOE},
+		"echok":   {lflag, syscall.ECHOK},
+		"echonl":  {lflag, syscall.ECHONL},
+		"echoctl": {lflag, syscall.ECHOCTL},
+		"echoke":  {lflag, syscall.ECHOKE},
+		"icanon":  {lflag, syscall.ICANON},
+		"iexten":  {lflag, syscall.IEXTEN},
+		"isig":    {lflag, syscall.ISIG},
+		"noflsh":  {lflag, syscall.NOFLSH},
+		"tostop":  {lflag, syscall.TOSTOP},
+		"icrnl":   {iflag, syscall.ICRNL},
+		"igncr":   {iflag, syscall.IGNCR},
+		"inlcr":   {iflag, syscall.INLCR},
+		"istrip":  {iflag, syscall.ISTRIP},
+		"ixon":    {iflag, syscall.IXON},
+		"ixoff":   {iflag, syscall.IXOFF},
+		"ixany":   {iflag, syscall.IXANY},
+		"imaxbel": {iflag, syscall.IMAXBEL},
+		"iutf8":   {iflag, syscall.IUTF8},
+		"opost":   {oflag, syscall.OPOST},
+		"onlcr":   {oflag, syscall.ONLCR},
+		"ocrnl":   {oflag, syscall.OCRNL},
+		"onocr":   {oflag, syscall.ONOCR},
+		"onlret":  {oflag, syscall.ONLRET},
+	}
+	termiosChars = map[string]int{
+		"vintr":    syscall.VINTR,
+		"vquit":    syscall.VQUIT,
+		"verase":   syscall.VERASE,
+		"vkill":    syscall.VKILL,
+		"veof":     syscall.VEOF,
+		"veol":     syscall.VEOL,
+		"veol2":    syscall.VEOL2,
+		"vstart":   syscall.VSTART,
+		"vstop":    syscall.VSTOP,
+		"vsusp":    syscall.VSUSP,
+		"vreprint": syscall.VREPRINT,
+		"vwerase":  syscall.VWERASE,
+		"vlnext":   syscall.VLNEXT,
+	}
+)
+
+// setTerminalModes changes the modes of the terminal f is either side of.
+func setTerminalModes(f *os.File, modes TerminalModes) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		var t syscall.Termios
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlGetTermios, uintptr(unsafe.Pointer(&t)))
+		if errno != 0 {
+			return
+		}
+		applyTerminalModes(&t, modes)
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlSetTermios, uintptr(unsafe.Pointer(&t)))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return xerrors.Errorf("set terminal modes: %w", errno)
+	}
+	return nil
+}
+
+// applyTerminalModes sets the modes in t.
+func applyTerminalModes(t *syscall.Termios, modes TerminalModes) {
+	for name, value := range modes {
+		if flag, ok := termiosFlags[name]; ok {
+			if value != 0 {
+				*flag.field(t) |= flag.bit
+			} else {
+				*flag.field(t) &^= flag.bit
+			}
+		}
+		if index, ok := termiosChars[name]; ok {
+			if value == 0 || value == 255 {
+				value = vdisable
+			}
+			t.Cc[index] = uint8(value)
+		}
+	}
+}
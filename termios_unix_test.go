@@ -0,0 +1,35 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package wsep
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestLocalTerminalModes(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	process, err := LocalExecer{}.Start(ctx, Command{
+		Command:       "stty",
+		Args:          []string{"-a"},
+		TTY:           true,
+		Rows:          24,
+		Cols:          200,
+		TerminalModes: TerminalModes{"echo": 0, "icanon": 1},
+	})
+	assert.Success(t, "start", err)
+	output, _ := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "wait", process.Wait())
+	fields := strings.Fields(string(output))
+	assert.True(t, "echo off", contains(fields, "-echo"))
+	assert.True(t, "icanon on", contains(fields, "icanon"))
+}
@@ -0,0 +1,133 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// throughputSize is how much data each throughput benchmark iteration moves.
+const throughputSize = 16 << 20
+
+// pipeExecer returns an execer served by a local server over an in-memory
+// stream so benchmarks measure wsep rather than the network.  The server stops
+// once the started process is closed.
+func pipeExecer(ctx context.Context) Execer {
+	client, server := net.Pipe()
+	go func() {
+		_ = NewServer().ServeStream(ctx, server, LocalExecer{}, nil)
+	}()
+	return RemoteStreamExecer(client)
+}
+
+func BenchmarkStdoutThroughput(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.SetBytes(throughputSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		process, err := pipeExecer(ctx).Start(ctx, Command{
+			Command: "head",
+			Args:    []string{"-c", fmt.Sprint(throughputSize), "/dev/zero"},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, process.Stderr())
+		}()
+		n, _ := io.Copy(ioutil.Discard, process.Stdout())
+		if n != throughputSize {
+			b.Fatalf("read %d bytes of stdout, expected %d", n, throughputSize)
+		}
+		err = process.Wait()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStdinThroughput(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chunk := make([]byte, 32*1024)
+	b.SetBytes(throughputSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		process, err := pipeExecer(ctx).Start(ctx, Command{
+			Command: "sh",
+			Args:    []string{"-c", "cat > /dev/null"},
+			Stdin:   true,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, process.Stderr())
+		}()
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, process.Stdout())
+		}()
+		for written := 0; written < throughputSize; written += len(chunk) {
+			_, err = process.Stdin().Write(chunk)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		err = process.Stdin().Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = process.Wait()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTTYEcho measures the round trip of a keystroke through a terminal
+// that echoes it straight back.
+func BenchmarkTTYEcho(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	process, err := pipeExecer(ctx).Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", "stty raw -echo && echo ready && cat"},
+		TTY:     true,
+		Stdin:   true,
+		Rows:    defaultRows,
+		Cols:    defaultCols,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer process.Close()
+
+	// Wait for the terminal to be raw so every byte comes back on its own.
+	var output []byte
+	key := make([]byte, 1)
+	for !bytes.Contains(output, []byte("ready\n")) {
+		_, err = io.ReadFull(process.Stdout(), key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		output = append(output, key[0])
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = process.Stdin().Write([]byte{'x'})
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = io.ReadFull(process.Stdout(), key)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+//go:build windows
+// +build windows
+
+package wsep
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	advapi32                    = syscall.NewLazyDLL("advapi32.dll")
+	procLogonUserW              = advapi32.NewProc("LogonUserW")
+	userenv                     = syscall.NewLazyDLL("userenv.dll")
+	procCreateEnvironmentBlock  = userenv.NewProc("CreateEnvironmentBlock")
+	procDestroyEnvironmentBlock = userenv.NewProc("DestroyEnvironmentBlock")
+)
+
+const (
+	logon32LogonInteractive = 2
+	logon32ProviderDefault  = 0
+)
+
+// logon logs the user on and returns their primary token, which the caller
+// must close.
+func (w *WindowsCredentials) logon() (syscall.Token, error) {
+	username, err := syscall.UTF16PtrFromString(w.Username)
+	if err != nil {
+		return 0, xerrors.Errorf("convert username: %w", err)
+	}
+	// A nil domain lets the username be a UPN like user@example.com.
+	var domain *uint16
+	if w.Domain != "" {
+		domain, err = syscall.UTF16PtrFromString(w.Domain)
+		if err != nil {
+			return 0, xerrors.Errorf("convert domain: %w", err)
+		}
+	}
+	password, err := syscall.UTF16PtrFromString(w.Password)
+	if err != nil {
+		return 0, xerrors.Errorf("convert password: %w", err)
+	}
+	var token syscall.Token
+	ok, _, err := procLogonUserW.Call(
+		uintptr(unsafe.Pointer(username)),
+		uintptr(unsafe.Pointer(domain)),
+		uintptr(unsafe.Pointer(password)),
+		logon32LogonInteractive,
+		logon32ProviderDefault,
+		uintptr(unsafe.Pointer(&token)),
+	)
+	if ok == 0 {
+		return 0, err
+	}
+	return token, nil
+}
+
+// userEnvironment returns the default environment of the user a token belongs
+// to, without any of this process' variables.
+func userEnvironment(token syscall.Token) ([]string, error) {
+	var block *uint16
+	ok, _, err := procCreateEnvironmentBlock.Call(uintptr(unsafe.Pointer(&block)), uintptr(token), 0)
+	if ok == 0 {
+		return nil, xerrors.Errorf("create environment block: %w", err)
+	}
+	defer procDestroyEnvironmentBlock.Call(uintptr(unsafe.Pointer(block)))
+
+	// The block is a sequence of NUL terminated variables ending with an empty
+	// one.
+	var env []string
+	p := unsafe.Pointer(block)
+	for {
+		var n uintptr
+		for *(*uint16)(unsafe.Pointer(uintptr(p) + n*2)) != 0 {
+			n++
+		}
+		if n == 0 {
+			return env, nil
+		}
+		env = append(env, syscall.UTF16ToString((*[1 << 29]uint16)(p)[:n:n]))
+		p = unsafe.Pointer(uintptr(p) + (n+1)*2)
+	}
+}
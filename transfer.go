@@ -0,0 +1,333 @@
+package wsep
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+// FileTransferer is implemented by remote execers to copy files to and from
+// the remote over the same connection.  Like SessionAdmin the methods may be
+// called any number of times before a command is started.
+type FileTransferer interface {
+	// Upload writes the contents of r to path on the remote, creating any
+	// missing parent directories.  The file is replaced atomically.
+	Upload(ctx context.Context, r io.Reader, path string, opts *TransferOptions) error
+	// Download writes the contents of path on the remote to w.
+	Download(ctx context.Context, path string, w io.Writer, opts *TransferOptions) error
+}
+
+// TransferOptions configures a file transfer.
+type TransferOptions struct {
+	// Mode sets the permissions of uploaded files.  Defaults to 0644.
+	Mode os.FileMode
+	// UID and GID set the user the transfer runs as on the remote which also
+	// determines the ownership of uploaded files.
+	UID uint32
+	GID uint32
+	// Progress is called after each chunk with the number of bytes transferred
+	// so far and the total size or -1 if it is unknown.
+	Progress func(transferred, total int64)
+}
+
+// Upload writes the contents of r to path on the remote.
+func (r remoteExec) Upload(ctx context.Context, reader io.Reader, path string, opts *TransferOptions) error {
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	mode := opts.Mode
+	if mode == 0 {
+		mode = 0o644
+	}
+	header, err := json.Marshal(proto.ClientUploadHeader{
+		Type: proto.TypeUpload,
+		Path: path,
+		Mode: uint32(mode.Perm()),
+		UID:  opts.UID,
+		GID:  opts.GID,
+	})
+	if err != nil {
+		return err
+	}
+	err = r.conn.Write(ctx, header)
+	if err != nil {
+		return err
+	}
+
+	dataHeader, err := json.Marshal(proto.Header{Type: proto.TypeFileData})
+	if err != nil {
+		return err
+	}
+	writer := proto.WithHeader(connWriter{ctx: ctx, conn: r.conn}, dataHeader)
+	buf := make([]byte, maxMessageSize-len(dataHeader)-1)
+	var transferred int64
+	for {
+		n, readErr := reader.Read(buf)
+		if n > 0 {
+			_, err = writer.Write(buf[:n])
+			if err != nil {
+				return err
+			}
+			transferred += int64(n)
+			if opts.Progress != nil {
+				opts.Progress(transferred, -1)
+			}
+		}
+		if xerrors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			// Abort rather than leave the connection mid-upload so it remains
+			// usable.  The destination is left untouched.
+			_ = r.request(ctx, proto.ClientFileEndHeader{Type: proto.TypeFileEnd, Abort: true})
+			return xerrors.Errorf("read upload: %w", readErr)
+		}
+	}
+
+	return r.request(ctx, proto.ClientFileEndHeader{Type: proto.TypeFileEnd})
+}
+
+// Download writes the contents of path on the remote to w.
+func (r remoteExec) Download(ctx context.Context, path string, w io.Writer, opts *TransferOptions) error {
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+	header, err := json.Marshal(proto.ClientDownloadHeader{
+		Type: proto.TypeDownload,
+		Path: path,
+		UID:  opts.UID,
+		GID:  opts.GID,
+	})
+	if err != nil {
+		return err
+	}
+	err = r.conn.Write(ctx, header)
+	if err != nil {
+		return err
+	}
+	return r.receiveFile(ctx, w, opts.Progress)
+}
+
+// receiveFile writes the file data the server sends in response to a request
+// to w until the result arrives.
+func (r remoteExec) receiveFile(ctx context.Context, w io.Writer, progress func(transferred, total int64)) error {
+	var (
+		transferred int64
+		total       int64 = -1
+	)
+	for {
+		payload, err := r.conn.Read(ctx)
+		if err != nil {
+			return xerrors.Errorf("read download: %w", err)
+		}
+		headerByt, body := proto.SplitMessage(payload)
+		var header proto.Header
+		err = json.Unmarshal(headerByt, &header)
+		if err != nil {
+			return xerrors.Errorf("failed to parse download message: %w", err)
+		}
+
+		switch header.Type {
+		case proto.TypeFileInfo:
+			var info proto.ServerFileInfoHeader
+			err = json.Unmarshal(headerByt, &info)
+			if err != nil {
+				return xerrors.Errorf("failed to parse file info message: %w", err)
+			}
+			total = info.Size
+		case proto.TypeFileData:
+			_, err = w.Write(body)
+			if err != nil {
+				// The rest of the download must still be read so the connection
+				// remains usable.
+				_ = drainDownload(ctx, r.conn)
+				return xerrors.Errorf("write download: %w", err)
+			}
+			transferred += int64(len(body))
+			if progress != nil {
+				progress(transferred, total)
+			}
+		case proto.TypeResult, proto.TypeError:
+			return parseResult(headerByt)
+		}
+	}
+}
+
+// drainDownload discards the rest of a download.
+func drainDownload(ctx context.Context, c conn) error {
+	for {
+		payload, err := c.Read(ctx)
+		if err != nil {
+			return err
+		}
+		headerByt, _ := proto.SplitMessage(payload)
+		var header proto.Header
+		err = json.Unmarshal(headerByt, &header)
+		if err != nil {
+			return err
+		}
+		if header.Type == proto.TypeResult || header.Type == proto.TypeError {
+			return nil
+		}
+	}
+}
+
+// uploadScript writes stdin to a temporary file next to the destination then
+// moves it into place so readers never see a partial file.
+const uploadScript = `dir=$(dirname "$1") && mkdir -p "$dir" || exit
+tmp="$1.wsep-upload.$$"
+umask 077
+if cat > "$tmp" && chmod "$2" "$tmp" && mv -f "$tmp" "$1"; then exit 0; fi
+rm -f "$tmp"
+exit 1`
+
+// downloadScript prints the size of the file on the first line followed by
+// its contents.
+const downloadScript = `wc -c < "$1" && exec cat -- "$1"`
+
+// fileUpload is an upload in progress on the server.
+type fileUpload struct {
+	path    string
+	process Process
+	stderr  <-chan string
+	// err is set if the upload failed, in which case any further data is
+	// discarded.
+	err error
+}
+
+// startUpload starts writing a file through the execer.
+func startUpload(ctx context.Context, execer Execer, header proto.ClientUploadHeader) *fileUpload {
+	upload := &fileUpload{path: header.Path}
+	upload.process, upload.err = execer.Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", uploadScript, "sh", header.Path, fmt.Sprintf("%o", header.Mode)},
+		Stdin:   true,
+		UID:     header.UID,
+		GID:     header.GID,
+	})
+	if upload.err != nil {
+		return upload
+	}
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, upload.process.Stdout())
+	}()
+	upload.stderr = captureAll(upload.process.Stderr())
+	return upload
+}
+
+// write writes a chunk of the file.
+func (u *fileUpload) write(body []byte) {
+	if u.err != nil {
+		return
+	}
+	_, err := u.process.Stdin().Write(body)
+	if err != nil {
+		u.err = err
+	}
+}
+
+// finish waits for the file to be written.
+func (u *fileUpload) finish() error {
+	if u.process == nil {
+		return codeErrorf(CodeTransferFailed, "upload %s: %w", u.path, u.err)
+	}
+	_ = u.process.Stdin().Close()
+	err := u.process.Wait()
+	stderr := <-u.stderr
+	if u.err == nil {
+		u.err = err
+	}
+	if u.err != nil {
+		return transferError("upload", u.path, u.err, stderr)
+	}
+	return nil
+}
+
+// abort stops an unfinished upload, leaving the destination untouched.
+func (u *fileUpload) abort() error {
+	if u.process != nil {
+		_ = u.process.Close()
+	}
+	return codeErrorf(CodeTransferFailed, "upload %s: aborted", u.path)
+}
+
+// streamDownload streams a file read through the execer.  The caller must send
+// the result.
+func streamDownload(ctx context.Context, execer Execer, header proto.ClientDownloadHeader, conn io.Writer) error {
+	process, err := execer.Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", downloadScript, "sh", header.Path},
+		UID:     header.UID,
+		GID:     header.GID,
+	})
+	if err != nil {
+		return codeErrorf(CodeTransferFailed, "download %s: %w", header.Path, err)
+	}
+	stderr := captureAll(process.Stderr())
+	stdout := bufio.NewReader(process.Stdout())
+
+	size, err := stdout.ReadString('\n')
+	if err == nil {
+		var info []byte
+		info, err = json.Marshal(proto.ServerFileInfoHeader{Type: proto.TypeFileInfo, Size: parseSize(size)})
+		if err == nil {
+			_, err = proto.WithHeader(conn, info).Write(nil)
+		}
+		if err == nil {
+			err = copyWithHeader(stdout, conn, proto.Header{Type: proto.TypeFileData})
+		}
+	}
+	if err != nil {
+		_, _ = io.Copy(ioutil.Discard, stdout)
+	}
+
+	waitErr := process.Wait()
+	if err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return transferError("download", header.Path, err, <-stderr)
+	}
+	return nil
+}
+
+func parseSize(line string) int64 {
+	size, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// transferError describes a failed transfer, preferring the error output of the
+// command since the exit code alone is not very helpful.
+func transferError(op, path string, err error, stderr string) error {
+	if stderr != "" {
+		return codeErrorf(CodeTransferFailed, "%s %s: %s", op, path, stderr)
+	}
+	return codeErrorf(CodeTransferFailed, "%s %s: %w", op, path, err)
+}
+
+// captureAll captures all of the reader's output up to a limit, trimmed of
+// surrounding whitespace.
+func captureAll(r io.Reader) <-chan string {
+	output := make(chan string, 1)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = io.Copy(&buf, io.LimitReader(r, 4096))
+		_, _ = io.Copy(ioutil.Discard, r)
+		output <- strings.TrimSpace(buf.String())
+	}()
+	return output
+}
@@ -0,0 +1,70 @@
+package wsep
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestTransfer(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, nil)
+	defer server.Close()
+	execer := RemoteExecer(ws)
+	transferer := execer.(FileTransferer)
+
+	// Larger than a single message so it must be chunked.
+	data := make([]byte, 3*maxMessageSize+123)
+	_, err := rand.Read(data)
+	assert.Success(t, "random data", err)
+
+	path := filepath.Join(tempDir(t), "nested", "file")
+	var uploaded int64
+	err = transferer.Upload(ctx, bytes.NewReader(data), path, &TransferOptions{
+		Mode: 0o600,
+		Progress: func(transferred, _ int64) {
+			uploaded = transferred
+		},
+	})
+	assert.Success(t, "upload", err)
+	assert.Equal(t, "upload progress", int64(len(data)), uploaded)
+
+	written, err := ioutil.ReadFile(path)
+	assert.Success(t, "read uploaded file", err)
+	assert.True(t, "uploaded contents", bytes.Equal(data, written))
+	info, err := os.Stat(path)
+	assert.Success(t, "stat uploaded file", err)
+	assert.Equal(t, "uploaded mode", os.FileMode(0o600), info.Mode().Perm())
+
+	var (
+		buf                     bytes.Buffer
+		downloaded, downloadLen int64
+	)
+	err = transferer.Download(ctx, path, &buf, &TransferOptions{
+		Progress: func(transferred, total int64) {
+			downloaded, downloadLen = transferred, total
+		},
+	})
+	assert.Success(t, "download", err)
+	assert.True(t, "downloaded contents", bytes.Equal(data, buf.Bytes()))
+	assert.Equal(t, "download progress", int64(len(data)), downloaded)
+	assert.Equal(t, "download total", int64(len(data)), downloadLen)
+
+	err = transferer.Download(ctx, filepath.Join(tempDir(t), "missing"), &buf, nil)
+	assert.Equal(t, "missing file", CodeTransferFailed, ErrorCode(err))
+
+	// The connection is still usable for a command afterward.
+	process, err := execer.Start(ctx, Command{Command: "true"})
+	assert.Success(t, "start command", err)
+	assert.Success(t, "wait command", process.Wait())
+}
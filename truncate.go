@@ -0,0 +1,90 @@
+package wsep
+
+import (
+	"io"
+	"sync"
+)
+
+// outputLimit is how much more output a command may send under
+// Options.MaxOutputBytes.  Its streams share it.
+type outputLimit struct {
+	mutex     sync.Mutex
+	remaining int64
+}
+
+// newOutputLimit returns a limit of max bytes, or nil if max is not positive.
+func newOutputLimit(max int64) *outputLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &outputLimit{remaining: max}
+}
+
+// take uses up to n bytes of the limit and returns how many of them may be
+// sent.
+func (l *outputLimit) take(n int) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+	}
+	l.remaining -= int64(n)
+	return n
+}
+
+// cappedReader reads a stream until its command's output limit is reached.
+// After that it keeps reading the stream so that the command is not blocked
+// on a full pipe, but only remembers the last tailSize bytes, and returns
+// io.EOF once the stream ends.
+type cappedReader struct {
+	r        io.Reader
+	limit    *outputLimit
+	tailSize int
+	// over is set once the limit is reached.
+	over bool
+	// tail is the most recent output read past the limit.
+	tail []byte
+	// skipped counts all output read past the limit, including the tail.
+	skipped int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.over {
+		return 0, c.drain(p)
+	}
+	n, err := c.r.Read(p)
+	allowed := c.limit.take(n)
+	if allowed < n {
+		c.over = true
+		c.keep(p[allowed:n])
+	}
+	return allowed, err
+}
+
+// drain reads the rest of the stream using p as a buffer.
+func (c *cappedReader) drain(p []byte) error {
+	for {
+		n, err := c.r.Read(p)
+		c.keep(p[:n])
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// keep records output read past the limit.
+func (c *cappedReader) keep(p []byte) {
+	c.skipped += int64(len(p))
+	if len(p) > c.tailSize {
+		p = p[len(p)-c.tailSize:]
+	}
+	c.tail = append(c.tail, p...)
+	if over := len(c.tail) - c.tailSize; over > 0 {
+		c.tail = append(c.tail[:0], c.tail[over:]...)
+	}
+}
+
+// dropped returns how much output past the limit is not in the tail.
+func (c *cappedReader) dropped() int64 {
+	return c.skipped - int64(len(c.tail))
+}
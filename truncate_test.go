@@ -0,0 +1,60 @@
+package wsep
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestCappedReader(t *testing.T) {
+	t.Parallel()
+
+	limit := newOutputLimit(4)
+	stdout := &cappedReader{r: strings.NewReader("abc"), limit: limit, tailSize: 2}
+	stderr := &cappedReader{r: strings.NewReader("defghij"), limit: limit, tailSize: 2}
+
+	// Streams share the limit.
+	out, err := ioutil.ReadAll(stdout)
+	assert.Success(t, "read stdout", err)
+	assert.Equal(t, "stdout", "abc", string(out))
+	assert.True(t, "stdout under limit", !stdout.over)
+
+	out, err = ioutil.ReadAll(stderr)
+	assert.Success(t, "read stderr", err)
+	assert.Equal(t, "stderr", "d", string(out))
+	assert.True(t, "stderr over limit", stderr.over)
+	assert.Equal(t, "tail", "ij", string(stderr.tail))
+	assert.Equal(t, "dropped", int64(4), stderr.dropped())
+
+	assert.True(t, "no limit", newOutputLimit(0) == nil)
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ws, server := mockConn(ctx, t, nil, &Options{MaxOutputBytes: 4, OutputTailBytes: 3})
+	defer server.Close()
+
+	truncated := make(chan string, 1)
+	process, err := RemoteExecer(ws).Start(ctx, Command{
+		Command: "printf",
+		Args:    []string{"0123456789abcdefghij"},
+		OnTruncate: func(stream string, dropped int64) {
+			truncated <- fmt.Sprintf("%s %d", stream, dropped)
+		},
+	})
+	assert.Success(t, "start command", err)
+	out, err := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.Success(t, "wait", process.Wait())
+
+	assert.Equal(t, "head and tail", "0123hij", string(out))
+	assert.Equal(t, "truncated", "stdout 13", <-truncated)
+}
@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"regexp"
 	"strings"
 	"sync"
@@ -61,7 +63,7 @@ func TestReconnectTTY(t *testing.T) {
 	})
 
 	t.Run("NoScreen", func(t *testing.T) {
-		t.Setenv("PATH", "/bin")
+		setenv(t, "PATH", "/bin")
 
 		// Run some output in a new session.
 		server := newServer(t)
@@ -145,6 +147,49 @@ func TestReconnectTTY(t *testing.T) {
 		assert.True(t, "find shell output", checkStdout(t, process3, expected, []string{}))
 	})
 
+	t.Run("AppHint", func(t *testing.T) {
+		t.Parallel()
+
+		server := newServer(t)
+		ctx, command := newSession(t)
+		command.AppHint = AppHintShell
+		process1, disconnect1 := connect(ctx, t, command, server, nil, "")
+		assert.Equal(t, "initial hint", AppHintShell, ProcessAppHint(process1))
+		disconnect1()
+
+		// Reattaching reports the hint the session was created with.
+		command.AppHint = AppHintREPL
+		process2, _ := connect(ctx, t, command, server, nil, "")
+		assert.Equal(t, "reconnected hint", AppHintShell, ProcessAppHint(process2))
+	})
+
+	t.Run("Freeze", func(t *testing.T) {
+		t.Parallel()
+
+		server := newServer(t)
+		ctx, command := newSession(t)
+		frozen := make(chan bool, 4)
+		command.OnFreeze = func(f bool) { frozen <- f }
+		process1, disconnect1 := connect(ctx, t, command, server, nil, "")
+		expected := writeUnique(t, process1)
+		assert.True(t, "find initial output", checkStdout(t, process1, expected, []string{}))
+
+		err := server.FreezeSession(command.ID)
+		assert.Success(t, "freeze", err)
+		assert.True(t, "frozen notification", <-frozen)
+
+		// The session should outlive its timeout while frozen.
+		disconnect1()
+		time.Sleep(2 * time.Second)
+		process2, _ := connect(ctx, t, command, server, nil, "")
+		assert.True(t, "frozen on attach", <-frozen)
+
+		err = server.ThawSession(command.ID)
+		assert.Success(t, "thaw", err)
+		assert.Equal(t, "thawed notification", false, <-frozen)
+		assert.True(t, "find reconnected output", checkStdout(t, process2, expected, []string{}))
+	})
+
 	t.Run("Simultaneous", func(t *testing.T) {
 		t.Parallel()
 
@@ -183,6 +228,31 @@ func newServer(t *testing.T) *Server {
 	return server
 }
 
+// tempDir returns a new directory that is removed once the test finishes.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wsep")
+	assert.Success(t, "create temp dir", err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// setenv sets an environment variable until the test finishes.  Tests that
+// call it must not run in parallel.
+func setenv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	err := os.Setenv(key, value)
+	assert.Success(t, "set "+key, err)
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, previous)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
 // newSession returns a command for starting/attaching to a session with a
 // context for timing out.
 func newSession(t *testing.T) (context.Context, Command) {
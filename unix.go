@@ -0,0 +1,40 @@
+package wsep
+
+import (
+	"context"
+	"net"
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+// ListenUnix listens on a unix socket at the provided path for use with
+// Server.ServeListener.  Any stale socket at the path is removed first and the
+// socket is only accessible by the current user.
+func ListenUnix(path string) (net.Listener, error) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, xerrors.Errorf("remove stale socket: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0o600)
+	if err != nil {
+		_ = l.Close()
+		return nil, xerrors.Errorf("chmod socket: %w", err)
+	}
+	return l, nil
+}
+
+// DialUnix connects to a wsep server listening on a unix socket.  Like
+// RemoteExecer the returned execer can start a single command.
+func DialUnix(ctx context.Context, path string) (Execer, error) {
+	var dialer net.Dialer
+	nc, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return RemoteStreamExecer(nc), nil
+}
@@ -0,0 +1,94 @@
+package wsep
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+// unixExecer serves wsep on a unix socket and returns a function that dials a
+// new execer for each call.
+func unixExecer(ctx context.Context, t *testing.T) func() Execer {
+	path := filepath.Join(tempDir(t), "wsep.sock")
+	l, err := ListenUnix(path)
+	assert.Success(t, "listen", err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	wsepServer := newServer(t)
+	go func() {
+		_ = wsepServer.ServeListener(ctx, l, LocalExecer{}, nil)
+	}()
+	t.Cleanup(cancel)
+
+	return func() Execer {
+		execer, err := DialUnix(ctx, path)
+		assert.Success(t, "dial", err)
+		return execer
+	}
+}
+
+func TestUnixExec(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	dial := unixExecer(ctx, t)
+	testExecer(ctx, t, dial())
+	testExecerFail(ctx, t, dial())
+}
+
+func TestUnixClose(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	process, err := unixExecer(ctx, t)().Start(ctx, Command{
+		Command: "sh",
+		TTY:     true,
+		Stdin:   true,
+		Rows:    defaultRows,
+		Cols:    defaultCols,
+		Env:     []string{"TERM=linux"},
+	})
+	assert.Success(t, "start command", err)
+
+	expected := writeUnique(t, process)
+	assert.True(t, "find output", checkStdout(t, process, expected, []string{}))
+
+	err = process.Close()
+	assert.Success(t, "close process", err)
+	assert.Success(t, "context", ctx.Err())
+}
+
+func TestUnixExitCode(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	process, err := unixExecer(ctx, t)().Start(ctx, Command{
+		Command: "sh",
+		Args:    []string{"-c", "cat; exit 4"},
+		Stdin:   true,
+	})
+	assert.Success(t, "start command", err)
+	go io.Copy(ioutil.Discard, process.Stderr())
+
+	_, err = process.Stdin().Write([]byte("hello"))
+	assert.Success(t, "write stdin", err)
+	err = process.Stdin().Close()
+	assert.Success(t, "close stdin", err)
+
+	stdout, err := ioutil.ReadAll(process.Stdout())
+	assert.Success(t, "read stdout", err)
+	assert.Equal(t, "stdout", "hello", string(stdout))
+
+	err = process.Wait()
+	exitErr, ok := err.(ExitError)
+	assert.True(t, "is exit error", ok)
+	assert.Equal(t, "exit code", 4, exitErr.ExitCode())
+}
@@ -0,0 +1,210 @@
+//go:build !windows
+// +build !windows
+
+package wsep
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// defaultLoginPath is the PATH of users whose login shell does not report
+	// one, as login(1) sets it.
+	defaultLoginPath = "/usr/local/bin:/usr/bin:/bin"
+	// defaultLoginShell is the shell of users whose passwd entry names none.
+	defaultLoginShell = "/bin/sh"
+	// loginPathTimeout bounds how long a login shell may take to report its
+	// PATH.
+	loginPathTimeout = 5 * time.Second
+	// loginPathTTL is how long the PATH of a user's login shell is reused
+	// before it is asked for again.
+	loginPathTTL = time.Minute
+)
+
+// targetUser is the account a command that switches UID runs as.
+type targetUser struct {
+	uid   uint32
+	gid   uint32
+	name  string
+	home  string
+	shell string
+	// path is the PATH the user's login shell sets.
+	path string
+}
+
+// lookupTargetUser returns the account of uid, or false if it has no passwd
+// entry.  gid is the group the user's login shell runs as to report its PATH.
+func lookupTargetUser(ctx context.Context, uid, gid uint32) (targetUser, bool) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return targetUser{}, false
+	}
+	target := targetUser{
+		uid:   uid,
+		gid:   gid,
+		name:  u.Username,
+		home:  u.HomeDir,
+		shell: loginShell(u.Username),
+	}
+	target.path = loginPaths.get(ctx, target)
+	return target, true
+}
+
+// environ returns the variables a login shell of the user starts with.
+func (u targetUser) environ() []string {
+	return []string{
+		"HOME=" + u.home,
+		"USER=" + u.name,
+		"LOGNAME=" + u.name,
+		"SHELL=" + u.shell,
+		"PATH=" + u.path,
+	}
+}
+
+// loginShell returns the login shell /etc/passwd lists for the user, or
+// defaultLoginShell if it lists none.
+func loginShell(name string) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return defaultLoginShell
+	}
+	defer f.Close()
+	if shell := passwdShell(f, name); shell != "" {
+		return shell
+	}
+	return defaultLoginShell
+}
+
+// currentLoginShell returns the login shell of the user running this process,
+// falling back to SHELL if the user cannot be looked up.
+func currentLoginShell() string {
+	u, err := user.Current()
+	if err != nil {
+		if shell := os.Getenv("SHELL"); shell != "" {
+			return shell
+		}
+		return defaultLoginShell
+	}
+	return loginShell(u.Username)
+}
+
+// userName returns the name of the user a command with uid runs as, where 0 is
+// the user running this process, or the UID itself if the user has no name.
+func userName(uid uint32) string {
+	if uid == 0 {
+		uid = uint32(os.Geteuid())
+	}
+	id := strconv.FormatUint(uint64(uid), 10)
+	u, err := user.LookupId(id)
+	if err != nil {
+		return id
+	}
+	return u.Username
+}
+
+// passwdShell returns the login shell of a user from a file in the format of
+// /etc/passwd, or an empty string if the user or their shell is not listed.
+func passwdShell(r io.Reader, name string) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == name {
+			return fields[6]
+		}
+	}
+	return ""
+}
+
+// loginPaths remembers the PATH each user's login shell sets since starting a
+// login shell for every command would be slow.
+var loginPaths = &loginPathCache{entries: map[uint32]loginPathEntry{}}
+
+type loginPathCache struct {
+	mutex   sync.Mutex
+	entries map[uint32]loginPathEntry
+}
+
+type loginPathEntry struct {
+	path    string
+	expires time.Time
+}
+
+// get returns the PATH the user's login shell sets, asking the shell if it is
+// not remembered.
+func (c *loginPathCache) get(ctx context.Context, u targetUser) string {
+	c.mutex.Lock()
+	entry, ok := c.entries[u.uid]
+	c.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.path
+	}
+	path := loginPath(ctx, u)
+	c.mutex.Lock()
+	c.entries[u.uid] = loginPathEntry{path: path, expires: time.Now().Add(loginPathTTL)}
+	c.mutex.Unlock()
+	return path
+}
+
+// loginPath runs the user's shell as a login shell to read the PATH its
+// profile sets, falling back to defaultLoginPath.
+func loginPath(ctx context.Context, u targetUser) string {
+	ctx, cancel := context.WithTimeout(ctx, loginPathTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, u.shell, "-c", "printenv PATH")
+	// A leading dash makes the shell a login shell, which every shell
+	// understands unlike the flags for it.
+	cmd.Args[0] = "-" + filepath.Base(u.shell)
+	// The profile starts from the PATH login(1) would give it.
+	u.path = defaultLoginPath
+	cmd.Env = u.environ()
+	cmd.Dir = u.home
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: u.uid, Gid: u.gid},
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return defaultLoginPath
+	}
+	// Profiles may print a banner so only the last line is the PATH.
+	lines := strings.Split(string(bytes.TrimSpace(out)), "\n")
+	path := strings.TrimSpace(lines[len(lines)-1])
+	if path == "" {
+		return defaultLoginPath
+	}
+	return path
+}
+
+// lookPathEnv finds a command the way exec.LookPath does but in the PATH of
+// env rather than this process'.
+func lookPathEnv(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	for _, dir := range filepath.SplitList(lookupEnv(env, "PATH")) {
+		// Relative directories would find commands in the working directory,
+		// which exec.LookPath also refuses.
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		name := filepath.Join(dir, file)
+		info, err := os.Stat(name)
+		if err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0o111 != 0 {
+			return name, nil
+		}
+	}
+	return "", xerrors.Errorf("%q: %w", file, exec.ErrNotFound)
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package wsep
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestPasswdShell(t *testing.T) {
+	t.Parallel()
+
+	passwd := "root:x:0:0:root:/root:/bin/bash\ncoder:x:1000:1000::/home/coder:/usr/bin/zsh\nbroken:x:1001\n"
+	assert.Equal(t, "root", "/bin/bash", passwdShell(strings.NewReader(passwd), "root"))
+	assert.Equal(t, "coder", "/usr/bin/zsh", passwdShell(strings.NewReader(passwd), "coder"))
+	assert.Equal(t, "broken", "", passwdShell(strings.NewReader(passwd), "broken"))
+	assert.Equal(t, "missing", "", passwdShell(strings.NewReader(passwd), "missing"))
+}
+
+func TestLoginShell(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "missing user", defaultLoginShell, loginShell("wsep-no-such-user"))
+	assert.True(t, "current user", currentLoginShell() != "")
+}
+
+func TestLookPathEnv(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "wsep")
+	assert.Success(t, "create temp dir", err)
+	defer os.RemoveAll(dir)
+	assert.Success(t, "write command", ioutil.WriteFile(filepath.Join(dir, "tool"), nil, 0o755))
+	assert.Success(t, "write file", ioutil.WriteFile(filepath.Join(dir, "data"), nil, 0o644))
+
+	// The last PATH wins as it does when the command runs.
+	env := []string{"PATH=/nonexistent", "PATH=relative:" + dir}
+	path, err := lookPathEnv("tool", env)
+	assert.Success(t, "find command", err)
+	assert.Equal(t, "path", filepath.Join(dir, "tool"), path)
+
+	_, err = lookPathEnv("data", env)
+	assert.True(t, "not executable", xerrors.Is(err, exec.ErrNotFound))
+
+	path, err = lookPathEnv("./tool", env)
+	assert.Success(t, "path with slash", err)
+	assert.Equal(t, "unchanged", "./tool", path)
+}
@@ -0,0 +1,150 @@
+package wsep
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+
+	"cdr.dev/wsep/internal/proto"
+)
+
+// Validation reports whether a command could start, checked without starting
+// it.
+type Validation struct {
+	// Command resolves to the path of the program that would run, which is
+	// the user's shell for commands that are empty or have Shell set.
+	Command Check
+	// WorkingDir resolves to the directory the command would start in.  It
+	// fails if the command would have to start somewhere else.
+	WorkingDir Check
+	// User resolves to the name of the user the command would run as.  It
+	// fails if the execer cannot switch to the command's UID and GID.
+	User Check
+}
+
+// Check is the outcome of one check of a Validation.
+type Check struct {
+	// Value is what the check resolved, such as the path of the command.
+	Value string
+	// Error says why the check failed and is empty if it passed.
+	Error string
+}
+
+// OK returns whether every check passed.
+func (v Validation) OK() bool {
+	return v.Command.Error == "" && v.WorkingDir.Error == "" && v.User.Error == ""
+}
+
+// CommandValidator is implemented by execers that can check whether a command
+// could start without starting it.
+type CommandValidator interface {
+	ValidateCommand(ctx context.Context, c Command) (Validation, error)
+}
+
+// ValidateCommand checks whether the execer could start c without running it,
+// for example to check a startup command a user configured before it is
+// needed.  Execers that do not implement CommandValidator are checked by
+// running a shell script as the command's user, which only requires sh, id and
+// command -v.  It only returns an error if the checks could not be made.
+func ValidateCommand(ctx context.Context, execer Execer, c Command) (Validation, error) {
+	if v, ok := execer.(CommandValidator); ok {
+		return v.ValidateCommand(ctx, c)
+	}
+	return execValidate(ctx, execer, c)
+}
+
+// validateScript reports the user running it, whether it can enter the
+// directory $1 and where the command $2, or the user's shell if that is
+// empty, is found.  Each line is a check's name then a tab and its value, or
+// the name with an _error suffix and why it failed.
+const validateScript = `printf 'user\t%s\n' "$(id -un 2>/dev/null || id -u)"
+if [ -n "$1" ] && ! cd "$1" 2>/dev/null; then
+	printf 'working_dir_error\tcannot enter %s\n' "$1"
+else
+	printf 'working_dir\t%s\n' "$PWD"
+fi
+command=${2:-${SHELL:-/bin/sh}}
+if path=$(command -v "$command"); then
+	printf 'command\t%s\n' "$path"
+else
+	printf 'command_error\t%s not found\n' "$command"
+fi`
+
+// execValidate validates a command by running validateScript through the
+// execer.  If the script cannot start as the command's user the other checks
+// are not made.
+func execValidate(ctx context.Context, execer Execer, c Command) (Validation, error) {
+	command := c.Command
+	if c.Shell {
+		command = ""
+	}
+	output, err := Output(ctx, execer, Command{
+		Command: "sh",
+		Args:    []string{"-c", validateScript, "sh", c.WorkingDir, command},
+		UID:     c.UID,
+		GID:     c.GID,
+		Env:     c.Env,
+	})
+	if ctx.Err() != nil {
+		return Validation{}, ctx.Err()
+	}
+	if err != nil {
+		return Validation{
+			Command:    Check{Error: "not checked"},
+			WorkingDir: Check{Error: "not checked"},
+			User:       Check{Error: err.Error()},
+		}, nil
+	}
+
+	var v Validation
+	checks := map[string]*Check{
+		"command":     &v.Command,
+		"working_dir": &v.WorkingDir,
+		"user":        &v.User,
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if check, ok := checks[parts[0]]; ok {
+			check.Value = parts[1]
+		} else if check, ok := checks[strings.TrimSuffix(parts[0], "_error")]; ok {
+			check.Error = parts[1]
+		}
+	}
+	return v, nil
+}
+
+// ValidateCommand asks the server whether it could start c.
+func (r remoteExec) ValidateCommand(ctx context.Context, c Command) (Validation, error) {
+	result, err := r.requestResult(ctx, proto.ClientValidateHeader{
+		Type:    proto.TypeValidate,
+		Command: mapToProtoCmd(c),
+	})
+	if err != nil {
+		return Validation{}, err
+	}
+	return mapToClientValidation(result.Validation), nil
+}
+
+func mapToProtoValidation(v Validation) *proto.Validation {
+	return &proto.Validation{
+		Command:    proto.Check(v.Command),
+		WorkingDir: proto.Check(v.WorkingDir),
+		User:       proto.Check(v.User),
+	}
+}
+
+func mapToClientValidation(v *proto.Validation) Validation {
+	if v == nil {
+		return Validation{}
+	}
+	return Validation{
+		Command:    Check(v.Command),
+		WorkingDir: Check(v.WorkingDir),
+		User:       Check(v.User),
+	}
+}
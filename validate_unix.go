@@ -0,0 +1,77 @@
+//go:build !windows
+// +build !windows
+
+package wsep
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+// ValidateCommand checks the command the way Start would resolve it, without
+// starting it.
+func (l LocalExecer) ValidateCommand(ctx context.Context, c Command) (Validation, error) {
+	var v Validation
+	env := os.Environ()
+	path := c.Command
+	shell := os.Getenv("SHELL")
+	uid, gid := c.UID, c.GID
+
+	if (uid != 0 || gid != 0) && os.Geteuid() != 0 {
+		v.User.Error = fmt.Sprintf("switching to uid %d and gid %d requires running as root", uid, gid)
+	}
+	if uid != 0 {
+		if user, ok := lookupTargetUser(ctx, uid, gid); ok {
+			env = append(env, user.environ()...)
+			shell = user.shell
+			if path == "" {
+				path = user.shell
+			}
+		}
+	}
+	v.User.Value = userName(uid)
+	if path == "" {
+		path = defaultLoginShell
+		if uid == 0 {
+			path = currentLoginShell()
+		}
+	}
+	if c.Shell {
+		path = shell
+		if path == "" {
+			path = defaultLoginShell
+		}
+	}
+	env = append(env, c.Env...)
+
+	resolved, err := lookPathEnv(path, env)
+	if err == nil {
+		err = checkExecutable(resolved)
+	}
+	v.Command.Value = resolved
+	if err != nil {
+		v.Command = Check{Value: path, Error: err.Error()}
+	}
+
+	dir, warning := resolveWorkingDir(c.WorkingDir, env, uid, gid)
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	v.WorkingDir = Check{Value: dir, Error: warning}
+	return v, nil
+}
+
+// checkExecutable returns why a program cannot be run, if it cannot.
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+		return xerrors.Errorf("%q is not executable", path)
+	}
+	return nil
+}
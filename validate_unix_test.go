@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package wsep
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestValidateCommand(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	wsepServer := NewServer()
+	defer wsepServer.Close()
+
+	ws, server := mockConn(ctx, t, wsepServer, nil)
+	defer server.Close()
+
+	execers := map[string]Execer{
+		"Local": LocalExecer{},
+		// Hiding LocalExecer's validation checks with the shell script.
+		"Script": struct{ Execer }{LocalExecer{}},
+		"Remote": RemoteExecer(ws),
+	}
+	for name, execer := range execers {
+		execer := execer
+		t.Run(name, func(t *testing.T) {
+			dir := tempDir(t)
+			v, err := ValidateCommand(ctx, execer, Command{Command: "sh", WorkingDir: dir})
+			assert.Success(t, "validate", err)
+			assert.True(t, "ok", v.OK())
+			assert.True(t, "command", strings.HasSuffix(v.Command.Value, "/sh"))
+			assert.Equal(t, "working dir", dir, v.WorkingDir.Value)
+			assert.True(t, "user", v.User.Value != "")
+
+			v, err = ValidateCommand(ctx, execer, Command{Command: "wsep-no-such-command"})
+			assert.Success(t, "validate missing command", err)
+			assert.True(t, "not ok", !v.OK())
+			assert.True(t, "command error", v.Command.Error != "")
+			assert.Equal(t, "working dir error", "", v.WorkingDir.Error)
+
+			v, err = ValidateCommand(ctx, execer, Command{Command: "sh", WorkingDir: "/nonexistent"})
+			assert.Success(t, "validate missing dir", err)
+			assert.True(t, "working dir error", v.WorkingDir.Error != "")
+			assert.Equal(t, "command error", "", v.Command.Error)
+		})
+	}
+}
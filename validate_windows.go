@@ -0,0 +1,50 @@
+package wsep
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+)
+
+// ValidateCommand checks the command the way Start would resolve it, without
+// starting it.  WindowsCredentials are checked by logging on.
+func (l LocalExecer) ValidateCommand(_ context.Context, c Command) (Validation, error) {
+	var v Validation
+	env := append(os.Environ(), c.Env...)
+	if l.WindowsCredentials != nil {
+		v.User.Value = l.WindowsCredentials.Username
+		token, err := l.WindowsCredentials.logon()
+		if err != nil {
+			v.User.Error = fmt.Sprintf("log on %q: %v", l.WindowsCredentials.Username, err)
+		} else {
+			userEnv, err := userEnvironment(token)
+			_ = token.Close()
+			if err == nil {
+				env = append(userEnv, c.Env...)
+			}
+		}
+	} else if u, err := user.Current(); err == nil {
+		v.User.Value = u.Username
+	}
+
+	if c.Shell {
+		v.Command.Error = "shell commands are not supported on Windows"
+	} else {
+		path, err := lookPathEnv(c.Command, env)
+		v.Command.Value = path
+		if err != nil {
+			v.Command = Check{Value: c.Command, Error: err.Error()}
+		}
+	}
+
+	v.WorkingDir.Value = c.WorkingDir
+	if c.WorkingDir == "" {
+		v.WorkingDir.Value, _ = os.Getwd()
+	} else if info, err := os.Stat(c.WorkingDir); err != nil {
+		v.WorkingDir.Error = err.Error()
+	} else if !info.IsDir() {
+		v.WorkingDir.Error = "not a directory"
+	}
+	return v, nil
+}
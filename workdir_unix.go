@@ -0,0 +1,102 @@
+//go:build !windows
+// +build !windows
+
+package wsep
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/xerrors"
+)
+
+// resolveWorkingDir expands a leading ~ and environment variables in the
+// working directory of a command using its environment, and checks that uid
+// and gid, or this process if both are zero, may enter it.  If they may not, it returns the HOME of the
+// environment instead, or / if that will not do either, with a warning for the
+// user rather than letting the command fail to start.
+func resolveWorkingDir(dir string, env []string, uid, gid uint32) (string, string) {
+	if dir == "" {
+		return "", ""
+	}
+	home := lookupEnv(env, "HOME")
+	expanded := dir
+	if expanded == "~" {
+		expanded = home
+	} else if strings.HasPrefix(expanded, "~/") {
+		expanded = filepath.Join(home, expanded[2:])
+	}
+	expanded = os.Expand(expanded, func(name string) string {
+		return lookupEnv(env, name)
+	})
+
+	err := checkDir(expanded, uid, gid)
+	if err == nil {
+		return expanded, ""
+	}
+	fallback := home
+	if fallback == "" || checkDir(fallback, uid, gid) != nil {
+		fallback = "/"
+	}
+	return fallback, fmt.Sprintf("cannot use working directory %q: %v; starting in %q instead", dir, err, fallback)
+}
+
+// accessExecute is X_OK, which syscall does not define.
+const accessExecute = 0x1
+
+// checkDir returns why uid and gid cannot enter dir, if they cannot.  If both
+// are zero the command keeps this process' credentials, supplementary groups
+// included, so the kernel decides.  Otherwise the command runs without
+// supplementary groups and only the owner, group or other bits apply.  Root
+// may enter any directory.
+func checkDir(dir string, uid, gid uint32) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return xerrors.New("does not exist")
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return xerrors.New("not a directory")
+	}
+	if uid == 0 && gid == 0 {
+		err = syscall.Access(dir, accessExecute)
+		if err == syscall.EACCES {
+			return xerrors.New("permission denied")
+		}
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || uid == 0 {
+		return nil
+	}
+	mode := info.Mode().Perm()
+	switch {
+	case stat.Uid == uid:
+		mode &= 0o100
+	case stat.Gid == gid:
+		mode &= 0o010
+	default:
+		mode &= 0o001
+	}
+	if mode == 0 {
+		return xerrors.New("permission denied")
+	}
+	return nil
+}
+
+// lookupEnv returns the value of a variable in env, where later entries win as
+// they do when the command runs.
+func lookupEnv(env []string, name string) string {
+	var value string
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			value = kv[len(name)+1:]
+		}
+	}
+	return value
+}
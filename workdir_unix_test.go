@@ -0,0 +1,68 @@
+//go:build !windows
+// +build !windows
+
+package wsep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+func TestResolveWorkingDir(t *testing.T) {
+	t.Parallel()
+
+	home := tempDir(t)
+	project := filepath.Join(home, "project")
+	assert.Success(t, "mkdir", os.Mkdir(project, 0o755))
+	env := []string{"HOME=/nonexistent", "HOME=" + home, "PROJECT=project"}
+	uid, gid := uint32(os.Geteuid()), uint32(os.Getegid())
+
+	dir, warning := resolveWorkingDir("~/$PROJECT", env, uid, gid)
+	assert.Equal(t, "expanded", project, dir)
+	assert.Equal(t, "no warning", "", warning)
+
+	dir, warning = resolveWorkingDir("~", env, uid, gid)
+	assert.Equal(t, "home", home, dir)
+	assert.Equal(t, "no warning", "", warning)
+
+	dir, warning = resolveWorkingDir("${HOME}/missing", env, uid, gid)
+	assert.Equal(t, "fallback", home, dir)
+	assert.True(t, "warning", strings.Contains(warning, "does not exist"))
+
+	dir, warning = resolveWorkingDir("/nonexistent", []string{"HOME=/nonexistent"}, uid, gid)
+	assert.Equal(t, "root fallback", "/", dir)
+	assert.True(t, "warning", warning != "")
+
+	dir, warning = resolveWorkingDir("", env, uid, gid)
+	assert.Equal(t, "unset", "", dir)
+	assert.Equal(t, "no warning", "", warning)
+}
+
+func TestCheckDir(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	assert.Success(t, "chmod", os.Chmod(dir, 0o700))
+	assert.Success(t, "owner", checkDir(dir, uint32(os.Geteuid()), 0))
+	assert.Success(t, "this process", checkDir(dir, 0, 0))
+	assert.Error(t, "other user", checkDir(dir, uint32(os.Geteuid())+1, 65534))
+
+	file := filepath.Join(dir, "file")
+	assert.Success(t, "write", ioutil.WriteFile(file, nil, 0o644))
+	assert.Error(t, "file", checkDir(file, 0, 0))
+
+	// Without switching credentials the kernel decides, which lets root in.
+	assert.Success(t, "chmod", os.Chmod(dir, 0))
+	defer os.Chmod(dir, 0o700)
+	err := checkDir(dir, 0, 0)
+	if os.Geteuid() == 0 {
+		assert.Success(t, "root", err)
+	} else {
+		assert.Error(t, "no access", err)
+	}
+}
@@ -0,0 +1,259 @@
+// Package wsepexec runs commands through a wsep.Execer with an API mirroring
+// os/exec so code written against os/exec can target a remote workspace with
+// minimal changes.
+package wsepexec
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/wsep"
+)
+
+// Cmd is a command being prepared or run through an execer.  Like exec.Cmd it
+// cannot be reused after calling Run, Output, CombinedOutput or Start.
+type Cmd struct {
+	// Path is the command to run.
+	Path string
+	// Args holds the command line arguments including the command as Args[0].
+	Args []string
+	// Env adds to the environment of the execer.
+	Env []string
+	// Dir is the working directory.  If empty the execer's default is used.
+	Dir string
+	// UID and GID set the user to run as if not zero.
+	UID uint32
+	GID uint32
+
+	// Stdin, Stdout and Stderr behave as in exec.Cmd.  If Stdin is nil the
+	// command runs without stdin.  If Stdout or Stderr is nil the output is
+	// discarded.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Process is the underlying process once started.
+	Process wsep.Process
+
+	ctx    context.Context
+	execer wsep.Execer
+	output errgroup.Group
+	// closeAfterWait holds the read end of the pipe returned by StdinPipe.
+	closeAfterWait []io.Closer
+	// stdoutPipe and stderrPipe are the write ends of the pipes returned by
+	// StdoutPipe and StderrPipe, closed once the output is copied.
+	stdoutPipe *io.PipeWriter
+	stderrPipe *io.PipeWriter
+	waited     bool
+}
+
+// Command returns a Cmd to run the named program with the arguments through
+// the execer.
+func Command(execer wsep.Execer, name string, arg ...string) *Cmd {
+	return CommandContext(context.Background(), execer, name, arg...)
+}
+
+// CommandContext is like Command but includes a context.  Ending the context
+// ends the command the same way it does for the execer.
+func CommandContext(ctx context.Context, execer wsep.Execer, name string, arg ...string) *Cmd {
+	return &Cmd{
+		Path:   name,
+		Args:   append([]string{name}, arg...),
+		ctx:    ctx,
+		execer: execer,
+	}
+}
+
+// Run starts the command and waits for it to complete.
+func (c *Cmd) Run() error {
+	err := c.Start()
+	if err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// Start starts the command but does not wait for it to complete.
+func (c *Cmd) Start() error {
+	if c.Process != nil {
+		return xerrors.New("wsepexec: already started")
+	}
+	var args []string
+	if len(c.Args) > 1 {
+		args = c.Args[1:]
+	}
+	process, err := c.execer.Start(c.ctx, wsep.Command{
+		Command:    c.Path,
+		Args:       args,
+		Stdin:      c.Stdin != nil,
+		UID:        c.UID,
+		GID:        c.GID,
+		Env:        c.Env,
+		WorkingDir: c.Dir,
+	})
+	if err != nil {
+		c.closePipes()
+		closeWriter(c.stdoutPipe, err)
+		closeWriter(c.stderrPipe, err)
+		return err
+	}
+	c.Process = process
+
+	if c.Stdin != nil {
+		// Like exec.Cmd, the copy is not waited on since the reader may never
+		// end; it stops once the command exits.
+		go func() {
+			_, _ = io.Copy(process.Stdin(), c.Stdin)
+			_ = process.Stdin().Close()
+		}()
+	}
+	// Output must always be drained or the command may block.
+	c.output.Go(func() error {
+		return copyOutput(c.Stdout, process.Stdout(), c.stdoutPipe)
+	})
+	c.output.Go(func() error {
+		return copyOutput(c.Stderr, process.Stderr(), c.stderrPipe)
+	})
+	return nil
+}
+
+// copyOutput copies the output to w then closes pipe if it is not nil so
+// readers see the end of the output.
+func copyOutput(w io.Writer, r io.Reader, pipe *io.PipeWriter) error {
+	if w == nil {
+		w = ioutil.Discard
+	}
+	_, err := io.Copy(w, r)
+	closeWriter(pipe, err)
+	return err
+}
+
+func closeWriter(pipe *io.PipeWriter, err error) {
+	if pipe != nil {
+		_ = pipe.CloseWithError(err)
+	}
+}
+
+// Wait waits for the command to exit and its output to be copied.  A non-zero
+// exit is returned as a wsep.ExitError.
+func (c *Cmd) Wait() error {
+	if c.Process == nil {
+		return xerrors.New("wsepexec: not started")
+	}
+	if c.waited {
+		return xerrors.New("wsepexec: Wait was already called")
+	}
+	c.waited = true
+
+	copyErr := c.output.Wait()
+	err := c.Process.Wait()
+	c.closePipes()
+	if err != nil {
+		return err
+	}
+	return copyErr
+}
+
+func (c *Cmd) closePipes() {
+	for _, closer := range c.closeAfterWait {
+		_ = closer.Close()
+	}
+	c.closeAfterWait = nil
+}
+
+// Output runs the command and returns its standard output.
+func (c *Cmd) Output() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, xerrors.New("wsepexec: Stdout already set")
+	}
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+	err := c.Run()
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns its standard output and
+// standard error combined.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	if c.Stdout != nil {
+		return nil, xerrors.New("wsepexec: Stdout already set")
+	}
+	if c.Stderr != nil {
+		return nil, xerrors.New("wsepexec: Stderr already set")
+	}
+	var output syncBuffer
+	c.Stdout = &output
+	c.Stderr = &output
+	err := c.Run()
+	return output.Bytes(), err
+}
+
+// StdoutPipe returns a pipe connected to the command's standard output.  As
+// with exec.Cmd all reads must finish before calling Wait.
+func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
+	if c.Stdout != nil {
+		return nil, xerrors.New("wsepexec: Stdout already set")
+	}
+	if c.Process != nil {
+		return nil, xerrors.New("wsepexec: StdoutPipe after process started")
+	}
+	pr, pw := io.Pipe()
+	c.Stdout = pw
+	c.stdoutPipe = pw
+	return pr, nil
+}
+
+// StderrPipe returns a pipe connected to the command's standard error.  As
+// with exec.Cmd all reads must finish before calling Wait.
+func (c *Cmd) StderrPipe() (io.ReadCloser, error) {
+	if c.Stderr != nil {
+		return nil, xerrors.New("wsepexec: Stderr already set")
+	}
+	if c.Process != nil {
+		return nil, xerrors.New("wsepexec: StderrPipe after process started")
+	}
+	pr, pw := io.Pipe()
+	c.Stderr = pw
+	c.stderrPipe = pw
+	return pr, nil
+}
+
+// StdinPipe returns a pipe connected to the command's standard input.  Closing
+// it closes the command's standard input.
+func (c *Cmd) StdinPipe() (io.WriteCloser, error) {
+	if c.Stdin != nil {
+		return nil, xerrors.New("wsepexec: Stdin already set")
+	}
+	if c.Process != nil {
+		return nil, xerrors.New("wsepexec: StdinPipe after process started")
+	}
+	pr, pw := io.Pipe()
+	c.Stdin = pr
+	c.closeAfterWait = append(c.closeAfterWait, pr)
+	return pw, nil
+}
+
+// syncBuffer is a buffer that is safe for the concurrent writes of combined
+// output.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) Bytes() []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.buf.Bytes()
+}
@@ -0,0 +1,81 @@
+package wsepexec
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/wsep"
+)
+
+func TestCmd(t *testing.T) {
+	t.Parallel()
+	// The subtests run after TestCmd returns so the context must outlive it.
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	t.Cleanup(cancel)
+	execer := wsep.LocalExecer{}
+
+	t.Run("Run", func(t *testing.T) {
+		t.Parallel()
+		var stdout bytes.Buffer
+		cmd := CommandContext(ctx, execer, "cat")
+		cmd.Stdin = strings.NewReader("hello")
+		cmd.Stdout = &stdout
+		assert.Success(t, "run", cmd.Run())
+		assert.Equal(t, "stdout", "hello", stdout.String())
+	})
+
+	t.Run("Output", func(t *testing.T) {
+		t.Parallel()
+		cmd := CommandContext(ctx, execer, "sh", "-c", "echo $GREETING")
+		cmd.Env = []string{"GREETING=hi"}
+		dir, err := ioutil.TempDir("", "wsepexec")
+		assert.Success(t, "create temp dir", err)
+		defer os.RemoveAll(dir)
+		cmd.Dir = dir
+		output, err := cmd.Output()
+		assert.Success(t, "output", err)
+		assert.Equal(t, "output", "hi\n", string(output))
+	})
+
+	t.Run("CombinedOutput", func(t *testing.T) {
+		t.Parallel()
+		output, err := CommandContext(ctx, execer, "sh", "-c", "echo out; echo err >&2; exit 2").CombinedOutput()
+		var exitErr wsep.ExitError
+		assert.True(t, "exit error", xerrors.As(err, &exitErr))
+		assert.Equal(t, "exit code", 2, exitErr.ExitCode())
+		assert.True(t, "stdout", strings.Contains(string(output), "out\n"))
+		assert.True(t, "stderr", strings.Contains(string(output), "err\n"))
+	})
+
+	t.Run("Pipes", func(t *testing.T) {
+		t.Parallel()
+		cmd := CommandContext(ctx, execer, "cat")
+		stdin, err := cmd.StdinPipe()
+		assert.Success(t, "stdin pipe", err)
+		stdout, err := cmd.StdoutPipe()
+		assert.Success(t, "stdout pipe", err)
+		assert.Success(t, "start", cmd.Start())
+
+		_, err = stdin.Write([]byte("piped"))
+		assert.Success(t, "write stdin", err)
+		assert.Success(t, "close stdin", stdin.Close())
+		output, err := ioutil.ReadAll(stdout)
+		assert.Success(t, "read stdout", err)
+		assert.Equal(t, "stdout", "piped", string(output))
+		assert.Success(t, "wait", cmd.Wait())
+	})
+
+	t.Run("StartFailed", func(t *testing.T) {
+		t.Parallel()
+		err := CommandContext(ctx, execer, "/does/not/exist").Run()
+		assert.Error(t, "run", err)
+	})
+}
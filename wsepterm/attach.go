@@ -0,0 +1,107 @@
+// Package wsepterm connects a local terminal to a wsep process so that CLIs
+// do not each have to manage raw mode and window resizing themselves.
+package wsepterm
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/term"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/wsep"
+)
+
+// Attach relays stdin to the process and its output to stdout until the
+// process exits or ctx ends, in which case the process is closed.  If stdin is
+// a terminal it is put in raw mode and restored before returning.  If stdout
+// (or failing that stdin) is a terminal the process is resized to match it now
+// and whenever it changes size.  Process errors, including ExitError, are
+// returned as-is.
+//
+// Reads from stdin cannot be interrupted so the goroutine reading it may
+// outlive Attach until the next read returns.
+func Attach(ctx context.Context, process wsep.Process, stdin io.Reader, stdout io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if fd, ok := terminalFd(stdin); ok {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return xerrors.Errorf("make terminal raw: %w", err)
+		}
+		defer func() {
+			_ = term.Restore(fd, state)
+		}()
+	}
+
+	sizeFd, ok := terminalFd(stdout)
+	if !ok {
+		sizeFd, ok = terminalFd(stdin)
+	}
+	if ok {
+		resize := func() {
+			width, height, err := term.GetSize(sizeFd)
+			if err != nil {
+				return
+			}
+			_ = process.Resize(ctx, uint16(height), uint16(width))
+		}
+		resize()
+		go watchSize(ctx, resize)
+	}
+
+	go func() {
+		stdinWriter := process.Stdin()
+		_, _ = io.Copy(stdinWriter, stdin)
+		_ = stdinWriter.Close()
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = process.Close()
+	}()
+
+	// A TTY has no separate stderr but a command without one does.
+	stdout = &lockedWriter{w: stdout}
+	var output errgroup.Group
+	output.Go(func() error {
+		_, err := io.Copy(stdout, process.Stdout())
+		return err
+	})
+	output.Go(func() error {
+		_, err := io.Copy(stdout, process.Stderr())
+		return err
+	})
+	_ = output.Wait()
+
+	err := process.Wait()
+	if err == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// terminalFd returns the file descriptor of f if it is a terminal.
+func terminalFd(f interface{}) (int, bool) {
+	file, ok := f.(*os.File)
+	if !ok || !term.IsTerminal(int(file.Fd())) {
+		return 0, false
+	}
+	return int(file.Fd()), true
+}
+
+// lockedWriter serializes writes from stdout and stderr.
+type lockedWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,57 @@
+package wsepterm
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+
+	"cdr.dev/wsep"
+)
+
+func TestAttach(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Relay", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		process, err := wsep.LocalExecer{}.Start(ctx, wsep.Command{
+			Command: "sh",
+			Args:    []string{"-c", "cat; echo done >&2"},
+			Stdin:   true,
+		})
+		assert.Success(t, "start", err)
+
+		var stdout bytes.Buffer
+		err = Attach(ctx, process, strings.NewReader("hello\n"), &stdout)
+		assert.Success(t, "attach", err)
+		// Stdout and stderr are copied concurrently so their order is not fixed.
+		lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+		sort.Strings(lines)
+		assert.Equal(t, "output", []string{"done", "hello"}, lines)
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		process, err := wsep.LocalExecer{}.Start(ctx, wsep.Command{
+			Command: "sleep",
+			Args:    []string{"10"},
+		})
+		assert.Success(t, "start", err)
+
+		attachCtx, attachCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer attachCancel()
+		var stdout bytes.Buffer
+		err = Attach(attachCtx, process, strings.NewReader(""), &stdout)
+		assert.Error(t, "attach", err)
+	})
+}
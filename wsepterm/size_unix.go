@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package wsepterm
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchSize calls resize whenever the terminal changes size until ctx ends.
+func watchSize(ctx context.Context, resize func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			resize()
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package wsepterm
+
+import (
+	"context"
+	"time"
+)
+
+// watchSize calls resize periodically until ctx ends since Windows has no
+// signal for terminal size changes.  Resizing to the same size is harmless.
+func watchSize(ctx context.Context, resize func()) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			resize()
+		}
+	}
+}
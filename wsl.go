@@ -0,0 +1,78 @@
+package wsep
+
+import (
+	"context"
+	"strconv"
+)
+
+// WSLExecer executes commands inside a Windows Subsystem for Linux
+// distribution through wsl.exe, so an agent running natively on Windows can
+// still offer Linux terminals.  TTY commands get a Linux TTY since WSL
+// allocates one when wsl.exe runs in a pseudoconsole, and resizing the
+// pseudoconsole resizes it.  Pid() returns the pid of wsl.exe.  Commands with a
+// UID or GID run through setpriv as root, which requires util-linux in the
+// distribution.
+type WSLExecer struct {
+	// Distribution is the name of the distribution commands run in, as listed
+	// by wsl.exe --list.  Defaults to the default distribution.
+	Distribution string
+	// User is the Linux user commands run as unless they set a UID or GID.
+	// Defaults to the distribution's default user.
+	User string
+	// Execer starts wsl.exe.  Defaults to LocalExecer.
+	Execer Execer
+}
+
+// Start executes the given command inside the distribution.
+func (w WSLExecer) Start(ctx context.Context, c Command) (Process, error) {
+	execer := w.Execer
+	if execer == nil {
+		execer = LocalExecer{}
+	}
+	c = shCommand(c)
+	command := c
+	command.Command = "wsl.exe"
+	command.Args = w.args(c)
+	// wsl.exe only shares variables listed in WSLENV with Linux so they are
+	// applied inside the distribution instead, and the user is chosen there.
+	command.Env = nil
+	command.UID, command.GID = 0, 0
+	command.WorkingDir = ""
+	return execer.Start(ctx, command)
+}
+
+// args returns the arguments to wsl.exe that run the command.
+func (w WSLExecer) args(c Command) []string {
+	var args []string
+	if w.Distribution != "" {
+		args = append(args, "--distribution", w.Distribution)
+	}
+	user := w.User
+	if c.UID != 0 || c.GID != 0 {
+		user = "root"
+	}
+	if user != "" {
+		args = append(args, "--user", user)
+	}
+	if c.WorkingDir != "" {
+		args = append(args, "--cd", c.WorkingDir)
+	}
+	args = append(args, "--exec")
+
+	env := c.Env
+	if c.TTY {
+		// This special WSEP_TTY variable helps debug unexpected TTYs.
+		env = append(env, "WSEP_TTY=true")
+	}
+	if c.UID != 0 || c.GID != 0 {
+		args = append(args, "setpriv",
+			"--reuid="+strconv.FormatUint(uint64(c.UID), 10),
+			"--regid="+strconv.FormatUint(uint64(c.GID), 10),
+			"--clear-groups",
+		)
+	}
+	if len(env) > 0 {
+		args = append(append(args, "env"), env...)
+	}
+	return append(append(args, c.Command), c.Args...)
+}
@@ -0,0 +1,68 @@
+package wsep
+
+import (
+	"context"
+	"testing"
+
+	"cdr.dev/slog/sloggers/slogtest/assert"
+)
+
+// recordingExecer records the last command it was asked to start without
+// starting anything.
+type recordingExecer struct {
+	command Command
+}
+
+func (r *recordingExecer) Start(_ context.Context, command Command) (Process, error) {
+	r.command = command
+	return nil, nil
+}
+
+func TestWSLExecer(t *testing.T) {
+	t.Parallel()
+
+	start := func(t *testing.T, execer WSLExecer, command Command) Command {
+		recorder := &recordingExecer{}
+		execer.Execer = recorder
+		_, err := execer.Start(context.Background(), command)
+		assert.Success(t, "start command", err)
+		return recorder.command
+	}
+
+	t.Run("Plain", func(t *testing.T) {
+		t.Parallel()
+		command := start(t, WSLExecer{}, Command{Command: "ls", Args: []string{"-l"}, Stdin: true})
+		assert.Equal(t, "command", "wsl.exe", command.Command)
+		assert.Equal(t, "args", []string{"--exec", "ls", "-l"}, command.Args)
+		assert.True(t, "stdin", command.Stdin)
+	})
+
+	t.Run("TTY", func(t *testing.T) {
+		t.Parallel()
+		command := start(t, WSLExecer{Distribution: "Ubuntu", User: "coder"}, Command{
+			Command:    "bash",
+			TTY:        true,
+			Rows:       24,
+			Cols:       80,
+			Env:        []string{"TERM=xterm-256color"},
+			WorkingDir: "/home/coder",
+		})
+		assert.Equal(t, "args", []string{
+			"--distribution", "Ubuntu", "--user", "coder", "--cd", "/home/coder", "--exec",
+			"env", "TERM=xterm-256color", "WSEP_TTY=true", "bash",
+		}, command.Args)
+		assert.Equal(t, "env", 0, len(command.Env))
+		assert.Equal(t, "working dir", "", command.WorkingDir)
+		assert.True(t, "tty", command.TTY)
+		assert.Equal(t, "rows", uint16(24), command.Rows)
+	})
+
+	t.Run("UID", func(t *testing.T) {
+		t.Parallel()
+		command := start(t, WSLExecer{User: "coder"}, Command{Command: "id", UID: 1000, GID: 1001})
+		assert.Equal(t, "args", []string{
+			"--user", "root", "--exec", "setpriv", "--reuid=1000", "--regid=1001", "--clear-groups", "id",
+		}, command.Args)
+		assert.Equal(t, "uid", uint32(0), command.UID)
+	})
+}